@@ -0,0 +1,394 @@
+/*
+*
+* Name:     Twitch IRC Listener
+* Sys Name: twitch-irc
+* Author:   Nifty255
+*
+*/
+
+package main
+
+import (
+  "os"            // File functions.
+  "sync"          // Mutual exclusion locks.
+  "time"          // Timing related functions.
+  "errors"        // Error creation functions.
+  "strings"       // String manipulation functions.
+  "net/url"       // URL encoding functions.
+  "net/http"      // HTTP client functions.
+  "io/ioutil"     // File reading and writing functions.
+  "path/filepath" // File path functions.
+  "encoding/json" // JSON encoding functions.
+)
+
+// Returned when Twitch rejects a token, as opposed to being unreachable.
+var ErrTokenInvalid = errors.New("Token is invalid or expired.")
+
+// Specifies how an account obtains a new token once its current one is rejected.
+// It returns the new access token and refresh token; an empty refresh token keeps the current one.
+type TokenRefresher func(a *BotAccount) (string, string, error)
+
+// Specifies Twitch's answer to a token validation.
+type TokenValidation struct {
+  
+  ClientID  string   `json:"client_id"`
+  Login     string   `json:"login"`
+  Scopes    []string `json:"scopes"`
+  UserID    string   `json:"user_id"`
+  ExpiresIn int      `json:"expires_in"`
+}
+
+// Specifies Twitch's answer to a token refresh.
+type TokenGrant struct {
+  
+  AccessToken  string   `json:"access_token"`
+  RefreshToken string   `json:"refresh_token"`
+  ExpiresIn    int      `json:"expires_in"`
+  Scope        []string `json:"scope"`
+  TokenType    string   `json:"token_type"`
+}
+
+// Specifies the state of an account, as reported by the "account-status" kite method.
+type AccountStatus struct {
+  
+  Login       string    `json:"login"`
+  UserID      string    `json:"user_id"`
+  Valid       bool      `json:"valid"`
+  Scopes      []string  `json:"scopes"`
+  ValidatedAt time.Time `json:"validated_at"`
+  ExpiresAt   time.Time `json:"expires_at"`
+  Listeners   int       `json:"listeners"`
+  Error       string    `json:"error,omitempty"`
+}
+
+// Specifies a bot account listeners log in as. Tokens are read from a file or the environment, never the config file itself.
+// A token is validated before each connect and again every validate interval, as Twitch asks; a rejected one is
+// replaced through Refresher. AuthLock serializes validation and refresh, so reconnecting listeners share one round trip.
+type BotAccount struct {
+  
+  Login        string
+  Config       ConfigAccount
+  Auth         ConfigAuth
+  Token        string
+  RefreshToken string
+  UserID       string
+  Scopes       []string
+  Valid        bool
+  ValidatedAt  time.Time
+  ExpiresAt    time.Time
+  LastError    string
+  Refresher    TokenRefresher
+  JoinLimiter  *JoinLimiter
+  Client       *http.Client
+  Ticker       *time.Ticker
+  Done         chan bool
+  AuthLock     sync.Mutex
+  Lock         sync.Mutex
+}
+
+// Static. Reads a secret from the named environment variable or, failing that, the named file.
+// An "oauth:" prefix is dropped, since Twitch's token generators often include it.
+func LoadSecret(file, env string) (string, error) {
+  
+  secret := ""
+  
+  if (env != "") { secret = os.Getenv(env) }
+  
+  if (secret == "" && file != "") {
+    
+    data, err := ioutil.ReadFile(file)
+    if (err != nil) { return "", err }
+    secret = string(data)
+  }
+  
+  secret = strings.TrimPrefix(strings.TrimSpace(secret), "oauth:")
+  if (secret == "" && (file != "" || env != "")) { return "", errors.New("Secret is empty.") }
+  
+  return secret, nil
+}
+
+// Static. Writes a secret to a file readable only by its owner, replacing the file in one step.
+func SaveSecret(file, secret string) error {
+  
+  temp := file + ".tmp"
+  
+  if err := ioutil.WriteFile(temp, []byte(secret + "\n"), 0600); err != nil { return err }
+  
+  return os.Rename(temp, filepath.Clean(file))
+}
+
+// Static. Creates a BotAccount and loads its tokens. Validation waits until the first connect.
+func BotAccountNew(c ConfigAccount, auth ConfigAuth) (*BotAccount, error) {
+  
+  if (c.Login == "") { return nil, errors.New("Account has no login.") }
+  if (c.TokenFile == "" && c.TokenEnv == "") { return nil, errors.New("Account " + c.Login + " has no token_file or token_env.") }
+  
+  token, err := LoadSecret(c.TokenFile, c.TokenEnv)
+  if (err != nil) { return nil, err }
+  
+  refreshToken, err := LoadSecret(c.RefreshTokenFile, c.RefreshTokenEnv)
+  if (err != nil) { return nil, err }
+  
+  limit := c.JoinLimit
+  window := c.JoinWindowMs
+  if (limit <= 0) { limit = config.Joins.Limit }
+  if (window <= 0) { window = config.Joins.WindowMs }
+  
+  return &(BotAccount{
+    Login: strings.ToLower(c.Login),
+    Config: c,
+    Auth: auth,
+    Token: token,
+    RefreshToken: refreshToken,
+    Refresher: DefaultRefresher,
+    JoinLimiter: JoinLimiterNew(limit, time.Duration(window) * time.Millisecond),
+    Client: &(http.Client{ Timeout: 10 * time.Second }) }), nil
+}
+
+// BotAccount. Returns a token to log in with, validating it first unless it was validated within the validate interval.
+// A rejected token is refreshed. If Twitch cannot be reached the current token is returned anyway; the login itself will tell.
+func (a *BotAccount) ValidToken() (string, error) {
+  
+  a.AuthLock.Lock()
+  defer a.AuthLock.Unlock()
+  
+  a.Lock.Lock()
+  token := a.Token
+  fresh := (a.Valid && time.Since(a.ValidatedAt) < time.Duration(a.Auth.ValidateIntervalMs) * time.Millisecond &&
+    (a.ExpiresAt.IsZero() || time.Now().Before(a.ExpiresAt)))
+  a.Lock.Unlock()
+  
+  if (fresh) { return token, nil }
+  
+  return a.Check()
+}
+
+// BotAccount. Validates the current token and refreshes it if Twitch rejects it. Call with AuthLock held.
+func (a *BotAccount) Check() (string, error) {
+  
+  err := a.Validate()
+  
+  if (err != nil && err != ErrTokenInvalid) {
+    
+    logger.Warn("Unable to validate token. Using it unvalidated.", LogFields{ "account": a.Login, "error": err })
+    return a.CurrentToken(), nil
+  }
+  
+  if (err == nil) { return a.CurrentToken(), nil }
+  
+  logger.Warn("Token rejected. Refreshing.", LogFields{ "account": a.Login })
+  
+  if err := a.RefreshLocked(); err != nil { return "", err }
+  
+  return a.CurrentToken(), nil
+}
+
+// BotAccount. Returns the current token without validating it.
+func (a *BotAccount) CurrentToken() string {
+  
+  a.Lock.Lock()
+  defer a.Lock.Unlock()
+  
+  return a.Token
+}
+
+// BotAccount. Asks Twitch whether the current token is valid and belongs to this account, and records the answer.
+// Returns ErrTokenInvalid if it is not, or another error if Twitch could not be asked.
+func (a *BotAccount) Validate() error {
+  
+  request, err := http.NewRequest("GET", a.Auth.ValidateUrl, nil)
+  if (err != nil) { return err }
+  request.Header.Set("Authorization", "OAuth " + a.CurrentToken())
+  
+  response, err := a.Client.Do(request)
+  if (err != nil) { return err }
+  defer response.Body.Close()
+  
+  if (response.StatusCode == http.StatusUnauthorized) {
+    
+    a.Invalidate("Token rejected.")
+    return ErrTokenInvalid
+  }
+  
+  if (response.StatusCode != http.StatusOK) { return errors.New("Validate returned " + response.Status + ".") }
+  
+  var validation TokenValidation
+  if err := json.NewDecoder(response.Body).Decode(&validation); err != nil { return err }
+  
+  // A token for another account would log in as that account.
+  if (strings.ToLower(validation.Login) != a.Login) {
+    
+    logger.Error("Token belongs to another account.", LogFields{ "account": a.Login, "owner": validation.Login })
+    a.Invalidate("Token belongs to " + validation.Login + ".")
+    return ErrTokenInvalid
+  }
+  
+  now := time.Now()
+  
+  a.Lock.Lock()
+  a.Valid = true
+  a.ValidatedAt = now
+  a.UserID = validation.UserID
+  a.Scopes = validation.Scopes
+  a.ExpiresAt = time.Time{}
+  if (validation.ExpiresIn > 0) { a.ExpiresAt = now.Add(time.Duration(validation.ExpiresIn) * time.Second) }
+  a.LastError = ""
+  a.Lock.Unlock()
+  
+  return nil
+}
+
+// BotAccount. Marks the current token as not valid, so the next connect validates it again.
+func (a *BotAccount) Invalidate(reason string) {
+  
+  a.Lock.Lock()
+  defer a.Lock.Unlock()
+  
+  a.Valid = false
+  a.LastError = reason
+}
+
+// BotAccount. Replaces the token through Refresher and validates the new one.
+func (a *BotAccount) Refresh() error {
+  
+  a.AuthLock.Lock()
+  defer a.AuthLock.Unlock()
+  
+  return a.RefreshLocked()
+}
+
+// BotAccount. Same as Refresh, for callers already holding AuthLock.
+func (a *BotAccount) RefreshLocked() error {
+  
+  token, refreshToken, err := a.Refresher(a)
+  if (err != nil) {
+    
+    logger.Error("Unable to refresh token.", LogFields{ "account": a.Login, "error": err })
+    a.Invalidate(err.Error())
+    return err
+  }
+  
+  a.Lock.Lock()
+  a.Token = token
+  if (refreshToken != "") { a.RefreshToken = refreshToken }
+  a.Valid = false
+  a.Lock.Unlock()
+  
+  if err := a.Validate(); err != nil {
+    
+    logger.Error("Refreshed token failed validation.", LogFields{ "account": a.Login, "error": err })
+    return err
+  }
+  
+  logger.Info("Token refreshed.", LogFields{ "account": a.Login })
+  
+  return nil
+}
+
+// Static. The default TokenRefresher. With a refresh token and client credentials it asks Twitch for a new token and
+// saves both to their files, if they came from files. Otherwise it reloads the token from its source, for setups where
+// something else rotates it.
+func DefaultRefresher(a *BotAccount) (string, string, error) {
+  
+  a.Lock.Lock()
+  refreshToken := a.RefreshToken
+  a.Lock.Unlock()
+  
+  clientID := os.Getenv(a.Auth.ClientIDEnv)
+  clientSecret := os.Getenv(a.Auth.ClientSecretEnv)
+  
+  if (refreshToken == "" || clientID == "" || clientSecret == "") {
+    
+    token, err := LoadSecret(a.Config.TokenFile, a.Config.TokenEnv)
+    return token, "", err
+  }
+  
+  grant, err := a.Grant(refreshToken, clientID, clientSecret)
+  if (err != nil) { return "", "", err }
+  
+  if (a.Config.TokenFile != "") {
+    
+    if err := SaveSecret(a.Config.TokenFile, grant.AccessToken); err != nil {
+      
+      logger.Warn("Unable to save refreshed token.", LogFields{ "account": a.Login, "path": a.Config.TokenFile, "error": err })
+    }
+  }
+  
+  if (a.Config.RefreshTokenFile != "" && grant.RefreshToken != "") {
+    
+    if err := SaveSecret(a.Config.RefreshTokenFile, grant.RefreshToken); err != nil {
+      
+      logger.Warn("Unable to save refresh token.", LogFields{ "account": a.Login, "path": a.Config.RefreshTokenFile, "error": err })
+    }
+  }
+  
+  return grant.AccessToken, grant.RefreshToken, nil
+}
+
+// BotAccount. Exchanges a refresh token for a new access token.
+func (a *BotAccount) Grant(refreshToken, clientID, clientSecret string) (TokenGrant, error) {
+  
+  var grant TokenGrant
+  
+  response, err := a.Client.PostForm(a.Auth.TokenUrl, url.Values{
+    "grant_type": { "refresh_token" },
+    "refresh_token": { refreshToken },
+    "client_id": { clientID },
+    "client_secret": { clientSecret } })
+  
+  if (err != nil) { return grant, err }
+  defer response.Body.Close()
+  
+  if (response.StatusCode != http.StatusOK) { return grant, errors.New("Token refresh returned " + response.Status + ".") }
+  
+  if err := json.NewDecoder(response.Body).Decode(&grant); err != nil { return grant, err }
+  if (grant.AccessToken == "") { return grant, errors.New("Token refresh returned no access token.") }
+  
+  return grant, nil
+}
+
+// BotAccount. Revalidates the token every validate interval until Stop is called.
+func (a *BotAccount) Watch() {
+  
+  a.Ticker = time.NewTicker(time.Duration(a.Auth.ValidateIntervalMs) * time.Millisecond)
+  a.Done = make(chan bool)
+  
+  go func() {
+    for {
+      select {
+      case <- a.Ticker.C:
+        a.AuthLock.Lock()
+        a.Check()
+        a.AuthLock.Unlock()
+      case <- a.Done:
+        return
+      }
+    }
+  }()
+}
+
+// BotAccount. Stops revalidating.
+func (a *BotAccount) Stop() {
+  
+  if (a.Ticker == nil) { return }
+  
+  a.Ticker.Stop()
+  close(a.Done)
+}
+
+// BotAccount. Returns a point-in-time view of the account.
+func (a *BotAccount) Status(listeners int) AccountStatus {
+  
+  a.Lock.Lock()
+  defer a.Lock.Unlock()
+  
+  return AccountStatus{
+    Login: a.Login,
+    UserID: a.UserID,
+    Valid: a.Valid,
+    Scopes: a.Scopes,
+    ValidatedAt: a.ValidatedAt,
+    ExpiresAt: a.ExpiresAt,
+    Listeners: listeners,
+    Error: a.LastError }
+}
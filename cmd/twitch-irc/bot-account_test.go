@@ -0,0 +1,172 @@
+/*
+*
+* Name:     Twitch IRC Listener
+* Sys Name: twitch-irc
+* Author:   Nifty255
+*
+*/
+
+package main
+
+import (
+  "os"            // Operating system functions.
+  "time"          // Timing related functions.
+  "strings"       // String manipulation functions.
+  "testing"       // Go's testing framework.
+  "path/filepath" // File path manipulation functions.
+  "github.com/the-opera-house/go-chat-bot/cmd/twitch-irc/faketmi"
+)
+
+// Starts a fake OAuth server reporting to the test's log, and points the global config's auth at it.
+func startTestOAuth(t *testing.T) *faketmi.OAuthServer {
+  
+  t.Helper()
+  
+  o, err := faketmi.NewOAuth("test-client", "test-secret")
+  if (err != nil) { t.Fatal(err) }
+  
+  o.Lock.Lock()
+  o.Logf = t.Logf
+  o.Lock.Unlock()
+  
+  saved := config
+  config = DefaultConfig()
+  config.Auth.ValidateUrl = o.ValidateUrl
+  config.Auth.TokenUrl = o.TokenUrl
+  config.Auth.ClientIDEnv = "TWITCH_IRC_TEST_CLIENT_ID"
+  config.Auth.ClientSecretEnv = "TWITCH_IRC_TEST_CLIENT_SECRET"
+  
+  t.Setenv(config.Auth.ClientIDEnv, "test-client")
+  t.Setenv(config.Auth.ClientSecretEnv, "test-secret")
+  
+  t.Cleanup(func() {
+    
+    o.Close()
+    config = saved
+  })
+  
+  return o
+}
+
+// Creates an account whose access and refresh tokens are kept in files under a temporary directory.
+func newTestAccount(t *testing.T, login, access, refresh string) *BotAccount {
+  
+  t.Helper()
+  
+  dir := t.TempDir()
+  c := ConfigAccount{ Login: login, TokenFile: filepath.Join(dir, "token"), RefreshTokenFile: filepath.Join(dir, "refresh") }
+  
+  if err := SaveSecret(c.TokenFile, "oauth:" + access); err != nil { t.Fatal(err) }
+  if err := SaveSecret(c.RefreshTokenFile, refresh); err != nil { t.Fatal(err) }
+  
+  a, err := BotAccountNew(c, config.Auth)
+  if (err != nil) { t.Fatal(err) }
+  
+  return a
+}
+
+func TestValidate(t *testing.T) {
+  
+  o := startTestOAuth(t)
+  
+  access, refresh := o.Issue("Nifty255", "1234", time.Hour, "chat:read", "chat:edit")
+  a := newTestAccount(t, "Nifty255", access, refresh)
+  
+  if (a.CurrentToken() != access) { t.Fatalf("token = %q, want it loaded without the oauth: prefix", a.CurrentToken()) }
+  if err := a.Validate(); err != nil { t.Fatal(err) }
+  
+  status := a.Status(0)
+  if (!status.Valid || status.UserID != "1234" || strings.Join(status.Scopes, " ") != "chat:read chat:edit") { t.Errorf("status = %+v", status) }
+  if (time.Until(status.ExpiresAt) < 59 * time.Minute || time.Until(status.ExpiresAt) > time.Hour) { t.Errorf("expires at = %v, want about an hour from now", status.ExpiresAt) }
+  
+  // A token validated within the interval is used without asking again.
+  if _, err := a.ValidToken(); err != nil { t.Fatal(err) }
+  if validations, _ := o.Counts(); validations != 1 { t.Errorf("validations = %d, want 1", validations) }
+  
+  o.Revoke(access)
+  
+  if err := a.Validate(); err != ErrTokenInvalid { t.Errorf("Validate with a revoked token = %v, want ErrTokenInvalid", err) }
+  if (a.Status(0).Valid) { t.Errorf("a revoked token is still marked valid") }
+}
+
+func TestValidateTokenOfAnotherAccount(t *testing.T) {
+  
+  o := startTestOAuth(t)
+  
+  access, refresh := o.Issue("someone_else", "5678", time.Hour)
+  a := newTestAccount(t, "nifty255", access, refresh)
+  
+  if err := a.Validate(); err != ErrTokenInvalid { t.Fatalf("Validate = %v, want ErrTokenInvalid", err) }
+  
+  status := a.Status(0)
+  if (status.Valid || status.UserID != "" || !strings.Contains(status.Error, "someone_else")) { t.Errorf("status = %+v, want it rejected naming the owner", status) }
+}
+
+func TestCheckRefreshesRejectedToken(t *testing.T) {
+  
+  o := startTestOAuth(t)
+  
+  access, refresh := o.Issue("nifty255", "1234", time.Hour)
+  a := newTestAccount(t, "nifty255", access, refresh)
+  
+  // Twitch answers 401 for the revoked token, so it is refreshed.
+  o.Revoke(access)
+  
+  a.AuthLock.Lock()
+  token, err := a.Check()
+  a.AuthLock.Unlock()
+  
+  if (err != nil) { t.Fatal(err) }
+  if (token == access || o.Lookup(token) == nil) { t.Fatalf("token = %q, want a new live one", token) }
+  if (!a.Status(0).Valid) { t.Errorf("the refreshed token is not marked valid") }
+  if _, grants := o.Counts(); grants != 1 { t.Errorf("grants = %d, want 1", grants) }
+  
+  // Both new tokens are saved, so a restart does not use the retired ones.
+  saved, err := LoadSecret(a.Config.TokenFile, "")
+  if (err != nil || saved != token) { t.Errorf("saved token = %q %v, want %q", saved, err, token) }
+  
+  savedRefresh, err := LoadSecret(a.Config.RefreshTokenFile, "")
+  if (err != nil || savedRefresh == refresh || savedRefresh != a.RefreshToken) { t.Errorf("saved refresh token = %q %v, want the new one", savedRefresh, err) }
+  
+  // The old refresh token was retired along with the old access token.
+  a.RefreshToken = refresh
+  if err := a.Refresh(); err == nil { t.Errorf("refreshing with a retired refresh token succeeded") }
+}
+
+func TestCheckKeepsTokenWhenTwitchIsDown(t *testing.T) {
+  
+  o := startTestOAuth(t)
+  
+  access, refresh := o.Issue("nifty255", "1234", time.Hour)
+  a := newTestAccount(t, "nifty255", access, refresh)
+  
+  o.Close()
+  
+  a.AuthLock.Lock()
+  token, err := a.Check()
+  a.AuthLock.Unlock()
+  
+  if (err != nil || token != access) { t.Errorf("Check = %q %v, want the current token used unvalidated", token, err) }
+}
+
+func TestSaveSecret(t *testing.T) {
+  
+  path := filepath.Join(t.TempDir(), "token")
+  
+  if err := SaveSecret(path, "first"); err != nil { t.Fatal(err) }
+  if err := SaveSecret(path, "oauth:second"); err != nil { t.Fatal(err) }
+  
+  info, err := os.Stat(path)
+  if (err != nil) { t.Fatal(err) }
+  if (info.Mode().Perm() != 0600) { t.Errorf("mode = %v, want 0600", info.Mode().Perm()) }
+  
+  if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) { t.Errorf("the temporary file was left behind") }
+  
+  secret, err := LoadSecret(path, "")
+  if (err != nil || secret != "second") { t.Errorf("LoadSecret = %q %v, want the replaced secret without its prefix", secret, err) }
+  
+  t.Setenv("TWITCH_IRC_TEST_TOKEN", "from-env")
+  if secret, _ := LoadSecret(path, "TWITCH_IRC_TEST_TOKEN"); secret != "from-env" { t.Errorf("LoadSecret = %q, want the environment preferred", secret) }
+  
+  if err := SaveSecret(filepath.Join(path, "missing", "token"), "x"); err == nil { t.Errorf("saving under a file succeeded") }
+}
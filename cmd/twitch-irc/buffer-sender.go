@@ -0,0 +1,87 @@
+/*
+*
+* Name:     Twitch IRC Listener
+* Sys Name: twitch-irc
+* Author:   Nifty255
+*
+*/
+
+package main
+
+import (
+  "time" // Timing related functions.
+)
+
+// Specifies the delivery loop for one OutboundBuffer. Items are sent in batches of up to BatchSize;
+// a partial batch is held until its oldest item has waited Linger, so bursts share round trips
+// without quiet periods adding more than Linger of latency.
+type BufferSender struct {
+  
+  Name      string
+  Buffer    *OutboundBuffer
+  Ready     func() bool
+  Send      func(items []OutboundItem) (int, error)
+  BatchSize int
+  Linger    time.Duration
+  Ticker    *time.Ticker
+  Done      chan bool
+}
+
+// Static. Creates a BufferSender and starts its delivery loop. Send returns how many items, from the front, were delivered.
+func BufferSenderNew(name string, buffer *OutboundBuffer, ready func() bool, send func(items []OutboundItem) (int, error), c ConfigDelivery) *BufferSender {
+  
+  s := &(BufferSender{
+    Name: name,
+    Buffer: buffer,
+    Ready: ready,
+    Send: send,
+    BatchSize: c.BatchSize,
+    Linger: time.Duration(c.MaxLingerMs) * time.Millisecond,
+    Done: make(chan bool) })
+  
+  if (s.BatchSize < 1) { s.BatchSize = 1 }
+  
+  // The ticker flushes lingering batches and retries after a failure or while the sink is not ready.
+  interval := s.Linger
+  if (interval < time.Millisecond) { interval = time.Millisecond }
+  s.Ticker = time.NewTicker(interval)
+  
+  go func() {
+    for {
+      select {
+      case <- s.Buffer.Notify:
+        s.Drain()
+      case <- s.Ticker.C:
+        s.Drain()
+      case <- s.Done:
+        return
+      }
+    }
+  }()
+  
+  return s
+}
+
+// BufferSender. Sends batches until the buffer is empty, only a lingering partial batch remains, the sink is not ready,
+// or a send fails. Items are only acknowledged once sent, so failed items are retried in order.
+func (s *BufferSender) Drain() {
+  
+  for s.Ready() {
+    
+    items := s.Buffer.Peek(s.BatchSize)
+    if (len(items) == 0) { return }
+    if (len(items) < s.BatchSize && time.Since(items[0].Queued) < s.Linger) { return }
+    
+    sent, err := s.Send(items)
+    s.Buffer.Ack(items[:sent])
+    
+    if (err != nil) { logger.Warn("Failed to send buffered items.", LogFields{ "buffer": s.Name, "error": err }); return }
+  }
+}
+
+// BufferSender. Stops the delivery loop. Anything still buffered stays in the buffer.
+func (s *BufferSender) Stop() {
+  
+  s.Ticker.Stop()
+  close(s.Done)
+}
@@ -0,0 +1,94 @@
+/*
+*
+* Name:     Twitch IRC Listener
+* Sys Name: twitch-irc
+* Author:   Nifty255
+*
+*/
+
+package main
+
+import (
+  "sync"        // Mutual exclusion locks.
+  "time"        // Timing related functions.
+  "testing"     // Go's testing framework.
+  "sync/atomic" // Atomic primitives.
+)
+
+// Chat lines per second the listener must sustain at peak.
+const RequiredChatThroughput = 20000
+
+// Specifies a chat sink that takes whole batches, each costing one round trip, as the Chat Handler kite does.
+type BatchingSink struct {
+  
+  RoundTrip time.Duration
+  Lines     atomic.Int64
+  Batches   atomic.Int64
+  Lock      sync.Mutex
+}
+
+func (s *BatchingSink) SendChat(raw string) error { _, err := s.SendChats([]string{ raw }); return err }
+func (s *BatchingSink) Ready() bool               { return true }
+func (s *BatchingSink) Close() error              { return nil }
+
+// BatchingSink. Takes the batch after one round trip. Calls are serialized, as on a single kite connection.
+func (s *BatchingSink) SendChats(raws []string) (int, error) {
+  
+  s.Lock.Lock()
+  defer s.Lock.Unlock()
+  
+  if (s.RoundTrip > 0) { time.Sleep(s.RoundTrip) }
+  
+  s.Lines.Add(int64(len(raws)))
+  s.Batches.Add(1)
+  
+  return len(raws), nil
+}
+
+// Pushes b.N chat lines through a BufferSender into a BatchingSink and reports lines delivered per second.
+func benchmarkBufferSender(b *testing.B, roundTrip time.Duration) {
+  
+  sink := &BatchingSink{ RoundTrip: roundTrip }
+  buffer := OutboundBufferNew("chat", ConfigBuffer{ Capacity: 50000, Overflow: OverflowBlock }, ConfigWal{})
+  line := "@badge-info=;badges=;color=;display-name=Viewer;emotes=;id=b34ccfc7;room-id=100;tmi-sent-ts=1642715756806;user-id=9 " +
+    ":viewer!viewer@viewer.tmi.twitch.tv PRIVMSG #dallas :hello there"
+  
+  sender := BufferSenderNew("chat", buffer, sink.Ready, func(items []OutboundItem) (int, error) {
+    
+    raws := make([]string, len(items))
+    for ind := 0; ind < len(items); ind++ { raws[ind] = items[ind].Chat }
+    
+    return SendChatBatch(sink, raws)
+  }, DefaultConfig().Delivery)
+  
+  defer buffer.Close()
+  defer sender.Stop()
+  
+  b.ResetTimer()
+  start := time.Now()
+  
+  for ind := 0; ind < b.N; ind++ {
+    
+    buffer.Push(OutboundItem{ Chat: line, Priority: PriorityChat })
+  }
+  
+  for sink.Lines.Load() < int64(b.N) { time.Sleep(100 * time.Microsecond) }
+  
+  elapsed := time.Since(start)
+  b.StopTimer()
+  
+  throughput := float64(b.N) / elapsed.Seconds()
+  
+  b.ReportMetric(throughput, "lines/s")
+  b.ReportMetric(float64(b.N) / float64(sink.Batches.Load()), "lines/batch")
+  
+  // Short runs are dominated by the first linger.
+  if (b.N >= RequiredChatThroughput && throughput < RequiredChatThroughput) { b.Errorf("%.0f lines/s, want at least %d", throughput, RequiredChatThroughput) }
+}
+
+func BenchmarkBufferSender(b *testing.B) {
+  
+  b.Run("local", func(b *testing.B) { benchmarkBufferSender(b, 0) })
+  b.Run("rtt-1ms", func(b *testing.B) { benchmarkBufferSender(b, time.Millisecond) })
+  b.Run("rtt-2ms", func(b *testing.B) { benchmarkBufferSender(b, 2 * time.Millisecond) })
+}
@@ -9,7 +9,6 @@
 package main
 
 import (
-  "fmt"
   "io/ioutil"
   "path/filepath"
   "encoding/json"
@@ -35,6 +34,162 @@ type ConfigDatabase struct {
   DbName  string    `json:"db_name"`
 }
 
+type ConfigReconnect struct {
+  
+  BaseDelayMs       int `json:"base_delay_ms"`
+  MaxDelayMs        int `json:"max_delay_ms"`
+  BreakerThreshold  int `json:"breaker_threshold"`
+  BreakerCooldownMs int `json:"breaker_cooldown_ms"`
+  ExitAfterFailures int `json:"exit_after_failures"`
+}
+
+type ConfigTwitch struct {
+  
+  Address            string `json:"address"`
+  UseTLS             bool   `json:"use_tls"`
+  InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+}
+
+type ConfigJoins struct {
+  
+  Limit     int `json:"limit"`
+  WindowMs  int `json:"window_ms"`
+  BatchSize int `json:"batch_size"`
+}
+
+type ConfigAccount struct {
+  
+  Login            string `json:"login"`
+  TokenFile        string `json:"token_file"`
+  TokenEnv         string `json:"token_env"`
+  RefreshTokenFile string `json:"refresh_token_file"`
+  RefreshTokenEnv  string `json:"refresh_token_env"`
+  MaxListeners     int    `json:"max_listeners"`
+  JoinLimit        int    `json:"join_limit"`
+  JoinWindowMs     int    `json:"join_window_ms"`
+}
+
+type ConfigAuth struct {
+  
+  Accounts           []ConfigAccount `json:"accounts"`
+  ValidateUrl        string          `json:"validate_url"`
+  TokenUrl           string          `json:"token_url"`
+  ClientIDEnv        string          `json:"client_id_env"`
+  ClientSecretEnv    string          `json:"client_secret_env"`
+  ValidateIntervalMs int             `json:"validate_interval_ms"`
+  RequireAccount     bool            `json:"require_account"`
+}
+
+type ConfigSay struct {
+  
+  Limit             int `json:"limit"`
+  ModLimit          int `json:"mod_limit"`
+  WindowMs          int `json:"window_ms"`
+  DuplicateWindowMs int `json:"duplicate_window_ms"`
+  MaxWaitMs         int `json:"max_wait_ms"`
+  MaxLength         int `json:"max_length"`
+}
+
+type ConfigSink struct {
+  
+  Type      string `json:"type"`
+  Path      string `json:"path"`
+  Url       string `json:"url"`
+  TimeoutMs int    `json:"timeout_ms"`
+}
+
+type ConfigSinks struct {
+  
+  Events []ConfigSink `json:"events"`
+  Chat   []ConfigSink `json:"chat"`
+}
+
+type ConfigWal struct {
+  
+  Enabled        bool   `json:"enabled"`
+  Path           string `json:"path"`
+  SegmentBytes   int    `json:"segment_bytes"`
+  Fsync          string `json:"fsync"`
+  SyncIntervalMs int    `json:"sync_interval_ms"`
+}
+
+type ConfigBuffer struct {
+  
+  Capacity  int    `json:"capacity"`
+  Overflow  string `json:"overflow"`
+  SpillPath string `json:"spill_path"`
+}
+
+type ConfigBuffers struct {
+  
+  Events ConfigBuffer `json:"events"`
+  Chat   ConfigBuffer `json:"chat"`
+}
+
+type ConfigTracing struct {
+  
+  ProbeUsers    []string `json:"probe_users"`
+  ProbeCommands []string `json:"probe_commands"`
+  Window        int      `json:"window"`
+}
+
+type ConfigMetrics struct {
+  
+  Enabled bool   `json:"enabled"`
+  Address string `json:"address"`
+}
+
+type ConfigInstance struct {
+  
+  Name    string `json:"name"`
+  Address string `json:"address"`
+  Port    int    `json:"port"`
+}
+
+type ConfigSharding struct {
+  
+  Enabled      bool             `json:"enabled"`
+  Self         string           `json:"self"`
+  Instances    []ConfigInstance `json:"instances"`
+  VirtualNodes int              `json:"virtual_nodes"`
+  DownAfterMs  int              `json:"down_after_ms"`
+}
+
+type ConfigDedup struct {
+  
+  WindowMs   int    `json:"window_ms"`
+  MaxEntries int    `json:"max_entries"`
+  Collection string `json:"collection"`
+}
+
+type ConfigElection struct {
+  
+  Enabled    bool   `json:"enabled"`
+  Lease      string `json:"lease"`
+  Collection string `json:"collection"`
+  TtlMs      int    `json:"ttl_ms"`
+  RenewMs    int    `json:"renew_ms"`
+}
+
+type ConfigShutdown struct {
+  
+  DrainTimeoutMs int `json:"drain_timeout_ms"`
+}
+
+type ConfigLogging struct {
+  
+  Level             string `json:"level"`
+  Format            string `json:"format"`
+  RateLimitWindowMs int    `json:"rate_limit_window_ms"`
+  RateLimitBurst    int    `json:"rate_limit_burst"`
+}
+
+type ConfigDelivery struct {
+  
+  BatchSize   int `json:"batch_size"`
+  MaxLingerMs int `json:"max_linger_ms"`
+}
+
 type Config struct {
   
   Name                string          `json:"name"`
@@ -42,14 +197,30 @@ type Config struct {
   Addresses           ConfigAddresses `json:"addresses"`
   Ports               ConfigPorts     `json:"ports"`
   Database            ConfigDatabase  `json:"database"`
+  Twitch              ConfigTwitch    `json:"twitch"`
   ChannelsPerListener int             `json:"channels_per_listener"`
+  Reconnect           ConfigReconnect `json:"reconnect"`
+  Joins               ConfigJoins     `json:"joins"`
+  Sinks               ConfigSinks     `json:"sinks"`
+  Wal                 ConfigWal       `json:"wal"`
+  Delivery            ConfigDelivery  `json:"delivery"`
+  Buffers             ConfigBuffers   `json:"buffers"`
+  Metrics             ConfigMetrics   `json:"metrics"`
+  Tracing             ConfigTracing   `json:"tracing"`
+  Logging             ConfigLogging   `json:"logging"`
+  Shutdown            ConfigShutdown  `json:"shutdown"`
+  Election            ConfigElection  `json:"election"`
+  Dedup               ConfigDedup     `json:"dedup"`
+  Sharding            ConfigSharding  `json:"sharding"`
+  Auth                ConfigAuth      `json:"auth"`
+  Say                 ConfigSay       `json:"say"`
 }
 
 func LoadConfig(filename string) *Config {
   
   var config Config
   
-  if (filename == "") { fmt.Println("File name empty."); return DefaultConfig() }
+  if (filename == "") { logger.Warn("Config file name empty. Using defaults.", nil); return DefaultConfig() }
   
   // Load config file.
   configPath := filepath.FromSlash("bin/config/twitch-irc/" + filename + ".json")
@@ -59,7 +230,7 @@ func LoadConfig(filename string) *Config {
   if (err != nil) {
     
     // Error loading file.
-    fmt.Println("No config file found at \"" + configPath + "\".")
+    logger.Warn("No config file found. Using defaults.", LogFields{ "path": configPath })
     return DefaultConfig()
   } else {
     
@@ -69,10 +240,44 @@ func LoadConfig(filename string) *Config {
     if (err2 != nil) {
       
       // Error parsing file.
-      fmt.Println("Error parsing config file:", err2)
+      logger.Error("Error parsing config file. Using defaults.", LogFields{ "path": configPath, "error": err2 })
       return DefaultConfig()
     } else {
       
+      if (config.Twitch.Address == "") { config.Twitch = DefaultConfig().Twitch }
+      if (config.Reconnect.BaseDelayMs <= 0) { config.Reconnect.BaseDelayMs = DefaultConfig().Reconnect.BaseDelayMs }
+      if (config.Reconnect.MaxDelayMs <= 0) { config.Reconnect.MaxDelayMs = DefaultConfig().Reconnect.MaxDelayMs }
+      if (config.Reconnect.BreakerThreshold <= 0) { config.Reconnect.BreakerThreshold = DefaultConfig().Reconnect.BreakerThreshold }
+      if (config.Reconnect.BreakerCooldownMs <= 0) { config.Reconnect.BreakerCooldownMs = DefaultConfig().Reconnect.BreakerCooldownMs }
+      if (config.Joins.Limit <= 0) { config.Joins = DefaultConfig().Joins }
+      if (config.Joins.BatchSize <= 0) { config.Joins.BatchSize = 1 }
+      if (len(config.Sinks.Events) == 0) { config.Sinks.Events = DefaultConfig().Sinks.Events }
+      if (len(config.Sinks.Chat) == 0) { config.Sinks.Chat = DefaultConfig().Sinks.Chat }
+      if (config.Wal.Path == "") { config.Wal.Path = DefaultConfig().Wal.Path }
+      if (config.Delivery.BatchSize <= 0) { config.Delivery = DefaultConfig().Delivery }
+      if (config.Buffers.Events.Overflow == "") { config.Buffers.Events = DefaultConfig().Buffers.Events }
+      if (config.Buffers.Chat.Overflow == "") { config.Buffers.Chat = DefaultConfig().Buffers.Chat }
+      if (config.Metrics.Address == "") { config.Metrics.Address = DefaultConfig().Metrics.Address }
+      if (config.Logging.Level == "") { config.Logging = DefaultConfig().Logging }
+      if (config.Shutdown.DrainTimeoutMs <= 0) { config.Shutdown = DefaultConfig().Shutdown }
+      if (config.Election.Lease == "") { config.Election.Lease = DefaultConfig().Election.Lease }
+      if (config.Election.Collection == "") { config.Election.Collection = DefaultConfig().Election.Collection }
+      if (config.Election.TtlMs <= 0) { config.Election.TtlMs = DefaultConfig().Election.TtlMs }
+      if (config.Election.RenewMs <= 0) { config.Election.RenewMs = DefaultConfig().Election.RenewMs }
+      if (config.Dedup.WindowMs <= 0) { config.Dedup.WindowMs = DefaultConfig().Dedup.WindowMs }
+      if (config.Dedup.MaxEntries <= 0) { config.Dedup.MaxEntries = DefaultConfig().Dedup.MaxEntries }
+      if (config.Dedup.Collection == "") { config.Dedup.Collection = DefaultConfig().Dedup.Collection }
+      if (config.Sharding.VirtualNodes <= 0) { config.Sharding.VirtualNodes = DefaultConfig().Sharding.VirtualNodes }
+      if (config.Sharding.DownAfterMs <= 0) { config.Sharding.DownAfterMs = DefaultConfig().Sharding.DownAfterMs }
+      if (config.Auth.ValidateUrl == "") { config.Auth.ValidateUrl = DefaultConfig().Auth.ValidateUrl }
+      if (config.Auth.TokenUrl == "") { config.Auth.TokenUrl = DefaultConfig().Auth.TokenUrl }
+      if (config.Auth.ValidateIntervalMs <= 0) { config.Auth.ValidateIntervalMs = DefaultConfig().Auth.ValidateIntervalMs }
+      if (config.Say.Limit <= 0) { config.Say.Limit = DefaultConfig().Say.Limit }
+      if (config.Say.ModLimit <= 0) { config.Say.ModLimit = DefaultConfig().Say.ModLimit }
+      if (config.Say.WindowMs <= 0) { config.Say.WindowMs = DefaultConfig().Say.WindowMs }
+      if (config.Say.DuplicateWindowMs <= 0) { config.Say.DuplicateWindowMs = DefaultConfig().Say.DuplicateWindowMs }
+      if (config.Say.MaxLength <= 0) { config.Say.MaxLength = DefaultConfig().Say.MaxLength }
+      
       return &config
     }
   }
@@ -94,5 +299,85 @@ func DefaultConfig() *Config {
       Urls: []string{ "localhost:56789" },
       Replset: "",
       DbName: "opera_gather_template" },
-    ChannelsPerListener: 1000 })
+    Twitch: ConfigTwitch{
+      Address: "irc.chat.twitch.tv:443",
+      UseTLS: true,
+      InsecureSkipVerify: false },
+    ChannelsPerListener: 1000,
+    Reconnect: ConfigReconnect{
+      BaseDelayMs: 1000,
+      MaxDelayMs: 60000,
+      BreakerThreshold: 8,
+      BreakerCooldownMs: 300000,
+      ExitAfterFailures: 0 },
+    Joins: ConfigJoins{
+      Limit: 20,
+      WindowMs: 10000,
+      BatchSize: 10 },
+    Sinks: ConfigSinks{
+      Events: []ConfigSink{ ConfigSink{ Type: "kite" } },
+      Chat: []ConfigSink{ ConfigSink{ Type: "kite" } } },
+    Wal: ConfigWal{
+      Enabled: false,
+      Path: "bin/data/twitch-irc/wal",
+      SegmentBytes: 16777216,
+      Fsync: "interval",
+      SyncIntervalMs: 1000 },
+    Delivery: ConfigDelivery{
+      BatchSize: 100,
+      MaxLingerMs: 5 },
+    Buffers: ConfigBuffers{
+      Events: ConfigBuffer{
+        Capacity: 25000,
+        Overflow: "drop-oldest",
+        SpillPath: "bin/data/twitch-irc/spill" },
+      Chat: ConfigBuffer{
+        Capacity: 50000,
+        Overflow: "drop-oldest",
+        SpillPath: "bin/data/twitch-irc/spill" } },
+    Metrics: ConfigMetrics{
+      Enabled: true,
+      Address: ":9102" },
+    Tracing: ConfigTracing{
+      ProbeUsers: []string{},
+      ProbeCommands: []string{},
+      Window: 1000 },
+    Logging: ConfigLogging{
+      Level: "info",
+      Format: "logfmt",
+      RateLimitWindowMs: 10000,
+      RateLimitBurst: 5 },
+    Shutdown: ConfigShutdown{
+      DrainTimeoutMs: 10000 },
+    Election: ConfigElection{
+      Enabled: false,
+      Lease: "twitch-irc",
+      Collection: "leases",
+      TtlMs: 6000,
+      RenewMs: 2000 },
+    Dedup: ConfigDedup{
+      WindowMs: 60000,
+      MaxEntries: 100000,
+      Collection: "delivered_events" },
+    Sharding: ConfigSharding{
+      Enabled: false,
+      Self: "",
+      Instances: []ConfigInstance{},
+      VirtualNodes: 128,
+      DownAfterMs: 10000 },
+    Auth: ConfigAuth{
+      Accounts: []ConfigAccount{},
+      ValidateUrl: "https://id.twitch.tv/oauth2/validate",
+      TokenUrl: "https://id.twitch.tv/oauth2/token",
+      ClientIDEnv: "TWITCH_CLIENT_ID",
+      ClientSecretEnv: "TWITCH_CLIENT_SECRET",
+      ValidateIntervalMs: 3600000,
+      RequireAccount: false },
+    Say: ConfigSay{
+      Limit: 20,
+      ModLimit: 100,
+      WindowMs: 30000,
+      DuplicateWindowMs: 30000,
+      MaxWaitMs: 5000,
+      MaxLength: 500 } })
 }
\ No newline at end of file
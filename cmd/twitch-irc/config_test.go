@@ -0,0 +1,102 @@
+/*
+*
+* Name:     Twitch IRC Listener
+* Sys Name: twitch-irc
+* Author:   Nifty255
+*
+*/
+
+package main
+
+import (
+  "os"            // Operating system functions.
+  "time"          // Timing related functions.
+  "testing"       // Go's testing framework.
+  "math/rand"     // Pseudo-random number functions.
+  "path/filepath" // File path manipulation functions.
+)
+
+// Writes a config file under a temporary working directory and loads it.
+func loadTestConfig(t *testing.T, contents string) *Config {
+  
+  t.Helper()
+  
+  dir := t.TempDir()
+  path := filepath.Join(dir, "bin", "config", "twitch-irc")
+  if err := os.MkdirAll(path, 0755); err != nil { t.Fatal(err) }
+  if err := os.WriteFile(filepath.Join(path, "test.json"), []byte(contents), 0644); err != nil { t.Fatal(err) }
+  
+  wd, err := os.Getwd()
+  if (err != nil) { t.Fatal(err) }
+  if err := os.Chdir(dir); err != nil { t.Fatal(err) }
+  defer os.Chdir(wd)
+  
+  return LoadConfig("test")
+}
+
+func TestLoadConfigReconnectDefaults(t *testing.T) {
+  
+  c := loadTestConfig(t, `{ "name": "old-config", "channels_per_listener": 50 }`)
+  defaults := DefaultConfig().Reconnect
+  
+  if (c.Reconnect != defaults) { t.Errorf("reconnect = %+v, want defaults %+v", c.Reconnect, defaults) }
+  
+  c = loadTestConfig(t, `{ "reconnect": { "base_delay_ms": 250, "exit_after_failures": 3 } }`)
+  
+  if (c.Reconnect.BaseDelayMs != 250 || c.Reconnect.ExitAfterFailures != 3) { t.Errorf("reconnect = %+v, lost the configured values", c.Reconnect) }
+  if (c.Reconnect.MaxDelayMs != defaults.MaxDelayMs || c.Reconnect.BreakerThreshold != defaults.BreakerThreshold || c.Reconnect.BreakerCooldownMs != defaults.BreakerCooldownMs) { t.Errorf("reconnect = %+v, want the unset values defaulted", c.Reconnect) }
+}
+
+func TestLoadConfigElectionOptIn(t *testing.T) {
+  
+  if (DefaultConfig().Election.Enabled) { t.Errorf("election is enabled by default") }
+  
+  template, err := os.ReadFile(filepath.Join("config", "template.json"))
+  if (err != nil) { t.Fatal(err) }
+  
+  if c := loadTestConfig(t, string(template)); c.Election.Enabled { t.Errorf("election is enabled in the template") }
+  if c := loadTestConfig(t, `{ "election": { "enabled": true } }`); !c.Election.Enabled || c.Election.Lease != DefaultConfig().Election.Lease { t.Errorf("election = %+v, want it enabled with the default lease", c.Election) }
+  
+  // Without a database driver the stores fail rather than dialing on their own.
+  if _, err := MongoSessionNew(nil, "test").Copy(); err == nil { t.Errorf("a session without a driver was copied") }
+}
+
+func TestReconnectDelay(t *testing.T) {
+  
+  c := ConfigReconnect{ BaseDelayMs: 1000, MaxDelayMs: 60000, BreakerThreshold: 8, BreakerCooldownMs: 300000 }
+  
+  // The delay before jitter: doubling from the base, capped at the maximum, then the breaker's cooldown.
+  cases := []struct {
+    
+    failures int
+    delay    time.Duration
+  }{
+    { 1, time.Second },
+    { 2, 2 * time.Second },
+    { 3, 4 * time.Second },
+    { 6, 32 * time.Second },
+    { 7, 60 * time.Second },
+  }
+  
+  for ind := 0; ind < len(cases); ind++ {
+    
+    low, high := cases[ind].delay / 2, cases[ind].delay
+    
+    // The jitter's extremes land exactly on the bounds.
+    if delay := BackoffDelay(c, cases[ind].failures, func(n int64) int64 { return 0 }); delay != low { t.Errorf("failures %d: least delay = %v, want %v", cases[ind].failures, delay, low) }
+    if delay := BackoffDelay(c, cases[ind].failures, func(n int64) int64 { return n - 1 }); delay != high { t.Errorf("failures %d: most delay = %v, want %v", cases[ind].failures, delay, high) }
+    
+    random := rand.New(rand.NewSource(int64(ind)))
+    for draw := 0; draw < 1000; draw++ {
+      
+      if delay := BackoffDelay(c, cases[ind].failures, random.Int63n); delay < low || delay > high { t.Fatalf("failures %d: delay = %v, want within [%v, %v]", cases[ind].failures, delay, low, high) }
+    }
+  }
+  
+  for failures := c.BreakerThreshold; failures < c.BreakerThreshold + 2; failures++ {
+    
+    if delay := BackoffDelay(c, failures, rand.Int63n); delay != 300 * time.Second { t.Errorf("failures %d: delay = %v, want the breaker's cooldown", failures, delay) }
+  }
+  
+  if delay := BackoffDelay(ConfigReconnect{}, 3, rand.Int63n); delay != 0 { t.Errorf("delay without a base = %v, want 0", delay) }
+}
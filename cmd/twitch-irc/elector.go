@@ -0,0 +1,207 @@
+/*
+*
+* Name:     Twitch IRC Listener
+* Sys Name: twitch-irc
+* Author:   Nifty255
+*
+*/
+
+package main
+
+import (
+  "os"      // File functions.
+  "sync"    // Mutual exclusion locks.
+  "time"    // Timing related functions.
+  "strconv" // String/Number conversion functions.
+)
+
+// Specifies the leadership state reported by the "are-you-primary" kite method.
+type LeaseStatus struct {
+  
+  IsPrimary bool      `json:"is_primary"`
+  Elected   bool      `json:"elected"`
+  Self      string    `json:"self"`
+  Holder    string    `json:"holder"`
+  Term      int64     `json:"term"`
+  Expires   time.Time `json:"expires"`
+}
+
+// Specifies a replica campaigning for a lease. Every renew interval the leader renews it and everyone else
+// tries to take it, so a dead leader is replaced within one TTL plus one renew interval.
+// The leader stops acting as one a renew interval before its lease expires, which absorbs that much clock skew
+// between replicas, and it stops at once if a renewal finds a newer term.
+type Elector struct {
+  
+  Store      LeaseStore
+  Name       string
+  Self       string
+  Ttl        time.Duration
+  Renew      time.Duration
+  OnChange   func(leader bool, lease Lease)
+  Lease      Lease
+  Leader     bool
+  ValidUntil time.Time
+  Done       chan bool
+  Exited     chan bool
+  Lock       sync.Mutex
+}
+
+// Static. Returns an identity unique to this process, such as "host:3001:1234".
+func ElectorIdentity() string {
+  
+  host, err := os.Hostname()
+  if (err != nil) { host = "unknown" }
+  
+  return host + ":" + strconv.Itoa(config.Ports.Irc) + ":" + strconv.Itoa(os.Getpid())
+}
+
+// Static. Creates an Elector and starts campaigning. onChange is called, from the campaign goroutine, whenever leadership is won or lost.
+func ElectorNew(store LeaseStore, self string, c ConfigElection, onChange func(leader bool, lease Lease)) *Elector {
+  
+  e := &(Elector{
+    Store: store,
+    Name: c.Lease,
+    Self: self,
+    Ttl: time.Duration(c.TtlMs) * time.Millisecond,
+    Renew: time.Duration(c.RenewMs) * time.Millisecond,
+    OnChange: onChange,
+    Done: make(chan bool),
+    Exited: make(chan bool) })
+  
+  if (e.Renew <= 0 || e.Renew * 2 > e.Ttl) { e.Renew = e.Ttl / 3 }
+  
+  go e.Run()
+  
+  return e
+}
+
+// Elector. Campaigns until Stop is called.
+func (e *Elector) Run() {
+  
+  defer close(e.Exited)
+  
+  for {
+    
+    e.Campaign()
+    
+    wait := e.Renew
+    
+    // Wake in time to step down if the lease lapses before the next renewal.
+    e.Lock.Lock()
+    if (e.Leader) {
+      
+      if until := time.Until(e.ValidUntil); until < wait { wait = until }
+    }
+    e.Lock.Unlock()
+    
+    timer := time.NewTimer(wait)
+    
+    select {
+    case <- timer.C:
+    case <- e.Done:
+      timer.Stop()
+      return
+    }
+  }
+}
+
+// Elector. Renews the lease if held, otherwise tries to take it.
+func (e *Elector) Campaign() {
+  
+  e.Lock.Lock()
+  held := (e.Lease.Holder == e.Self)
+  term := e.Lease.Term
+  e.Lock.Unlock()
+  
+  sent := time.Now()
+  
+  var lease Lease
+  var ok bool
+  var err error
+  
+  if (held) { lease, ok, err = e.Store.Renew(e.Name, e.Self, term, e.Ttl) }
+  if (!held || (err == nil && !ok && time.Now().After(lease.Expires))) { lease, ok, err = e.Store.Acquire(e.Name, e.Self, e.Ttl) }
+  
+  e.Lock.Lock()
+  
+  if (err != nil) {
+    
+    logger.Warn("Unable to reach lease store.", LogFields{ "lease": e.Name, "error": err })
+  } else {
+    
+    e.Lease = lease
+    if (ok) { e.ValidUntil = sent.Add(e.Ttl - e.Renew) } else { e.ValidUntil = time.Time{} }
+  }
+  
+  e.Update()
+}
+
+// Elector. Works out whether this replica leads and reports any change. Call with Lock held; it is released.
+func (e *Elector) Update() {
+  
+  leader := (e.Lease.Holder == e.Self && time.Now().Before(e.ValidUntil))
+  changed := (leader != e.Leader)
+  e.Leader = leader
+  lease := e.Lease
+  
+  e.Lock.Unlock()
+  
+  if (!changed) { return }
+  
+  if (leader) {
+    
+    logger.Info("Elected primary.", LogFields{ "lease": lease.Name, "term": lease.Term })
+  } else {
+    
+    logger.Warn("No longer primary.", LogFields{ "lease": lease.Name, "term": lease.Term, "holder": lease.Holder })
+  }
+  
+  if (e.OnChange != nil) { e.OnChange(leader, lease) }
+}
+
+// Elector. Returns whether this replica holds an unexpired lease. The result is a fencing check:
+// call it before each write or delivery rather than caching it.
+func (e *Elector) IsLeader() bool {
+  
+  e.Lock.Lock()
+  defer e.Lock.Unlock()
+  
+  return (e.Lease.Holder == e.Self && time.Now().Before(e.ValidUntil))
+}
+
+// Elector. Returns the lease as last seen.
+func (e *Elector) Status() LeaseStatus {
+  
+  e.Lock.Lock()
+  defer e.Lock.Unlock()
+  
+  return LeaseStatus{
+    IsPrimary: (e.Lease.Holder == e.Self && time.Now().Before(e.ValidUntil)),
+    Elected: true,
+    Self: e.Self,
+    Holder: e.Lease.Holder,
+    Term: e.Lease.Term,
+    Expires: e.Lease.Expires }
+}
+
+// Elector. Stops campaigning and, if leading, gives up the lease so another replica takes over at once.
+func (e *Elector) Stop() {
+  
+  close(e.Done)
+  <- e.Exited
+  
+  e.Lock.Lock()
+  held := (e.Lease.Holder == e.Self)
+  lease := e.Lease
+  e.ValidUntil = time.Time{}
+  e.Lease.Holder = ""
+  
+  e.Update()
+  
+  if (!held) { return }
+  
+  if err := e.Store.Release(lease.Name, e.Self, lease.Term); err != nil {
+    
+    logger.Warn("Unable to release lease.", LogFields{ "lease": lease.Name, "term": lease.Term, "error": err })
+  }
+}
@@ -0,0 +1,173 @@
+/*
+*
+* Name:     Twitch IRC Listener
+* Sys Name: twitch-irc
+* Author:   Nifty255
+*
+*/
+
+package main
+
+import (
+  "sync"    // Mutual exclusion locks.
+  "time"    // Timing related functions.
+  "testing" // Go's testing framework.
+)
+
+// Specifies a LeaseStore kept in memory, with the same rules as MongoLeaseStore.
+type MemoryLeaseStore struct {
+  
+  Leases map[string]Lease
+  Lock   sync.Mutex
+}
+
+func (m *MemoryLeaseStore) Acquire(name, holder string, ttl time.Duration) (Lease, bool, error) {
+  
+  m.Lock.Lock()
+  defer m.Lock.Unlock()
+  
+  now := time.Now()
+  lease, ok := m.Leases[name]
+  
+  if (ok && !lease.Expires.Before(now)) { return lease, false, nil }
+  
+  lease = Lease{ Name: name, Holder: holder, Term: lease.Term + 1, Expires: now.Add(ttl) }
+  m.Leases[name] = lease
+  
+  return lease, true, nil
+}
+
+func (m *MemoryLeaseStore) Renew(name, holder string, term int64, ttl time.Duration) (Lease, bool, error) {
+  
+  m.Lock.Lock()
+  defer m.Lock.Unlock()
+  
+  lease := m.Leases[name]
+  if (lease.Holder != holder || lease.Term != term) { return lease, false, nil }
+  
+  lease.Expires = time.Now().Add(ttl)
+  m.Leases[name] = lease
+  
+  return lease, true, nil
+}
+
+func (m *MemoryLeaseStore) Release(name, holder string, term int64) error {
+  
+  m.Lock.Lock()
+  defer m.Lock.Unlock()
+  
+  lease := m.Leases[name]
+  if (lease.Holder != holder || lease.Term != term) { return nil }
+  
+  lease.Expires = time.Now()
+  m.Leases[name] = lease
+  
+  return nil
+}
+
+// MemoryLeaseStore. Returns the named lease as it stands.
+func (m *MemoryLeaseStore) Get(name string) Lease {
+  
+  m.Lock.Lock()
+  defer m.Lock.Unlock()
+  
+  return m.Leases[name]
+}
+
+// Starts an elector campaigning on the store, stopped when the test ends if it still runs, and a channel of its leadership changes.
+func startTestElector(t *testing.T, store LeaseStore, self string, ttl, renew time.Duration) (*Elector, chan bool) {
+  
+  t.Helper()
+  
+  changes := make(chan bool, 16)
+  e := ElectorNew(store, self, ConfigElection{ Lease: "primary", TtlMs: int(ttl.Milliseconds()), RenewMs: int(renew.Milliseconds()) }, func(leader bool, lease Lease) { changes <- leader })
+  
+  t.Cleanup(func() {
+    
+    select {
+    case <- e.Exited:
+    default:
+      e.Stop()
+    }
+  })
+  
+  return e, changes
+}
+
+// Waits for the next leadership change and fails the test unless it is the one wanted.
+func waitForLeadership(t *testing.T, name string, changes chan bool, leader bool, timeout time.Duration) {
+  
+  t.Helper()
+  
+  select {
+  case got := <- changes:
+    if (got != leader) { t.Fatalf("%s leader = %v, want %v", name, got, leader) }
+  case <- time.After(timeout):
+    t.Fatalf("%s leader did not become %v within %v", name, leader, timeout)
+  }
+}
+
+func TestElectorTakesOverExpiredLease(t *testing.T) {
+  
+  store := &(MemoryLeaseStore{ Leases: make(map[string]Lease, 1) })
+  
+  a, aChanges := startTestElector(t, store, "a", 600 * time.Millisecond, 100 * time.Millisecond)
+  waitForLeadership(t, "a", aChanges, true, time.Second)
+  
+  b, bChanges := startTestElector(t, store, "b", 600 * time.Millisecond, 100 * time.Millisecond)
+  time.Sleep(300 * time.Millisecond)
+  if (b.IsLeader()) { t.Fatalf("b leads while a renews its lease") }
+  
+  // a stops renewing without releasing, as if it had crashed.
+  close(a.Done)
+  <- a.Exited
+  crashed := time.Now()
+  term := store.Get("primary").Term
+  
+  waitForLeadership(t, "b", bChanges, true, 2 * time.Second)
+  
+  if took := time.Since(crashed); took < 400 * time.Millisecond { t.Errorf("b took over %v after a stopped, before its lease expired", took) }
+  if (a.IsLeader()) { t.Errorf("a still counts itself leader once b has taken over") }
+  if lease := store.Get("primary"); lease.Holder != "b" || lease.Term != term + 1 { t.Errorf("lease = %+v, want b holding term %d", lease, term + 1) }
+}
+
+func TestElectorStepsDownOnNewerTerm(t *testing.T) {
+  
+  store := &(MemoryLeaseStore{ Leases: make(map[string]Lease, 1) })
+  
+  a, changes := startTestElector(t, store, "a", 2 * time.Second, 100 * time.Millisecond)
+  waitForLeadership(t, "a", changes, true, time.Second)
+  
+  // Someone else took the lease in a newer term, say while a could not reach the store.
+  term := store.Get("primary").Term
+  store.Lock.Lock()
+  store.Leases["primary"] = Lease{ Name: "primary", Holder: "b", Term: term + 1, Expires: time.Now().Add(2 * time.Second) }
+  store.Lock.Unlock()
+  
+  // The next renewal finds it, long before a's own lease would have lapsed.
+  waitForLeadership(t, "a", changes, false, 500 * time.Millisecond)
+  
+  if status := a.Status(); status.IsPrimary || status.Holder != "b" || status.Term != term + 1 { t.Errorf("status = %+v, want b holding term %d", status, term + 1) }
+}
+
+func TestElectorStopReleasesLease(t *testing.T) {
+  
+  store := &(MemoryLeaseStore{ Leases: make(map[string]Lease, 1) })
+  
+  a, aChanges := startTestElector(t, store, "a", 5 * time.Second, 100 * time.Millisecond)
+  waitForLeadership(t, "a", aChanges, true, time.Second)
+  
+  _, bChanges := startTestElector(t, store, "b", 5 * time.Second, 100 * time.Millisecond)
+  
+  stopped := time.Now()
+  a.Stop()
+  
+  waitForLeadership(t, "a", aChanges, false, time.Second)
+  if (a.IsLeader()) { t.Errorf("a leads after Stop") }
+  
+  // b takes over within a renew interval, not the five second TTL.
+  waitForLeadership(t, "b", bChanges, true, time.Second)
+  
+  if took := time.Since(stopped); took > time.Second { t.Errorf("b took over %v after a stopped, want the lease released", took) }
+  if lease := store.Get("primary"); lease.Holder != "b" { t.Errorf("lease = %+v, want b holding it", lease) }
+}
@@ -0,0 +1,215 @@
+/*
+*
+* Name:     Twitch IRC Listener
+* Sys Name: twitch-irc
+* Author:   Nifty255
+*
+*/
+
+package main
+
+import (
+  "sync"                 // Mutual exclusion locks.
+  "time"                 // Timing related functions.
+  "strconv"              // String/Number conversion functions.
+  "gopkg.in/mgo.v2"      // MongoDB driver.
+  "gopkg.in/mgo.v2/bson" // BSON encoding functions.
+  ogdm "github.com/the-opera-house/go-common-lib/models"
+)
+
+var DuplicatesTotal = CounterNew("twitch_irc_duplicate_events_total", "Events dropped as duplicates, by event type.", "type")
+
+// Static. Returns the key an event is deduplicated on: Twitch's id tag or, for host events, which have none,
+// the type and the hosting and hosted channels. Replicas derive the same key for the same event.
+// A deletion carries the id of the message it deletes, so it is keyed apart from that message's own event.
+// Timeouts, bans and clears have no id either, and are keyed on Twitch's timestamp, which is their Time.
+// Room mode changes have neither, and are keyed on when the ROOMSTATE was received, so a mode toggled off and back on
+// within the window is reported each time. Replicas receive it at different times, so one taking over may repeat such a
+// change the old primary delivered, but never drops one.
+func EventKey(e *ogdm.Event) string {
+  
+  switch(e.EventType) {
+    
+    case "delete":
+    return "delete:" + e.EventID
+    case "timeout", "ban", "clear":
+    return e.EventType + ":" + e.EventChannelID + ":" + e.EventTargetID + ":" + strconv.FormatInt(e.Time.UnixMilli(), 10)
+    case "room-mode":
+    return e.EventType + ":" + e.EventChannelName + ":" + e.EventSubtype + ":" + strconv.FormatInt(e.Time.UnixNano(), 10)
+  }
+  
+  if (e.EventID != "") { return e.EventID }
+  
+  return e.EventType + ":" + e.EventSenderLogin + ":" + e.EventTargetLogin
+}
+
+// Static. Returns the key recording that an event sink member delivered the event with the given key.
+func DeliveredKey(key, member string) string {
+  
+  return key + "@" + member
+}
+
+// Specifies an event seen within the dedup window. Pushed is set once it is queued for delivery.
+type DedupEntry struct {
+  
+  Key    string
+  Seen   time.Time
+  SentAt time.Time
+  Event  *ogdm.Event
+  Pushed bool
+}
+
+// Specifies the events seen in the last Window, up to MaxEntries, oldest first.
+// A secondary keeps the ones it did not push so that, on becoming primary, it can deliver whatever the old primary had not.
+type EventDedup struct {
+  
+  Window     time.Duration
+  MaxEntries int
+  Entries    []*DedupEntry
+  Keys       map[string]*DedupEntry
+  Lock       sync.Mutex
+}
+
+// Static. Creates an EventDedup from config.
+func EventDedupNew(c ConfigDedup) *EventDedup {
+  
+  return &(EventDedup{
+    Window: time.Duration(c.WindowMs) * time.Millisecond,
+    MaxEntries: c.MaxEntries,
+    Entries: make([]*DedupEntry, 0, 1024),
+    Keys: make(map[string]*DedupEntry, 1024) })
+}
+
+// EventDedup. Forgets entries older than the window, and the oldest beyond MaxEntries. Call with Lock held.
+func (d *EventDedup) Expire(now time.Time) {
+  
+  expired := 0
+  for expired < len(d.Entries) &&
+      (now.Sub(d.Entries[expired].Seen) > d.Window || len(d.Entries) - expired > d.MaxEntries) {
+    
+    if (d.Keys[d.Entries[expired].Key] == d.Entries[expired]) { delete(d.Keys, d.Entries[expired].Key) }
+    d.Entries[expired] = nil
+    expired++
+  }
+  
+  if (expired > 0) { d.Entries = d.Entries[expired:] }
+}
+
+// EventDedup. Records an event. Returns false if it was already seen within the window, and otherwise whether it should be pushed.
+// isPrimary is asked under Lock, so an event is either pushed here or left for TakeUnpushed, never neither.
+func (d *EventDedup) Add(e *ogdm.Event, sentAt time.Time, isPrimary func() bool) (bool, bool) {
+  
+  now := time.Now()
+  key := EventKey(e)
+  
+  d.Lock.Lock()
+  defer d.Lock.Unlock()
+  
+  d.Expire(now)
+  
+  if _, ok := d.Keys[key]; ok { return false, false }
+  
+  entry := &(DedupEntry{ Key: key, Seen: now, SentAt: sentAt, Event: e, Pushed: isPrimary() })
+  d.Entries = append(d.Entries, entry)
+  d.Keys[key] = entry
+  
+  return true, entry.Pushed
+}
+
+// EventDedup. Returns every entry in the window that was not pushed, oldest first, and marks them pushed.
+func (d *EventDedup) TakeUnpushed() []DedupEntry {
+  
+  d.Lock.Lock()
+  defer d.Lock.Unlock()
+  
+  d.Expire(time.Now())
+  
+  entries := make([]DedupEntry, 0, len(d.Entries))
+  for ind := 0; ind < len(d.Entries); ind++ {
+    
+    if (d.Entries[ind].Pushed) { continue }
+    
+    d.Entries[ind].Pushed = true
+    entries = append(entries, *d.Entries[ind])
+  }
+  
+  return entries
+}
+
+// Specifies where the primary records the keys of delivered events, so a replica taking over knows which to skip.
+type DeliveredStore interface {
+  
+  // Records that the events with the given keys were delivered.
+  Mark(keys []string) error
+  
+  // Returns which of the given keys were delivered.
+  Delivered(keys []string) (map[string]bool, error)
+}
+
+// Specifies a DeliveredStore backed by a MongoDB collection. Keys expire after Ttl through a TTL index.
+type MongoDeliveredStore struct {
+  
+  *MongoSession
+  Collection string
+  Ttl        time.Duration
+  Indexed    bool
+}
+
+// Static. Creates a MongoDeliveredStore on the given session.
+func MongoDeliveredStoreNew(session *MongoSession, collection string, ttl time.Duration) *MongoDeliveredStore {
+  
+  return &(MongoDeliveredStore{
+    MongoSession: session,
+    Collection: collection,
+    Ttl: ttl })
+}
+
+func (m *MongoDeliveredStore) Mark(keys []string) error {
+  
+  if (len(keys) == 0) { return nil }
+  
+  session, err := m.Copy()
+  if (err != nil) { return err }
+  defer session.Close()
+  
+  collection := session.DB(m.DbName).C(m.Collection)
+  
+  if (!m.Indexed) {
+    
+    err = collection.EnsureIndex(mgo.Index{ Key: []string{ "time" }, ExpireAfter: m.Ttl })
+    if (err != nil) { return err }
+    m.Indexed = true
+  }
+  
+  // Keys already marked are fine; a replica may have delivered the same event before handing over.
+  bulk := collection.Bulk()
+  bulk.Unordered()
+  
+  now := time.Now()
+  for ind := 0; ind < len(keys); ind++ {
+    
+    bulk.Upsert(bson.M{ "_id": keys[ind] }, bson.M{ "$set": bson.M{ "time": now } })
+  }
+  
+  _, err = bulk.Run()
+  
+  return err
+}
+
+func (m *MongoDeliveredStore) Delivered(keys []string) (map[string]bool, error) {
+  
+  delivered := make(map[string]bool, len(keys))
+  if (len(keys) == 0) { return delivered, nil }
+  
+  session, err := m.Copy()
+  if (err != nil) { return delivered, err }
+  defer session.Close()
+  
+  var found []struct{ Key string `bson:"_id"` }
+  err = session.DB(m.DbName).C(m.Collection).Find(bson.M{ "_id": bson.M{ "$in": keys } }).Select(bson.M{ "_id": 1 }).All(&found)
+  if (err != nil) { return delivered, err }
+  
+  for ind := 0; ind < len(found); ind++ { delivered[found[ind].Key] = true }
+  
+  return delivered, nil
+}
@@ -0,0 +1,578 @@
+/*
+*
+* Name:     Twitch IRC Listener
+* Sys Name: twitch-irc
+* Author:   Nifty255
+*
+*/
+
+package main
+
+import (
+  "os"                     // File functions.
+  "sync"                   // Mutual exclusion locks.
+  "time"                   // Timing related functions.
+  "bytes"                  // Byte buffer functions.
+  "errors"                 // Error creation functions.
+  "strconv"                // String conversion functions.
+  "net/http"               // HTTP client functions.
+  "encoding/json"          // JSON encoding functions.
+  "github.com/koding/kite" // Microservice functions and structures.
+  ogdm "github.com/the-opera-house/go-common-lib/models"
+)
+
+// Specifies a destination for events fired by the listeners.
+type EventSink interface {
+  
+  // Delivers a single event.
+  SendEvent(e *ogdm.Event) error
+  // Whether the sink can accept events right now. Events stay buffered while it cannot.
+  Ready() bool
+  Close() error
+}
+
+// Specifies a destination for raw chat lines.
+type ChatSink interface {
+  
+  // Delivers a single raw IRC line.
+  SendChat(raw string) error
+  // Whether the sink can accept chat right now. Chat stays buffered while it cannot.
+  Ready() bool
+  Close() error
+}
+
+// Specifies an EventSink that can deliver several events in one call.
+type BatchEventSink interface {
+  
+  EventSink
+  // Delivers events in order and returns how many, from the front, were delivered.
+  SendEvents(events []*ogdm.Event) (int, error)
+}
+
+// Specifies a ChatSink that can deliver several chat lines in one call.
+type BatchChatSink interface {
+  
+  ChatSink
+  // Delivers raw lines in order and returns how many, from the front, were delivered.
+  SendChats(raws []string) (int, error)
+}
+
+// Static. Sends events as one batch if the sink supports it, otherwise one at a time. Returns how many were delivered.
+func SendEventBatch(sink EventSink, events []*ogdm.Event) (int, error) {
+  
+  if batch, ok := sink.(BatchEventSink); ok { return batch.SendEvents(events) }
+  
+  for ind := 0; ind < len(events); ind++ {
+    
+    if err := sink.SendEvent(events[ind]); err != nil { return ind, err }
+  }
+  
+  return len(events), nil
+}
+
+// Static. Sends chat lines as one batch if the sink supports it, otherwise one at a time. Returns how many were delivered.
+func SendChatBatch(sink ChatSink, raws []string) (int, error) {
+  
+  if batch, ok := sink.(BatchChatSink); ok { return batch.SendChats(raws) }
+  
+  for ind := 0; ind < len(raws); ind++ {
+    
+    if err := sink.SendChat(raws[ind]); err != nil { return ind, err }
+  }
+  
+  return len(raws), nil
+}
+
+// Specifies a chat line as written by the file, stdout and webhook sinks.
+type ChatRecord struct {
+  
+  Time time.Time `json:"time"`
+  Raw  string    `json:"raw"`
+}
+
+// Specifies one sink of a MultiSink. With more than one member, each has its own buffer and delivery loop,
+// so it is waited on and retried without holding up or repeating deliveries to the others.
+// Name is the member's buffer name, or the stream's if it is sent to directly. Delivered, if set, is told of every
+// item the sink acknowledges.
+type SinkMember struct {
+  
+  Name      string
+  Sink      interface{}
+  Buffer    *OutboundBuffer
+  Sender    *BufferSender
+  Delivered func(member *SinkMember, items []OutboundItem)
+}
+
+// SinkMember. Whether the sink can accept items right now.
+func (s *SinkMember) Ready() bool {
+  
+  return s.Sink.(interface{ Ready() bool }).Ready()
+}
+
+// SinkMember. Delivers buffered items, as events or chat lines depending on what they hold. Returns how many were delivered.
+func (s *SinkMember) Send(items []OutboundItem) (int, error) {
+  
+  start := time.Now()
+  var sent int
+  var err error
+  
+  if (items[0].Event != nil) {
+    
+    events := make([]*ogdm.Event, len(items))
+    for ind := 0; ind < len(items); ind++ { events[ind] = items[ind].Event }
+    
+    sent, err = SendEventBatch(s.Sink.(EventSink), events)
+  } else {
+    
+    raws := make([]string, len(items))
+    for ind := 0; ind < len(items); ind++ { raws[ind] = items[ind].Chat }
+    
+    sent, err = SendChatBatch(s.Sink.(ChatSink), raws)
+  }
+  
+  RecordSend(s.Sink, start, err)
+  
+  for ind := 0; ind < sent; ind++ {
+    
+    if (!items[ind].SentAt.IsZero()) { DeliveryLatency.Observe(time.Since(items[ind].SentAt).Seconds(), s.Name) }
+  }
+  
+  if (sent > 0 && s.Delivered != nil) { s.Delivered(s, items[:sent]) }
+  
+  return sent, err
+}
+
+// Specifies a set of sinks that all receive every event or every chat line. A single member is sent to directly.
+// With more, items are taken only as far as every member's buffer has room, so no member ever drops one, and each
+// member delivers from its own buffer when it is ready. A member whose buffer is full holds up the rest.
+type MultiSink struct {
+  
+  Name    string
+  Members []*SinkMember
+}
+
+// Static. Creates a MultiSink over the given sinks, buffering each under its own name, such as "events-1",
+// if there is more than one. Fails if there are no sinks, since everything sent would be lost.
+func MultiSinkNew(name string, sinks []interface{}, c ConfigBuffer, w ConfigWal) (*MultiSink, error) {
+  
+  if (len(sinks) == 0) { return nil, errors.New("No " + name + " sinks could be created.") }
+  
+  m := &(MultiSink{ Name: name, Members: make([]*SinkMember, len(sinks)) })
+  
+  for ind := 0; ind < len(sinks); ind++ {
+    
+    m.Members[ind] = &(SinkMember{ Name: name, Sink: sinks[ind] })
+    
+    if (len(sinks) > 1) {
+      
+      m.Members[ind].Name = name + "-" + strconv.Itoa(ind)
+      m.Members[ind].Buffer = OutboundBufferNew(m.Members[ind].Name, c, w)
+    }
+  }
+  
+  return m, nil
+}
+
+// MultiSink. Starts a delivery loop for each buffered member. Members only deliver while ready returns true, too,
+// and report what each of them delivered to delivered, if it is set. Call before anything is sent.
+func (m *MultiSink) Start(ready func() bool, delivered func(member *SinkMember, items []OutboundItem), c ConfigDelivery) {
+  
+  for ind := 0; ind < len(m.Members); ind++ {
+    
+    member := m.Members[ind]
+    member.Delivered = delivered
+    if (member.Buffer == nil) { continue }
+    
+    member.Sender = BufferSenderNew(member.Buffer.Name, member.Buffer, func() bool { return ready() && member.Ready() }, member.Send, c)
+  }
+}
+
+// MultiSink. Hands items to every member, as many from the front as every member's buffer has room for.
+// Returns how many were taken, with an error if that was not all of them.
+func (m *MultiSink) Send(items []OutboundItem) (int, error) {
+  
+  if (len(m.Members) == 0) { return 0, errors.New("No " + m.Name + " sinks.") }
+  if (m.Members[0].Buffer == nil) { return m.Members[0].Send(items) }
+  
+  taken := len(items)
+  for ind := 0; ind < len(m.Members); ind++ {
+    
+    if room := m.Members[ind].Buffer.Room(); room < taken { taken = room }
+  }
+  
+  for ind := 0; ind < len(m.Members); ind++ {
+    
+    for item := 0; item < taken; item++ { m.Members[ind].Buffer.Push(items[item]) }
+  }
+  
+  if (taken < len(items)) { return taken, errors.New("Sink member buffers are full.") }
+  
+  return taken, nil
+}
+
+func (m *MultiSink) SendEvent(e *ogdm.Event) error { _, err := m.SendEvents([]*ogdm.Event{ e }); return err }
+func (m *MultiSink) SendChat(raw string) error     { _, err := m.SendChats([]string{ raw }); return err }
+
+func (m *MultiSink) SendEvents(events []*ogdm.Event) (int, error) {
+  
+  items := make([]OutboundItem, len(events))
+  for ind := 0; ind < len(events); ind++ { items[ind] = OutboundItem{ Event: events[ind], Priority: EventPriority(events[ind]) } }
+  
+  return m.Send(items)
+}
+
+func (m *MultiSink) SendChats(raws []string) (int, error) {
+  
+  items := make([]OutboundItem, len(raws))
+  for ind := 0; ind < len(raws); ind++ { items[ind] = OutboundItem{ Chat: raws[ind], Priority: PriorityChat } }
+  
+  return m.Send(items)
+}
+
+// MultiSink. Returns the number of items buffered for members, across all of them.
+func (m *MultiSink) Count() int {
+  
+  count := 0
+  
+  for ind := 0; ind < len(m.Members); ind++ {
+    
+    if (m.Members[ind].Buffer != nil) { count += m.Members[ind].Buffer.Count() }
+  }
+  
+  return count
+}
+
+// MultiSink. Returns the status of each member's buffer, if members are buffered.
+func (m *MultiSink) Status() []BufferStatus {
+  
+  statuses := make([]BufferStatus, 0, len(m.Members))
+  
+  for ind := 0; ind < len(m.Members); ind++ {
+    
+    if (m.Members[ind].Buffer != nil) { statuses = append(statuses, m.Members[ind].Buffer.Status()) }
+  }
+  
+  return statuses
+}
+
+// Static. Returns a sink's name for metrics, such as "kite:Event Handler" or "file:events.jsonl".
+func SinkName(sink interface{}) string {
+  
+  switch s := sink.(type) {
+    
+    case *KiteSink:
+    return "kite:" + s.Name
+    case *FileSink:
+    return "file:" + s.Path
+    case *WebhookSink:
+    return "webhook:" + s.Url
+    case *StdoutSink:
+    return "stdout"
+  }
+  
+  return "unknown"
+}
+
+// Static. Records the latency and outcome of a send to a sink.
+func RecordSend(sink interface{}, start time.Time, err error) {
+  
+  name := SinkName(sink)
+  
+  SinkLatency.Observe(time.Since(start).Seconds(), name)
+  if (err != nil) { SinkFailures.Inc(name) }
+}
+
+// MultiSink. Whether a batch can be taken now: the single member is ready, or no member's buffer would block.
+func (m *MultiSink) Ready() bool {
+  
+  if (len(m.Members) == 0) { return false }
+  if (m.Members[0].Buffer == nil) { return m.Members[0].Ready() }
+  
+  for ind := 0; ind < len(m.Members); ind++ {
+    
+    if (m.Members[ind].Buffer.Full()) { return false }
+  }
+  
+  return true
+}
+
+// MultiSink. Stops delivering to members, then closes their buffers and sinks. Anything still buffered stays
+// in the members' write-ahead logs, if there are any.
+func (m *MultiSink) Close() error {
+  
+  var firstErr error
+  
+  for ind := 0; ind < len(m.Members); ind++ {
+    
+    member := m.Members[ind]
+    
+    if (member.Sender != nil) { member.Sender.Stop() }
+    if (member.Buffer != nil) { member.Buffer.Close() }
+    
+    if err := member.Sink.(interface{ Close() error }).Close(); err != nil && firstErr == nil { firstErr = err }
+  }
+  
+  return firstErr
+}
+
+// Specifies a sink that appends one JSON object per line to a file.
+type FileSink struct {
+  
+  Path string
+  File *os.File
+  Lock sync.Mutex
+}
+
+// Static. Opens (or creates) the file at the given path for appending.
+func FileSinkNew(path string) (*FileSink, error) {
+  
+  file, err := os.OpenFile(path, os.O_CREATE | os.O_WRONLY | os.O_APPEND, 0644)
+  if (err != nil) { return nil, err }
+  
+  return &(FileSink{ Path: path, File: file }), nil
+}
+
+// FileSink. Writes values as JSON lines in a single write.
+func (f *FileSink) WriteJson(values ...interface{}) error {
+  
+  data, err := JsonLines(values)
+  if (err != nil) { return err }
+  
+  f.Lock.Lock()
+  defer f.Lock.Unlock()
+  
+  _, err = f.File.Write(data)
+  
+  return err
+}
+
+func (f *FileSink) SendEvent(e *ogdm.Event) error { return f.WriteJson(e) }
+func (f *FileSink) SendChat(raw string) error     { return f.WriteJson(ChatRecord{ Time: time.Now(), Raw: raw }) }
+func (f *FileSink) Ready() bool                   { return true }
+
+func (f *FileSink) SendEvents(events []*ogdm.Event) (int, error) {
+  
+  if err := f.WriteJson(EventValues(events)...); err != nil { return 0, err }
+  
+  return len(events), nil
+}
+
+func (f *FileSink) SendChats(raws []string) (int, error) {
+  
+  if err := f.WriteJson(ChatValues(raws)...); err != nil { return 0, err }
+  
+  return len(raws), nil
+}
+
+func (f *FileSink) Close() error {
+  
+  f.Lock.Lock()
+  defer f.Lock.Unlock()
+  
+  return f.File.Close()
+}
+
+// Specifies a sink that prints one JSON object per line to stdout.
+type StdoutSink struct {
+  
+  Lock sync.Mutex
+}
+
+// StdoutSink. Prints values as JSON lines in a single write.
+func (s *StdoutSink) WriteJson(values ...interface{}) error {
+  
+  data, err := JsonLines(values)
+  if (err != nil) { return err }
+  
+  s.Lock.Lock()
+  defer s.Lock.Unlock()
+  
+  _, err = os.Stdout.Write(data)
+  
+  return err
+}
+
+func (s *StdoutSink) SendEvent(e *ogdm.Event) error { return s.WriteJson(e) }
+func (s *StdoutSink) SendChat(raw string) error     { return s.WriteJson(ChatRecord{ Time: time.Now(), Raw: raw }) }
+func (s *StdoutSink) Ready() bool                   { return true }
+func (s *StdoutSink) Close() error                  { return nil }
+
+func (s *StdoutSink) SendEvents(events []*ogdm.Event) (int, error) {
+  
+  if err := s.WriteJson(EventValues(events)...); err != nil { return 0, err }
+  
+  return len(events), nil
+}
+
+func (s *StdoutSink) SendChats(raws []string) (int, error) {
+  
+  if err := s.WriteJson(ChatValues(raws)...); err != nil { return 0, err }
+  
+  return len(raws), nil
+}
+
+// Static. Encodes values as newline-terminated JSON lines.
+func JsonLines(values []interface{}) ([]byte, error) {
+  
+  var buffer bytes.Buffer
+  encoder := json.NewEncoder(&buffer)
+  
+  for ind := 0; ind < len(values); ind++ {
+    
+    if err := encoder.Encode(values[ind]); err != nil { return nil, err }
+  }
+  
+  return buffer.Bytes(), nil
+}
+
+// Static. Returns events as a slice of values for JsonLines.
+func EventValues(events []*ogdm.Event) []interface{} {
+  
+  values := make([]interface{}, len(events))
+  for ind := 0; ind < len(events); ind++ { values[ind] = events[ind] }
+  
+  return values
+}
+
+// Static. Returns raw chat lines as ChatRecords for JsonLines.
+func ChatValues(raws []string) []interface{} {
+  
+  now := time.Now()
+  values := make([]interface{}, len(raws))
+  for ind := 0; ind < len(raws); ind++ { values[ind] = ChatRecord{ Time: now, Raw: raws[ind] } }
+  
+  return values
+}
+
+// Specifies a sink that POSTs each event or chat line as JSON to a URL.
+type WebhookSink struct {
+  
+  Url    string
+  Client *http.Client
+}
+
+// Static. Creates a WebhookSink posting to the given URL.
+func WebhookSinkNew(url string, timeout time.Duration) *WebhookSink {
+  
+  if (timeout <= 0) { timeout = 5 * time.Second }
+  
+  return &(WebhookSink{
+    Url: url,
+    Client: &http.Client{ Timeout: timeout } })
+}
+
+// WebhookSink. POSTs a value as JSON. Any non-2xx response is an error.
+func (w *WebhookSink) Post(value interface{}) error {
+  
+  data, err := json.Marshal(value)
+  if (err != nil) { return err }
+  
+  resp, err := w.Client.Post(w.Url, "application/json", bytes.NewReader(data))
+  if (err != nil) { return err }
+  resp.Body.Close()
+  
+  if (resp.StatusCode < 200 || resp.StatusCode >= 300) {
+    
+    return errors.New("Webhook " + w.Url + " responded " + resp.Status)
+  }
+  
+  return nil
+}
+
+func (w *WebhookSink) SendEvent(e *ogdm.Event) error { return w.Post(e) }
+func (w *WebhookSink) SendChat(raw string) error     { return w.Post(ChatRecord{ Time: time.Now(), Raw: raw }) }
+func (w *WebhookSink) Ready() bool                   { return true }
+func (w *WebhookSink) Close() error                  { return nil }
+
+// Builds sinks of types other than the built-in ones, keyed by type.
+var SinkFactories = make(map[string]func(c ConfigSink) (interface{}, error))
+
+// Static. Registers a sink type, so config entries of that type are built by the given factory.
+// The sink it returns must be an EventSink, a ChatSink, or both, for whichever lists it is used in.
+func RegisterSink(sinkType string, factory func(c ConfigSink) (interface{}, error)) {
+  
+  SinkFactories[sinkType] = factory
+}
+
+// Static. Builds the sink described by a config entry. Kite sinks are created by the caller,
+// since they are tied to the Event and Chat Handler addresses.
+func CreateSink(c ConfigSink) (interface{}, error) {
+  
+  if factory, ok := SinkFactories[c.Type]; ok { return factory(c) }
+  
+  switch(c.Type) {
+    
+    case "file":
+    if (c.Path == "") { return nil, errors.New("File sink needs a path.") }
+    return FileSinkNew(c.Path)
+    case "stdout":
+    return &StdoutSink{}, nil
+    case "webhook":
+    if (c.Url == "") { return nil, errors.New("Webhook sink needs a url.") }
+    return WebhookSinkNew(c.Url, time.Duration(c.TimeoutMs) * time.Millisecond), nil
+  }
+  
+  return nil, errors.New("Unknown sink type \"" + c.Type + "\".")
+}
+
+// Static. Builds the event sinks from config. Returns the combined sink and the Event Handler kite sink, if configured.
+// Fails if no event sink could be built.
+func CreateEventSinks(k *kite.Kite, configs []ConfigSink) (*MultiSink, *KiteSink, error) {
+  
+  sinks := make([]interface{}, 0, len(configs))
+  var kiteSink *KiteSink
+  
+  for ind := 0; ind < len(configs); ind++ {
+    
+    if (configs[ind].Type == "kite") {
+      
+      kiteSink = KiteSinkNew(k, "Event Handler", config.Addresses.Event, config.Ports.Event, "process-event", "process-events")
+      sinks = append(sinks, kiteSink)
+      continue
+    }
+    
+    sink, err := CreateSink(configs[ind])
+    if (err == nil) {
+      
+      if _, ok := sink.(EventSink); !ok { err = errors.New("Sink type \"" + configs[ind].Type + "\" cannot take events.") }
+    }
+    if (err != nil) { logger.Error("Skipping event sink.", LogFields{ "type": configs[ind].Type, "error": err }); continue }
+    
+    sinks = append(sinks, sink)
+  }
+  
+  multi, err := MultiSinkNew("events", sinks, config.Buffers.Events, config.Wal)
+  
+  return multi, kiteSink, err
+}
+
+// Static. Builds the chat sinks from config. Returns the combined sink and the Chat Handler kite sink, if configured.
+// Fails if no chat sink could be built.
+func CreateChatSinks(k *kite.Kite, configs []ConfigSink) (*MultiSink, *KiteSink, error) {
+  
+  sinks := make([]interface{}, 0, len(configs))
+  var kiteSink *KiteSink
+  
+  for ind := 0; ind < len(configs); ind++ {
+    
+    if (configs[ind].Type == "kite") {
+      
+      kiteSink = KiteSinkNew(k, "Chat Handler", config.Addresses.Chat, config.Ports.Chat, "twitch-chatter", "twitch-chatters")
+      sinks = append(sinks, kiteSink)
+      continue
+    }
+    
+    sink, err := CreateSink(configs[ind])
+    if (err == nil) {
+      
+      if _, ok := sink.(ChatSink); !ok { err = errors.New("Sink type \"" + configs[ind].Type + "\" cannot take chat.") }
+    }
+    if (err != nil) { logger.Error("Skipping chat sink.", LogFields{ "type": configs[ind].Type, "error": err }); continue }
+    
+    sinks = append(sinks, sink)
+  }
+  
+  multi, err := MultiSinkNew("chat", sinks, config.Buffers.Chat, config.Wal)
+  
+  return multi, kiteSink, err
+}
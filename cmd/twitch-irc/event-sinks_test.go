@@ -0,0 +1,295 @@
+/*
+*
+* Name:     Twitch IRC Listener
+* Sys Name: twitch-irc
+* Author:   Nifty255
+*
+*/
+
+package main
+
+import (
+  "sync"    // Mutual exclusion locks.
+  "time"    // Timing related functions.
+  "strconv" // String conversion functions.
+  "errors"  // Error creation functions.
+  "testing" // Go's testing framework.
+  ogdm "github.com/the-opera-house/go-common-lib/models"
+)
+
+// Specifies a DeliveredStore kept in memory.
+type MemoryDeliveredStore struct {
+  
+  Keys map[string]bool
+  Lock sync.Mutex
+}
+
+func (m *MemoryDeliveredStore) Mark(keys []string) error {
+  
+  m.Lock.Lock()
+  defer m.Lock.Unlock()
+  
+  if (m.Keys == nil) { m.Keys = make(map[string]bool, len(keys)) }
+  for ind := 0; ind < len(keys); ind++ { m.Keys[keys[ind]] = true }
+  
+  return nil
+}
+
+func (m *MemoryDeliveredStore) Delivered(keys []string) (map[string]bool, error) {
+  
+  m.Lock.Lock()
+  defer m.Lock.Unlock()
+  
+  delivered := make(map[string]bool, len(keys))
+  for ind := 0; ind < len(keys); ind++ { if (m.Keys[keys[ind]]) { delivered[keys[ind]] = true } }
+  
+  return delivered, nil
+}
+
+// Creates a started MultiSink over the given capture sinks, whose members buffer up to capacity items and record
+// what they deliver in the returned store, by DeliveredKey. The sink is closed when the test ends.
+func startTestMultiSink(t *testing.T, capacity int, sinks ...*CaptureSink) (*MultiSink, *MemoryDeliveredStore) {
+  
+  t.Helper()
+  
+  members := make([]interface{}, len(sinks))
+  for ind := 0; ind < len(sinks); ind++ { members[ind] = sinks[ind] }
+  
+  m, err := MultiSinkNew("events", members, ConfigBuffer{ Capacity: capacity, Overflow: OverflowDropOldest }, ConfigWal{})
+  if (err != nil) { t.Fatal(err) }
+  
+  store := &MemoryDeliveredStore{}
+  delivered := func(member *SinkMember, items []OutboundItem) {
+    
+    keys := make([]string, len(items))
+    for ind := 0; ind < len(items); ind++ { keys[ind] = DeliveredKey(EventKey(items[ind].Event), member.Name) }
+    store.Mark(keys)
+  }
+  
+  m.Start(func() bool { return true }, delivered, ConfigDelivery{ BatchSize: 10, MaxLingerMs: 1 })
+  t.Cleanup(func() { m.Close() })
+  
+  return m, store
+}
+
+// Returns n events with IDs event0, event1, ...
+func testEvents(n int) []*ogdm.Event {
+  
+  events := make([]*ogdm.Event, n)
+  for ind := 0; ind < n; ind++ { events[ind] = &(ogdm.Event{ EventID: "event" + strconv.Itoa(ind), EventType: "raid" }) }
+  
+  return events
+}
+
+// Waits until the sink holds count events, failing the test after five seconds.
+func waitForCaptured(t *testing.T, sink *CaptureSink, count int) {
+  
+  t.Helper()
+  
+  deadline := time.Now().Add(5 * time.Second)
+  for len(sink.EventsOfType("raid")) < count {
+    
+    if (time.Now().After(deadline)) { t.Fatalf("events = %d, want %d", len(sink.EventsOfType("raid")), count) }
+    time.Sleep(5 * time.Millisecond)
+  }
+}
+
+func TestMultiSinkRefusesNoSinks(t *testing.T) {
+  
+  if _, err := MultiSinkNew("events", nil, ConfigBuffer{}, ConfigWal{}); err == nil { t.Errorf("a MultiSink without sinks was created") }
+  
+  saved := config
+  defer func() { config = saved }()
+  config = DefaultConfig()
+  
+  // Every configured sink fails to build.
+  if _, _, err := CreateEventSinks(nil, []ConfigSink{ { Type: "file" }, { Type: "missing" } }); err == nil { t.Errorf("event sinks were created with none working") }
+  
+  m := &MultiSink{ Name: "events" }
+  if (m.Ready()) { t.Errorf("an empty MultiSink is ready") }
+  if _, err := m.SendEvents(testEvents(1)); err == nil { t.Errorf("an empty MultiSink took events") }
+}
+
+func TestMultiSinkMemberOutage(t *testing.T) {
+  
+  file, handler := &CaptureSink{}, &CaptureSink{}
+  handler.Down.Store(true)
+  
+  m, _ := startTestMultiSink(t, 100, file, handler)
+  
+  // The handler being down neither holds up the batch nor the file.
+  if (!m.Ready()) { t.Fatalf("MultiSink is not ready with one member down") }
+  if sent, err := m.SendEvents(testEvents(5)); sent != 5 || err != nil { t.Fatalf("SendEvents = %d %v, want all taken", sent, err) }
+  
+  waitForCaptured(t, file, 5)
+  
+  if (len(handler.EventsOfType("raid")) != 0 || m.Count() != 5) { t.Fatalf("handler events = %d, buffered = %d, want all 5 held for it", len(handler.EventsOfType("raid")), m.Count()) }
+  
+  handler.Down.Store(false)
+  waitForCaptured(t, handler, 5)
+  
+  if (len(file.EventsOfType("raid")) != 5) { t.Errorf("file events = %d, want each once", len(file.EventsOfType("raid"))) }
+}
+
+func TestMultiSinkRetriesOnlyFailedMember(t *testing.T) {
+  
+  file, handler := &CaptureSink{}, &CaptureSink{}
+  handler.Failures.Store(2)
+  
+  m, _ := startTestMultiSink(t, 100, file, handler)
+  
+  if _, err := m.SendEvents(testEvents(5)); err != nil { t.Fatal(err) }
+  
+  waitForCaptured(t, handler, 5)
+  waitForCaptured(t, file, 5)
+  
+  events := handler.EventsOfType("raid")
+  for ind := 0; ind < len(events); ind++ {
+    
+    if (events[ind].EventID != "event" + strconv.Itoa(ind)) { t.Errorf("handler event %d = %q, want them in order", ind, events[ind].EventID) }
+  }
+  
+  time.Sleep(50 * time.Millisecond)
+  if (len(file.EventsOfType("raid")) != 5) { t.Errorf("file events = %d, want none repeated by the handler's retries", len(file.EventsOfType("raid"))) }
+}
+
+func TestMultiSinkSingleMemberIsDirect(t *testing.T) {
+  
+  handler := &CaptureSink{}
+  m, _ := startTestMultiSink(t, 100, handler)
+  
+  handler.Down.Store(true)
+  if (m.Ready()) { t.Errorf("a single member's readiness is not passed through") }
+  
+  handler.Down.Store(false)
+  if sent, err := m.SendEvents(testEvents(3)); sent != 3 || err != nil { t.Fatalf("SendEvents = %d %v", sent, err) }
+  
+  if (len(handler.EventsOfType("raid")) != 3 || m.Count() != 0) { t.Errorf("events = %d, buffered = %d, want them delivered directly", len(handler.EventsOfType("raid")), m.Count()) }
+}
+
+func TestMultiSinkTakesOnlyWhatMembersHaveRoomFor(t *testing.T) {
+  
+  file, handler := &CaptureSink{}, &CaptureSink{}
+  handler.Down.Store(true)
+  
+  m, _ := startTestMultiSink(t, 3, file, handler)
+  
+  // The handler's buffer fills up; the rest stays with the caller rather than being dropped by the member.
+  sent, err := m.SendEvents(testEvents(5))
+  if (sent != 3 || err == nil) { t.Fatalf("SendEvents = %d %v, want 3 taken and an error", sent, err) }
+  
+  statuses := m.Status()
+  for ind := 0; ind < len(statuses); ind++ {
+    
+    if (len(statuses[ind].Dropped) != 0) { t.Errorf("%s dropped %v, want nothing", statuses[ind].Name, statuses[ind].Dropped) }
+  }
+  
+  if sent, err := m.SendEvents(testEvents(1)); sent != 0 || err == nil { t.Errorf("SendEvents into a full member = %d %v, want none taken", sent, err) }
+}
+
+func TestMultiSinkReportsDeliveryPerMember(t *testing.T) {
+  
+  file, handler := &CaptureSink{}, &CaptureSink{}
+  handler.Down.Store(true)
+  
+  m, store := startTestMultiSink(t, 100, file, handler)
+  events := testEvents(2)
+  
+  if _, err := m.SendEvents(events); err != nil { t.Fatal(err) }
+  waitForCaptured(t, file, 2)
+  
+  delivered, _ := store.Delivered([]string{ DeliveredKey(EventKey(events[1]), "events-0"), DeliveredKey(EventKey(events[1]), "events-1") })
+  if (!delivered[DeliveredKey(EventKey(events[1]), "events-0")] || len(delivered) != 1) { t.Fatalf("delivered = %v, want only the file's delivery recorded", delivered) }
+  
+  handler.Down.Store(false)
+  waitForCaptured(t, handler, 2)
+  
+  err := waitUntil(func() bool {
+    
+    delivered, _ := store.Delivered([]string{ DeliveredKey(EventKey(events[1]), "events-1") })
+    return len(delivered) == 1
+  })
+  if (err != nil) { t.Errorf("the handler's delivery was not recorded") }
+}
+
+// Waits up to five seconds for condition to hold.
+func waitUntil(condition func() bool) error {
+  
+  deadline := time.Now().Add(5 * time.Second)
+  for !condition() {
+    
+    if (time.Now().After(deadline)) { return errors.New("Timed out.") }
+    time.Sleep(5 * time.Millisecond)
+  }
+  
+  return nil
+}
+
+func TestTakeOverReplaysOnlyToMissingMembers(t *testing.T) {
+  
+  handler := &CaptureSink{}
+  RegisterSink("capture-handler", func(c ConfigSink) (interface{}, error) { return handler, nil })
+  defer delete(SinkFactories, "capture-handler")
+  
+  _, file := startTestDriver(t, func(c *Config) { c.Sinks.Events = []ConfigSink{ { Type: "capture" }, { Type: "capture-handler" } } })
+  
+  store := &MemoryDeliveredStore{}
+  ircDriver.Delivered = store
+  
+  // Seen while secondary. The old primary's file had both events, its handler only the first.
+  ircDriver.IsPrimary.Store(false)
+  events := testEvents(3)
+  for ind := 0; ind < len(events); ind++ { ircDriver.FireEvent(events[ind], time.Time{}) }
+  
+  store.Mark([]string{ DeliveredKey(EventKey(events[0]), "events-0"), DeliveredKey(EventKey(events[0]), "events-1"), DeliveredKey(EventKey(events[1]), "events-0") })
+  
+  ircDriver.IsPrimary.Store(true)
+  ircDriver.TakeOver()
+  
+  waitForCaptured(t, handler, 2)
+  waitForCaptured(t, file, 1)
+  time.Sleep(50 * time.Millisecond)
+  
+  if got := handler.EventsOfType("raid"); len(got) != 2 || got[0].EventID != "event1" || got[1].EventID != "event2" { t.Errorf("handler events = %d, want event1 and event2", len(got)) }
+  if got := file.EventsOfType("raid"); len(got) != 1 || got[0].EventID != "event2" { t.Errorf("file events = %d, want only event2", len(got)) }
+  
+  // Deliveries are recorded per member, now that each has everything.
+  keys := make([]string, 0, 6)
+  for ind := 0; ind < len(events); ind++ { keys = append(keys, DeliveredKey(EventKey(events[ind]), "events-0"), DeliveredKey(EventKey(events[ind]), "events-1")) }
+  
+  if err := waitUntil(func() bool { found, _ := store.Delivered(keys); return len(found) == 6 }); err != nil { t.Errorf("not every member's delivery was recorded") }
+}
+
+func TestMultiSinkMembersTimeTheirOwnDelivery(t *testing.T) {
+  
+  file, handler := &CaptureSink{}, &CaptureSink{}
+  handler.Down.Store(true)
+  
+  m, err := MultiSinkNew("chat", []interface{}{ file, handler }, ConfigBuffer{ Capacity: 100, Overflow: OverflowDropOldest }, ConfigWal{})
+  if (err != nil) { t.Fatal(err) }
+  
+  delivered := make(chan OutboundItem, 2)
+  m.Start(func() bool { return true }, func(member *SinkMember, items []OutboundItem) {
+    
+    for ind := 0; ind < len(items); ind++ { delivered <- items[ind] }
+  }, ConfigDelivery{ BatchSize: 10, MaxLingerMs: 1 })
+  t.Cleanup(func() { m.Close() })
+  
+  fileBefore, handlerBefore := observations(DeliveryLatency, "chat-0"), observations(DeliveryLatency, "chat-1")
+  sentAt := time.Now().Add(-time.Second)
+  
+  if _, err := m.Send([]OutboundItem{ { Chat: "hello", Priority: PriorityChat, SentAt: sentAt, Traced: true, Seq: 7 } }); err != nil { t.Fatal(err) }
+  
+  // Members get the whole item, less its place in the caller's log.
+  item := <-delivered
+  if (!item.SentAt.Equal(sentAt) || !item.Traced || item.Seq != 0) { t.Errorf("delivered item = %+v, want SentAt and Traced kept and Seq cleared", item) }
+  
+  // Only the member that delivered is timed.
+  if got := observations(DeliveryLatency, "chat-0") - fileBefore; got != 1 { t.Errorf("file delivery observations = %d, want 1", got) }
+  if got := observations(DeliveryLatency, "chat-1") - handlerBefore; got != 0 { t.Errorf("handler delivery observations = %d, want none while down", got) }
+  
+  handler.Down.Store(false)
+  <-delivered
+  
+  if got := observations(DeliveryLatency, "chat-1") - handlerBefore; got != 1 { t.Errorf("handler delivery observations = %d, want 1", got) }
+}
@@ -0,0 +1,250 @@
+/*
+*
+* Name:     Fake Twitch Messaging Interface
+* Sys Name: faketmi
+* Author:   Nifty255
+*
+*/
+
+package faketmi
+
+import (
+  "net"           // Network functions and structures.
+  "sync"          // Mutual exclusion locks.
+  "time"          // Timing related functions.
+  "strings"       // String manipulation functions.
+  "net/http"      // HTTP server functions.
+  "crypto/rand"   // Cryptographic randomness.
+  "encoding/hex"  // Hexadecimal encoding functions.
+  "encoding/json" // JSON encoding functions.
+)
+
+// Specifies an access token issued by the fake OAuth server.
+type OAuthToken struct {
+  
+  AccessToken  string
+  Login        string
+  UserID       string
+  Scopes       []string
+  Expires      time.Time
+  RefreshToken string
+}
+
+// Specifies an in-process stand-in for Twitch's OAuth endpoints: /oauth2/validate and the refresh_token grant of /oauth2/token.
+// Point the listener's "auth" config at ValidateUrl and TokenUrl. Responses that cannot be written are reported to Logf,
+// e.g. a test's t.Logf, if it is set.
+type OAuthServer struct {
+  
+  Addr         string
+  ValidateUrl  string
+  TokenUrl     string
+  ClientID     string
+  ClientSecret string
+  Listener     net.Listener
+  Tokens       map[string]*OAuthToken
+  Refreshes    map[string]*OAuthToken
+  Validations  int
+  Grants       int
+  Logf         func(format string, args ...interface{})
+  Lock         sync.Mutex
+}
+
+// Static. Starts a fake OAuth server on a random local port, accepting refreshes from the given client.
+func NewOAuth(clientID, clientSecret string) (*OAuthServer, error) {
+  
+  listener, err := net.Listen("tcp", "127.0.0.1:0")
+  if (err != nil) { return nil, err }
+  
+  o := &(OAuthServer{
+    Addr: listener.Addr().String(),
+    ClientID: clientID,
+    ClientSecret: clientSecret,
+    Listener: listener,
+    Tokens: make(map[string]*OAuthToken),
+    Refreshes: make(map[string]*OAuthToken) })
+  
+  o.ValidateUrl = "http://" + o.Addr + "/oauth2/validate"
+  o.TokenUrl = "http://" + o.Addr + "/oauth2/token"
+  
+  mux := http.NewServeMux()
+  mux.HandleFunc("/oauth2/validate", o.HandleValidate)
+  mux.HandleFunc("/oauth2/token", o.HandleToken)
+  
+  go http.Serve(listener, mux)
+  
+  return o, nil
+}
+
+// Static. Returns a random token in Twitch's format.
+func RandomToken() string {
+  
+  b := make([]byte, 15)
+  rand.Read(b)
+  
+  return hex.EncodeToString(b)
+}
+
+// OAuthServer. Issues an access token and refresh token for the given account, valid for ttl.
+func (o *OAuthServer) Issue(login, userID string, ttl time.Duration, scopes ...string) (string, string) {
+  
+  access := RandomToken()
+  refresh := RandomToken()
+  
+  o.Lock.Lock()
+  defer o.Lock.Unlock()
+  
+  token := &(OAuthToken{
+    AccessToken: access,
+    Login: strings.ToLower(login),
+    UserID: userID,
+    Scopes: scopes,
+    Expires: time.Now().Add(ttl),
+    RefreshToken: refresh })
+  
+  o.Tokens[access] = token
+  o.Refreshes[refresh] = token
+  
+  return access, refresh
+}
+
+// OAuthServer. Revokes an access token. Its refresh token still works, as on Twitch.
+func (o *OAuthServer) Revoke(access string) {
+  
+  o.Lock.Lock()
+  defer o.Lock.Unlock()
+  
+  delete(o.Tokens, access)
+}
+
+// OAuthServer. Returns a copy of an access token's record, or nil if it is unknown or expired.
+func (o *OAuthServer) Lookup(access string) *OAuthToken {
+  
+  o.Lock.Lock()
+  defer o.Lock.Unlock()
+  
+  token, ok := o.Tokens[access]
+  if (!ok || time.Now().After(token.Expires)) { return nil }
+  
+  copied := *token
+  return &copied
+}
+
+// OAuthServer. Reports whether a TMI login is allowed: the password must be "oauth:" and a live token for the nick.
+// Anonymous "justinfan" logins are always allowed. Assign it to Server.Authenticate.
+func (o *OAuthServer) Check(nick, password string) bool {
+  
+  if (strings.HasPrefix(nick, "justinfan")) { return true }
+  
+  token := o.Lookup(strings.TrimPrefix(password, "oauth:"))
+  
+  return (token != nil && token.Login == nick)
+}
+
+// OAuthServer. Returns how many validations and refresh grants were served.
+func (o *OAuthServer) Counts() (int, int) {
+  
+  o.Lock.Lock()
+  defer o.Lock.Unlock()
+  
+  return o.Validations, o.Grants
+}
+
+// OAuthServer. Answers GET /oauth2/validate, authorized by "OAuth <token>".
+func (o *OAuthServer) HandleValidate(w http.ResponseWriter, r *http.Request) {
+  
+  o.Lock.Lock()
+  o.Validations++
+  o.Lock.Unlock()
+  
+  access := strings.TrimPrefix(r.Header.Get("Authorization"), "OAuth ")
+  token := o.Lookup(access)
+  
+  if (token == nil) {
+    
+    o.Respond(w, http.StatusUnauthorized, map[string]interface{}{ "status": 401, "message": "invalid access token" })
+    return
+  }
+  
+  o.Respond(w, http.StatusOK, map[string]interface{}{
+    "client_id": o.ClientID,
+    "login": token.Login,
+    "scopes": token.Scopes,
+    "user_id": token.UserID,
+    "expires_in": int(time.Until(token.Expires).Seconds()) })
+}
+
+// OAuthServer. Answers POST /oauth2/token with grant_type=refresh_token, retiring the old access token.
+func (o *OAuthServer) HandleToken(w http.ResponseWriter, r *http.Request) {
+  
+  if (r.Method != "POST" || r.ParseForm() != nil || r.PostForm.Get("grant_type") != "refresh_token") {
+    
+    o.Respond(w, http.StatusBadRequest, map[string]interface{}{ "status": 400, "message": "invalid request" })
+    return
+  }
+  
+  if (r.PostForm.Get("client_id") != o.ClientID || r.PostForm.Get("client_secret") != o.ClientSecret) {
+    
+    o.Respond(w, http.StatusForbidden, map[string]interface{}{ "status": 403, "message": "invalid client secret" })
+    return
+  }
+  
+  o.Lock.Lock()
+  o.Grants++
+  
+  refresh := r.PostForm.Get("refresh_token")
+  previous, ok := o.Refreshes[refresh]
+  if (!ok) {
+    
+    o.Lock.Unlock()
+    o.Respond(w, http.StatusBadRequest, map[string]interface{}{ "status": 400, "message": "Invalid refresh token" })
+    return
+  }
+  
+  // Refreshing retires both the old access token and the old refresh token.
+  delete(o.Tokens, previous.AccessToken)
+  delete(o.Refreshes, refresh)
+  
+  token := *previous
+  token.AccessToken = RandomToken()
+  token.RefreshToken = RandomToken()
+  token.Expires = time.Now().Add(4 * time.Hour)
+  
+  o.Tokens[token.AccessToken] = &token
+  o.Refreshes[token.RefreshToken] = &token
+  o.Lock.Unlock()
+  
+  o.Respond(w, http.StatusOK, map[string]interface{}{
+    "access_token": token.AccessToken,
+    "refresh_token": token.RefreshToken,
+    "expires_in": int(time.Until(token.Expires).Seconds()),
+    "scope": token.Scopes,
+    "token_type": "bearer" })
+}
+
+// OAuthServer. Writes a JSON response with the given status, reporting a failure to Logf.
+func (o *OAuthServer) Respond(w http.ResponseWriter, status int, body interface{}) {
+  
+  err := WriteJSON(w, status, body)
+  if (err == nil) { return }
+  
+  o.Lock.Lock()
+  logf := o.Logf
+  o.Lock.Unlock()
+  
+  if (logf != nil) { logf("faketmi: unable to write response: %v", err) }
+}
+
+// Static. Writes a JSON response with the given status.
+func WriteJSON(w http.ResponseWriter, status int, body interface{}) error {
+  
+  w.Header().Set("Content-Type", "application/json")
+  w.WriteHeader(status)
+  
+  return json.NewEncoder(w).Encode(body)
+}
+
+// OAuthServer. Stops serving.
+func (o *OAuthServer) Close() error {
+  
+  return o.Listener.Close()
+}
@@ -0,0 +1,452 @@
+/*
+*
+* Name:     Fake Twitch Messaging Interface
+* Sys Name: faketmi
+* Author:   Nifty255
+*
+*/
+
+// Package faketmi is an in-process stand-in for Twitch's IRC server (TMI), for driving
+// the twitch-irc listener end to end without the network. Point the listener's
+// "twitch" config at Server.Addr, with insecure_skip_verify set when using TLS.
+package faketmi
+
+import (
+  "fmt"               // String formatting functions.
+  "net"               // Network functions and structures.
+  "sync"              // Mutual exclusion locks.
+  "time"              // Timing related functions.
+  "bufio"             // Buffered line reading.
+  "strings"           // String manipulation functions.
+  "math/big"          // Arbitrary precision integers, for certificate serials.
+  "crypto/tls"        // Web security functions and structures.
+  "crypto/rand"       // Cryptographic randomness.
+  "crypto/x509"       // Certificate functions.
+  "crypto/ecdsa"      // Elliptic curve keys.
+  "crypto/elliptic"   // Elliptic curves.
+  "crypto/x509/pkix"  // Certificate subject names.
+)
+
+// Specifies a client connected to the fake server.
+type Client struct {
+  
+  Nick     string
+  Password string
+  Caps     []string
+  Channels map[string]bool
+  Conn     net.Conn
+  Writer   *bufio.Writer
+  Lock     sync.Mutex
+}
+
+// Specifies a single line received from a client.
+type Received struct {
+  
+  Nick string
+  Line string
+  Time time.Time
+}
+
+// Specifies an in-process fake TMI server. When Authenticate is set, a client whose nick and PASS it rejects
+// is sent Twitch's login failure notice and disconnected; OAuthServer.Check fits.
+type Server struct {
+  
+  Addr         string
+  UseTLS       bool
+  Listener     net.Listener
+  Clients      []*Client
+  Received     []Received
+  Authenticate func(nick, password string) bool
+  Lock         sync.Mutex
+  Closed       bool
+}
+
+// Static. Starts a fake TMI server on a random local port. With useTLS, a self-signed certificate is generated.
+func New(useTLS bool) (*Server, error) {
+  
+  var listener net.Listener
+  var err error
+  
+  if (useTLS) {
+    
+    cert, certErr := SelfSignedCert()
+    if (certErr != nil) { return nil, certErr }
+    
+    listener, err = tls.Listen("tcp", "127.0.0.1:0", &tls.Config{ Certificates: []tls.Certificate{ cert } })
+  } else {
+    
+    listener, err = net.Listen("tcp", "127.0.0.1:0")
+  }
+  
+  if (err != nil) { return nil, err }
+  
+  s := &(Server{
+    Addr: listener.Addr().String(),
+    UseTLS: useTLS,
+    Listener: listener,
+    Clients: make([]*Client, 0, 4),
+    Received: make([]Received, 0, 256),
+    Closed: false })
+  
+  go s.Accept()
+  
+  return s, nil
+}
+
+// Server. Accepts clients until the server is closed.
+func (s *Server) Accept() {
+  
+  for {
+    
+    conn, err := s.Listener.Accept()
+    if (err != nil) { return }
+    
+    client := &(Client{
+      Channels: make(map[string]bool),
+      Conn: conn,
+      Writer: bufio.NewWriter(conn) })
+    
+    s.Lock.Lock()
+    s.Clients = append(s.Clients, client)
+    s.Lock.Unlock()
+    
+    go s.Serve(client)
+  }
+}
+
+// Server. Reads and answers lines from a client until it disconnects.
+func (s *Server) Serve(c *Client) {
+  
+  defer s.Drop(c)
+  
+  reader := bufio.NewReader(c.Conn)
+  
+  for {
+    
+    line, err := reader.ReadString('\n')
+    if (err != nil) { return }
+    
+    line = strings.TrimRight(line, "\r\n")
+    if (line == "") { continue }
+    
+    c.Lock.Lock()
+    nick := c.Nick
+    c.Lock.Unlock()
+    
+    s.Lock.Lock()
+    s.Received = append(s.Received, Received{ Nick: nick, Line: line, Time: time.Now() })
+    s.Lock.Unlock()
+    
+    command, rest, _ := strings.Cut(line, " ")
+    
+    switch(strings.ToUpper(command)) {
+      
+      case "PASS":
+      c.Lock.Lock()
+      c.Password = rest
+      c.Lock.Unlock()
+      
+      case "NICK":
+      c.Lock.Lock()
+      c.Nick = strings.ToLower(rest)
+      nick = c.Nick
+      password := c.Password
+      c.Lock.Unlock()
+      
+      s.Lock.Lock()
+      authenticate := s.Authenticate
+      s.Lock.Unlock()
+      
+      if (authenticate != nil && !authenticate(nick, password)) {
+        
+        c.Send(":tmi.twitch.tv NOTICE * :Login authentication failed")
+        return
+      }
+      
+      c.Send(":tmi.twitch.tv 001 " + nick + " :Welcome, GLHF!")
+      c.Send(":tmi.twitch.tv 002 " + nick + " :Your host is tmi.twitch.tv")
+      c.Send(":tmi.twitch.tv 003 " + nick + " :This server is rather new")
+      c.Send(":tmi.twitch.tv 004 " + nick + " :-")
+      c.Send(":tmi.twitch.tv 375 " + nick + " :-")
+      c.Send(":tmi.twitch.tv 372 " + nick + " :You are in a maze of twisty passages, all alike.")
+      c.Send(":tmi.twitch.tv 376 " + nick + " :>")
+      
+      case "CAP":
+      // "REQ :twitch.tv/tags"
+      _, caps, _ := strings.Cut(rest, ":")
+      c.Lock.Lock()
+      c.Caps = append(c.Caps, strings.Fields(caps)...)
+      c.Lock.Unlock()
+      
+      c.Send(":tmi.twitch.tv CAP * ACK :" + caps)
+      
+      case "JOIN":
+      channels := strings.Split(strings.TrimSpace(rest), ",")
+      for ind := 0; ind < len(channels); ind++ {
+        
+        channel := strings.ToLower(channels[ind])
+        if (!strings.HasPrefix(channel, "#")) { continue }
+        
+        c.Lock.Lock()
+        c.Channels[channel] = true
+        c.Lock.Unlock()
+        
+        c.Send(":" + nick + "!" + nick + "@" + nick + ".tmi.twitch.tv JOIN " + channel)
+        c.Send(":" + nick + ".tmi.twitch.tv 353 " + nick + " = " + channel + " :" + nick)
+        c.Send(":" + nick + ".tmi.twitch.tv 366 " + nick + " " + channel + " :End of /NAMES list")
+      }
+      
+      case "PART":
+      channels := strings.Split(strings.TrimSpace(rest), ",")
+      for ind := 0; ind < len(channels); ind++ {
+        
+        channel := strings.ToLower(channels[ind])
+        
+        c.Lock.Lock()
+        delete(c.Channels, channel)
+        c.Lock.Unlock()
+        
+        c.Send(":" + nick + "!" + nick + "@" + nick + ".tmi.twitch.tv PART " + channel)
+      }
+      
+      case "PING":
+      c.Send("PONG " + rest)
+      
+      case "QUIT":
+      return
+    }
+  }
+}
+
+// Server. Forgets a disconnected client.
+func (s *Server) Drop(c *Client) {
+  
+  c.Conn.Close()
+  
+  s.Lock.Lock()
+  defer s.Lock.Unlock()
+  
+  for ind := 0; ind < len(s.Clients); ind++ {
+    
+    if (s.Clients[ind] == c) {
+      
+      s.Clients = append(s.Clients[:ind], s.Clients[ind + 1:]...)
+      return
+    }
+  }
+}
+
+// Client. Writes a single line to the client.
+func (c *Client) Send(line string) error {
+  
+  c.Lock.Lock()
+  defer c.Lock.Unlock()
+  
+  if _, err := c.Writer.WriteString(line + "\r\n"); err != nil { return err }
+  
+  return c.Writer.Flush()
+}
+
+// Client. Returns whether the client has joined the given channel (without '#').
+func (c *Client) InChannel(channel string) bool {
+  
+  c.Lock.Lock()
+  defer c.Lock.Unlock()
+  
+  return c.Channels["#" + strings.ToLower(channel)]
+}
+
+// Server. Returns a copy of the connected clients.
+func (s *Server) ConnectedClients() []*Client {
+  
+  s.Lock.Lock()
+  defer s.Lock.Unlock()
+  
+  clients := make([]*Client, len(s.Clients))
+  copy(clients, s.Clients)
+  
+  return clients
+}
+
+// Server. Returns a copy of every line received so far.
+func (s *Server) Lines() []Received {
+  
+  s.Lock.Lock()
+  defer s.Lock.Unlock()
+  
+  lines := make([]Received, len(s.Received))
+  copy(lines, s.Received)
+  
+  return lines
+}
+
+// Server. Returns every received line starting with the given command, e.g. "JOIN".
+func (s *Server) LinesWithCommand(command string) []string {
+  
+  lines := s.Lines()
+  matches := make([]string, 0, len(lines))
+  
+  for ind := 0; ind < len(lines); ind++ {
+    
+    if (strings.HasPrefix(strings.ToUpper(lines[ind].Line), command + " ")) { matches = append(matches, lines[ind].Line) }
+  }
+  
+  return matches
+}
+
+// Server. Sends a raw line to every client that has joined the channel (without '#'), or to every client if channel is "".
+func (s *Server) Broadcast(channel string, line string) int {
+  
+  clients := s.ConnectedClients()
+  sent := 0
+  
+  for ind := 0; ind < len(clients); ind++ {
+    
+    if (channel != "" && !clients[ind].InChannel(channel)) { continue }
+    
+    if (clients[ind].Send(line) == nil) { sent++ }
+  }
+  
+  return sent
+}
+
+// Server. Emits a PRIVMSG from the given user in the given channel.
+func (s *Server) Privmsg(channel, login, tags, message string) int {
+  
+  return s.Broadcast(channel, Tagged(tags) + ":" + login + "!" + login + "@" + login + ".tmi.twitch.tv PRIVMSG #" + channel + " :" + message)
+}
+
+// Server. Emits a USERNOTICE in the given channel. The message may be empty.
+func (s *Server) UserNotice(channel, tags, message string) int {
+  
+  line := Tagged(tags) + ":tmi.twitch.tv USERNOTICE #" + channel
+  if (message != "") { line += " :" + message }
+  
+  return s.Broadcast(channel, line)
+}
+
+// Server. Emits a CLEARCHAT in the given channel: for the given user, as a timeout or ban depending on the tags, or for everyone if login is "".
+func (s *Server) ClearChat(channel, tags, login string) int {
+  
+  line := Tagged(tags) + ":tmi.twitch.tv CLEARCHAT #" + channel
+  if (login != "") { line += " :" + login }
+  
+  return s.Broadcast(channel, line)
+}
+
+// Server. Emits a NOTICE in the given channel, or a global NOTICE if channel is "".
+func (s *Server) Notice(channel, tags, message string) int {
+  
+  target := "*"
+  if (channel != "") { target = "#" + channel }
+  
+  return s.Broadcast(channel, Tagged(tags) + ":tmi.twitch.tv NOTICE " + target + " :" + message)
+}
+
+// Server. Emits a RECONNECT to every client. If dropAfter is positive, clients still connected afterwards are dropped.
+func (s *Server) Reconnect(dropAfter time.Duration) int {
+  
+  clients := s.ConnectedClients()
+  sent := s.Broadcast("", ":tmi.twitch.tv RECONNECT")
+  
+  if (dropAfter > 0) {
+    
+    go func() {
+      
+      time.Sleep(dropAfter)
+      for ind := 0; ind < len(clients); ind++ {
+        
+        clients[ind].Conn.Close()
+      }
+    }()
+  }
+  
+  return sent
+}
+
+// Server. Waits until the given condition is true, polling every 10ms.
+func (s *Server) WaitFor(condition func() bool, timeout time.Duration) error {
+  
+  deadline := time.Now().Add(timeout)
+  
+  for time.Now().Before(deadline) {
+    
+    if (condition()) { return nil }
+    time.Sleep(10 * time.Millisecond)
+  }
+  
+  if (condition()) { return nil }
+  
+  return fmt.Errorf("condition not met within %s", timeout)
+}
+
+// Server. Waits until some client has joined every given channel (without '#').
+func (s *Server) WaitForJoins(channels []string, timeout time.Duration) error {
+  
+  return s.WaitFor(func() bool {
+    
+    clients := s.ConnectedClients()
+    
+    for ind := 0; ind < len(channels); ind++ {
+      
+      joined := false
+      for j := 0; j < len(clients); j++ {
+        
+        if (clients[j].InChannel(channels[ind])) { joined = true; break }
+      }
+      
+      if (!joined) { return false }
+    }
+    
+    return true
+  }, timeout)
+}
+
+// Server. Stops accepting clients and disconnects every client.
+func (s *Server) Close() error {
+  
+  s.Lock.Lock()
+  if (s.Closed) { s.Lock.Unlock(); return nil }
+  s.Closed = true
+  s.Lock.Unlock()
+  
+  err := s.Listener.Close()
+  
+  clients := s.ConnectedClients()
+  for ind := 0; ind < len(clients); ind++ {
+    
+    clients[ind].Conn.Close()
+  }
+  
+  return err
+}
+
+// Static. Prefixes a raw tag string with '@', or returns "" for no tags.
+func Tagged(tags string) string {
+  
+  if (tags == "") { return "" }
+  
+  return "@" + tags + " "
+}
+
+// Static. Generates a throwaway self-signed certificate for 127.0.0.1.
+func SelfSignedCert() (tls.Certificate, error) {
+  
+  key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+  if (err != nil) { return tls.Certificate{}, err }
+  
+  template := x509.Certificate{
+    SerialNumber: big.NewInt(time.Now().UnixNano()),
+    Subject: pkix.Name{ CommonName: "tmi.twitch.tv" },
+    NotBefore: time.Now().Add(-time.Hour),
+    NotAfter: time.Now().Add(24 * time.Hour),
+    KeyUsage: x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+    ExtKeyUsage: []x509.ExtKeyUsage{ x509.ExtKeyUsageServerAuth },
+    IPAddresses: []net.IP{ net.ParseIP("127.0.0.1") },
+    DNSNames: []string{ "localhost", "tmi.twitch.tv" } }
+  
+  der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+  if (err != nil) { return tls.Certificate{}, err }
+  
+  return tls.Certificate{ Certificate: [][]byte{ der }, PrivateKey: key }, nil
+}
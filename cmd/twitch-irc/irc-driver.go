@@ -14,7 +14,8 @@ import (
   "regexp"                      // Regular Expression functions.
   "strings"                     // String manipulation functions.
   "strconv"                     // String/Number conversion functions.
-  "crypto/tls"                  // Web security functions and structures.
+  "sync"                        // Mutual exclusion locks.
+  "sync/atomic"                 // Atomic primitives.
   "github.com/koding/kite"      // Microservice functions and structures.
   "github.com/thoj/go-ircevent" // IRC client functions and structures.
   ogcl "github.com/the-opera-house/go-common-lib/common"
@@ -22,64 +23,84 @@ import (
   ogdm "github.com/the-opera-house/go-common-lib/models"
 )
 
+// How long shutdown waits for the listeners to part and close before carrying on without them.
+const ListenerCloseTimeout = 5 * time.Second
+
+// The IRCDriver is shared by kite handlers, IRC callbacks and tickers.
+// StateLock guards Channels, ChannelsVersion, Syncs, Backfilled and ConnectQueue. Each KiteSink guards its own client.
+// RoomsLock guards RoomStates, which are kept by channel login since ROOMSTATE is addressed by login.
+// ChattersLock guards ActiveChatters. BufferEvents and BufferChat guard themselves.
+// Locks are taken in the order StateLock, RoomsLock, then a Listener's Lock. The ListenerPool's lock and each JoinLimiter's
+// are only ever held on their own.
+// Once ShuttingDown is set no new channels are taken. With election enabled, Elector decides IsPrimary.
 type IRCDriver struct {
   
   DbDriver        *ogcn.DatabaseDriver
   ConnectTicker   *time.Ticker
   ConnectQueue    *ogdm.StringQueue
-  ListenerPool    []Listener
+  ListenerPool    *ListenerPool
+  Accounts        []*BotAccount
+  Speaker         *Speaker
+  JoinLimiter     *JoinLimiter
   ChattersTicker  *time.Ticker
   ActiveChatters  []ogdm.ChattersBatch
-  BufferTicker    *time.Ticker
-  BufferEvents    *ogdm.EventQueue
-  BufferChat      *ogdm.StringQueue
+  BufferEvents    *OutboundBuffer
+  BufferChat      *OutboundBuffer
+  EventSender     *BufferSender
+  ChatSender      *BufferSender
   KiteManager     *kite.Kite
-  EventClient     *kite.Client
-  ChatClient      *kite.Client
-  EventConnected  bool
-  ChatConnected   bool
+  EventSink       *MultiSink
+  ChatSink        *MultiSink
+  EventKite       *KiteSink
+  ChatKite        *KiteSink
   Channels        map[string]*ogdm.IdentitySlim
-  IsPrimary       bool
+  ChannelsVersion int64
+  Backfilled      map[string]string
+  RoomStates      map[string]*RoomState
+  Syncs           map[string][]ogdm.IdentitySlim
+  Tracer          *LatencyTracer
+  Elector         *Elector
+  Sharder         *Sharder
+  Dedup           *EventDedup
+  Delivered       DeliveredStore
+  IsPrimary       atomic.Bool
+  PoolFailures    atomic.Int32
+  ShuttingDown    atomic.Bool
+  StateLock       sync.RWMutex
+  ChattersLock    sync.Mutex
+  RoomsLock       sync.RWMutex
 }
 
-func CreateIrcDriver(d *ogcn.DatabaseDriver, k *kite.Kite) *IRCDriver {
+func CreateIrcDriver(d *ogcn.DatabaseDriver, k *kite.Kite) (*IRCDriver, error) {
+  
+  eventSink, eventKite, err := CreateEventSinks(k, config.Sinks.Events)
+  if (err != nil) { return nil, err }
   
-  e := k.NewClient("http://" +
-                   config.Addresses.Event +
-                   ":" +
-                   strconv.Itoa(config.Ports.Event) +
-                   "/kite")
-  c := k.NewClient("http://" +
-                   config.Addresses.Chat +
-                   ":" +
-                   strconv.Itoa(config.Ports.Chat) +
-                   "/kite")
+  chatSink, chatKite, err := CreateChatSinks(k, config.Sinks.Chat)
+  if (err != nil) { eventSink.Close(); return nil, err }
   
   driver := IRCDriver{
     DbDriver: d,
     ConnectTicker: time.NewTicker(time.Second),
     ConnectQueue: ogdm.StringQueueNew(20),
-    ListenerPool: make([]Listener, 0, 100),
+    ListenerPool: ListenerPoolNew(100),
+    JoinLimiter: JoinLimiterNew(config.Joins.Limit, time.Duration(config.Joins.WindowMs) * time.Millisecond),
     ChattersTicker: time.NewTicker(15 * time.Minute ),
     ActiveChatters: make([]ogdm.ChattersBatch, 0, 25000),
-    BufferTicker: time.NewTicker(500 * time.Microsecond),
-    BufferEvents: ogdm.EventQueueNew(250),
-    BufferChat: ogdm.StringQueueNew(2500),
+    BufferEvents: OutboundBufferNew("events", config.Buffers.Events, config.Wal),
+    BufferChat: OutboundBufferNew("chat", config.Buffers.Chat, config.Wal),
     KiteManager: k,
-    EventClient: e,
-    ChatClient: c,
-    EventConnected: false,
-    ChatConnected: false,
+    EventSink: eventSink,
+    ChatSink: chatSink,
+    EventKite: eventKite,
+    ChatKite: chatKite,
+    Tracer: LatencyTracerNew(config.Tracing),
+    Dedup: EventDedupNew(config.Dedup),
+    Speaker: SpeakerNew(config.Say),
     Channels: make(map[string]*ogdm.IdentitySlim, 500000),
-    IsPrimary: false }
-  
-  e.OnConnect(driver.EventConnect)
-  e.OnDisconnect(driver.EventDisconnect)
-  c.OnConnect(driver.ChatConnect)
-  c.OnDisconnect(driver.ChatDisconnect)
-  
-  e.DialForever()
-  c.DialForever()
+    Backfilled: make(map[string]string, 64),
+    RoomStates: make(map[string]*RoomState, 500000),
+    Syncs: make(map[string][]ogdm.IdentitySlim, 4) }
   
   // Chat Handler health ticker
   go func() {
@@ -89,32 +110,29 @@ func CreateIrcDriver(d *ogcn.DatabaseDriver, k *kite.Kite) *IRCDriver {
       
       <- ticker.C
       
-      if (driver.ChatConnected && driver.IsPrimary) {
+      if (driver.ChatKite != nil && driver.ChatKite.Ready() && driver.IsPrimary.Load() && !driver.ShuttingDown.Load()) {
         
-        driver.ChatClient.Tell("im-here", true)
+        driver.ChatKite.Tell("im-here", true)
       }
     }
   }()
   
-  // Listener connection queue
+  // Listener connection queue. One connection per tick keeps well within Twitch's connection rate;
+  // joins are throttled separately by the JoinLimiter.
   go func() {
     for {
       select {
       case <- driver.ConnectTicker.C:
         
-        if (!(driver.ListenerQueuesBusy())) {
+        driver.StateLock.Lock()
+        nextUp := driver.ConnectQueue.Pop()
+        driver.StateLock.Unlock()
+        
+        if (nextUp != "") {
           
-          nextUp := driver.ConnectQueue.Pop()
-          if (nextUp != "") {
+          if listener := driver.ListenerPool.Find(nextUp); listener != nil {
             
-            for i := 0; i < len(driver.ListenerPool); i++ {
-              
-              if (driver.ListenerPool[i].Username == nextUp) {
-                
-                driver.ListenerPool[i].Listen()
-                break;
-              }
-            }
+            listener.Listen()
           }
         }
       }
@@ -126,127 +144,121 @@ func CreateIrcDriver(d *ogcn.DatabaseDriver, k *kite.Kite) *IRCDriver {
     for {
        select {
         case <- driver.ChattersTicker.C:
-         if (driver.IsPrimary) {
-           
-           ogdm.ChattersBatchCreate(driver.DbDriver, driver.ActiveChatters)
-         }
-         
-         driver.ActiveChatters = make([]ogdm.ChattersBatch, 0, 25000)
+         driver.FlushChatters()
        }
     }
   }()
   
-  // Buffer sender
-  go func() {
-    for {
-       select {
-        case <- driver.BufferTicker.C:
-         if (driver.EventConnected && driver.BufferEvents.Count > 0) {
-           
-           event := driver.BufferEvents.Pop()
-           driver.EventClient.Tell("process-event", event)
-         }
-         if (driver.ChatConnected && driver.BufferChat.Count > 0) {
-           
-           message := driver.BufferChat.Pop()
-           driver.ChatClient.Tell("twitch-chatter", message)
-         }
-       }
-    }
-  }()
-  
-  return &driver
-}
-
-func (i *IRCDriver) ListenerQueuesBusy() bool {
-  
-  channelsBusy := 0
-  
-  for ind := 0; ind < len(i.ListenerPool); ind++ {
+  for ind := 0; ind < len(config.Auth.Accounts); ind++ {
     
-    if (i.ListenerPool[ind].Listening && i.ListenerPool[ind].ChannelBuffer.Count > 0) {
+    account, err := BotAccountNew(config.Auth.Accounts[ind], config.Auth)
+    if (err != nil) {
       
-      channelsBusy++
-      if (channelsBusy >= 3) { return true }
+      logger.Error("Unable to load account. Skipping.", LogFields{ "account": config.Auth.Accounts[ind].Login, "error": err })
+      continue
     }
+    
+    account.Watch()
+    driver.Accounts = append(driver.Accounts, account)
   }
   
-  return false
-}
-
-func (i *IRCDriver) EventConnect() {
+  // Monetary events borrow room from chat, within the two capacities together, before they are ever dropped.
+  driver.BufferEvents.Yield = driver.BufferChat
   
-  i.EventConnected = true
-  fmt.Println("Connected to Event Handler.")
-}
-
-func (i *IRCDriver) ChatConnect() {
+  if (config.Sharding.Enabled) {
+    
+    driver.Sharder = SharderNew(k, config.Sharding,
+      func(old, ring *HashRing) { driver.Rebalance(old, ring) },
+      func(peer *ShardPeer) { go driver.SyncPeer(peer) })
+  }
   
-  i.ChatConnected = true
-  fmt.Println("Connected to Chat Handler.")
-}
-
-func (i *IRCDriver) EventDisconnect() {
+  if (config.Election.Enabled && d == nil) {
+    
+    logger.Error("Election needs a database. Running without it.", nil)
   
-  i.EventConnected = false
-  fmt.Println("Disconnected from Event Handler.")
+  } else if (config.Election.Enabled) {
+    
+    // With sharding, each shard's replicas elect their own primary.
+    election := config.Election
+    if (driver.Sharder != nil) { election.Lease += ":" + driver.Sharder.Self }
+    
+    session := MongoSessionNew(d, config.Database.DbName)
+    
+    // Delivered keys outlive the window so a replica taking over never replays what it can still see.
+    driver.Delivered = MongoDeliveredStoreNew(session, config.Dedup.Collection, 2 * driver.Dedup.Window)
+    driver.Elector = ElectorNew(MongoLeaseStoreNew(session, election.Collection), ElectorIdentity(), election,
+      func(leader bool, lease Lease) {
+        
+        driver.IsPrimary.Store(leader)
+        if (leader) { go driver.TakeOver() }
+      })
+  }
+  
+  // Members are started first, so they report deliveries from the first batch on.
+  driver.EventSink.Start(func() bool { return !driver.Fenced() }, driver.MarkDelivered, config.Delivery)
+  driver.ChatSink.Start(func() bool { return !driver.Fenced() }, driver.TraceDelivered, config.Delivery)
   
-  i.EventClient.Close()
-  i.EventClient = i.KiteManager.NewClient("http://" +
-                                          config.Addresses.Event +
-                                          ":" +
-                                          strconv.Itoa(config.Ports.Event) +
-                                          "/kite")
+  driver.EventSender = BufferSenderNew("events", driver.BufferEvents, func() bool { return driver.EventSink.Ready() && !driver.Fenced() },
+    driver.EventSink.Send, config.Delivery)
   
-  i.EventClient.OnConnect(i.EventConnect)
-  i.EventClient.OnDisconnect(i.EventDisconnect)
+  driver.ChatSender = BufferSenderNew("chat", driver.BufferChat, func() bool { return driver.ChatSink.Ready() && !driver.Fenced() },
+    driver.ChatSink.Send, config.Delivery)
   
-  i.EventClient.DialForever()
+  return &driver, nil
 }
 
-func (i *IRCDriver) ChatDisconnect() {
+func (i *IRCDriver) ListenToChannel(user *ogdm.IdentitySlim) {
   
-  i.ChatConnected = false
-  fmt.Println("Disconnected from Chat Handler.")
+  if (i.ShuttingDown.Load()) { return }
   
-  i.ChatClient.Close()
-  i.ChatClient = i.KiteManager.NewClient("http://" +
-                                         config.Addresses.Chat +
-                                         ":" +
-                                         strconv.Itoa(config.Ports.Chat) +
-                                         "/kite")
+  i.StateLock.Lock()
   
-  i.ChatClient.OnConnect(i.ChatConnect)
-  i.ChatClient.OnDisconnect(i.ChatDisconnect)
+  key := i.ChannelKey(user)
   
-  i.ChatClient.DialForever()
-}
-
-func (i *IRCDriver) ListenToChannel(user *ogdm.IdentitySlim) {
+  // Given without an ID, but its ROOMSTATE has told us it since.
+  if (user.PlatformID == "" && !strings.HasPrefix(key, "#")) {
+    
+    filled := *user
+    filled.PlatformID = key
+    user = &filled
+  }
   
-  existing, exists := i.Channels[user.PlatformID]
+  joined, stale := i.UpgradePending(user, key)
+  
+  existing, exists := i.Channels[key]
   
   if (exists) {
     
     if (existing.Login == user.Login) {
       
+      i.StateLock.Unlock()
+      if (stale != "") { i.PartChannel(stale) }
       return
     }
     
-    fmt.Println("Given channel with recognized ID but different username. Switching channels from \"" + existing.Login +  "\" to \"" + user.Login + "\".")
+    logger.Info("Given channel with recognized ID but different username. Switching channels.", LogFields{ "channel": user.Login, "old_channel": existing.Login, "channel_id": user.PlatformID })
+    
+    i.Channels[key] = user
+    i.StateLock.Unlock()
+    
+    if (stale != "") { i.PartChannel(stale) }
+    
+    // Another shard has it joined.
+    if (!i.Owns(key)) { return }
     
-    i.Channels[user.PlatformID] = user
     i.PartChannel(existing.Login)
     timer := time.NewTimer(time.Second)
     go func() {
       
       <-timer.C
       
-      for ind := 0; ind < len(i.ListenerPool); ind++ {
+      listeners := i.ListenerPool.Snapshot()
+      
+      for ind := 0; ind < len(listeners); ind++ {
         
-        if (len(i.ListenerPool[ind].Channels) < config.ChannelsPerListener) {
+        if (listeners[ind].AcceptsChannels() && listeners[ind].JoinedCount() < config.ChannelsPerListener) {
           
-          i.ListenerPool[ind].ChannelBuffer.Push(user)
+          listeners[ind].QueueChannel(user)
           break
         }
       }
@@ -255,80 +267,451 @@ func (i *IRCDriver) ListenToChannel(user *ogdm.IdentitySlim) {
     return
   }
   
-  i.Channels[user.PlatformID] = user
+  i.Channels[key] = user
+  
+  if (!joined && i.Owns(key)) { i.Assign(user) }
   
-  var lastListener *Listener
+  i.StateLock.Unlock()
   
-  if (len(i.ListenerPool) == 0) {
+  // Parted only now, as parting waits on the listener's connection.
+  if (stale != "") { i.PartChannel(stale) }
+}
+
+// Returns the key a channel is kept under in Channels: its platform ID, one back-filled from its ROOMSTATE,
+// or, until then, "#" and its login. No platform ID starts with '#'. Call with StateLock held.
+func (i *IRCDriver) ChannelKey(user *ogdm.IdentitySlim) string {
+  
+  if (user.PlatformID != "") { return user.PlatformID }
+  
+  login := strings.ToLower(user.Login)
+  if id, ok := i.Backfilled[login]; ok { return id }
+  
+  return "#" + login
+}
+
+// Drops the placeholder of a channel that was given without a platform ID, now that it is given with one.
+// If this instance had it joined and still owns it under its ID, the listener's copy is updated and true is returned,
+// as it needs no new assignment; if it no longer owns it, its login is returned for the caller to part once it has
+// released StateLock. Call with StateLock held.
+func (i *IRCDriver) UpgradePending(user *ogdm.IdentitySlim, key string) (bool, string) {
+  
+  login := strings.ToLower(user.Login)
+  pending := "#" + login
+  
+  if (key == pending) { return false, "" }
+  if _, ok := i.Channels[pending]; !ok { return false, "" }
+  
+  delete(i.Channels, pending)
+  i.Backfilled[login] = key
+  
+  if (!i.Owns(pending)) { return false, "" }
+  
+  if (!i.Owns(key)) { return false, login }
+  
+  listeners := i.ListenerPool.Snapshot()
+  for ind := 0; ind < len(listeners); ind++ { listeners[ind].Backfill(user) }
+  
+  return true, ""
+}
+
+// Fills in the platform ID of a channel given without one, from the room-id of its ROOMSTATE, and tells the other shards,
+// which may own it under its ID.
+func (i *IRCDriver) BackfillChannelID(login, roomID string) {
+  
+  i.StateLock.RLock()
+  user, ok := i.Channels["#" + login]
+  i.StateLock.RUnlock()
+  
+  if (!ok) { return }
+  
+  filled := *user
+  filled.PlatformID = roomID
+  
+  logger.Info("Back-filled channel ID from ROOMSTATE.", LogFields{ "channel": login, "channel_id": roomID })
+  
+  i.ListenToChannel(&filled)
+  
+  version := i.TouchChannels(0)
+  if (i.Sharder != nil) { go i.ShareChannels("shard-channels", version, []ogdm.IdentitySlim{ filled }) }
+}
+
+// Queues a channel on the last listener, or on a new one if it is full. Call with StateLock held.
+func (i *IRCDriver) Assign(user *ogdm.IdentitySlim) {
+  
+  lastListener := i.ListenerPool.Last()
+  
+  if (lastListener == nil || lastListener.ChannelCount() >= config.ChannelsPerListener) {
     
-    username := "Justinfan" + strconv.Itoa(ogcl.SpecificRand(1000, 9999))
-    lastListener = CreateListener(username, "", i)
-    i.ListenerPool = append(i.ListenerPool, *lastListener)
-    i.ConnectQueue.Push(lastListener.Username)
-  } else {
+    lastListener = i.NewListener()
+    if (lastListener == nil) {
+      
+      logger.Error("Every account is at its listener limit. Channel not joined.", LogFields{ "channel": user.Login })
+      return
+    }
     
-    lastListener = &(i.ListenerPool[len(i.ListenerPool) - 1])
+    i.ListenerPool.Add(lastListener)
+    i.ConnectQueue.Push(lastListener.Username)
   }
   
-  if ((len(lastListener.Channels) + lastListener.ChannelBuffer.Count) < config.ChannelsPerListener) {
+  lastListener.QueueChannel(user)
+}
+
+// Creates a listener on the account with the fewest listeners that has room for another, or an anonymous one
+// if none has and accounts are not required. Returns nil if there is nowhere to put it. Call with StateLock held.
+func (i *IRCDriver) NewListener() *Listener {
+  
+  var account *BotAccount
+  fewest := 0
+  
+  for ind := 0; ind < len(i.Accounts); ind++ {
     
-    lastListener.ChannelBuffer.Push(user)
-  } else {
+    count := i.AccountListeners(i.Accounts[ind])
+    max := i.Accounts[ind].Config.MaxListeners
     
-    username := ""
-    alreadyExists := true
-    for alreadyExists {
+    if (max > 0 && count >= max) { continue }
+    if (account == nil || count < fewest) { account = i.Accounts[ind]; fewest = count }
+  }
+  
+  if (account == nil && config.Auth.RequireAccount) { return nil }
+  
+  username := ""
+  for username == "" || i.ListenerPool.Find(username) != nil {
+    
+    if (account != nil) {
+      
+      username = account.Login + "-" + strconv.Itoa(ogcl.SpecificRand(1000, 9999))
+    } else {
       
-      alreadyExists = false
       username = "Justinfan" + strconv.Itoa(ogcl.SpecificRand(1000, 9999))
-      for j := 0; j < len(i.ListenerPool); j++ {
+    }
+  }
+  
+  return CreateListener(username, account, i)
+}
+
+// Returns how many live listeners log in as the given account.
+func (i *IRCDriver) AccountListeners(account *BotAccount) int {
+  
+  listeners := i.ListenerPool.Snapshot()
+  count := 0
+  
+  for ind := 0; ind < len(listeners); ind++ {
+    
+    if (listeners[ind].Account == account && listeners[ind].AcceptsChannels()) { count++ }
+  }
+  
+  return count
+}
+
+// Returns a point-in-time view of every account, as reported by the "account-status" kite method.
+func (i *IRCDriver) AccountStatuses() []AccountStatus {
+  
+  statuses := make([]AccountStatus, len(i.Accounts))
+  
+  for ind := 0; ind < len(i.Accounts); ind++ {
+    
+    statuses[ind] = i.Accounts[ind].Status(i.AccountListeners(i.Accounts[ind]))
+  }
+  
+  return statuses
+}
+
+// Refreshes the token of the named account, or of every account if login is empty.
+// Existing connections keep their session; the new token is used from the next connect.
+func (i *IRCDriver) RefreshAccounts(login string) []AccountStatus {
+  
+  for ind := 0; ind < len(i.Accounts); ind++ {
+    
+    if (login != "" && !strings.EqualFold(login, i.Accounts[ind].Login)) { continue }
+    
+    i.Accounts[ind].Refresh()
+  }
+  
+  return i.AccountStatuses()
+}
+
+// Returns whether this instance should join the channel with the given platform ID. Without sharding it joins every channel.
+func (i *IRCDriver) Owns(channelID string) bool {
+  
+  return (i.Sharder == nil || i.Sharder.Owns(channelID))
+}
+
+// Joins the channels this shard gained and parts the ones it lost when the ring changes.
+func (i *IRCDriver) Rebalance(old, ring *HashRing) {
+  
+  if (i.ShuttingDown.Load()) { return }
+  
+  self := i.Sharder.Self
+  lost := make([]string, 0)
+  gained := 0
+  
+  i.StateLock.Lock()
+  
+  for id, user := range i.Channels {
+    
+    was := (old.Owner(id) == self)
+    owns := (ring.Owner(id) == self)
+    
+    if (was && !owns) { lost = append(lost, user.Login) }
+    if (!was && owns) { i.Assign(user); gained++ }
+  }
+  
+  i.StateLock.Unlock()
+  
+  for ind := 0; ind < len(lost); ind++ { i.PartChannel(lost[ind]) }
+  
+  logger.Info("Rebalanced channels.", LogFields{ "gained": gained, "lost": len(lost), "shards": len(ring.Members) })
+}
+
+// Specifies channels sent between shards. Version is when the sender's channel set last changed.
+// A "shard-sync" carries the sender's whole set over one or more batches, from First to Final,
+// and replaces the receiver's set only if it is newer, so a shard that missed a part while down cannot bring the channel back.
+type ShardChannelSet struct {
+  
+  From     string              `json:"from"`
+  Version  int64               `json:"version"`
+  Channels []ogdm.IdentitySlim `json:"channels"`
+  First    bool                `json:"first"`
+  Final    bool                `json:"final"`
+}
+
+// Records a change to the channel set. A version of 0 means a change made here, now. Returns the current version.
+func (i *IRCDriver) TouchChannels(version int64) int64 {
+  
+  if (version == 0) { version = time.Now().UnixNano() }
+  
+  i.StateLock.Lock()
+  defer i.StateLock.Unlock()
+  
+  if (version > i.ChannelsVersion) { i.ChannelsVersion = version }
+  
+  return i.ChannelsVersion
+}
+
+// Sends the whole channel set to a peer that just became reachable. It is kept only if newer than the peer's.
+func (i *IRCDriver) SyncPeer(peer *ShardPeer) {
+  
+  i.StateLock.RLock()
+  channels := make([]ogdm.IdentitySlim, 0, len(i.Channels))
+  for _, user := range i.Channels { channels = append(channels, *user) }
+  version := i.ChannelsVersion
+  i.StateLock.RUnlock()
+  
+  if err := ForwardChannels(peer, "shard-sync", ShardChannelSet{ From: i.Sharder.Self, Version: version, Channels: channels }); err != nil {
+    
+    logger.Warn("Unable to sync channels to shard peer.", LogFields{ "shard": peer.Name, "address": peer.Address, "error": err })
+  }
+}
+
+// Takes one batch of a peer's "shard-sync". Returns false if the set is not newer than this one, or its first batch was missed.
+func (i *IRCDriver) ReceiveSync(set ShardChannelSet) bool {
+  
+  i.StateLock.Lock()
+  
+  if (set.Version <= i.ChannelsVersion) { i.StateLock.Unlock(); return false }
+  
+  if (set.First) { i.Syncs[set.From] = make([]ogdm.IdentitySlim, 0, len(set.Channels)) }
+  
+  pending, ok := i.Syncs[set.From]
+  if (!ok) { i.StateLock.Unlock(); return false }
+  
+  pending = append(pending, set.Channels...)
+  
+  if (!set.Final) { i.Syncs[set.From] = pending; i.StateLock.Unlock(); return true }
+  
+  delete(i.Syncs, set.From)
+  i.StateLock.Unlock()
+  
+  removed := i.ReplaceChannels(pending)
+  i.TouchChannels(set.Version)
+  
+  logger.Info("Took channel set from shard peer.", LogFields{ "shard": set.From, "channels": len(pending), "removed": removed })
+  
+  return true
+}
+
+// Sends a change to every reachable peer with the given method, so each shard knows the whole set
+// and can take over its share on a rebalance.
+func (i *IRCDriver) ShareChannels(method string, version int64, channels []ogdm.IdentitySlim) {
+  
+  peers := i.Sharder.UpPeers()
+  set := ShardChannelSet{ From: i.Sharder.Self, Version: version, Channels: channels }
+  
+  for ind := 0; ind < len(peers); ind++ {
+    
+    if err := ForwardChannels(peers[ind], method, set); err != nil {
+      
+      logger.Warn("Unable to share channels with shard peer.", LogFields{ "shard": peers[ind].Name, "address": peers[ind].Address, "method": method, "error": err })
+    }
+  }
+}
+
+// Static. Sends a set to one of a peer's "shard-*" methods in batches. Even an empty set is sent, as one final batch.
+func ForwardChannels(peer *ShardPeer, method string, set ShardChannelSet) error {
+  
+  channels := set.Channels
+  
+  for ind := 0; ind == 0 || ind < len(channels); ind += 10000 {
+    
+    end := ind + 10000
+    if (end > len(channels)) { end = len(channels) }
+    
+    set.Channels = channels[ind:end]
+    set.First = (ind == 0)
+    set.Final = (end == len(channels))
+    
+    if err := peer.Kite.Tell(method, set); err != nil { return err }
+  }
+  
+  return nil
+}
+
+// Forgets channels, matched by platform ID or else by login, parts them and closes any listener left empty.
+// Returns how many known channels were removed.
+func (i *IRCDriver) RemoveChannels(channels []ogdm.IdentitySlim) int {
+  
+  logins := make([]string, 0, len(channels))
+  removed := 0
+  
+  i.StateLock.Lock()
+  
+  var byLogin map[string]string
+  
+  for ind := 0; ind < len(channels); ind++ {
+    
+    id := channels[ind].PlatformID
+    login := strings.ToLower(channels[ind].Login)
+    
+    if _, ok := i.Channels[id]; !ok && login != "" {
+      
+      // Built once, and only if some channel has no known ID.
+      if (byLogin == nil) {
         
-        if (i.ListenerPool[j].Username == username) {
-          alreadyExists = true
-          break
-        }
+        byLogin = make(map[string]string, len(i.Channels))
+        for key, user := range i.Channels { byLogin[user.Login] = key }
       }
+      
+      id = byLogin[login]
+    }
+    
+    if user, ok := i.Channels[id]; ok {
+      
+      login = user.Login
+      delete(i.Channels, id)
+      delete(i.Backfilled, login)
+      removed++
     }
     
-    twitchListener := CreateListener(username, "", i)
-    twitchListener.ChannelBuffer.Push(user)
-    i.ListenerPool = append(i.ListenerPool, *twitchListener)
-    i.ConnectQueue.Push(twitchListener.Username)
+    if (login != "") { logins = append(logins, login) }
+  }
+  
+  i.StateLock.Unlock()
+  
+  for ind := 0; ind < len(logins); ind++ { i.PartChannel(logins[ind]) }
+  
+  i.PruneListeners()
+  
+  return removed
+}
+
+// Makes the channel set exactly the given channels: parts every other one and listens to any new ones. Returns how many were removed.
+func (i *IRCDriver) ReplaceChannels(channels []ogdm.IdentitySlim) int {
+  
+  keep := make(map[string]bool, len(channels))
+  
+  i.StateLock.RLock()
+  for ind := 0; ind < len(channels); ind++ { keep[i.ChannelKey(&channels[ind])] = true }
+  
+  stale := make([]ogdm.IdentitySlim, 0)
+  for id, user := range i.Channels {
+    
+    if (!keep[id]) { stale = append(stale, *user) }
+  }
+  i.StateLock.RUnlock()
+  
+  removed := i.RemoveChannels(stale)
+  
+  for ind := 0; ind < len(channels); ind++ { i.ListenToChannel(&channels[ind]) }
+  
+  return removed
+}
+
+// Closes and removes every listener with no channels joined or waiting to be joined.
+func (i *IRCDriver) PruneListeners() {
+  
+  // StateLock keeps ListenToChannel from queueing on a listener while it is being removed.
+  i.StateLock.Lock()
+  
+  listeners := i.ListenerPool.Snapshot()
+  empty := make([]*Listener, 0)
+  
+  for ind := 0; ind < len(listeners); ind++ {
+    
+    if (listeners[ind].ChannelCount() == 0 && i.ListenerPool.Remove(listeners[ind])) { empty = append(empty, listeners[ind]) }
   }
+  
+  i.StateLock.Unlock()
+  
+  for ind := 0; ind < len(empty); ind++ {
+    
+    empty[ind].Close()
+  }
+  
+  if (len(empty) > 0) { logger.Info("Closed empty listeners.", LogFields{ "count": len(empty) }) }
 }
 
+// Returns the known channel with the given platform ID or login, or nil.
+func (i *IRCDriver) FindChannel(name string) *ogdm.IdentitySlim {
+  
+  i.StateLock.RLock()
+  defer i.StateLock.RUnlock()
+  
+  if user, ok := i.Channels[name]; ok { return user }
+  
+  login := strings.ToLower(name)
+  for _, user := range i.Channels {
+    
+    if (user.Login == login) { return user }
+  }
+  
+  return nil
+}
+
+// Parts a channel on every listener and forgets its room state. Call without StateLock held.
 func (i *IRCDriver) PartChannel(name string) {
   
-  for ind := 0; ind < len(i.ListenerPool); ind++ {
+  listeners := i.ListenerPool.Snapshot()
+  
+  for ind := 0; ind < len(listeners); ind++ {
     
-    i.ListenerPool[ind].Connection.Part("#" + name)
-    delete(i.ListenerPool[ind].Channels, name)
+    listeners[ind].Part(name)
   }
+  
+  i.ForgetRoomState(name)
 }
 
-func (i *IRCDriver) ActiveChatter(data map[string]string) {
+func (i *IRCDriver) ActiveChatter(msg *IrcMessage, tags *TwitchTags) {
   
   defer func() {
     
     if r := recover(); r != nil {
       
-      fmt.Println("--------")
-      fmt.Println("PANIC!!!")
-      fmt.Println("--------")
-      fmt.Println(r)
-      fmt.Println(data)
+      logger.Error("Recovered from panic recording active chatter.", LogFields{ "panic": fmt.Sprint(r), "channel": msg.Channel(), "raw": msg.Raw })
     }
   }()
   
+  i.ChattersLock.Lock()
+  defer i.ChattersLock.Unlock()
+  
   theUser := ogdm.IdentitySlim{
     Platform: "twitch",
-    Display: data["display-name"],
-    Login: strings.ToLower(data["display-name"]),
-    PlatformID: data["user-id"] }
+    Display: tags.DisplayName,
+    Login: tags.Login,
+    PlatformID: tags.UserID }
   
   for ind := 0; ind < len(i.ActiveChatters); ind++ {
     
-    if (i.ActiveChatters[ind].Channel.PlatformID == data["room-id"]) {
+    if (i.ActiveChatters[ind].Channel.PlatformID == tags.RoomID) {
       
       for j := 0; j < len(i.ActiveChatters[ind].Chatters); j++ {
         
@@ -346,131 +729,281 @@ func (i *IRCDriver) ActiveChatter(data map[string]string) {
   
   i.ActiveChatters = append(i.ActiveChatters, ogdm.ChattersBatch{
     Channel: ogdm.IdentitySlim{
-      PlatformID: data["room-id"],
-      Login: data["channel"],
+      PlatformID: tags.RoomID,
+      Login: msg.Channel(),
       Platform: "twitch",
       },
       Chatters: []ogdm.IdentitySlim{ theUser },
     })
 }
 
-func (i *IRCDriver) FireEvent(e *ogdm.Event) {
+// Saves the chatters seen since the last flush, if this instance is primary and has a database.
+func (i *IRCDriver) FlushChatters() {
   
-  if (i.IsPrimary) { i.BufferEvents.Push(e) }
-}
-
-func (i *IRCDriver) CloseListeners() {
+  i.ChattersLock.Lock()
+  batches := i.ActiveChatters
+  i.ActiveChatters = make([]ogdm.ChattersBatch, 0, 25000)
+  i.ChattersLock.Unlock()
+  
+  if (!i.IsPrimary.Load() || i.Fenced() || i.DbDriver == nil || len(batches) == 0) { return }
   
-  for ind := 0; ind < len(i.ListenerPool); ind++ {
+  if err := ogdm.ChattersBatchCreate(i.DbDriver, batches); err != nil {
     
-    i.ListenerPool[ind].Connection.Quit()
+    logger.Error("Unable to save active chatters.", LogFields{ "channels": len(batches), "error": err })
   }
+}
+
+// Returns whether this replica has lost its lease, in which case it must not deliver or write anything.
+// Without election nothing is fenced.
+func (i *IRCDriver) Fenced() bool {
   
-  i.ConnectTicker.Stop()
-  i.ChattersTicker.Stop()
-  i.EventClient.Close()
-  i.ChatClient.Close()
+  return (i.Elector != nil && !i.Elector.IsLeader())
 }
 
-// Specifies an IRC Listener data structure.
-type Listener struct {
+// Returns who is primary. Without election only this replica's own flag is known.
+func (i *IRCDriver) PrimaryStatus() LeaseStatus {
+  
+  if (i.Elector != nil) { return i.Elector.Status() }
+  
+  status := LeaseStatus{ IsPrimary: i.IsPrimary.Load(), Self: ElectorIdentity() }
+  if (status.IsPrimary) { status.Holder = status.Self }
+  
+  return status
+}
+
+// Queues an event for the Event Handler if this instance is primary. sentAt is the message's tmi-sent-ts, if it had one.
+// Events already seen within the dedup window, from a replayed message or another listener, are dropped.
+func (i *IRCDriver) FireEvent(e *ogdm.Event, sentAt time.Time) {
+  
+  fresh, push := i.Dedup.Add(e, sentAt, i.IsPrimary.Load)
   
-  Username      string
-  Listening     bool
-  ChannelBuffer *ogdm.IdentityQueue
-  Connection    *irc.Connection
-  IrcDriver     *IRCDriver
-  Channels      map[string]*ogdm.IdentitySlim
-  Disconnected  bool
-  RetryLater    bool
+  if (!fresh) {
+    
+    DuplicatesTotal.Inc(e.EventType)
+    logger.Debug("Dropped duplicate event.", LogFields{ "event_id": e.EventID, "type": e.EventType, "channel": e.EventChannelName })
+    return
+  }
+  
+  EventsTotal.Inc(e.EventType)
+  logger.Debug("Fired event.", LogFields{ "event_id": e.EventID, "type": e.EventType, "channel": e.EventChannelName })
+  
+  if (push) { i.PushEvent(e, sentAt) }
 }
 
-// Static. Creates a Listener using the specified nickname, and password.
-func CreateListener (nick, token string, d *IRCDriver) *Listener {
-  conn := irc.IRC(strings.ToLower(nick), nick)
-  l := Listener{
-    Username: nick,
-    Listening: false,
-    ChannelBuffer: ogdm.IdentityQueueNew(10000),
-    Connection: conn,
-    IrcDriver: d,
-    Channels: make(map[string]*ogdm.IdentitySlim, config.ChannelsPerListener),
-    Disconnected: false,
-    RetryLater: false }
+// Records that an event sink member delivered the given events, one key per event and member, so a replica taking over
+// knows which members still need them.
+func (i *IRCDriver) MarkDelivered(member *SinkMember, items []OutboundItem) {
   
-  l.Connection.Password = "oauth:" + token
-  l.Connection.UseTLS = true
-  l.Connection.TLSConfig = &tls.Config{}
-  l.Connection.AddCallback("001", l.On001)
-  l.Connection.AddCallback("CAP", l.OnCapAck)
-  l.Connection.AddCallback("NOTICE", l.OnNotice)
-  l.Connection.AddCallback("USERNOTICE", l.OnUserNotice)
-  l.Connection.AddCallback("PRIVMSG", l.OnMessage)
-  l.Connection.AddCallback("RECONNECT", func(e *irc.Event) { fmt.Println("Twitch issued reconnect.") })
+  if (i.Delivered == nil) { return }
   
-  fmt.Println("Created listener \"" + nick + "\".")
+  keys := make([]string, len(items))
+  for ind := 0; ind < len(items); ind++ { keys[ind] = DeliveredKey(EventKey(items[ind].Event), member.Name) }
   
-  return &l;
+  if err := i.Delivered.Mark(keys); err != nil {
+    
+    logger.Warn("Unable to record delivered events.", LogFields{ "sink": member.Name, "count": len(items), "error": err })
+  }
 }
 
-// Listener. Begins Listening to the Twitch IRC servers.
-func (l *Listener) Listen() {
+// Times traced chat lines at their delivery by a chat sink member.
+func (i *IRCDriver) TraceDelivered(member *SinkMember, items []OutboundItem) {
   
-  l.Listening = true
+  for ind := 0; ind < len(items); ind++ {
+    
+    if (items[ind].Traced) { i.Tracer.Record(StageDelivery, items[ind].SentAt) }
+  }
+}
+
+// Called on becoming primary. Queues the events seen while secondary that the old primary did not record as delivered
+// to every event sink member: to all members if none had it, otherwise only to those that did not.
+// If that cannot be checked they are all queued; a duplicate is better than a gap.
+func (i *IRCDriver) TakeOver() {
+  
+  entries := i.Dedup.TakeUnpushed()
+  if (len(entries) == 0) { return }
   
-  if err := l.Connection.Connect("irc.chat.twitch.tv:443"); err != nil {
-    fmt.Printf("Connection error: %s\n", err.Error())
+  members := i.EventSink.Members
+  delivered := make(map[string]bool, 0)
+  
+  if (i.Delivered != nil) {
+    
+    keys := make([]string, 0, len(entries) * len(members))
+    for ind := 0; ind < len(entries); ind++ {
+      
+      for member := 0; member < len(members); member++ { keys = append(keys, DeliveredKey(entries[ind].Key, members[member].Name)) }
+    }
+    
+    found, err := i.Delivered.Delivered(keys)
+    if (err != nil) {
+      
+      logger.Warn("Unable to check delivered events. Replaying all of them.", LogFields{ "count": len(entries), "error": err })
+    } else {
+      
+      delivered = found
+    }
   }
   
-  ticker := time.NewTicker(50 * time.Millisecond)
-  go func() {
-    for {
-      select {
-        case <- ticker.C:
-        if (!l.Disconnected) {
-          nextChannel := l.ChannelBuffer.Pop()
-          if (nextChannel != nil) {
-            l.Connection.Join("#" + nextChannel.Login)
-            l.Channels[nextChannel.Login] = nextChannel
-          }
-        }
-      }
+  replayed := 0
+  for ind := 0; ind < len(entries); ind++ {
+    
+    missing := make([]*SinkMember, 0, len(members))
+    for member := 0; member < len(members); member++ {
+      
+      if (!delivered[DeliveredKey(entries[ind].Key, members[member].Name)]) { missing = append(missing, members[member]) }
     }
-  }()
+    
+    if (len(missing) == 0) { continue }
+    replayed++
+    
+    if (len(missing) == len(members)) { i.PushEvent(entries[ind].Event, entries[ind].SentAt); continue }
+    
+    // Only buffered members can have been delivered to separately.
+    for member := 0; member < len(missing); member++ {
+      
+      missing[member].Buffer.Push(OutboundItem{ Event: entries[ind].Event, Priority: EventPriority(entries[ind].Event), SentAt: entries[ind].SentAt })
+    }
+  }
+  
+  logger.Info("Took over events seen while secondary.", LogFields{ "seen": len(entries), "replayed": replayed })
+}
+
+// Queues a raw chat line for the Chat Handler if this instance is primary. Traced lines are timed through to delivery.
+func (i *IRCDriver) ForwardChat(raw string, sentAt time.Time, traced bool) {
   
-  go l.Connection.Loop()
+  if (!i.IsPrimary.Load()) { return }
+  
+  i.PushChat(raw, sentAt, traced)
+  
+  i.Tracer.Observe(StageEnqueue, sentAt)
+  if (traced) { i.Tracer.Record(StageEnqueue, sentAt) }
+}
+
+func (i *IRCDriver) PushEvent(e *ogdm.Event, sentAt time.Time) {
+  
+  i.BufferEvents.Push(OutboundItem{ Event: e, Priority: EventPriority(e), SentAt: sentAt })
+}
+
+func (i *IRCDriver) PushChat(raw string, sentAt time.Time, traced bool) {
   
+  i.BufferChat.Push(OutboundItem{ Chat: raw, Priority: PriorityChat, SentAt: sentAt, Traced: traced })
+}
+
+// Shuts down in order: stops taking channels, parts and closes every listener within ListenerCloseTimeout, flushes active chatters,
+// waits up to drainTimeout for the outbound buffers to empty, then closes the buffers and sinks.
+// Returns false if items were left undelivered. With a write-ahead log they are replayed on the next start.
+func (i *IRCDriver) Shutdown(drainTimeout time.Duration) bool {
+  
+  i.ShuttingDown.Store(true)
+  i.ConnectTicker.Stop()
+  if (i.Sharder != nil) { i.Sharder.Stop() }
+  i.ChattersTicker.Stop()
+  
+  listeners := i.ListenerPool.Snapshot()
+  closed := make(chan struct{})
+  
+  // A listener stuck on a dead connection must not hold up draining the buffers.
   go func() {
     
-    err := <- l.Connection.Error
-    fmt.Println("Twich IRC error: " + err.Error())
-    l.Disconnected = true
-    if (l.RetryLater) { time.Sleep(time.Second) }
-    closer <- true
+    var wg sync.WaitGroup
+    
+    for ind := 0; ind < len(listeners); ind++ {
+      
+      wg.Add(1)
+      go func(l *Listener) {
+        
+        defer wg.Done()
+        
+        parted := l.PartAll()
+        logger.Info("Parted channels.", LogFields{ "listener": l.Username, "channels": parted })
+        l.Close()
+      }(listeners[ind])
+    }
+    
+    wg.Wait()
+    close(closed)
   }()
+  
+  select {
+    case <- closed:
+    case <- time.After(ListenerCloseTimeout):
+    logger.Warn("Listeners did not close in time. Shutting down without them.", LogFields{ "listeners": len(listeners) })
+  }
+  
+  i.ListenerPool.Prune()
+  
+  i.FlushChatters()
+  
+  drained := i.DrainBuffers(drainTimeout)
+  
+  // Only now hand over, so nothing this replica buffered as primary is delivered by it after another takes over.
+  if (i.Elector != nil) { i.Elector.Stop() }
+  
+  for ind := 0; ind < len(i.Accounts); ind++ { i.Accounts[ind].Stop() }
+  
+  i.EventSender.Stop()
+  i.ChatSender.Stop()
+  i.BufferEvents.Close()
+  i.BufferChat.Close()
+  i.EventSink.Close()
+  i.ChatSink.Close()
+  
+  return drained
 }
 
-// Listener. Called when the client connects to the IRC server.
-func (l *Listener) On001(e *irc.Event) {
+// Returns the status of both outbound buffers, followed by any sink members' buffers.
+func (i *IRCDriver) BufferStatus() []BufferStatus {
   
-  l.Connection.SendRaw("CAP REQ :twitch.tv/commands")
-  l.Connection.SendRaw("CAP REQ :twitch.tv/tags")
+  statuses := []BufferStatus{ i.BufferEvents.Status(), i.BufferChat.Status() }
+  statuses = append(statuses, i.EventSink.Status()...)
   
-  if (l.Disconnected) {
+  return append(statuses, i.ChatSink.Status()...)
+}
+
+// Waits until both outbound buffers, and any sink members' buffers, are empty or the timeout passes. Returns whether they emptied.
+func (i *IRCDriver) DrainBuffers(timeout time.Duration) bool {
+  
+  deadline := time.Now().Add(timeout)
+  
+  for {
     
-    for _, channel := range l.Channels {
+    events := i.BufferEvents.Count() + i.EventSink.Count()
+    chat := i.BufferChat.Count() + i.ChatSink.Count()
+    
+    if (events == 0 && chat == 0) { return true }
+    
+    if (i.Fenced()) {
       
-      l.ChannelBuffer.Push(channel)
+      logger.Warn("Not primary. Leaving items undelivered.", LogFields{ "events": events, "chat": chat })
+      return false
     }
     
-    l.Disconnected = false
+    if (time.Now().After(deadline)) {
+      
+      logger.Warn("Drain deadline passed with items undelivered.", LogFields{ "events": events, "chat": chat })
+      return false
+    }
+    
+    time.Sleep(50 * time.Millisecond)
   }
 }
 
+// Listener. Called for every message the IRC server sends.
+func (l *Listener) OnAny(e *irc.Event) {
+  
+  MessagesTotal.Inc(e.Code)
+}
+
 // Listener. Called when the IRC server acknowledges a capability the client requests.
 func (l *Listener) OnCapAck(e *irc.Event) {
   
-  fmt.Println("Twitch acknowledged capability: ", strings.Split(e.Raw, " :")[1])
+  msg, err := ParseIrcMessage(e.Raw)
+  if (err != nil) { logger.Warn("Unable to parse CAP.", LogFields{ "listener": l.Username, "error": err, "raw": e.Raw }); return }
+  
+  // The capabilities are usually the trailing parameter, but a single one may be sent as a middle parameter.
+  capability := msg.Trailing
+  if (!msg.HasTrailing && len(msg.Params) > 0) { capability = msg.Params[len(msg.Params) - 1] }
+  
+  logger.Info("Twitch acknowledged capability.", LogFields{ "listener": l.Username, "capability": capability })
 }
 
 // Listener. Called when the IRC server issues a USERNOTICE message.
@@ -480,90 +1013,197 @@ func (l *Listener) OnNotice(e *irc.Event) {
     
     if r := recover(); r != nil {
       
-      if (e.Message() == "Error logging in") {
-        
-        l.RetryLater = true
-        return
-      }
-      
-      fmt.Println("--------")
-      fmt.Println("PANIC!!!")
-      fmt.Println("--------")
-      fmt.Println(r)
-      fmt.Println("")
-      fmt.Println(e.Raw)
+      logger.Error("Recovered from panic handling NOTICE.", LogFields{ "listener": l.Username, "panic": fmt.Sprint(r), "raw": e.Raw })
     }
   }()
   
-  data := ParseMessage(e.Raw)
+  if (!l.IsActiveConnection(e)) { return }
+  
+  msg, err := ParseIrcMessage(e.Raw)
+  if (err != nil) { logger.Warn("Unable to parse NOTICE.", LogFields{ "listener": l.Username, "error": err, "raw": e.Raw }); return }
+  
+  // Login failures are sent without a channel.
+  if (msg.Channel() == "") {
+    
+    if (msg.Message() == "Error logging in" || msg.Message() == "Login authentication failed") {
+      
+      // Make the reconnect validate, and if need be refresh, the token before trying again.
+      if (l.Account != nil) { l.Account.Invalidate(msg.Message() + ".") }
+      
+      l.Lock.Lock()
+      l.RetryLater = true
+      l.Lock.Unlock()
+    }
+    
+    return
+  }
+  
+  tags := ParseTwitchTags(msg)
   
-  switch(data["msg-id"]) {
+  switch(tags.MsgID) {
     
+    case "msg_duplicate", "msg_ratelimit", "msg_slowmode", "msg_banned", "msg_timedout", "msg_channel_suspended",
+         "msg_followersonly", "msg_subsonly", "msg_emoteonly", "msg_r9k", "msg_verified_email", "msg_requires_verified_phone_number":
+    logger.Warn("Twitch rejected message.", LogFields{ "listener": l.Username, "channel": msg.Channel(), "msg_id": tags.MsgID, "notice": msg.Message() })
+    SayRejectsTotal.Inc(tags.MsgID)
     case "host_on":
-    event := CreateHostEvent(data, l.Channels)
-    l.IrcDriver.FireEvent(event)
+    event := CreateHostEvent(msg, tags, l.GetChannel(msg.Channel()))
+    l.IrcDriver.FireEvent(event, tags.SentAt)
     case "host_off":
-    event := CreateHostEvent(data, l.Channels)
-    l.IrcDriver.FireEvent(event)
+    event := CreateHostEvent(msg, tags, l.GetChannel(msg.Channel()))
+    l.IrcDriver.FireEvent(event, tags.SentAt)
   }
 }
 
 // Listener. Called when the IRC server issues a USERNOTICE message.
 func (l *Listener) OnUserNotice(e *irc.Event) {
   
-  data := ParseMessage(e.Raw)
+  msg, err := ParseIrcMessage(e.Raw)
+  if (err != nil) { logger.Warn("Unable to parse USERNOTICE.", LogFields{ "listener": l.Username, "error": err, "raw": e.Raw }); return }
+  
+  tags := ParseTwitchTags(msg)
+  if (!l.FirstCopy(e, tags.ID)) { return }
+  
+  l.IrcDriver.Tracer.Observe(StageParse, tags.SentAt)
   
-  if _, hasMsg := data["message"]; hasMsg {
+  if (msg.HasTrailing) {
     
-    if (l.IrcDriver.IsPrimary) {
-      
-      l.IrcDriver.BufferChat.Push(e.Raw)
-    }
+    l.IrcDriver.ForwardChat(e.Raw, tags.SentAt, false)
   }
   
-  switch(data["msg-id"]) {
+  logger.Debug("Received USERNOTICE.", LogFields{ "listener": l.Username, "channel": msg.Channel(), "msg_id": tags.MsgID, "event_id": tags.ID })
+  
+  switch(tags.MsgID) {
     
     case "sub":
-    event := CreateSubEvent(data)
-    l.IrcDriver.FireEvent(event)
+    event := CreateSubEvent(msg, tags)
+    l.IrcDriver.FireEvent(event, tags.SentAt)
     case "resub":
-    event := CreateSubEvent(data)
-    l.IrcDriver.FireEvent(event)
-    case "subgift":
-    event := CreateSubEvent(data)
-    l.IrcDriver.FireEvent(event)
-    case "raid":
-    event := CreateRaidEvent(data)
-    l.IrcDriver.FireEvent(event)
+    event := CreateSubEvent(msg, tags)
+    l.IrcDriver.FireEvent(event, tags.SentAt)
+    case "subgift", "anonsubgift", "primepaidupgrade":
+    event := CreateSubEvent(msg, tags)
+    l.IrcDriver.FireEvent(event, tags.SentAt)
+    case "submysterygift", "anonsubmysterygift":
+    event := CreateGiftEvent(msg, tags)
+    l.IrcDriver.FireEvent(event, tags.SentAt)
+    case "giftpaidupgrade", "anongiftpaidupgrade":
+    event := CreateUpgradeEvent(msg, tags)
+    l.IrcDriver.FireEvent(event, tags.SentAt)
+    case "standardpayforward", "communitypayforward":
+    event := CreatePayForwardEvent(msg, tags)
+    l.IrcDriver.FireEvent(event, tags.SentAt)
+    case "raid", "unraid":
+    event := CreateRaidEvent(msg, tags)
+    l.IrcDriver.FireEvent(event, tags.SentAt)
     case "ritual":
-    event := CreateRitualEvent(data)
-    l.IrcDriver.FireEvent(event)
+    event := CreateRitualEvent(msg, tags)
+    l.IrcDriver.FireEvent(event, tags.SentAt)
+    case "charitydonation":
+    event := CreateCharityEvent(msg, tags)
+    l.IrcDriver.FireEvent(event, tags.SentAt)
+    case "announcement":
+    event := CreateNoticeEvent(msg, tags, tags.MsgID, tags.Param("color"), -1)
+    l.IrcDriver.FireEvent(event, tags.SentAt)
+    case "bitsbadgetier":
+    threshold, _ := tags.ParamInt("threshold")
+    event := CreateNoticeEvent(msg, tags, tags.MsgID, "", threshold)
+    l.IrcDriver.FireEvent(event, tags.SentAt)
+    case "rewardgift":
+    count, _ := tags.ParamInt("selected-count")
+    event := CreateNoticeEvent(msg, tags, tags.MsgID, tags.Param("domain"), count)
+    l.IrcDriver.FireEvent(event, tags.SentAt)
+    case "viewermilestone":
+    value, _ := tags.ParamInt("value")
+    event := CreateNoticeEvent(msg, tags, tags.MsgID, tags.Param("category"), value)
+    l.IrcDriver.FireEvent(event, tags.SentAt)
+    
+    // Forwarded as they are, so new kinds of notice reach the Event Handler before they are given a type of their own.
+    default:
+    logger.Info("Received unknown USERNOTICE.", LogFields{ "listener": l.Username, "channel": msg.Channel(), "msg_id": tags.MsgID })
+    event := CreateNoticeEvent(msg, tags, "usernotice", tags.MsgID, -1)
+    l.IrcDriver.FireEvent(event, tags.SentAt)
   }
 }
 
-// Listener. Called when the IRC server issues a PRIVMSG message.
-func (l *Listener) OnMessage(e *irc.Event) {
+// Listener. Called when the IRC server issues a ROOMSTATE message, on join with every mode and afterwards with only the ones that changed.
+func (l *Listener) OnRoomState(e *irc.Event) {
+  
+  if (!l.IsActiveConnection(e)) { return }
   
-  data := ParseMessage(e.Raw)
+  msg, err := ParseIrcMessage(e.Raw)
+  if (err != nil) { logger.Warn("Unable to parse ROOMSTATE.", LogFields{ "listener": l.Username, "error": err, "raw": e.Raw }); return }
+  
+  l.IrcDriver.UpdateRoomState(msg.Channel(), msg.Tags)
+}
 
-  if (data["username"] == "nifty255" &&
-      data["message"] == "!bonk") {
-    then, _ := strconv.ParseInt(data["tmi-sent-ts"], 10, 64)
-    now := ogcl.ToUtcMilliseconds(time.Now())
-    fmt.Println(data["tmi-sent-ts"], now, now - then)
-  }
+// Listener. Called when the IRC server issues a USERSTATE message, describing the listener's own account in a channel.
+func (l *Listener) OnUserState(e *irc.Event) {
+  
+  if (l.Account == nil || !l.IsActiveConnection(e)) { return }
   
-  if (l.IrcDriver.IsPrimary) {
+  msg, err := ParseIrcMessage(e.Raw)
+  if (err != nil) { logger.Warn("Unable to parse USERSTATE.", LogFields{ "listener": l.Username, "error": err, "raw": e.Raw }); return }
+  
+  tags := ParseTwitchTags(msg)
+  l.IrcDriver.Speaker.SetMod(l.Account, msg.Channel(), tags.Mod || tags.Broadcaster)
+}
 
-    l.IrcDriver.BufferChat.Push(e.Raw)
-  }
+// Listener. Called when the IRC server issues a CLEARCHAT message: a timeout, a ban, or the whole chat being cleared.
+// The line is also forwarded to the Chat Handler so it can retract the messages it already displayed.
+func (l *Listener) OnClearChat(e *irc.Event) {
+  
+  if (!l.IsActiveConnection(e)) { return }
+  
+  msg, err := ParseIrcMessage(e.Raw)
+  if (err != nil) { logger.Warn("Unable to parse CLEARCHAT.", LogFields{ "listener": l.Username, "error": err, "raw": e.Raw }); return }
+  
+  tags := ParseTwitchTags(msg)
+  l.IrcDriver.Tracer.Observe(StageParse, tags.SentAt)
+  
+  l.IrcDriver.ForwardChat(e.Raw, tags.SentAt, false)
+  
+  event := CreateClearChatEvent(msg, tags)
+  l.IrcDriver.FireEvent(event, tags.SentAt)
+}
+
+// Listener. Called when the IRC server issues a CLEARMSG message, for a single deleted message.
+// The line is also forwarded to the Chat Handler so it can retract the message.
+func (l *Listener) OnClearMsg(e *irc.Event) {
   
-  bitsStr, bP := data["bits"]
-  bitsNum, err := strconv.Atoi(bitsStr)
+  if (!l.IsActiveConnection(e)) { return }
   
+  msg, err := ParseIrcMessage(e.Raw)
+  if (err != nil) { logger.Warn("Unable to parse CLEARMSG.", LogFields{ "listener": l.Username, "error": err, "raw": e.Raw }); return }
+  
+  tags := ParseTwitchTags(msg)
+  l.IrcDriver.Tracer.Observe(StageParse, tags.SentAt)
+  
+  l.IrcDriver.ForwardChat(e.Raw, tags.SentAt, false)
+  
+  event := CreateDeleteEvent(msg, tags)
+  l.IrcDriver.FireEvent(event, tags.SentAt)
+}
+
+// Listener. Called when the IRC server issues a PRIVMSG message.
+func (l *Listener) OnMessage(e *irc.Event) {
+  
+  msg, err := ParseIrcMessage(e.Raw)
+  if (err != nil) { logger.Warn("Unable to parse PRIVMSG.", LogFields{ "listener": l.Username, "error": err, "raw": e.Raw }); return }
+  
+  tags := ParseTwitchTags(msg)
+  if (!l.FirstCopy(e, tags.ID)) { return }
+  
+  l.IrcDriver.Tracer.Observe(StageParse, tags.SentAt)
+  
+  probe := l.IrcDriver.Tracer.IsProbe(tags.Login, msg.Message())
+  if (probe) { l.IrcDriver.Tracer.Record(StageParse, tags.SentAt) }
+  
+  l.IrcDriver.ForwardChat(e.Raw, tags.SentAt, probe)
+
   cheermoteFinder := regexp.MustCompile(`^[A-Za-z]{3,15}\d+$`)
   
-  words := strings.Split(data["message"], " ")
+  words := strings.Split(msg.Message(), " ")
   cheermotes := make([]string, 0, len(words))
   for i := 0; i < len(words); i++ {
     
@@ -573,53 +1213,52 @@ func (l *Listener) OnMessage(e *irc.Event) {
     }
   }
   
-  go l.IrcDriver.ActiveChatter(data)
+  go l.IrcDriver.ActiveChatter(msg, tags)
   
-  if (!bP || err != nil) { return; }
+  if (!tags.HasBits) { return; }
   
   event := ogdm.Event{
-    Time: time.Now(),
+    Time: tags.EventTime(),
     Platform: "twitch",
-    EventID: data["id"],
+    EventID: tags.ID,
     EventType: "bits",
     EventCmotes: cheermotes,
-    EventAmount: bitsNum,
-    EventMessage: data["message"],
-    EventSenderID: data["user-id"],
-    EventSenderLogin: data["username"],
-    EventSenderDisplay: data["display-name"],
+    EventAmount: tags.Bits,
+    EventMessage: msg.Message(),
+    EventSenderID: tags.UserID,
+    EventSenderLogin: tags.Login,
+    EventSenderDisplay: tags.DisplayName,
     EventTargetID: "",
     EventTargetLogin: "",
     EventTargetDisplay: "",
-    EventChannelID: data["room-id"],
-    EventChannelName: data["channel"] }
+    EventChannelID: tags.RoomID,
+    EventChannelName: msg.Channel() }
   
-  l.IrcDriver.FireEvent(&event)
+  l.IrcDriver.FireEvent(&event, tags.SentAt)
 }
 
-// Creates a host on/off Event using the provided map.
-func CreateHostEvent(data map[string]string, users map[string]*ogdm.IdentitySlim) *ogdm.Event {
+// Creates a host on/off Event using the provided message.
+func CreateHostEvent(msg *IrcMessage, tags *TwitchTags, hostSender *ogdm.IdentitySlim) *ogdm.Event {
   
-  timeOfEvent := time.Now()
+  timeOfEvent := tags.EventTime()
   
-  channelName := data["channel"]
+  channelName := msg.Channel()
   
-  hostType := data["msg-id"]
+  hostType := tags.MsgID
   
   hostSenderId := ""
   hostSenderDisplay := ""
-  hostSender, exists := users[channelName]
-  if (exists) {
+  if (hostSender != nil) {
     hostSenderId = hostSender.PlatformID
     hostSenderDisplay = hostSender.Display
   }
   
   hostTarget := ""
   
-  if (data["msg-id"] == "host_on") {
+  if (hostType == "host_on") {
     
-    msg := data["message"]
-    hostTarget = ogcl.Substring(msg, 12, len(msg) - 13)
+    hostMsg := msg.Message()
+    hostTarget = ogcl.Substring(hostMsg, 12, len(hostMsg) - 13)
   }
   
   return &(ogdm.Event{
@@ -641,27 +1280,27 @@ func CreateHostEvent(data map[string]string, users map[string]*ogdm.IdentitySlim
     EventCmotes: []string{} })
 }
 
-// Creates a subscriber Event using the provided map.
-func CreateSubEvent(data map[string]string) *ogdm.Event {
-  
-  timeOfEvent := time.Now()
-  subId := data["id"]
-  subType := data["msg-id"]
-  subTier := data["msg-param-sub-plan"]
-  subSenderId := data["user-id"]
-  subSenderLogin := data["login"]
-  subSenderDisplay := data["display-name"]
-  subTargetId, sTP := data["msg-param-recipient-id"]
-  subTargetLogin, _ := data["msg-param-recipient-user-name"]
-  subTargetDisplay, _ := data["msg-param-recipient-display-name"]
-  subChannelId := data["room-id"]
-  subChannelName := data["channel"]
-  subMessage, mP := data["message"]
-  subLengthStr := data["msg-param-months"]
-  
-  subLengthNum, err := strconv.Atoi(subLengthStr)
-  
-  if (err != nil) {
+// Creates a subscriber Event using the provided message.
+func CreateSubEvent(msg *IrcMessage, tags *TwitchTags) *ogdm.Event {
+  
+  timeOfEvent := tags.EventTime()
+  subId := tags.ID
+  subType := tags.MsgID
+  subTier := tags.Param("sub-plan")
+  subSenderId := tags.UserID
+  subSenderLogin := tags.Login
+  subSenderDisplay := tags.DisplayName
+  sTP := tags.HasParam("recipient-id")
+  subTargetId := tags.Param("recipient-id")
+  subTargetLogin := tags.Param("recipient-user-name")
+  subTargetDisplay := tags.Param("recipient-display-name")
+  subChannelId := tags.RoomID
+  subChannelName := msg.Channel()
+  subMessage, mP := msg.Trailing, msg.HasTrailing
+  
+  subLengthNum, lP := tags.ParamInt("months")
+  
+  if (!lP) {
     
     subLengthNum = -1
   }
@@ -674,6 +1313,11 @@ func CreateSubEvent(data map[string]string) *ogdm.Event {
     subTargetLogin = subSenderLogin
     subTargetDisplay = subSenderDisplay
     
+    subSenderId = ""
+    subSenderLogin = ""
+    subSenderDisplay = ""
+  } else if (IsAnonymousGift(tags)) {
+    
     subSenderId = ""
     subSenderLogin = ""
     subSenderDisplay = ""
@@ -700,26 +1344,243 @@ func CreateSubEvent(data map[string]string) *ogdm.Event {
     EventCmotes: []string{} })
 }
 
-// Creates a raid Event using the provided map.
-func CreateRaidEvent(data map[string]string) *ogdm.Event {
+// Static. Returns whether a notice is of a gift given anonymously, which Twitch marks by msg-id or by the "ananonymousgifter" account.
+func IsAnonymousGift(tags *TwitchTags) bool {
+  
+  return (strings.HasPrefix(tags.MsgID, "anon") || tags.Login == "ananonymousgifter")
+}
+
+// Creates a gift Event using the provided message, for a batch of subs gifted to the community.
+// The amount is the size of the batch; each sub also arrives as its own subgift. Anonymous gifts have no sender.
+func CreateGiftEvent(msg *IrcMessage, tags *TwitchTags) *ogdm.Event {
+  
+  timeOfEvent := tags.EventTime()
+  giftId := tags.ID
+  giftType := tags.MsgID
+  giftTier := tags.Param("sub-plan")
+  giftSenderId := tags.UserID
+  giftSenderLogin := tags.Login
+  giftSenderDisplay := tags.DisplayName
+  giftChannelId := tags.RoomID
+  giftChannelName := msg.Channel()
+  
+  giftAmountNum, aP := tags.ParamInt("mass-gift-count")
+  
+  if (!aP) {
+    
+    giftAmountNum = -1
+  }
+  
+  if (IsAnonymousGift(tags)) {
+    
+    giftSenderId = ""
+    giftSenderLogin = ""
+    giftSenderDisplay = ""
+  }
+  
+  return &(ogdm.Event{
+    Time: timeOfEvent,
+    Platform: "twitch",
+    EventID: giftId,
+    EventType: giftType,
+    EventSubtype: giftTier,
+    EventSenderID: giftSenderId,
+    EventSenderLogin: giftSenderLogin,
+    EventSenderDisplay: giftSenderDisplay,
+    EventTargetID: "",
+    EventTargetLogin: "",
+    EventTargetDisplay: "",
+    EventChannelID: giftChannelId,
+    EventChannelName: giftChannelName,
+    EventAmount: giftAmountNum,
+    EventMessage: "",
+    EventCmotes: []string{} })
+}
+
+// Creates an upgrade Event using the provided message, for a gifted sub continued as a paid one.
+// As with a subgift, the target is the subscriber and the sender the original gifter, who Twitch gives without an ID.
+func CreateUpgradeEvent(msg *IrcMessage, tags *TwitchTags) *ogdm.Event {
+  
+  timeOfEvent := tags.EventTime()
+  upgradeId := tags.ID
+  upgradeType := tags.MsgID
+  upgradeSenderLogin := tags.Param("sender-login")
+  upgradeSenderDisplay := tags.Param("sender-name")
+  upgradeTargetId := tags.UserID
+  upgradeTargetLogin := tags.Login
+  upgradeTargetDisplay := tags.DisplayName
+  upgradeChannelId := tags.RoomID
+  upgradeChannelName := msg.Channel()
+  
+  if (IsAnonymousGift(tags)) {
+    
+    upgradeSenderLogin = ""
+    upgradeSenderDisplay = ""
+  }
+  
+  return &(ogdm.Event{
+    Time: timeOfEvent,
+    Platform: "twitch",
+    EventID: upgradeId,
+    EventType: upgradeType,
+    EventSubtype: "",
+    EventSenderID: "",
+    EventSenderLogin: upgradeSenderLogin,
+    EventSenderDisplay: upgradeSenderDisplay,
+    EventTargetID: upgradeTargetId,
+    EventTargetLogin: upgradeTargetLogin,
+    EventTargetDisplay: upgradeTargetDisplay,
+    EventChannelID: upgradeChannelId,
+    EventChannelName: upgradeChannelName,
+    EventAmount: -1,
+    EventMessage: "",
+    EventCmotes: []string{} })
+}
+
+// Creates a pay-forward Event using the provided message, for a viewer who was gifted a sub gifting one in turn.
+// The sender is the viewer and the target whoever they gifted to; a communitypayforward gifts to the community, so has none.
+// The subtype is the login of the gift being paid forward, empty if it was anonymous.
+func CreatePayForwardEvent(msg *IrcMessage, tags *TwitchTags) *ogdm.Event {
+  
+  timeOfEvent := tags.EventTime()
+  forwardId := tags.ID
+  forwardType := tags.MsgID
+  forwardPrior := tags.Param("prior-gifter-user-name")
+  forwardSenderId := tags.UserID
+  forwardSenderLogin := tags.Login
+  forwardSenderDisplay := tags.DisplayName
+  forwardTargetId := tags.Param("recipient-id")
+  forwardTargetLogin := tags.Param("recipient-user-name")
+  forwardTargetDisplay := tags.Param("recipient-display-name")
+  forwardChannelId := tags.RoomID
+  forwardChannelName := msg.Channel()
+  
+  if (tags.Param("prior-gifter-anonymous") == "true") { forwardPrior = "" }
+  
+  return &(ogdm.Event{
+    Time: timeOfEvent,
+    Platform: "twitch",
+    EventID: forwardId,
+    EventType: forwardType,
+    EventSubtype: forwardPrior,
+    EventSenderID: forwardSenderId,
+    EventSenderLogin: forwardSenderLogin,
+    EventSenderDisplay: forwardSenderDisplay,
+    EventTargetID: forwardTargetId,
+    EventTargetLogin: forwardTargetLogin,
+    EventTargetDisplay: forwardTargetDisplay,
+    EventChannelID: forwardChannelId,
+    EventChannelName: forwardChannelName,
+    EventAmount: -1,
+    EventMessage: "",
+    EventCmotes: []string{} })
+}
+
+// Creates a timeout, ban or clear Event using the provided CLEARCHAT message.
+// A timeout has a ban-duration, in seconds, which becomes the amount; a ban has a target but no duration; a clear has neither.
+// The moderator is not given by Twitch, so there is no sender.
+func CreateClearChatEvent(msg *IrcMessage, tags *TwitchTags) *ogdm.Event {
+  
+  timeOfEvent := tags.EventTime()
   
-  timeOfEvent := time.Now()
-  raidId := data["id"]
-  raidType := data["msg-id"]
-  raidAmountStr := data["msg-param-viewerCount"]
-  raidSenderId := data["user-id"]
-  raidSenderLogin := data["login"]
-  raidSenderDisplay := data["display-name"]
-  raidChannelId := data["room-id"]
-  raidChannelName := data["channel"]
+  clearType := "clear"
+  clearTargetId := tags.TargetUserID
+  clearTargetLogin, tP := msg.Trailing, msg.HasTrailing
+  clearChannelId := tags.RoomID
+  clearChannelName := msg.Channel()
   
-  raidAmountNum, err := strconv.Atoi(raidAmountStr)
+  clearDuration, dP := tags.BanDuration, tags.HasBanDuration
   
-  if (err != nil) {
+  if (tP && dP) {
+    
+    clearType = "timeout"
+  } else if (tP) {
+    
+    clearType = "ban"
+  } else {
+    
+    clearTargetLogin = ""
+  }
+  
+  return &(ogdm.Event{
+    Time: timeOfEvent,
+    Platform: "twitch",
+    EventID: "",
+    EventType: clearType,
+    EventSubtype: "",
+    EventSenderID: "",
+    EventSenderLogin: "",
+    EventSenderDisplay: "",
+    EventTargetID: clearTargetId,
+    EventTargetLogin: clearTargetLogin,
+    EventTargetDisplay: "",
+    EventChannelID: clearChannelId,
+    EventChannelName: clearChannelName,
+    EventAmount: clearDuration,
+    EventMessage: "",
+    EventCmotes: []string{} })
+}
+
+// Creates a delete Event using the provided CLEARMSG message. The event's id is the target-msg-id of the deleted message,
+// its target is the message's author, and its message is the deleted text.
+func CreateDeleteEvent(msg *IrcMessage, tags *TwitchTags) *ogdm.Event {
+  
+  timeOfEvent := tags.EventTime()
+  deleteId := tags.TargetMsgID
+  deleteTargetLogin := tags.Login
+  deleteChannelId := tags.RoomID
+  deleteChannelName := msg.Channel()
+  deleteMessage, mP := msg.Trailing, msg.HasTrailing
+  
+  if (!mP) { deleteMessage = "" }
+  
+  return &(ogdm.Event{
+    Time: timeOfEvent,
+    Platform: "twitch",
+    EventID: deleteId,
+    EventType: "delete",
+    EventSubtype: "",
+    EventSenderID: "",
+    EventSenderLogin: "",
+    EventSenderDisplay: "",
+    EventTargetID: "",
+    EventTargetLogin: deleteTargetLogin,
+    EventTargetDisplay: "",
+    EventChannelID: deleteChannelId,
+    EventChannelName: deleteChannelName,
+    EventAmount: 0,
+    EventMessage: deleteMessage,
+    EventCmotes: []string{} })
+}
+
+// Creates a raid Event using the provided message. An unraid is sent in the raiding channel, whose target Twitch does not give,
+// so it has no target and carries the channel instead.
+func CreateRaidEvent(msg *IrcMessage, tags *TwitchTags) *ogdm.Event {
+  
+  timeOfEvent := tags.EventTime()
+  raidId := tags.ID
+  raidType := tags.MsgID
+  raidSenderId := tags.UserID
+  raidSenderLogin := tags.Login
+  raidSenderDisplay := tags.DisplayName
+  raidTargetId := tags.RoomID
+  raidTargetLogin := msg.Channel()
+  raidChannelId := ""
+  raidChannelName := ""
+  
+  raidAmountNum, aP := tags.ParamInt("viewerCount")
+  
+  if (!aP) {
     
     raidAmountNum = -1
   }
   
+  if (raidType == "unraid") {
+    
+    raidChannelId, raidTargetId = raidTargetId, ""
+    raidChannelName, raidTargetLogin = raidTargetLogin, ""
+  }
+  
   return &(ogdm.Event{
     Time: timeOfEvent,
     Platform: "twitch",
@@ -729,28 +1590,28 @@ func CreateRaidEvent(data map[string]string) *ogdm.Event {
     EventSenderID: raidSenderId,
     EventSenderLogin: raidSenderLogin,
     EventSenderDisplay: raidSenderDisplay,
-    EventTargetID: raidChannelId,
-    EventTargetLogin: raidChannelName,
+    EventTargetID: raidTargetId,
+    EventTargetLogin: raidTargetLogin,
     EventTargetDisplay: "",
-    EventChannelID: "",
-    EventChannelName: "",
+    EventChannelID: raidChannelId,
+    EventChannelName: raidChannelName,
     EventAmount: raidAmountNum,
     EventMessage: "",
     EventCmotes: []string{} })
 }
 
-// Creates a ritual Event using the provided map.
-func CreateRitualEvent(data map[string]string) *ogdm.Event {
-  
-  timeOfEvent := time.Now()
-  ritualId := data["id"]
-  ritualType := data["msg-id"]
-  ritualName := data["msg-param-ritual-name"]
-  ritualSenderId := data["user-id"]
-  ritualSenderLogin := data["login"]
-  ritualSenderDisplay := data["display-name"]
-  ritualChannelId := data["room-id"]
-  ritualChannelName := data["channel"]
+// Creates a ritual Event using the provided message.
+func CreateRitualEvent(msg *IrcMessage, tags *TwitchTags) *ogdm.Event {
+  
+  timeOfEvent := tags.EventTime()
+  ritualId := tags.ID
+  ritualType := tags.MsgID
+  ritualName := tags.Param("ritual-name")
+  ritualSenderId := tags.UserID
+  ritualSenderLogin := tags.Login
+  ritualSenderDisplay := tags.DisplayName
+  ritualChannelId := tags.RoomID
+  ritualChannelName := msg.Channel()
   
   return &(ogdm.Event{
     Time: timeOfEvent,
@@ -771,19 +1632,78 @@ func CreateRitualEvent(data map[string]string) *ogdm.Event {
     EventCmotes: []string{} })
 }
 
-// Parses a raw string message into a map.
-func ParseMessage(raw string) map[string]string {
+// Creates a charity donation Event using the provided message. The amount is in the currency's minor units, as Twitch gives it
+// with msg-param-exponent decimal places, the subtype is the currency and the message the charity's name.
+func CreateCharityEvent(msg *IrcMessage, tags *TwitchTags) *ogdm.Event {
+  
+  timeOfEvent := tags.EventTime()
+  charityId := tags.ID
+  charityType := tags.MsgID
+  charityCurrency := tags.Param("donation-currency")
+  charityName := tags.Param("charity-name")
+  charitySenderId := tags.UserID
+  charitySenderLogin := tags.Login
+  charitySenderDisplay := tags.DisplayName
+  charityChannelId := tags.RoomID
+  charityChannelName := msg.Channel()
+  
+  charityAmountNum, aP := tags.ParamInt("donation-amount")
+  
+  if (!aP) {
+    
+    charityAmountNum = -1
+  }
   
-  m := make(map[string]string)
-  theSplit := strings.Split(raw, " :")
-  pairs := strings.Split(theSplit[0], ";")
-  m["username"] = strings.Split(theSplit[1], "!")[0]
-  m["channel"] = strings.Split(theSplit[1], "#")[1]
-  if (len(theSplit) == 3) { m["message"] = theSplit[2] }
+  return &(ogdm.Event{
+    Time: timeOfEvent,
+    Platform: "twitch",
+    EventID: charityId,
+    EventType: charityType,
+    EventSubtype: charityCurrency,
+    EventSenderID: charitySenderId,
+    EventSenderLogin: charitySenderLogin,
+    EventSenderDisplay: charitySenderDisplay,
+    EventTargetID: "",
+    EventTargetLogin: "",
+    EventTargetDisplay: "",
+    EventChannelID: charityChannelId,
+    EventChannelName: charityChannelName,
+    EventAmount: charityAmountNum,
+    EventMessage: charityName,
+    EventCmotes: []string{} })
+}
+
+// Creates an Event of the given type, subtype and amount using the provided message, for notices that only need those:
+// announcements, bits badge tiers, reward gifts, viewer milestones, and unknown msg-ids, which are typed "usernotice"
+// with the msg-id as their subtype. The sender is the viewer the notice is about and the message their chat message, if any.
+func CreateNoticeEvent(msg *IrcMessage, tags *TwitchTags, noticeType, noticeSubtype string, noticeAmount int) *ogdm.Event {
+  
+  timeOfEvent := tags.EventTime()
+  noticeId := tags.ID
+  noticeSenderId := tags.UserID
+  noticeSenderLogin := tags.Login
+  noticeSenderDisplay := tags.DisplayName
+  noticeChannelId := tags.RoomID
+  noticeChannelName := msg.Channel()
+  noticeMessage, mP := msg.Trailing, msg.HasTrailing
+  
+  if (!mP) { noticeMessage = "" }
   
-  for i := 0; i < len(pairs); i++ {
-    p := strings.Split(pairs[i], "=")
-    if (len(p) == 2) { m[p[0]] = p[1] }
-  }
-  return m
+  return &(ogdm.Event{
+    Time: timeOfEvent,
+    Platform: "twitch",
+    EventID: noticeId,
+    EventType: noticeType,
+    EventSubtype: noticeSubtype,
+    EventSenderID: noticeSenderId,
+    EventSenderLogin: noticeSenderLogin,
+    EventSenderDisplay: noticeSenderDisplay,
+    EventTargetID: "",
+    EventTargetLogin: "",
+    EventTargetDisplay: "",
+    EventChannelID: noticeChannelId,
+    EventChannelName: noticeChannelName,
+    EventAmount: noticeAmount,
+    EventMessage: noticeMessage,
+    EventCmotes: []string{} })
 }
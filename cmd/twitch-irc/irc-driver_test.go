@@ -0,0 +1,619 @@
+/*
+*
+* Name:     Twitch IRC Listener
+* Sys Name: twitch-irc
+* Author:   Nifty255
+*
+*/
+
+package main
+
+import (
+  "sync"                          // Mutual exclusion locks.
+  "time"                          // Timing related functions.
+  "errors"                        // Error creation functions.
+  "strconv"                       // String conversion functions.
+  "strings"                       // String manipulation functions.
+  "testing"                       // Go's testing framework.
+  "sync/atomic"                   // Atomic primitives.
+  "path/filepath"                 // File path manipulation functions.
+  "encoding/json"                 // JSON encoding functions.
+  "github.com/koding/kite"        // Microservice functions and structures.
+  "github.com/koding/kite/dnode"  // Kite argument structures.
+  "github.com/thoj/go-ircevent"   // IRC client functions and structures.
+  "github.com/the-opera-house/go-chat-bot/cmd/twitch-irc/faketmi"
+  ogdm "github.com/the-opera-house/go-common-lib/models"
+)
+
+// Specifies a sink that keeps everything delivered to it, for asserting on what the driver sends.
+// While Down is set it is not ready, and the next Failures sends fail.
+type CaptureSink struct {
+  
+  Events   []*ogdm.Event
+  Chat     []string
+  Down     atomic.Bool
+  Failures atomic.Int32
+  Lock     sync.Mutex
+}
+
+func (c *CaptureSink) SendEvent(e *ogdm.Event) error {
+  
+  if (c.Failures.Add(-1) >= 0) { return errors.New("Capture sink failed.") }
+  
+  c.Lock.Lock()
+  defer c.Lock.Unlock()
+  
+  c.Events = append(c.Events, e)
+  
+  return nil
+}
+
+func (c *CaptureSink) SendChat(raw string) error {
+  
+  if (c.Failures.Add(-1) >= 0) { return errors.New("Capture sink failed.") }
+  
+  c.Lock.Lock()
+  defer c.Lock.Unlock()
+  
+  c.Chat = append(c.Chat, raw)
+  
+  return nil
+}
+
+func (c *CaptureSink) Ready() bool  { return !c.Down.Load() }
+func (c *CaptureSink) Close() error { return nil }
+
+// CaptureSink. Returns the delivered events of the given type.
+func (c *CaptureSink) EventsOfType(eventType string) []*ogdm.Event {
+  
+  c.Lock.Lock()
+  defer c.Lock.Unlock()
+  
+  events := make([]*ogdm.Event, 0)
+  for ind := 0; ind < len(c.Events); ind++ {
+    
+    if (c.Events[ind].EventType == eventType) { events = append(events, c.Events[ind]) }
+  }
+  
+  return events
+}
+
+// CaptureSink. Returns how many chat lines were delivered.
+func (c *CaptureSink) ChatCount() int {
+  
+  c.Lock.Lock()
+  defer c.Lock.Unlock()
+  
+  return len(c.Chat)
+}
+
+// Starts a fake TMI server and a primary driver that delivers to a CaptureSink, as main would.
+// Each configure func may change the config before the driver is created.
+// The driver is shut down and the globals restored when the test ends.
+func startTestDriver(t *testing.T, configure ...func(c *Config)) (*faketmi.Server, *CaptureSink) {
+  
+  t.Helper()
+  
+  return startTestDriverOver(t, false, configure...)
+}
+
+// As startTestDriver, with the fake server and the driver's connections using TLS if useTLS is set.
+func startTestDriverOver(t *testing.T, useTLS bool, configure ...func(c *Config)) (*faketmi.Server, *CaptureSink) {
+  
+  t.Helper()
+  
+  srv, err := faketmi.New(useTLS)
+  if (err != nil) { t.Fatal(err) }
+  
+  sink := &CaptureSink{}
+  RegisterSink("capture", func(c ConfigSink) (interface{}, error) { return sink, nil })
+  
+  savedConfig, savedDriver, savedCloser := config, ircDriver, closer
+  
+  config = DefaultConfig()
+  config.Twitch = ConfigTwitch{ Address: srv.Addr, UseTLS: useTLS, InsecureSkipVerify: useTLS }
+  config.Election.Enabled = false
+  config.Sinks = ConfigSinks{ Events: []ConfigSink{ { Type: "capture" } }, Chat: []ConfigSink{ { Type: "capture" } } }
+  closer = make(chan int, 1)
+  
+  for ind := 0; ind < len(configure); ind++ { configure[ind](config) }
+  
+  driver, err := CreateIrcDriver(nil, kite.New("twitch-irc-test", "1.0.0"))
+  if (err != nil) {
+    
+    srv.Close()
+    delete(SinkFactories, "capture")
+    config, ircDriver, closer = savedConfig, savedDriver, savedCloser
+    t.Fatal(err)
+  }
+  
+  ircDriver = driver
+  ircDriver.IsPrimary.Store(true)
+  
+  t.Cleanup(func() {
+    
+    if (!ircDriver.ShuttingDown.Load()) { ircDriver.Shutdown(2 * time.Second) }
+    srv.Close()
+    delete(SinkFactories, "capture")
+    config, ircDriver, closer = savedConfig, savedDriver, savedCloser
+  })
+  
+  return srv, sink
+}
+
+// Builds a kite request whose single argument is the given value.
+func kiteRequest(t *testing.T, arg interface{}) *kite.Request {
+  
+  t.Helper()
+  
+  raw, err := json.Marshal([]interface{}{ arg })
+  if (err != nil) { t.Fatal(err) }
+  
+  return &(kite.Request{ Args: &(dnode.Partial{ Raw: raw }) })
+}
+
+// Returns n channels named prefix0, prefix1, ... with platform IDs starting at firstID.
+func testChannels(prefix string, n int, firstID int) []ogdm.IdentitySlim {
+  
+  channels := make([]ogdm.IdentitySlim, n)
+  for ind := 0; ind < n; ind++ {
+    
+    channels[ind] = ogdm.IdentitySlim{ Platform: "twitch", Login: prefix + strconv.Itoa(ind), PlatformID: strconv.Itoa(firstID + ind) }
+  }
+  
+  return channels
+}
+
+// Returns the logins of the given channels.
+func channelLogins(channels []ogdm.IdentitySlim) []string {
+  
+  logins := make([]string, len(channels))
+  for ind := 0; ind < len(channels); ind++ { logins[ind] = channels[ind].Login }
+  
+  return logins
+}
+
+// Listens to the given channels through the kite handler and waits until the fake server has seen every join.
+func listenAndWait(t *testing.T, srv *faketmi.Server, channels []ogdm.IdentitySlim) {
+  
+  t.Helper()
+  
+  if _, err := ListenToChannels(kiteRequest(t, channels)); err != nil { t.Fatal(err) }
+  if err := srv.WaitForJoins(channelLogins(channels), 10 * time.Second); err != nil { t.Fatal(err) }
+}
+
+// Waits until the sink has received count events of the given type and returns them.
+func waitForEvents(t *testing.T, srv *faketmi.Server, sink *CaptureSink, eventType string, count int) []*ogdm.Event {
+  
+  t.Helper()
+  
+  if err := srv.WaitFor(func() bool { return len(sink.EventsOfType(eventType)) >= count }, 5 * time.Second); err != nil {
+    
+    t.Fatalf("%s events = %d, want %d: %v", eventType, len(sink.EventsOfType(eventType)), count, err)
+  }
+  
+  return sink.EventsOfType(eventType)
+}
+
+// Runs the driver's message handling, kite handlers and tickers all at once. Run with -race.
+func TestDriverConcurrentLoad(t *testing.T) {
+  
+  srv, sink := startTestDriver(t)
+  
+  stable := testChannels("stable", 4, 100)
+  churn := testChannels("churn", 2, 200)
+  
+  listenAndWait(t, srv, append(append([]ogdm.IdentitySlim{}, stable...), churn...))
+  
+  stop := make(chan struct{})
+  var wg, senders sync.WaitGroup
+  
+  // Runs fn repeatedly, without pause, until stop is closed.
+  loop := func(fn func(n int)) {
+    
+    wg.Add(1)
+    go func() {
+      
+      defer wg.Done()
+      for n := 0; ; n++ {
+        
+        select {
+          case <- stop: return
+          default:
+        }
+        
+        fn(n)
+      }
+    }()
+  }
+  
+  // Messages from the server, through the listeners' read loops, as fast as several senders can write them.
+  const sending, perSender = 4, 1500
+  for g := 0; g < sending; g++ {
+    
+    senders.Add(1)
+    go func(g int) {
+      
+      defer senders.Done()
+      for n := 0; n < perSender; n++ {
+        
+        channel := stable[n % len(stable)]
+        tags := "bits=10;display-name=Viewer;id=srv-" + strconv.Itoa(g) + "-" + strconv.Itoa(n) + ";room-id=" + channel.PlatformID + ";user-id=" + strconv.Itoa(n % 7)
+        srv.Privmsg(channel.Login, "viewer", tags, "cheer10 hello")
+      }
+    }(g)
+  }
+  
+  // Messages handed straight to the listeners, racing the read loops.
+  loop(func(n int) {
+    
+    listeners := ircDriver.ListenerPool.Snapshot()
+    for ind := 0; ind < len(listeners); ind++ {
+      
+      raw := "@id=direct-" + strconv.Itoa(n) + ";room-id=100;user-id=" + strconv.Itoa(n % 5) + " :viewer!viewer@viewer.tmi.twitch.tv PRIVMSG #stable0 :hi"
+      listeners[ind].OnMessage(&(irc.Event{ Code: "PRIVMSG", Raw: raw }))
+    }
+  })
+  
+  // Kite handlers.
+  loop(func(n int) {
+    
+    ReadyCheck(nil)
+    ListenerStatusCheck(nil)
+    BufferStatusCheck(nil)
+    PrimaryCheck(nil)
+    ChannelStateCheck(kiteRequest(t, stable[n % len(stable)].Login))
+  })
+  
+  // Channels coming and going, directly and through kite.
+  loop(func(n int) {
+    
+    channel := churn[n % len(churn)]
+    
+    switch(n % 4) {
+      case 0: ircDriver.PartChannel(channel.Login)
+      case 1: ircDriver.ListenToChannel(&channel)
+      case 2: PartChannels(kiteRequest(t, churn))
+      case 3: ListenToChannels(kiteRequest(t, churn))
+    }
+  })
+  
+  // What the tickers do.
+  loop(func(n int) {
+    
+    ircDriver.FlushChatters()
+    ircDriver.PruneListeners()
+    
+    listeners := ircDriver.ListenerPool.Snapshot()
+    for ind := 0; ind < len(listeners); ind++ { listeners[ind].JoinNext() }
+  })
+  
+  senders.Wait()
+  close(stop)
+  wg.Wait()
+  
+  // Every message the server sent is delivered once, however hard it was pressed.
+  delivered := func() int {
+    
+    count := 0
+    bits := sink.EventsOfType("bits")
+    for ind := 0; ind < len(bits); ind++ {
+      
+      if (strings.HasPrefix(bits[ind].EventID, "srv-")) { count++ }
+    }
+    
+    return count
+  }
+  
+  if err := srv.WaitFor(func() bool { return delivered() >= sending * perSender }, 10 * time.Second); err != nil { t.Errorf("bits delivered = %d, want %d", delivered(), sending * perSender) }
+  if got := delivered(); got != sending * perSender { t.Errorf("bits delivered = %d, want each of the %d once", got, sending * perSender) }
+  
+  done := make(chan bool, 1)
+  go func() { done <- ircDriver.Shutdown(5 * time.Second) }()
+  
+  select {
+    case <- done:
+    case <- time.After(10 * time.Second):
+    t.Fatal("Shutdown did not return.")
+  }
+}
+
+func TestDriverJoinsAndRequestsCapabilities(t *testing.T) {
+  
+  srv, _ := startTestDriver(t)
+  
+  listenAndWait(t, srv, testChannels("dallas", 3, 100))
+  
+  caps := strings.Join(srv.LinesWithCommand("CAP"), " ")
+  if (!strings.Contains(caps, "twitch.tv/tags") || !strings.Contains(caps, "twitch.tv/commands")) { t.Errorf("CAP lines = %q, want tags and commands requested", caps) }
+  
+  status := ircDriver.ListenerPool.Status()
+  if (len(status) != 1 || status[0].State != ListenerJoined.String() || status[0].Joined != 3) { t.Errorf("listeners = %+v, want one joined to 3 channels", status) }
+  
+  // Channels already listened to are not joined again.
+  if _, err := ListenToChannels(kiteRequest(t, testChannels("dallas", 1, 100))); err != nil { t.Fatal(err) }
+  time.Sleep(200 * time.Millisecond)
+  
+  if joins := srv.LinesWithCommand("JOIN"); strings.Count(strings.Join(joins, ","), "#") != 3 { t.Errorf("JOIN lines = %q, want each channel joined once", joins) }
+}
+
+func TestDriverOverTLS(t *testing.T) {
+  
+  srv, sink := startTestDriverOver(t, true)
+  
+  listenAndWait(t, srv, testChannels("dallas", 2, 100))
+  
+  srv.Privmsg("dallas1", "ronni", "display-name=Ronni;id=msg-1;room-id=101;user-id=9", "hello over tls")
+  
+  if err := srv.WaitFor(func() bool { return sink.ChatCount() == 1 }, 5 * time.Second); err != nil { t.Fatalf("chat lines = %d, want the message delivered", sink.ChatCount()) }
+  
+  status := ircDriver.ListenerPool.Status()
+  if (len(status) != 1 || status[0].State != ListenerJoined.String() || status[0].Joined != 2) { t.Errorf("listeners = %+v, want one joined to 2 channels", status) }
+}
+
+func TestDriverLogsInAsAccount(t *testing.T) {
+  
+  o := startTestOAuth(t)
+  
+  access, refresh := o.Issue("nifty_bot", "1234", time.Hour, "chat:read", "chat:edit")
+  
+  dir := t.TempDir()
+  account := ConfigAccount{ Login: "nifty_bot", TokenFile: filepath.Join(dir, "token"), RefreshTokenFile: filepath.Join(dir, "refresh") }
+  if err := SaveSecret(account.TokenFile, access); err != nil { t.Fatal(err) }
+  if err := SaveSecret(account.RefreshTokenFile, refresh); err != nil { t.Fatal(err) }
+  
+  auth := config.Auth
+  auth.Accounts = []ConfigAccount{ account }
+  auth.RequireAccount = true
+  
+  srv, _ := startTestDriver(t, func(c *Config) { c.Auth = auth })
+  
+  // Only the account's own token gets in; an anonymous login would be let through.
+  srv.Lock.Lock()
+  srv.Authenticate = func(nick, password string) bool { return !strings.HasPrefix(nick, "justinfan") && o.Check(nick, password) }
+  srv.Lock.Unlock()
+  
+  listenAndWait(t, srv, testChannels("dallas", 1, 100))
+  
+  clients := srv.ConnectedClients()
+  if (len(clients) != 1) { t.Fatalf("connected clients = %d, want 1", len(clients)) }
+  
+  clients[0].Lock.Lock()
+  nick, password := clients[0].Nick, clients[0].Password
+  clients[0].Lock.Unlock()
+  
+  if (nick != "nifty_bot" || password != "oauth:" + access) { t.Errorf("logged in as %q with %q, want nifty_bot with its token", nick, password) }
+  
+  // The authenticated listener can speak.
+  result, err := ircDriver.Say(SayRequest{ Channel: "dallas0", Message: "hello" })
+  if (err != nil || result.Account != "nifty_bot") { t.Errorf("Say = %+v, %v, want it sent as nifty_bot", result, err) }
+}
+
+func TestDriverDeliversPrivmsg(t *testing.T) {
+  
+  srv, sink := startTestDriver(t)
+  
+  listenAndWait(t, srv, testChannels("dallas", 1, 100))
+  
+  srv.Privmsg("dallas0", "ronni", "display-name=Ronni;id=msg-1;room-id=100;user-id=9", "hello")
+  srv.Privmsg("dallas0", "ronni", "bits=150;display-name=Ronni;id=msg-2;room-id=100;user-id=9", "cheer100 Kappa cheer50")
+  
+  bits := waitForEvents(t, srv, sink, "bits", 1)
+  
+  e := bits[0]
+  if (e.EventID != "msg-2" || e.EventAmount != 150 || e.EventChannelID != "100" || e.EventChannelName != "dallas0") { t.Errorf("bits event = %+v", e) }
+  if (e.EventSenderID != "9" || e.EventSenderLogin != "ronni" || e.EventSenderDisplay != "Ronni") { t.Errorf("bits sender = %q %q %q", e.EventSenderID, e.EventSenderLogin, e.EventSenderDisplay) }
+  if (len(e.EventCmotes) != 2 || e.EventCmotes[0] != "cheer100" || e.EventCmotes[1] != "cheer50") { t.Errorf("cheermotes = %q", e.EventCmotes) }
+  
+  // Every message reaches the Chat Handler, bits or not.
+  if err := srv.WaitFor(func() bool { return sink.ChatCount() == 2 }, 5 * time.Second); err != nil { t.Errorf("chat lines = %d, want 2", sink.ChatCount()) }
+}
+
+// Returns how many observations a histogram series has.
+func observations(m *MetricFamily, values ...string) uint64 {
+  
+  m.Lock.Lock()
+  defer m.Lock.Unlock()
+  
+  return m.Get(values).Count
+}
+
+func TestDriverTimesEveryMessage(t *testing.T) {
+  
+  srv, sink := startTestDriver(t)
+  
+  listenAndWait(t, srv, testChannels("dallas", 1, 100))
+  
+  parsed, enqueued, traced := observations(StageLatency, StageParse), observations(StageLatency, StageEnqueue), observations(TraceLatency, StageParse)
+  sentAt := strconv.FormatInt(time.Now().UnixNano() / int64(time.Millisecond), 10)
+  
+  srv.Privmsg("dallas0", "ronni", "display-name=Ronni;id=msg-1;room-id=100;tmi-sent-ts=" + sentAt + ";user-id=9", "hello")
+  srv.Privmsg("dallas0", "ronni", "display-name=Ronni;id=msg-2;room-id=100;tmi-sent-ts=" + sentAt + ";user-id=9", "hello again")
+  
+  if err := srv.WaitFor(func() bool { return sink.ChatCount() == 2 }, 5 * time.Second); err != nil { t.Fatalf("chat lines = %d, want 2", sink.ChatCount()) }
+  
+  // Ordinary messages are timed at each stage; only probes feed the trace.
+  if got := observations(StageLatency, StageParse) - parsed; got != 2 { t.Errorf("parse observations = %d, want 2", got) }
+  if got := observations(StageLatency, StageEnqueue) - enqueued; got != 2 { t.Errorf("enqueue observations = %d, want 2", got) }
+  if got := observations(TraceLatency, StageParse) - traced; got != 0 { t.Errorf("trace observations = %d, want none for ordinary messages", got) }
+}
+
+func TestDriverTypesEveryUserNotice(t *testing.T) {
+  
+  srv, sink := startTestDriver(t)
+  
+  listenAndWait(t, srv, testChannels("dallas", 1, 100))
+  
+  viewer := "display-name=Ronni;login=ronni;room-id=100;user-id=9;"
+  anonymous := "display-name=AnAnonymousGifter;login=ananonymousgifter;room-id=100;user-id=274598607;"
+  
+  cases := []struct {
+    
+    tags    string
+    message string
+    want    ogdm.Event
+  }{
+    { "display-name=Gifter;login=gifter;room-id=100;user-id=8;id=n-1;msg-id=submysterygift;msg-param-mass-gift-count=5;msg-param-sub-plan=1000", "",
+      ogdm.Event{ EventID: "n-1", EventType: "submysterygift", EventSubtype: "1000", EventSenderLogin: "gifter", EventChannelName: "dallas0", EventAmount: 5 } },
+    { anonymous + "id=n-2;msg-id=anonsubgift;msg-param-months=1;msg-param-recipient-display-name=Ronni;msg-param-recipient-id=9;msg-param-recipient-user-name=ronni;msg-param-sub-plan=1000", "",
+      ogdm.Event{ EventID: "n-2", EventType: "anonsubgift", EventSubtype: "1000", EventTargetID: "9", EventTargetLogin: "ronni", EventChannelName: "dallas0", EventAmount: 1 } },
+    { anonymous + "id=n-3;msg-id=anonsubmysterygift;msg-param-mass-gift-count=10;msg-param-sub-plan=2000", "",
+      ogdm.Event{ EventID: "n-3", EventType: "anonsubmysterygift", EventSubtype: "2000", EventChannelName: "dallas0", EventAmount: 10 } },
+    { viewer + "id=n-4;msg-id=giftpaidupgrade;msg-param-sender-login=gifter;msg-param-sender-name=Gifter", "",
+      ogdm.Event{ EventID: "n-4", EventType: "giftpaidupgrade", EventSenderLogin: "gifter", EventTargetID: "9", EventTargetLogin: "ronni", EventChannelName: "dallas0", EventAmount: -1 } },
+    { viewer + "id=n-5;msg-id=anongiftpaidupgrade", "",
+      ogdm.Event{ EventID: "n-5", EventType: "anongiftpaidupgrade", EventTargetID: "9", EventTargetLogin: "ronni", EventChannelName: "dallas0", EventAmount: -1 } },
+    { viewer + "id=n-6;msg-id=primepaidupgrade;msg-param-sub-plan=1000", "",
+      ogdm.Event{ EventID: "n-6", EventType: "primepaidupgrade", EventSubtype: "1000", EventTargetID: "9", EventTargetLogin: "ronni", EventChannelName: "dallas0", EventAmount: -1 } },
+    { viewer + "id=n-7;msg-id=rewardgift;msg-param-domain=pride_megacommerce_2020;msg-param-selected-count=5", "",
+      ogdm.Event{ EventID: "n-7", EventType: "rewardgift", EventSubtype: "pride_megacommerce_2020", EventSenderLogin: "ronni", EventChannelName: "dallas0", EventAmount: 5 } },
+    { viewer + "id=n-8;msg-id=bitsbadgetier;msg-param-threshold=1000", "cheered!",
+      ogdm.Event{ EventID: "n-8", EventType: "bitsbadgetier", EventSenderLogin: "ronni", EventChannelName: "dallas0", EventAmount: 1000, EventMessage: "cheered!" } },
+    { viewer + "id=n-9;msg-id=announcement;msg-param-color=PRIMARY", "Hello all",
+      ogdm.Event{ EventID: "n-9", EventType: "announcement", EventSubtype: "PRIMARY", EventSenderLogin: "ronni", EventChannelName: "dallas0", EventAmount: -1, EventMessage: "Hello all" } },
+    { viewer + "id=n-10;msg-id=standardpayforward;msg-param-prior-gifter-anonymous=false;msg-param-prior-gifter-user-name=gifter;" +
+      "msg-param-recipient-display-name=Dallas;msg-param-recipient-id=12;msg-param-recipient-user-name=dallas", "",
+      ogdm.Event{ EventID: "n-10", EventType: "standardpayforward", EventSubtype: "gifter", EventSenderLogin: "ronni", EventTargetID: "12", EventTargetLogin: "dallas", EventChannelName: "dallas0", EventAmount: -1 } },
+    { viewer + "id=n-11;msg-id=communitypayforward;msg-param-prior-gifter-anonymous=true;msg-param-prior-gifter-user-name=ananonymousgifter", "",
+      ogdm.Event{ EventID: "n-11", EventType: "communitypayforward", EventSenderLogin: "ronni", EventChannelName: "dallas0", EventAmount: -1 } },
+    { "display-name=Raider;login=raider;room-id=100;user-id=7;id=n-12;msg-id=raid;msg-param-viewerCount=42", "",
+      ogdm.Event{ EventID: "n-12", EventType: "raid", EventSenderLogin: "raider", EventTargetID: "100", EventTargetLogin: "dallas0", EventAmount: 42 } },
+    { "display-name=Dallas0;login=dallas0;room-id=100;user-id=100;id=n-13;msg-id=unraid", "",
+      ogdm.Event{ EventID: "n-13", EventType: "unraid", EventSenderLogin: "dallas0", EventChannelID: "100", EventChannelName: "dallas0", EventAmount: -1 } },
+    { viewer + "id=n-14;msg-id=ritual;msg-param-ritual-name=new_chatter", "HeyGuys",
+      ogdm.Event{ EventID: "n-14", EventType: "ritual", EventSubtype: "new_chatter", EventSenderLogin: "ronni", EventChannelName: "dallas0", EventAmount: -1 } },
+    { viewer + "id=n-15;msg-id=viewermilestone;msg-param-category=watch-streak;msg-param-value=7", "7 streams!",
+      ogdm.Event{ EventID: "n-15", EventType: "viewermilestone", EventSubtype: "watch-streak", EventSenderLogin: "ronni", EventChannelName: "dallas0", EventAmount: 7, EventMessage: "7 streams!" } },
+    { viewer + "id=n-16;msg-id=charitydonation;msg-param-charity-name=Turtles;msg-param-donation-amount=5000;msg-param-donation-currency=USD;msg-param-exponent=2", "",
+      ogdm.Event{ EventID: "n-16", EventType: "charitydonation", EventSubtype: "USD", EventSenderLogin: "ronni", EventChannelName: "dallas0", EventAmount: 5000, EventMessage: "Turtles" } },
+    
+    // A msg-id without a type of its own is still forwarded, as a generic notice.
+    { viewer + "id=n-17;msg-id=somethingnew", "surprise",
+      ogdm.Event{ EventID: "n-17", EventType: "usernotice", EventSubtype: "somethingnew", EventSenderLogin: "ronni", EventChannelName: "dallas0", EventAmount: -1, EventMessage: "surprise" } },
+  }
+  
+  for ind := 0; ind < len(cases); ind++ { srv.UserNotice("dallas0", cases[ind].tags, cases[ind].message) }
+  
+  for ind := 0; ind < len(cases); ind++ {
+    
+    want := cases[ind].want
+    got := waitForEvents(t, srv, sink, want.EventType, 1)[0]
+    
+    if (got.EventID != want.EventID || got.EventSubtype != want.EventSubtype || got.EventAmount != want.EventAmount || got.EventMessage != want.EventMessage) {
+      
+      t.Errorf("%s: event %s subtype %q amount %d message %q, want %s %q %d %q", want.EventType, got.EventID, got.EventSubtype, got.EventAmount, got.EventMessage,
+        want.EventID, want.EventSubtype, want.EventAmount, want.EventMessage)
+    }
+    
+    if (got.EventSenderLogin != want.EventSenderLogin || got.EventTargetLogin != want.EventTargetLogin || got.EventTargetID != want.EventTargetID) {
+      
+      t.Errorf("%s: sender %q target %q (%q), want %q %q (%q)", want.EventType, got.EventSenderLogin, got.EventTargetLogin, got.EventTargetID,
+        want.EventSenderLogin, want.EventTargetLogin, want.EventTargetID)
+    }
+    
+    if (got.EventChannelName != want.EventChannelName || (want.EventChannelID != "" && got.EventChannelID != want.EventChannelID)) {
+      
+      t.Errorf("%s: channel %q (%q), want %q (%q)", want.EventType, got.EventChannelName, got.EventChannelID, want.EventChannelName, want.EventChannelID)
+    }
+  }
+}
+
+func TestDriverReportsEveryRoomModeChange(t *testing.T) {
+  
+  srv, sink := startTestDriver(t)
+  
+  listenAndWait(t, srv, testChannels("dallas", 1, 100))
+  
+  srv.Broadcast("dallas0", "@emote-only=0;followers-only=-1;r9k=0;room-id=100;slow=0;subs-only=0 :tmi.twitch.tv ROOMSTATE #dallas0")
+  
+  // Toggled back and forth within the dedup window, each change is its own event.
+  for _, slow := range []string{ "30", "0", "30" } { srv.Broadcast("dallas0", "@room-id=100;slow=" + slow + " :tmi.twitch.tv ROOMSTATE #dallas0") }
+  
+  modes := waitForEvents(t, srv, sink, "room-mode", 3)
+  
+  for ind, want := range []int{ 30, 0, 30 } {
+    
+    if (modes[ind].EventSubtype != "slow" || modes[ind].EventAmount != want) { t.Errorf("room-mode event %d = %s %d, want slow %d", ind, modes[ind].EventSubtype, modes[ind].EventAmount, want) }
+  }
+}
+
+func TestDriverDeliversUserNotice(t *testing.T) {
+  
+  srv, sink := startTestDriver(t)
+  
+  listenAndWait(t, srv, testChannels("dallas", 1, 100))
+  
+  srv.UserNotice("dallas0", "display-name=Ronni;id=sub-1;login=ronni;msg-id=resub;msg-param-cumulative-months=6;msg-param-months=6;msg-param-sub-plan=1000;room-id=100;user-id=9", "six months")
+  srv.UserNotice("dallas0", "display-name=Gifter;id=gift-1;login=gifter;msg-id=subgift;msg-param-months=1;msg-param-recipient-display-name=Ronni;" +
+    "msg-param-recipient-id=9;msg-param-recipient-user-name=ronni;msg-param-sub-plan=2000;room-id=100;user-id=8", "")
+  
+  resub := waitForEvents(t, srv, sink, "resub", 1)[0]
+  
+  if (resub.EventID != "sub-1" || resub.EventSubtype != "1000" || resub.EventAmount != 6 || resub.EventMessage != "six months") { t.Errorf("resub event = %+v", resub) }
+  if (resub.EventTargetLogin != "ronni" || resub.EventSenderLogin != "") { t.Errorf("resub target %q sender %q, want the subscriber as target", resub.EventTargetLogin, resub.EventSenderLogin) }
+  
+  gift := waitForEvents(t, srv, sink, "subgift", 1)[0]
+  
+  if (gift.EventSenderLogin != "gifter" || gift.EventTargetID != "9" || gift.EventTargetLogin != "ronni" || gift.EventSubtype != "2000") { t.Errorf("subgift event = %+v", gift) }
+  
+  // Only the notice with a message is forwarded as chat.
+  if err := srv.WaitFor(func() bool { return sink.ChatCount() == 1 }, 5 * time.Second); err != nil { t.Errorf("chat lines = %d, want 1", sink.ChatCount()) }
+}
+
+func TestDriverDeliversClearChat(t *testing.T) {
+  
+  srv, sink := startTestDriver(t)
+  
+  listenAndWait(t, srv, testChannels("dallas", 1, 100))
+  
+  srv.ClearChat("dallas0", "ban-duration=600;room-id=100;target-user-id=9;tmi-sent-ts=1642715756806", "ronni")
+  srv.ClearChat("dallas0", "room-id=100;target-user-id=8;tmi-sent-ts=1642715756807", "spammer")
+  srv.ClearChat("dallas0", "room-id=100;tmi-sent-ts=1642715756808", "")
+  
+  timeout := waitForEvents(t, srv, sink, "timeout", 1)[0]
+  if (timeout.EventTargetID != "9" || timeout.EventTargetLogin != "ronni" || timeout.EventAmount != 600 || timeout.EventChannelID != "100") { t.Errorf("timeout event = %+v", timeout) }
+  
+  ban := waitForEvents(t, srv, sink, "ban", 1)[0]
+  if (ban.EventTargetID != "8" || ban.EventTargetLogin != "spammer") { t.Errorf("ban event = %+v", ban) }
+  
+  clear := waitForEvents(t, srv, sink, "clear", 1)[0]
+  if (clear.EventTargetID != "" || clear.EventTargetLogin != "" || clear.EventChannelName != "dallas0") { t.Errorf("clear event = %+v", clear) }
+  
+  // Every CLEARCHAT is forwarded so the Chat Handler can retract what it displayed.
+  if err := srv.WaitFor(func() bool { return sink.ChatCount() == 3 }, 5 * time.Second); err != nil { t.Errorf("chat lines = %d, want 3", sink.ChatCount()) }
+}
+
+func TestDriverPartsChannels(t *testing.T) {
+  
+  srv, _ := startTestDriver(t)
+  
+  channels := testChannels("dallas", 2, 100)
+  listenAndWait(t, srv, channels)
+  
+  if _, err := PartChannels(kiteRequest(t, channels[:1])); err != nil { t.Fatal(err) }
+  
+  if err := srv.WaitFor(func() bool { return len(srv.LinesWithCommand("PART")) == 1 }, 5 * time.Second); err != nil { t.Fatalf("PART lines = %q", srv.LinesWithCommand("PART")) }
+  if (ircDriver.FindChannel("dallas0") != nil || ircDriver.FindChannel("dallas1") == nil) { t.Errorf("dallas0 should be forgotten and dallas1 kept") }
+  
+  // Parting the last channel closes the listener.
+  if _, err := PartChannels(kiteRequest(t, channels[1:])); err != nil { t.Fatal(err) }
+  
+  if err := srv.WaitFor(func() bool { return len(srv.ConnectedClients()) == 0 }, 5 * time.Second); err != nil { t.Errorf("clients = %d, want the empty listener closed", len(srv.ConnectedClients())) }
+  if (len(ircDriver.ListenerPool.Snapshot()) != 0) { t.Errorf("listeners = %+v, want none", ircDriver.ListenerPool.Status()) }
+}
+
+func TestDriverRefusesEmptyChannelSet(t *testing.T) {
+  
+  srv, _ := startTestDriver(t)
+  
+  channels := testChannels("dallas", 2, 100)
+  listenAndWait(t, srv, channels)
+  
+  if _, err := ReplaceChannelSet(kiteRequest(t, []ogdm.IdentitySlim{})); err == nil || err.Error() != "Empty list." { t.Errorf("replacing with an empty set = %v, want Empty list.", err) }
+  if (ircDriver.FindChannel("dallas0") == nil || ircDriver.FindChannel("dallas1") == nil) { t.Errorf("channels were parted by an empty set") }
+  
+  if _, err := ReplaceChannelSet(kiteRequest(t, channels[1:])); err != nil { t.Fatal(err) }
+  
+  if err := srv.WaitFor(func() bool { return len(srv.LinesWithCommand("PART")) == 1 }, 5 * time.Second); err != nil { t.Fatalf("PART lines = %q", srv.LinesWithCommand("PART")) }
+  if (ircDriver.FindChannel("dallas0") != nil || ircDriver.FindChannel("dallas1") == nil) { t.Errorf("dallas0 should be parted and dallas1 kept") }
+}
@@ -0,0 +1,186 @@
+/*
+*
+* Name:     Twitch IRC Listener
+* Sys Name: twitch-irc
+* Author:   Nifty255
+*
+*/
+
+package main
+
+import (
+  "errors"  // Error creation functions.
+  "strings" // String manipulation functions.
+)
+
+// Specifies a parsed IRCv3 message.
+type IrcMessage struct {
+  
+  Raw         string
+  Tags        map[string]string
+  Nick        string
+  User        string
+  Host        string
+  Command     string
+  Params      []string
+  Trailing    string
+  HasTrailing bool
+}
+
+// Static. Parses a raw IRCv3 line into an IrcMessage. Never panics on malformed input.
+func ParseIrcMessage(raw string) (*IrcMessage, error) {
+  
+  m := IrcMessage{
+    Raw: raw,
+    Tags: make(map[string]string),
+    Params: make([]string, 0, 2) }
+  
+  line := strings.TrimRight(raw, "\r\n")
+  
+  // Tags.
+  if (strings.HasPrefix(line, "@")) {
+    
+    end := strings.IndexByte(line, ' ')
+    if (end == -1) { return nil, errors.New("IRC message has tags but no command.") }
+    
+    ParseIrcTags(line[1:end], m.Tags)
+    line = line[end + 1:]
+  }
+  
+  line = strings.TrimLeft(line, " ")
+  
+  // Prefix.
+  if (strings.HasPrefix(line, ":")) {
+    
+    end := strings.IndexByte(line, ' ')
+    if (end == -1) { return nil, errors.New("IRC message has prefix but no command.") }
+    
+    m.Nick, m.User, m.Host = ParseIrcPrefix(line[1:end])
+    line = strings.TrimLeft(line[end + 1:], " ")
+  }
+  
+  // Command.
+  end := strings.IndexByte(line, ' ')
+  if (end == -1) {
+    
+    m.Command = line
+    line = ""
+  } else {
+    
+    m.Command = line[:end]
+    line = line[end + 1:]
+  }
+  
+  if (m.Command == "") { return nil, errors.New("IRC message has no command.") }
+  
+  m.Command = strings.ToUpper(m.Command)
+  
+  // Params and trailing.
+  for {
+    
+    line = strings.TrimLeft(line, " ")
+    if (line == "") { break }
+    
+    if (line[0] == ':') {
+      
+      m.Trailing = line[1:]
+      m.HasTrailing = true
+      break
+    }
+    
+    end := strings.IndexByte(line, ' ')
+    if (end == -1) {
+      
+      m.Params = append(m.Params, line)
+      break
+    }
+    
+    m.Params = append(m.Params, line[:end])
+    line = line[end + 1:]
+  }
+  
+  return &m, nil
+}
+
+// Static. Parses a raw tag string (without the leading '@') into the given map, unescaping values.
+func ParseIrcTags(raw string, tags map[string]string) {
+  
+  pairs := strings.Split(raw, ";")
+  
+  for i := 0; i < len(pairs); i++ {
+    
+    if (pairs[i] == "") { continue }
+    
+    // Only the first '=' separates the key from the value.
+    key, value, _ := strings.Cut(pairs[i], "=")
+    if (key == "") { continue }
+    
+    tags[key] = UnescapeTagValue(value)
+  }
+}
+
+// Static. Unescapes an IRCv3 tag value.
+func UnescapeTagValue(value string) string {
+  
+  if (strings.IndexByte(value, '\\') == -1) { return value }
+  
+  var b strings.Builder
+  b.Grow(len(value))
+  
+  for i := 0; i < len(value); i++ {
+    
+    if (value[i] != '\\') {
+      
+      b.WriteByte(value[i])
+      continue
+    }
+    
+    // A lone trailing backslash is dropped.
+    if (i + 1 >= len(value)) { break }
+    
+    i++
+    switch(value[i]) {
+      
+      case ':':
+      b.WriteByte(';')
+      case 's':
+      b.WriteByte(' ')
+      case '\\':
+      b.WriteByte('\\')
+      case 'r':
+      b.WriteByte('\r')
+      case 'n':
+      b.WriteByte('\n')
+      default:
+      b.WriteByte(value[i])
+    }
+  }
+  
+  return b.String()
+}
+
+// Static. Splits an IRC prefix into its nick, user, and host parts.
+func ParseIrcPrefix(prefix string) (string, string, string) {
+  
+  nick, host, _ := strings.Cut(prefix, "@")
+  nick, user, _ := strings.Cut(nick, "!")
+  
+  return nick, user, host
+}
+
+// IrcMessage. Returns the first channel parameter without its '#', or "" if there is none.
+func (m *IrcMessage) Channel() string {
+  
+  for i := 0; i < len(m.Params); i++ {
+    
+    if (strings.HasPrefix(m.Params[i], "#")) { return m.Params[i][1:] }
+  }
+  
+  return ""
+}
+
+// IrcMessage. Returns the trailing parameter, which holds the chat message for most Twitch commands.
+func (m *IrcMessage) Message() string {
+  
+  return m.Trailing
+}
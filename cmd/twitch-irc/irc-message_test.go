@@ -0,0 +1,184 @@
+/*
+*
+* Name:     Twitch IRC Listener
+* Sys Name: twitch-irc
+* Author:   Nifty255
+*
+*/
+
+package main
+
+import (
+  "reflect"                     // Deep equality checks.
+  "testing"                     // Go's testing framework.
+  "github.com/thoj/go-ircevent" // IRC client functions and structures.
+)
+
+func TestParseIrcMessage(t *testing.T) {
+  
+  cases := []struct {
+    
+    Name        string
+    Raw         string
+    Tags        map[string]string
+    Nick        string
+    User        string
+    Host        string
+    Command     string
+    Params      []string
+    Trailing    string
+    HasTrailing bool
+  }{
+    {
+      Name: "privmsg with tags and prefix",
+      Raw: "@badges=moderator/1;display-name=Ronni;mod=1 :ronni!ronni@ronni.tmi.twitch.tv PRIVMSG #dallas :Kappa Keepo\r\n",
+      Tags: map[string]string{ "badges": "moderator/1", "display-name": "Ronni", "mod": "1" },
+      Nick: "ronni", User: "ronni", Host: "ronni.tmi.twitch.tv",
+      Command: "PRIVMSG", Params: []string{ "#dallas" }, Trailing: "Kappa Keepo", HasTrailing: true },
+    {
+      Name: "no prefix",
+      Raw: "PING :tmi.twitch.tv",
+      Tags: map[string]string{},
+      Command: "PING", Params: []string{}, Trailing: "tmi.twitch.tv", HasTrailing: true },
+    {
+      Name: "no prefix and no params",
+      Raw: "RECONNECT",
+      Tags: map[string]string{},
+      Command: "RECONNECT", Params: []string{} },
+    {
+      Name: "tags without prefix",
+      Raw: "@msg-id=host_off NOTICE #dallas :Exited host mode.",
+      Tags: map[string]string{ "msg-id": "host_off" },
+      Command: "NOTICE", Params: []string{ "#dallas" }, Trailing: "Exited host mode.", HasTrailing: true },
+    {
+      Name: "empty tag values",
+      Raw: "@badge-info=;color=;emotes= :tmi.twitch.tv USERSTATE #dallas",
+      Tags: map[string]string{ "badge-info": "", "color": "", "emotes": "" },
+      Host: "", Nick: "tmi.twitch.tv",
+      Command: "USERSTATE", Params: []string{ "#dallas" } },
+    {
+      Name: "tag without a value",
+      Raw: "@vip;mod=0 :tmi.twitch.tv USERSTATE #dallas",
+      Tags: map[string]string{ "vip": "", "mod": "0" },
+      Nick: "tmi.twitch.tv",
+      Command: "USERSTATE", Params: []string{ "#dallas" } },
+    {
+      Name: "escaped tag values",
+      Raw: `@system-msg=5\sraiders\sfrom\sfoo;semi=a\:b;slash=c\\d;crlf=e\r\nf;unknown=\q;lone=g\ :tmi.twitch.tv USERNOTICE #dallas`,
+      Tags: map[string]string{ "system-msg": "5 raiders from foo", "semi": "a;b", "slash": `c\d`, "crlf": "e\r\nf", "unknown": "q", "lone": "g" },
+      Nick: "tmi.twitch.tv",
+      Command: "USERNOTICE", Params: []string{ "#dallas" } },
+    {
+      Name: "equals sign in a tag value",
+      Raw: "@reply-parent-msg-body=a=b :tmi.twitch.tv PRIVMSG #dallas :hi",
+      Tags: map[string]string{ "reply-parent-msg-body": "a=b" },
+      Nick: "tmi.twitch.tv",
+      Command: "PRIVMSG", Params: []string{ "#dallas" }, Trailing: "hi", HasTrailing: true },
+    {
+      Name: "empty trailing",
+      Raw: ":tmi.twitch.tv CAP * ACK :",
+      Tags: map[string]string{},
+      Nick: "tmi.twitch.tv",
+      Command: "CAP", Params: []string{ "*", "ACK" }, Trailing: "", HasTrailing: true },
+    {
+      Name: "trailing with colons and extra spaces",
+      Raw: ":tmi.twitch.tv  001  justinfan123  ::Welcome,  GLHF!",
+      Tags: map[string]string{},
+      Nick: "tmi.twitch.tv",
+      Command: "001", Params: []string{ "justinfan123" }, Trailing: ":Welcome,  GLHF!", HasTrailing: true },
+    {
+      Name: "lowercase command",
+      Raw: "ping :tmi.twitch.tv",
+      Tags: map[string]string{},
+      Command: "PING", Params: []string{}, Trailing: "tmi.twitch.tv", HasTrailing: true },
+  }
+  
+  for ind := 0; ind < len(cases); ind++ {
+    
+    c := cases[ind]
+    
+    m, err := ParseIrcMessage(c.Raw)
+    if (err != nil) { t.Errorf("%s: unexpected error: %v", c.Name, err); continue }
+    
+    if (!reflect.DeepEqual(m.Tags, c.Tags)) { t.Errorf("%s: tags = %q, want %q", c.Name, m.Tags, c.Tags) }
+    if (m.Nick != c.Nick || m.User != c.User || m.Host != c.Host) { t.Errorf("%s: prefix = %q %q %q, want %q %q %q", c.Name, m.Nick, m.User, m.Host, c.Nick, c.User, c.Host) }
+    if (m.Command != c.Command) { t.Errorf("%s: command = %q, want %q", c.Name, m.Command, c.Command) }
+    if (!reflect.DeepEqual(m.Params, c.Params)) { t.Errorf("%s: params = %q, want %q", c.Name, m.Params, c.Params) }
+    if (m.Trailing != c.Trailing || m.HasTrailing != c.HasTrailing) { t.Errorf("%s: trailing = %q %v, want %q %v", c.Name, m.Trailing, m.HasTrailing, c.Trailing, c.HasTrailing) }
+  }
+}
+
+func TestParseIrcMessageMalformed(t *testing.T) {
+  
+  cases := []string{ "", "   ", "@a=b", "@a=b ", ":prefix", ":prefix ", "@a=b :prefix" }
+  
+  for ind := 0; ind < len(cases); ind++ {
+    
+    if m, err := ParseIrcMessage(cases[ind]); err == nil { t.Errorf("%q: expected an error, got %+v", cases[ind], m) }
+  }
+}
+
+func TestUnescapeTagValue(t *testing.T) {
+  
+  cases := map[string]string{
+    "": "",
+    "plain": "plain",
+    `\s`: " ",
+    `\:`: ";",
+    `\\`: `\`,
+    `\r\n`: "\r\n",
+    `\\s`: `\s`,
+    `a\`: "a",
+    `\x`: "x",
+    `hello\sworld\:\sbye`: "hello world; bye" }
+  
+  for raw, want := range cases {
+    
+    if got := UnescapeTagValue(raw); got != want { t.Errorf("UnescapeTagValue(%q) = %q, want %q", raw, got, want) }
+  }
+}
+
+func TestParseIrcPrefix(t *testing.T) {
+  
+  cases := [][4]string{
+    { "nick!user@host", "nick", "user", "host" },
+    { "nick@host", "nick", "", "host" },
+    { "tmi.twitch.tv", "tmi.twitch.tv", "", "" },
+    { "", "", "", "" } }
+  
+  for ind := 0; ind < len(cases); ind++ {
+    
+    nick, user, host := ParseIrcPrefix(cases[ind][0])
+    if (nick != cases[ind][1] || user != cases[ind][2] || host != cases[ind][3]) { t.Errorf("ParseIrcPrefix(%q) = %q %q %q", cases[ind][0], nick, user, host) }
+  }
+}
+
+func TestIrcMessageChannel(t *testing.T) {
+  
+  cases := map[string]string{
+    ":tmi.twitch.tv ROOMSTATE #dallas": "dallas",
+    ":tmi.twitch.tv CAP * ACK :twitch.tv/tags": "",
+    ":tmi.twitch.tv 353 justinfan123 = #dallas :ronni": "dallas",
+    "PING": "" }
+  
+  for raw, want := range cases {
+    
+    m, err := ParseIrcMessage(raw)
+    if (err != nil) { t.Errorf("%q: unexpected error: %v", raw, err); continue }
+    
+    if got := m.Channel(); got != want { t.Errorf("%q: channel = %q, want %q", raw, got, want) }
+  }
+}
+
+func TestOnCapAck(t *testing.T) {
+  
+  l := &(Listener{ Username: "justinfan123" })
+  
+  // A single capability may be acknowledged without a trailing parameter.
+  lines := []string{ ":tmi.twitch.tv CAP * ACK :twitch.tv/tags twitch.tv/commands", ":tmi.twitch.tv CAP * ACK twitch.tv/tags", ":tmi.twitch.tv CAP * ACK", "@" }
+  
+  for ind := 0; ind < len(lines); ind++ {
+    
+    l.OnCapAck(&(irc.Event{ Code: "CAP", Raw: lines[ind] }))
+  }
+}
@@ -0,0 +1,79 @@
+/*
+*
+* Name:     Twitch IRC Listener
+* Sys Name: twitch-irc
+* Author:   Nifty255
+*
+*/
+
+package main
+
+import (
+  "sync" // Mutual exclusion locks.
+  "time" // Timing related functions.
+)
+
+// Specifies a token bucket shared by every listener, so the pool as a whole stays within Twitch's join limit.
+// Twitch counts each channel of a batched JOIN separately, so one token is one channel.
+type JoinLimiter struct {
+  
+  Capacity  float64
+  Tokens    float64
+  PerSecond float64
+  LastFill  time.Time
+  Lock      sync.Mutex
+}
+
+// Static. Creates a JoinLimiter allowing the given number of joins per window. The bucket starts full.
+func JoinLimiterNew(limit int, window time.Duration) *JoinLimiter {
+  
+  if (limit < 1) { limit = 1 }
+  if (window <= 0) { window = time.Second }
+  
+  return &(JoinLimiter{
+    Capacity: float64(limit),
+    Tokens: float64(limit),
+    PerSecond: float64(limit) / window.Seconds(),
+    LastFill: time.Now() })
+}
+
+// JoinLimiter. Takes up to max tokens without blocking and returns how many were granted.
+func (j *JoinLimiter) Take(max int) int {
+  
+  if (max <= 0) { return 0 }
+  
+  j.Lock.Lock()
+  defer j.Lock.Unlock()
+  
+  now := time.Now()
+  j.Tokens += now.Sub(j.LastFill).Seconds() * j.PerSecond
+  if (j.Tokens > j.Capacity) { j.Tokens = j.Capacity }
+  j.LastFill = now
+  
+  granted := int(j.Tokens)
+  if (granted > max) { granted = max }
+  
+  j.Tokens -= float64(granted)
+  
+  return granted
+}
+
+// JoinLimiter. Puts back tokens that were taken but not used, up to capacity.
+func (j *JoinLimiter) Give(n int) {
+  
+  j.Lock.Lock()
+  defer j.Lock.Unlock()
+  
+  j.Tokens += float64(n)
+  if (j.Tokens > j.Capacity) { j.Tokens = j.Capacity }
+}
+
+// JoinLimiter. Blocks until n tokens have been taken, polling at the given interval.
+func (j *JoinLimiter) Wait(n int, interval time.Duration) {
+  
+  for n > 0 {
+    
+    n -= j.Take(n)
+    if (n > 0) { time.Sleep(interval) }
+  }
+}
@@ -0,0 +1,110 @@
+/*
+*
+* Name:     Twitch IRC Listener
+* Sys Name: twitch-irc
+* Author:   Nifty255
+*
+*/
+
+package main
+
+import (
+  "time"    // Timing related functions.
+  "strings" // String manipulation functions.
+  "testing" // Go's testing framework.
+)
+
+func TestJoinLimiterBurstAndRefill(t *testing.T) {
+  
+  // Ten tokens a second, five at once.
+  j := JoinLimiterNew(5, 500 * time.Millisecond)
+  
+  if got := j.Take(10); got != 5 { t.Fatalf("took %d from a full bucket, want the burst of 5", got) }
+  if got := j.Take(1); got != 0 { t.Fatalf("took %d from an empty bucket, want none", got) }
+  
+  time.Sleep(250 * time.Millisecond)
+  if got := j.Take(10); got < 1 || got > 3 { t.Errorf("took %d after a quarter second, want about 2", got) }
+  
+  // However long it sits, it holds no more than the burst.
+  time.Sleep(time.Second)
+  if got := j.Take(100); got != 5 { t.Errorf("took %d after a second idle, want the burst of 5", got) }
+}
+
+func TestJoinLimiterGive(t *testing.T) {
+  
+  j := JoinLimiterNew(5, time.Minute)
+  
+  j.Take(5)
+  j.Give(2)
+  
+  if got := j.Take(5); got != 2 { t.Errorf("took %d after giving back 2, want 2", got) }
+  
+  j.Give(100)
+  if got := j.Take(100); got != 5 { t.Errorf("took %d after giving back more than fits, want the capacity of 5", got) }
+}
+
+func TestJoinLimiterWaitUnblocksOnRefill(t *testing.T) {
+  
+  j := JoinLimiterNew(2, 400 * time.Millisecond)
+  j.Take(2)
+  
+  done := make(chan time.Duration, 1)
+  start := time.Now()
+  go func() { j.Wait(2, 10 * time.Millisecond); done <- time.Since(start) }()
+  
+  select {
+  case took := <- done:
+    if (took < 300 * time.Millisecond) { t.Errorf("Wait returned after %v, before the bucket refilled", took) }
+  case <- time.After(2 * time.Second):
+    t.Fatal("Wait still blocked after the bucket refilled")
+  }
+}
+
+func TestDriverBatchedJoinsStayWithinRate(t *testing.T) {
+  
+  srv, _ := startTestDriver(t, func(c *Config) {
+    
+    c.Joins = ConfigJoins{ Limit: 10, WindowMs: 1000, BatchSize: 4 }
+    c.ChannelsPerListener = 10
+  })
+  
+  start := time.Now()
+  listenAndWait(t, srv, testChannels("dallas", 40, 100))
+  
+  if got := len(srv.ConnectedClients()); got < 4 { t.Fatalf("connected clients = %d, want the channels spread across at least 4 listeners", got) }
+  
+  // Ten at once and ten a second after that: the last thirty take at least three seconds.
+  if took := time.Since(start); took < 2500 * time.Millisecond { t.Errorf("joined 40 channels in %v, faster than the limit allows", took) }
+  
+  type join struct {
+    
+    at       time.Time
+    channels int
+  }
+  
+  joins := []join{}
+  lines := srv.Lines()
+  for ind := 0; ind < len(lines); ind++ {
+    
+    if (!strings.HasPrefix(lines[ind].Line, "JOIN ")) { continue }
+    
+    channels := len(strings.Split(strings.TrimPrefix(lines[ind].Line, "JOIN "), ","))
+    if (channels > 4) { t.Errorf("JOIN of %d channels, want at most the batch size of 4", channels) }
+    
+    joins = append(joins, join{ at: lines[ind].Time, channels: channels })
+  }
+  
+  // Across every listener, any stretch holds no more than the burst plus what refilled over it. The slack covers
+  // the time between a token being taken and the server reading the JOIN.
+  for ind := 0; ind < len(joins); ind++ {
+    
+    total := 0
+    for j := ind; j < len(joins); j++ {
+      
+      total += joins[j].channels
+      
+      allowed := 10 + 10 * (joins[j].at.Sub(joins[ind].at) + 100 * time.Millisecond).Seconds()
+      if (float64(total) > allowed) { t.Fatalf("%d channels joined within %v, want at most %.1f", total, joins[j].at.Sub(joins[ind].at), allowed) }
+    }
+  }
+}
@@ -0,0 +1,184 @@
+/*
+*
+* Name:     Twitch IRC Listener
+* Sys Name: twitch-irc
+* Author:   Nifty255
+*
+*/
+
+package main
+
+import (
+  "sync"                   // Mutual exclusion locks.
+  "strconv"                // String/Number conversion functions.
+  "sync/atomic"            // Atomic primitives.
+  "github.com/koding/kite" // Microservice functions and structures.
+  ogdm "github.com/the-opera-house/go-common-lib/models"
+)
+
+// Specifies a sink that forwards to another kite, such as the Event Handler or Chat Handler.
+// The client is replaced whenever it disconnects, so it is guarded by Lock.
+// Batches go to BatchMethod until the kite reports it does not have one, after which items are sent singly.
+type KiteSink struct {
+  
+  Name        string
+  Url         string
+  Method      string
+  BatchMethod string
+  Unbatched   atomic.Bool
+  KiteManager *kite.Kite
+  Client      *kite.Client
+  Connected   atomic.Bool
+  Closed      bool
+  Lock        sync.RWMutex
+}
+
+// Static. Creates a KiteSink and starts dialing the kite at the given address and port.
+func KiteSinkNew(k *kite.Kite, name, address string, port int, method, batchMethod string) *KiteSink {
+  
+  s := &(KiteSink{
+    Name: name,
+    Url: "http://" + address + ":" + strconv.Itoa(port) + "/kite",
+    Method: method,
+    BatchMethod: batchMethod,
+    KiteManager: k })
+  
+  s.Client = s.NewClient()
+  s.Client.DialForever()
+  
+  return s
+}
+
+// KiteSink. Creates a client with the sink's connect callbacks registered.
+func (s *KiteSink) NewClient() *kite.Client {
+  
+  c := s.KiteManager.NewClient(s.Url)
+  
+  c.OnConnect(s.OnConnect)
+  c.OnDisconnect(s.OnDisconnect)
+  
+  return c
+}
+
+// KiteSink. Returns the current client.
+func (s *KiteSink) GetClient() *kite.Client {
+  
+  s.Lock.RLock()
+  defer s.Lock.RUnlock()
+  
+  return s.Client
+}
+
+func (s *KiteSink) OnConnect() {
+  
+  s.Unbatched.Store(false)
+  s.Connected.Store(true)
+  logger.Info("Connected to kite.", LogFields{ "sink": s.Name })
+}
+
+func (s *KiteSink) OnDisconnect() {
+  
+  s.Connected.Store(false)
+  
+  s.Lock.Lock()
+  
+  // Closed on purpose. Don't redial.
+  if (s.Closed) { s.Lock.Unlock(); return }
+  
+  logger.Warn("Disconnected from kite.", LogFields{ "sink": s.Name })
+  
+  s.Client.Close()
+  s.Client = s.NewClient()
+  client := s.Client
+  s.Lock.Unlock()
+  
+  client.DialForever()
+}
+
+// KiteSink. Calls an arbitrary method on the kite.
+func (s *KiteSink) Tell(method string, args ...interface{}) error {
+  
+  _, err := s.GetClient().Tell(method, args...)
+  
+  return err
+}
+
+func (s *KiteSink) SendEvent(e *ogdm.Event) error {
+  
+  return s.Tell(s.Method, e)
+}
+
+func (s *KiteSink) SendChat(raw string) error {
+  
+  return s.Tell(s.Method, raw)
+}
+
+func (s *KiteSink) SendEvents(events []*ogdm.Event) (int, error) {
+  
+  if (!s.Unbatched.Load()) {
+    
+    err := s.Tell(s.BatchMethod, events)
+    if (!s.IsMethodNotFound(err)) {
+      
+      if (err != nil) { return 0, err }
+      return len(events), nil
+    }
+  }
+  
+  for ind := 0; ind < len(events); ind++ {
+    
+    if err := s.SendEvent(events[ind]); err != nil { return ind, err }
+  }
+  
+  return len(events), nil
+}
+
+func (s *KiteSink) SendChats(raws []string) (int, error) {
+  
+  if (!s.Unbatched.Load()) {
+    
+    err := s.Tell(s.BatchMethod, raws)
+    if (!s.IsMethodNotFound(err)) {
+      
+      if (err != nil) { return 0, err }
+      return len(raws), nil
+    }
+  }
+  
+  for ind := 0; ind < len(raws); ind++ {
+    
+    if err := s.SendChat(raws[ind]); err != nil { return ind, err }
+  }
+  
+  return len(raws), nil
+}
+
+// KiteSink. Reports whether err means the kite has no BatchMethod, and if so stops batching.
+// Batching is tried again on the next connect, in case the handler was upgraded.
+func (s *KiteSink) IsMethodNotFound(err error) bool {
+  
+  kiteErr, ok := err.(*kite.Error)
+  if (!ok || kiteErr.Type != "methodNotFound") { return false }
+  
+  if (!s.Unbatched.Swap(true)) { logger.Warn("Kite has no batch method. Sending singly.", LogFields{ "sink": s.Name, "method": s.BatchMethod }) }
+  
+  return true
+}
+
+func (s *KiteSink) Ready() bool {
+  
+  return s.Connected.Load()
+}
+
+// KiteSink. Closes the client for good; it is not redialed.
+func (s *KiteSink) Close() error {
+  
+  s.Lock.Lock()
+  s.Closed = true
+  client := s.Client
+  s.Lock.Unlock()
+  
+  client.Close()
+  
+  return nil
+}
@@ -0,0 +1,186 @@
+/*
+*
+* Name:     Twitch IRC Listener
+* Sys Name: twitch-irc
+* Author:   Nifty255
+*
+*/
+
+package main
+
+import (
+  "math"    // Math functions.
+  "sort"    // Sorting functions.
+  "sync"    // Mutual exclusion locks.
+  "time"    // Timing related functions.
+  "strings" // String manipulation functions.
+)
+
+// Stages a chat message is timed at, each measured from its tmi-sent-ts. Every message is observed at parse and enqueue
+// in StageLatency, and at delivery in DeliveryLatency; probes are also timed through TraceLatency and the latency report.
+const (
+  StageParse    = "parse"    // Tags parsed in the PRIVMSG callback.
+  StageEnqueue  = "enqueue"  // Pushed into the chat buffer.
+  StageDelivery = "delivery" // Acknowledged by the chat sink.
+)
+
+var TraceStages = []string{ StageParse, StageEnqueue, StageDelivery }
+
+var (
+  StageLatency = HistogramNew("twitch_irc_stage_latency_seconds", "Time from tmi-sent-ts to parse and enqueue, for every chat message.", LatencyBuckets, "stage")
+  TraceLatency = HistogramNew("twitch_irc_trace_latency_seconds", "Time from tmi-sent-ts to each stage, for probe messages.", LatencyBuckets, "stage")
+)
+
+// Specifies the most recent samples of one stage, in milliseconds.
+type LatencySamples struct {
+  
+  Values []float64
+  Next   int
+  Count  uint64
+}
+
+// Specifies a stage's summary, as reported by the "latency-report" kite method. Times are in milliseconds.
+type LatencyReport struct {
+  
+  Stage string  `json:"stage"`
+  Count uint64  `json:"count"`
+  Min   float64 `json:"min"`
+  Max   float64 `json:"max"`
+  Mean  float64 `json:"mean"`
+  P50   float64 `json:"p50"`
+  P95   float64 `json:"p95"`
+  P99   float64 `json:"p99"`
+}
+
+// Specifies which chat messages are probes and keeps their recent latencies.
+// A message is a probe if its sender is in Users and its first word is in Commands; an empty set matches anything,
+// but at least one must be configured or nothing is traced.
+type LatencyTracer struct {
+  
+  Users    map[string]bool
+  Commands map[string]bool
+  Window   int
+  Stages   map[string]*LatencySamples
+  Lock     sync.Mutex
+}
+
+// Static. Creates a LatencyTracer from config.
+func LatencyTracerNew(c ConfigTracing) *LatencyTracer {
+  
+  t := &(LatencyTracer{
+    Users: make(map[string]bool, len(c.ProbeUsers)),
+    Commands: make(map[string]bool, len(c.ProbeCommands)),
+    Window: c.Window,
+    Stages: make(map[string]*LatencySamples, len(TraceStages)) })
+  
+  if (t.Window <= 0) { t.Window = 1000 }
+  
+  for ind := 0; ind < len(c.ProbeUsers); ind++ { t.Users[strings.ToLower(c.ProbeUsers[ind])] = true }
+  for ind := 0; ind < len(c.ProbeCommands); ind++ { t.Commands[c.ProbeCommands[ind]] = true }
+  
+  for ind := 0; ind < len(TraceStages); ind++ {
+    
+    t.Stages[TraceStages[ind]] = &(LatencySamples{ Values: make([]float64, 0, t.Window) })
+  }
+  
+  return t
+}
+
+// LatencyTracer. Returns whether a message from the given login is a probe.
+func (t *LatencyTracer) IsProbe(login, message string) bool {
+  
+  if (len(t.Users) == 0 && len(t.Commands) == 0) { return false }
+  if (len(t.Users) > 0 && !t.Users[login]) { return false }
+  
+  if (len(t.Commands) > 0) {
+    
+    command := message
+    if space := strings.IndexByte(message, ' '); space >= 0 { command = message[:space] }
+    
+    if (!t.Commands[command]) { return false }
+  }
+  
+  return true
+}
+
+// LatencyTracer. Records that any message sent at sentAt reached a stage now. Messages without a tmi-sent-ts are ignored.
+func (t *LatencyTracer) Observe(stage string, sentAt time.Time) {
+  
+  if (sentAt.IsZero()) { return }
+  
+  StageLatency.Observe(time.Since(sentAt).Seconds(), stage)
+}
+
+// LatencyTracer. Records that a probe sent at sentAt reached a stage now. Probes without a tmi-sent-ts are ignored.
+func (t *LatencyTracer) Record(stage string, sentAt time.Time) {
+  
+  if (sentAt.IsZero()) { return }
+  
+  elapsed := time.Since(sentAt)
+  TraceLatency.Observe(elapsed.Seconds(), stage)
+  
+  t.Lock.Lock()
+  defer t.Lock.Unlock()
+  
+  samples, ok := t.Stages[stage]
+  if (!ok) { return }
+  
+  ms := float64(elapsed) / float64(time.Millisecond)
+  
+  if (len(samples.Values) < t.Window) {
+    
+    samples.Values = append(samples.Values, ms)
+  } else {
+    
+    samples.Values[samples.Next] = ms
+  }
+  samples.Next = (samples.Next + 1) % t.Window
+  samples.Count++
+  
+  if (stage == StageDelivery) { logger.Info("Probe delivered.", LogFields{ "latency_ms": ms }) }
+}
+
+// LatencyTracer. Summarises the recent samples of every stage, in stage order.
+func (t *LatencyTracer) Report() []LatencyReport {
+  
+  t.Lock.Lock()
+  defer t.Lock.Unlock()
+  
+  reports := make([]LatencyReport, 0, len(TraceStages))
+  
+  for ind := 0; ind < len(TraceStages); ind++ {
+    
+    samples := t.Stages[TraceStages[ind]]
+    report := LatencyReport{ Stage: TraceStages[ind], Count: samples.Count }
+    
+    if (len(samples.Values) > 0) {
+      
+      sorted := append([]float64{}, samples.Values...)
+      sort.Float64s(sorted)
+      
+      sum := 0.0
+      for val := 0; val < len(sorted); val++ { sum += sorted[val] }
+      
+      report.Min = sorted[0]
+      report.Max = sorted[len(sorted) - 1]
+      report.Mean = sum / float64(len(sorted))
+      report.P50 = Percentile(sorted, 0.50)
+      report.P95 = Percentile(sorted, 0.95)
+      report.P99 = Percentile(sorted, 0.99)
+    }
+    
+    reports = append(reports, report)
+  }
+  
+  return reports
+}
+
+// Static. Returns the nearest-rank percentile of sorted values.
+func Percentile(sorted []float64, p float64) float64 {
+  
+  rank := int(math.Ceil(p * float64(len(sorted)))) - 1
+  if (rank < 0) { rank = 0 }
+  if (rank >= len(sorted)) { rank = len(sorted) - 1 }
+  
+  return sorted[rank]
+}
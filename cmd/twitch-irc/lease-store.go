@@ -0,0 +1,147 @@
+/*
+*
+* Name:     Twitch IRC Listener
+* Sys Name: twitch-irc
+* Author:   Nifty255
+*
+*/
+
+package main
+
+import (
+  "time"                     // Timing related functions.
+  "errors"                   // Error creation functions.
+  "gopkg.in/mgo.v2"          // MongoDB driver.
+  "gopkg.in/mgo.v2/bson"     // BSON encoding functions.
+  ogcn "github.com/the-opera-house/go-common-lib/net"
+)
+
+// Specifies a leadership lease. Term goes up by one every time the lease changes hands,
+// so it doubles as a fencing token: a holder with an older term has been replaced.
+type Lease struct {
+  
+  Name    string    `bson:"_id"     json:"name"`
+  Holder  string    `bson:"holder"  json:"holder"`
+  Term    int64     `bson:"term"    json:"term"`
+  Expires time.Time `bson:"expires" json:"expires"`
+}
+
+// Specifies where leases are kept. Every call returns the lease as it stands afterwards,
+// and whether the caller holds it.
+type LeaseStore interface {
+  
+  // Takes the lease if nobody holds it or it has expired, starting a new term.
+  Acquire(name, holder string, ttl time.Duration) (Lease, bool, error)
+  
+  // Extends the lease, only if the holder still holds it in the given term.
+  Renew(name, holder string, term int64, ttl time.Duration) (Lease, bool, error)
+  
+  // Expires the lease now, only if the holder still holds it in the given term.
+  Release(name, holder string, term int64) error
+}
+
+// Specifies the database the stores below use, reached through the service's DatabaseDriver.
+type MongoSession struct {
+  
+  DbDriver *ogcn.DatabaseDriver
+  DbName   string
+}
+
+// Static. Creates a MongoSession on the given driver.
+func MongoSessionNew(d *ogcn.DatabaseDriver, dbName string) *MongoSession {
+  
+  return &(MongoSession{ DbDriver: d, DbName: dbName })
+}
+
+// MongoSession. Returns a copy of the driver's session. Close the copy when done.
+func (m *MongoSession) Copy() (*mgo.Session, error) {
+  
+  if (m.DbDriver == nil || m.DbDriver.Session == nil) { return nil, errors.New("No database connection.") }
+  
+  // Leases and delivered keys must be read from and written to the primary.
+  session := m.DbDriver.Session.Copy()
+  session.SetMode(mgo.Strong, true)
+  session.SetSafe(&(mgo.Safe{ WMode: "majority" }))
+  
+  return session, nil
+}
+
+// Specifies a LeaseStore backed by a MongoDB collection, one document per lease.
+type MongoLeaseStore struct {
+  
+  *MongoSession
+  Collection string
+}
+
+// Static. Creates a MongoLeaseStore on the given session.
+func MongoLeaseStoreNew(session *MongoSession, collection string) *MongoLeaseStore {
+  
+  return &(MongoLeaseStore{
+    MongoSession: session,
+    Collection: collection })
+}
+
+func (m *MongoLeaseStore) Acquire(name, holder string, ttl time.Duration) (Lease, bool, error) {
+  
+  session, err := m.Copy()
+  if (err != nil) { return Lease{}, false, err }
+  defer session.Close()
+  
+  collection := session.DB(m.DbName).C(m.Collection)
+  now := time.Now()
+  
+  var lease Lease
+  _, err = collection.Find(bson.M{ "_id": name, "expires": bson.M{ "$lt": now } }).Apply(mgo.Change{
+    Update: bson.M{ "$set": bson.M{ "holder": holder, "expires": now.Add(ttl) }, "$inc": bson.M{ "term": 1 } },
+    ReturnNew: true }, &lease)
+  
+  if (err == nil) { return lease, true, nil }
+  if (err != mgo.ErrNotFound) { return Lease{}, false, err }
+  
+  // Either the lease is held or it has never existed.
+  lease = Lease{ Name: name, Holder: holder, Term: 1, Expires: now.Add(ttl) }
+  err = collection.Insert(&lease)
+  
+  if (err == nil) { return lease, true, nil }
+  if (!mgo.IsDup(err)) { return Lease{}, false, err }
+  
+  err = collection.FindId(name).One(&lease)
+  
+  return lease, false, err
+}
+
+func (m *MongoLeaseStore) Renew(name, holder string, term int64, ttl time.Duration) (Lease, bool, error) {
+  
+  session, err := m.Copy()
+  if (err != nil) { return Lease{}, false, err }
+  defer session.Close()
+  
+  collection := session.DB(m.DbName).C(m.Collection)
+  
+  var lease Lease
+  _, err = collection.Find(bson.M{ "_id": name, "holder": holder, "term": term }).Apply(mgo.Change{
+    Update: bson.M{ "$set": bson.M{ "expires": time.Now().Add(ttl) } },
+    ReturnNew: true }, &lease)
+  
+  if (err == nil) { return lease, true, nil }
+  if (err != mgo.ErrNotFound) { return Lease{}, false, err }
+  
+  err = collection.FindId(name).One(&lease)
+  
+  return lease, false, err
+}
+
+func (m *MongoLeaseStore) Release(name, holder string, term int64) error {
+  
+  session, err := m.Copy()
+  if (err != nil) { return err }
+  defer session.Close()
+  
+  err = session.DB(m.DbName).C(m.Collection).Update(
+    bson.M{ "_id": name, "holder": holder, "term": term },
+    bson.M{ "$set": bson.M{ "expires": time.Now() } })
+  
+  if (err == mgo.ErrNotFound) { return nil }
+  
+  return err
+}
@@ -0,0 +1,191 @@
+/*
+*
+* Name:     Twitch IRC Listener
+* Sys Name: twitch-irc
+* Author:   Nifty255
+*
+*/
+
+package main
+
+import (
+  "sync" // Mutual exclusion locks.
+)
+
+// Specifies the lifecycle state of a Listener.
+type ListenerState int
+
+const (
+  ListenerCreated    ListenerState = iota // Created, waiting in the connect queue.
+  ListenerConnecting                      // Connecting or reconnecting; not joining yet.
+  ListenerJoined                          // Connected and joining channels from its buffer.
+  ListenerDraining                        // Shutting down; no further joins or reconnects.
+  ListenerDead                            // Closed for good.
+)
+
+func (s ListenerState) String() string {
+  
+  switch(s) {
+    
+    case ListenerCreated:
+    return "created"
+    case ListenerConnecting:
+    return "connecting"
+    case ListenerJoined:
+    return "joined"
+    case ListenerDraining:
+    return "draining"
+    case ListenerDead:
+    return "dead"
+  }
+  
+  return "unknown"
+}
+
+// Specifies a point-in-time view of a Listener, as reported by the "listener-status" kite method.
+type ListenerStatus struct {
+  
+  Username  string `json:"username"`
+  Account   string `json:"account,omitempty"`
+  State     string `json:"state"`
+  Joined    int    `json:"joined"`
+  Buffered  int    `json:"buffered"`
+  Migrating bool   `json:"migrating"`
+  Failures  int    `json:"failures"`
+}
+
+// Specifies the managed set of Listeners. It is the single source of truth for which listeners exist.
+type ListenerPool struct {
+  
+  Listeners []*Listener
+  Lock      sync.RWMutex
+}
+
+// Static. Creates an empty ListenerPool.
+func ListenerPoolNew(capacity int) *ListenerPool {
+  
+  return &(ListenerPool{
+    Listeners: make([]*Listener, 0, capacity) })
+}
+
+// ListenerPool. Adds a listener to the pool.
+func (p *ListenerPool) Add(l *Listener) {
+  
+  p.Lock.Lock()
+  defer p.Lock.Unlock()
+  
+  p.Listeners = append(p.Listeners, l)
+}
+
+// ListenerPool. Removes a listener from the pool. Returns whether it was found.
+func (p *ListenerPool) Remove(l *Listener) bool {
+  
+  p.Lock.Lock()
+  defer p.Lock.Unlock()
+  
+  for ind := 0; ind < len(p.Listeners); ind++ {
+    
+    if (p.Listeners[ind] == l) {
+      
+      p.Listeners = append(p.Listeners[:ind], p.Listeners[ind + 1:]...)
+      return true
+    }
+  }
+  
+  return false
+}
+
+// ListenerPool. Returns the listener with the given username, or nil if there is none.
+func (p *ListenerPool) Find(username string) *Listener {
+  
+  p.Lock.RLock()
+  defer p.Lock.RUnlock()
+  
+  for ind := 0; ind < len(p.Listeners); ind++ {
+    
+    if (p.Listeners[ind].Username == username) { return p.Listeners[ind] }
+  }
+  
+  return nil
+}
+
+// ListenerPool. Returns the most recently added listener that still accepts channels, or nil.
+func (p *ListenerPool) Last() *Listener {
+  
+  listeners := p.Snapshot()
+  
+  for ind := len(listeners) - 1; ind >= 0; ind-- {
+    
+    if (listeners[ind].AcceptsChannels()) { return listeners[ind] }
+  }
+  
+  return nil
+}
+
+// ListenerPool. Returns a copy of the pool that is safe to iterate without holding the lock.
+func (p *ListenerPool) Snapshot() []*Listener {
+  
+  p.Lock.RLock()
+  defer p.Lock.RUnlock()
+  
+  listeners := make([]*Listener, len(p.Listeners))
+  copy(listeners, p.Listeners)
+  
+  return listeners
+}
+
+// ListenerPool. Returns the number of listeners in the pool.
+func (p *ListenerPool) Count() int {
+  
+  p.Lock.RLock()
+  defer p.Lock.RUnlock()
+  
+  return len(p.Listeners)
+}
+
+// ListenerPool. Returns the status of every listener in the pool.
+func (p *ListenerPool) Status() []ListenerStatus {
+  
+  listeners := p.Snapshot()
+  statuses := make([]ListenerStatus, len(listeners))
+  
+  for ind := 0; ind < len(listeners); ind++ {
+    
+    statuses[ind] = listeners[ind].Status()
+  }
+  
+  return statuses
+}
+
+// ListenerPool. Removes every dead listener from the pool and returns how many were removed.
+func (p *ListenerPool) Prune() int {
+  
+  // States are read without the pool's lock held. A dead listener stays dead, so they cannot go stale.
+  listeners := p.Snapshot()
+  dead := make(map[*Listener]bool, 0)
+  
+  for ind := 0; ind < len(listeners); ind++ {
+    
+    if (listeners[ind].GetState() == ListenerDead) { dead[listeners[ind]] = true }
+  }
+  
+  if (len(dead) == 0) { return 0 }
+  
+  p.Lock.Lock()
+  defer p.Lock.Unlock()
+  
+  alive := p.Listeners[:0]
+  for ind := 0; ind < len(p.Listeners); ind++ {
+    
+    if (!dead[p.Listeners[ind]]) { alive = append(alive, p.Listeners[ind]) }
+  }
+  
+  removed := len(p.Listeners) - len(alive)
+  for ind := len(alive); ind < len(p.Listeners); ind++ {
+    
+    p.Listeners[ind] = nil
+  }
+  p.Listeners = alive
+  
+  return removed
+}
@@ -0,0 +1,820 @@
+/*
+*
+* Name:     Twitch IRC Listener
+* Sys Name: twitch-irc
+* Author:   Nifty255
+*
+*/
+
+package main
+
+import (
+  "time"                        // Timing related functions.
+  "sync"                        // Mutual exclusion locks.
+  "math/rand"                   // Pseudo-random number functions.
+  "strings"                     // String manipulation functions.
+  "crypto/tls"                  // Web security functions and structures.
+  "github.com/thoj/go-ircevent" // IRC client functions and structures.
+  ogdm "github.com/the-opera-house/go-common-lib/models"
+)
+
+// Delay between join attempts by a single listener. How many channels each attempt joins is up to the JoinLimiter.
+const ListenerJoinInterval = 50 * time.Millisecond
+
+// How many channels a listener's ChannelBuffer holds. Every rebuild of the queue uses the same size, as it does not grow.
+const ChannelBufferCapacity = 10000
+
+// How long a migrating connection may take to confirm its joins before the old connection is retired regardless.
+const RejoinConfirmTimeout = 10 * time.Second
+
+// Specifies an IRC Listener data structure.
+// Username names the listener within the pool; Nick is who it logs in as, which several listeners of one account share.
+// Connected and NextConnected say whether Connection and NextConnection finished connecting; nothing may be sent on one that has not,
+// as the library blocks forever writing to a connection that never connected.
+// During a migration, Rejoined holds the channels NextConnection has confirmed joining. From then until the old connection,
+// then Retired, has closed, messages arrive on both and Seen holds the ids already handled, so each is handled once.
+// Lock guards every mutable field; Username, Nick, Account and IrcDriver never change after creation.
+type Listener struct {
+  
+  Username       string
+  Nick           string
+  Account        *BotAccount
+  State          ListenerState
+  ChannelBuffer  *ogdm.IdentityQueue
+  Connection     *irc.Connection
+  NextConnection *irc.Connection
+  Connected      bool
+  NextConnected  bool
+  IrcDriver      *IRCDriver
+  Channels       map[string]*ogdm.IdentitySlim
+  RetryLater     bool
+  Migrating      bool
+  Rejoined       map[string]bool
+  Retired        *irc.Connection
+  Seen           map[string]bool
+  Failures       int
+  Lock           sync.Mutex
+}
+
+// Static. Creates a Listener with the specified name, logging in as the given account, or anonymously as name if it is nil.
+func CreateListener (name string, account *BotAccount, d *IRCDriver) *Listener {
+  
+  nick := name
+  if (account != nil) { nick = account.Login }
+  
+  l := &Listener{
+    Username: name,
+    Nick: nick,
+    Account: account,
+    State: ListenerCreated,
+    ChannelBuffer: ogdm.IdentityQueueNew(ChannelBufferCapacity),
+    Connection: nil,
+    NextConnection: nil,
+    Connected: false,
+    NextConnected: false,
+    IrcDriver: d,
+    Channels: make(map[string]*ogdm.IdentitySlim, config.ChannelsPerListener),
+    RetryLater: false,
+    Migrating: false,
+    Rejoined: nil,
+    Retired: nil,
+    Seen: nil,
+    Failures: 0 }
+  
+  l.Connection = l.NewConnection()
+  
+  logger.Info("Created listener.", LogFields{ "listener": name, "nick": nick })
+  
+  return l;
+}
+
+// Listener. Creates a new IRC connection with all of the Listener's callbacks registered.
+func (l *Listener) NewConnection() *irc.Connection {
+  
+  conn := irc.IRC(strings.ToLower(l.Nick), l.Nick)
+  
+  // Anonymous logins take any password.
+  conn.Password = "oauth:"
+  conn.UseTLS = config.Twitch.UseTLS
+  conn.TLSConfig = &tls.Config{ InsecureSkipVerify: config.Twitch.InsecureSkipVerify }
+  conn.AddCallback("*", l.OnAny)
+  conn.AddCallback("001", l.On001)
+  conn.AddCallback("CAP", l.OnCapAck)
+  conn.AddCallback("JOIN", l.OnJoin)
+  conn.AddCallback("NOTICE", l.OnNotice)
+  conn.AddCallback("USERNOTICE", l.OnUserNotice)
+  conn.AddCallback("PRIVMSG", l.OnMessage)
+  conn.AddCallback("RECONNECT", l.OnReconnect)
+  conn.AddCallback("ROOMSTATE", l.OnRoomState)
+  conn.AddCallback("USERSTATE", l.OnUserState)
+  conn.AddCallback("CLEARCHAT", l.OnClearChat)
+  conn.AddCallback("CLEARMSG", l.OnClearMsg)
+  
+  return conn
+}
+
+// Listener. Sets the connection's password to the account's token, validating it first. Anonymous listeners need nothing.
+func (l *Listener) Authenticate(conn *irc.Connection) error {
+  
+  if (l.Account == nil) { return nil }
+  
+  token, err := l.Account.ValidToken()
+  if (err != nil) { return err }
+  
+  conn.Password = "oauth:" + token
+  
+  return nil
+}
+
+// Listener. Returns the JoinLimiter the listener's joins count against: its account's, or the anonymous pool's.
+func (l *Listener) Limiter() *JoinLimiter {
+  
+  if (l.Account != nil) { return l.Account.JoinLimiter }
+  
+  return l.IrcDriver.JoinLimiter
+}
+
+// Listener. Begins Listening to the Twitch IRC servers.
+func (l *Listener) Listen() {
+  
+  l.Lock.Lock()
+  if (l.State != ListenerCreated) { l.Lock.Unlock(); return }
+  l.State = ListenerConnecting
+  conn := l.Connection
+  l.Lock.Unlock()
+  
+  ticker := time.NewTicker(ListenerJoinInterval)
+  go func() {
+    for {
+      select {
+        case <- ticker.C:
+        if (l.GetState() == ListenerDead) { ticker.Stop(); return }
+        l.JoinNext()
+      }
+    }
+  }()
+  
+  if err := l.Authenticate(conn); err != nil {
+    
+    logger.Error("Unable to authenticate.", LogFields{ "listener": l.Username, "account": l.Nick, "error": err })
+    go l.Reconnect()
+    return
+  }
+  
+  if err := conn.Connect(config.Twitch.Address); err != nil {
+    
+    logger.Error("Connection error.", LogFields{ "listener": l.Username, "error": err })
+    go l.Reconnect()
+    return
+  }
+  
+  if (!l.MarkConnected(conn)) { return }
+  
+  go l.WatchConnection(conn)
+}
+
+// Listener. Records that conn finished connecting, making it the active connection if the listener is still waiting for one.
+// A connection no longer wanted, because the listener closed or moved on while it connected, is quit and false is returned.
+func (l *Listener) MarkConnected(conn *irc.Connection) bool {
+  
+  l.Lock.Lock()
+  
+  if (conn == l.NextConnection) {
+    
+    l.NextConnected = true
+    l.Lock.Unlock()
+    return true
+  }
+  
+  if (l.State == ListenerConnecting || (l.State == ListenerJoined && conn == l.Connection)) {
+    
+    l.Connection = conn
+    l.Connected = true
+    l.Lock.Unlock()
+    return true
+  }
+  
+  l.Lock.Unlock()
+  
+  conn.Quit()
+  
+  return false
+}
+
+// Listener. Joins the next batch of buffered channels the JoinLimiter allows,
+// unless the listener is not joined or is migrating.
+func (l *Listener) JoinNext() {
+  
+  l.Lock.Lock()
+  
+  if (l.State != ListenerJoined || l.Migrating) { l.Lock.Unlock(); return }
+  
+  wanted := l.ChannelBuffer.Count
+  if (wanted > config.Joins.BatchSize) { wanted = config.Joins.BatchSize }
+  
+  l.Lock.Unlock()
+  
+  // Tokens are taken without holding Lock; any left unused by the time it is retaken go back.
+  granted := l.Limiter().Take(wanted)
+  if (granted == 0) { return }
+  
+  l.Lock.Lock()
+  
+  if (l.State != ListenerJoined || l.Migrating) { l.Lock.Unlock(); l.Limiter().Give(granted); return }
+  
+  names := make([]string, 0, granted)
+  for ind := 0; ind < granted; ind++ {
+    
+    nextChannel := l.ChannelBuffer.Pop()
+    if (nextChannel == nil) { break }
+    
+    l.Channels[nextChannel.Login] = nextChannel
+    names = append(names, "#" + nextChannel.Login)
+  }
+  conn := l.Connection
+  
+  l.Lock.Unlock()
+  
+  if (len(names) < granted) { l.Limiter().Give(granted - len(names)) }
+  if (len(names) > 0) { conn.Join(strings.Join(names, ",")) }
+}
+
+// Listener. Waits for an error on the given connection. Errors on retired connections are ignored.
+// This is the only reader of conn.Error: the library's own Loop is never run, as it would reconnect the same connection
+// behind the listener's back, and reconnects are left to Reconnect.
+func (l *Listener) WatchConnection(conn *irc.Connection) {
+  
+  err := <- conn.Error
+  
+  l.Lock.Lock()
+  
+  if (conn != l.Connection) {
+    
+    if (conn == l.NextConnection) {
+      
+      logger.Error("Twitch IRC error on migrating connection.", LogFields{ "listener": l.Username, "error": err })
+      l.NextConnection = nil
+      l.NextConnected = false
+      l.Migrating = false
+      l.Rejoined = nil
+      l.Seen = nil
+    }
+    
+    // The old connection is gone, so messages only arrive on the active one again.
+    if (conn == l.Retired) { l.Retired = nil; l.Seen = nil }
+    
+    l.Lock.Unlock()
+    return
+  }
+  
+  // The old connection was dropped before migration finished. Promote the new one now.
+  if (l.Migrating && l.NextConnection != nil) {
+    
+    next := l.NextConnection
+    l.Connected = false
+    l.Lock.Unlock()
+    
+    logger.Warn("Old connection dropped mid-migration. Promoting new connection.", LogFields{ "listener": l.Username })
+    l.FinishMigration(next)
+    return
+  }
+  
+  l.Connected = false
+  
+  // Errors caused by closing the listener are expected.
+  if (l.State == ListenerDraining || l.State == ListenerDead) { l.Lock.Unlock(); return }
+  
+  logger.Error("Twitch IRC error.", LogFields{ "listener": l.Username, "error": err })
+  l.State = ListenerConnecting
+  l.Lock.Unlock()
+  
+  go l.Reconnect()
+}
+
+// Listener. Reconnects with a fresh connection using jittered exponential backoff.
+// The fresh connection only replaces the dead one once it has connected.
+// Channels are re-queued through the ChannelBuffer by On001 once the connection succeeds.
+func (l *Listener) Reconnect() {
+  
+  for {
+    
+    l.Lock.Lock()
+    if (l.State != ListenerConnecting) { l.Lock.Unlock(); return }
+    l.Failures++
+    failures := l.Failures
+    retryLater := l.RetryLater
+    l.RetryLater = false
+    l.Lock.Unlock()
+    
+    ReconnectsTotal.Inc(l.Username)
+    poolFailures := int(l.IrcDriver.PoolFailures.Add(1))
+    
+    if (config.Reconnect.ExitAfterFailures > 0 &&
+        poolFailures >= config.Reconnect.ExitAfterFailures) {
+      
+      logger.Error("Too many consecutive connection failures across the listener pool. Closing.", LogFields{ "failures": poolFailures })
+      RequestClose(ExitListenerFailure)
+      return
+    }
+    
+    delay := l.ReconnectDelay(failures)
+    
+    if (retryLater) { delay += time.Second }
+    
+    logger.Info("Reconnecting listener.", LogFields{ "listener": l.Username, "delay": delay.String(), "failures": failures })
+    time.Sleep(delay)
+    
+    if (l.GetState() != ListenerConnecting) { return }
+    
+    conn := l.NewConnection()
+    
+    if err := l.Authenticate(conn); err != nil {
+      
+      logger.Error("Unable to authenticate.", LogFields{ "listener": l.Username, "account": l.Nick, "error": err })
+      continue
+    }
+    
+    if err := conn.Connect(config.Twitch.Address); err != nil {
+      
+      logger.Error("Connection error.", LogFields{ "listener": l.Username, "error": err })
+      continue
+    }
+    
+    if (!l.MarkConnected(conn)) { return }
+    
+    go l.WatchConnection(conn)
+    
+    return
+  }
+}
+
+// Listener. Returns how long to wait before the next reconnect attempt after the given number of consecutive failures.
+// Once the listener has failed too many times in a row the circuit breaker opens and it waits out the cooldown.
+func (l *Listener) ReconnectDelay(failures int) time.Duration {
+  
+  if (config.Reconnect.BreakerThreshold > 0 && failures >= config.Reconnect.BreakerThreshold) {
+    
+    logger.Warn("Circuit breaker open.", LogFields{ "listener": l.Username })
+  }
+  
+  return BackoffDelay(config.Reconnect, failures, rand.Int63n)
+}
+
+// Static. Returns the delay after the given number of consecutive failures: the breaker's cooldown once they reach its
+// threshold, otherwise the base delay doubled per failure up to the maximum, with equal jitter (half fixed, half drawn
+// from jitter, which returns a value in [0, n) like rand.Int63n).
+func BackoffDelay(c ConfigReconnect, failures int, jitter func(n int64) int64) time.Duration {
+  
+  if (c.BreakerThreshold > 0 && failures >= c.BreakerThreshold) { return time.Duration(c.BreakerCooldownMs) * time.Millisecond }
+  
+  base := time.Duration(c.BaseDelayMs) * time.Millisecond
+  maxDelay := time.Duration(c.MaxDelayMs) * time.Millisecond
+  
+  delay := base
+  for ind := 1; ind < failures && delay < maxDelay; ind++ {
+    
+    delay *= 2
+  }
+  
+  if (delay > maxDelay) { delay = maxDelay }
+  if (delay <= 0) { return 0 }
+  
+  return delay / 2 + time.Duration(jitter(int64(delay / 2) + 1))
+}
+
+// Listener. Called when Twitch is about to drop the connection for maintenance.
+// Opens a new connection and rejoins every channel before retiring the old one.
+func (l *Listener) OnReconnect(e *irc.Event) {
+  
+  l.Lock.Lock()
+  
+  if (!l.IsActiveConnectionLocked(e) || l.Migrating || l.State != ListenerJoined) { l.Lock.Unlock(); return }
+  
+  logger.Info("Twitch issued reconnect. Migrating listener.", LogFields{ "listener": l.Username })
+  
+  next := l.NewConnection()
+  l.Migrating = true
+  l.NextConnection = next
+  l.NextConnected = false
+  l.Rejoined = make(map[string]bool, len(l.Channels))
+  l.Seen = make(map[string]bool, 256)
+  l.Lock.Unlock()
+  
+  err := l.Authenticate(next)
+  if (err == nil) { err = next.Connect(config.Twitch.Address) }
+  
+  if (err != nil) {
+    
+    logger.Error("Migration connection error.", LogFields{ "listener": l.Username, "error": err })
+    
+    l.Lock.Lock()
+    if (l.NextConnection == next) { l.NextConnection = nil; l.Migrating = false; l.Rejoined = nil; l.Seen = nil }
+    l.Lock.Unlock()
+    return
+  }
+  
+  if (!l.MarkConnected(next)) { return }
+  
+  go l.WatchConnection(next)
+}
+
+// Listener. Rejoins every known channel on the given connection at the join rate and finishes the migration once
+// Twitch has confirmed every join, or RejoinConfirmTimeout after the last was sent.
+func (l *Listener) RejoinChannels(conn *irc.Connection) {
+  
+  channels := l.JoinedNames()
+  
+  for ind := 0; ind < len(channels); ind += config.Joins.BatchSize {
+    
+    // The migration was abandoned or already finished.
+    l.Lock.Lock()
+    abandoned := (conn != l.NextConnection && conn != l.Connection)
+    l.Lock.Unlock()
+    
+    if (abandoned) { return }
+    
+    end := ind + config.Joins.BatchSize
+    if (end > len(channels)) { end = len(channels) }
+    
+    names := make([]string, 0, end - ind)
+    for j := ind; j < end; j++ {
+      
+      names = append(names, "#" + channels[j])
+    }
+    
+    l.Limiter().Wait(len(names), ListenerJoinInterval)
+    conn.Join(strings.Join(names, ","))
+  }
+  
+  deadline := time.Now().Add(RejoinConfirmTimeout)
+  for !l.RejoinedAll(conn, channels) {
+    
+    if (time.Now().After(deadline)) {
+      
+      logger.Warn("Not every channel confirmed joined on new connection. Migrating anyway.", LogFields{ "listener": l.Username, "channels": len(channels) })
+      break
+    }
+    
+    time.Sleep(ListenerJoinInterval)
+  }
+  
+  logger.Info("Rejoined channels on new connection.", LogFields{ "listener": l.Username, "channels": len(channels) })
+  
+  l.FinishMigration(conn)
+}
+
+// Listener. Returns whether the given migrating connection has confirmed joining every given channel,
+// or is no longer migrating, leaving nothing to wait for.
+func (l *Listener) RejoinedAll(conn *irc.Connection, channels []string) bool {
+  
+  l.Lock.Lock()
+  defer l.Lock.Unlock()
+  
+  if (conn != l.NextConnection) { return true }
+  
+  for ind := 0; ind < len(channels); ind++ {
+    
+    if (!l.Rejoined[channels[ind]]) { return false }
+  }
+  
+  return true
+}
+
+// Listener. Called when a client joins a channel. Only the listener's own joins on a migrating connection are counted.
+func (l *Listener) OnJoin(e *irc.Event) {
+  
+  if (len(e.Arguments) == 0 || !strings.EqualFold(e.Nick, l.Nick)) { return }
+  
+  l.Lock.Lock()
+  defer l.Lock.Unlock()
+  
+  if (e.Connection == nil || e.Connection != l.NextConnection || l.Rejoined == nil) { return }
+  
+  l.Rejoined[strings.TrimPrefix(strings.ToLower(e.Arguments[0]), "#")] = true
+}
+
+// Listener. Makes the given connection the active one and closes the old one.
+func (l *Listener) FinishMigration(conn *irc.Connection) {
+  
+  l.Lock.Lock()
+  
+  if (conn != l.NextConnection) { l.Lock.Unlock(); return }
+  
+  old := l.Connection
+  oldConnected := l.Connected
+  
+  l.Connection = conn
+  l.Connected = l.NextConnected
+  l.NextConnection = nil
+  l.NextConnected = false
+  l.Migrating = false
+  l.Rejoined = nil
+  
+  // Messages still in flight on the old connection are handled until it closes, unless they were already.
+  if (oldConnected) { l.Retired = old } else { l.Seen = nil }
+  
+  l.Lock.Unlock()
+  
+  if (oldConnected) { old.Quit() }
+  
+  logger.Info("Listener migrated to new connection.", LogFields{ "listener": l.Username })
+}
+
+// Listener. Returns whether the event came from the connection currently delivering messages.
+func (l *Listener) IsActiveConnection(e *irc.Event) bool {
+  
+  l.Lock.Lock()
+  defer l.Lock.Unlock()
+  
+  return l.IsActiveConnectionLocked(e)
+}
+
+// Listener. Returns whether a message with the given id tag should be handled. Normally that is whether it came from
+// the active connection. During a migration it may come from either connection, old or new, and only its first copy is.
+func (l *Listener) FirstCopy(e *irc.Event, id string) bool {
+  
+  l.Lock.Lock()
+  defer l.Lock.Unlock()
+  
+  if (l.Seen == nil || e.Connection == nil || id == "") { return l.IsActiveConnectionLocked(e) }
+  
+  if (e.Connection != l.Connection && e.Connection != l.NextConnection && e.Connection != l.Retired) { return false }
+  if (l.Seen[id]) { return false }
+  
+  l.Seen[id] = true
+  
+  return true
+}
+
+// Listener. Same as IsActiveConnection, for callers already holding Lock.
+func (l *Listener) IsActiveConnectionLocked(e *irc.Event) bool {
+  
+  return (e.Connection == nil || e.Connection == l.Connection)
+}
+
+// Listener. Returns the connection currently delivering messages.
+func (l *Listener) ActiveConnection() *irc.Connection {
+  
+  l.Lock.Lock()
+  defer l.Lock.Unlock()
+  
+  return l.Connection
+}
+
+// Listener. Returns the active connection if the listener is joined on it and it has connected, so it can be sent on
+// without waiting for a reconnect. Returns nil otherwise.
+func (l *Listener) SendingConnection() *irc.Connection {
+  
+  l.Lock.Lock()
+  defer l.Lock.Unlock()
+  
+  if (l.State != ListenerJoined || !l.Connected) { return nil }
+  
+  return l.Connection
+}
+
+// Listener. Returns the current lifecycle state.
+func (l *Listener) GetState() ListenerState {
+  
+  l.Lock.Lock()
+  defer l.Lock.Unlock()
+  
+  return l.State
+}
+
+// Listener. Returns whether new channels may be queued on this listener.
+func (l *Listener) AcceptsChannels() bool {
+  
+  l.Lock.Lock()
+  defer l.Lock.Unlock()
+  
+  return (l.State != ListenerDraining && l.State != ListenerDead)
+}
+
+// Listener. Returns a point-in-time view of the listener.
+func (l *Listener) Status() ListenerStatus {
+  
+  l.Lock.Lock()
+  defer l.Lock.Unlock()
+  
+  return ListenerStatus{
+    Username: l.Username,
+    Account: l.AccountLogin(),
+    State: l.State.String(),
+    Joined: len(l.Channels),
+    Buffered: l.ChannelBuffer.Count,
+    Migrating: l.Migrating,
+    Failures: l.Failures }
+}
+
+// Listener. Returns the login of the listener's account, or "" if it is anonymous.
+func (l *Listener) AccountLogin() string {
+  
+  if (l.Account == nil) { return "" }
+  
+  return l.Account.Login
+}
+
+// Listener. Closes the listener for good. Its channels are dropped along with the connection.
+func (l *Listener) Close() {
+  
+  l.Lock.Lock()
+  
+  if (l.State == ListenerDraining || l.State == ListenerDead) { l.Lock.Unlock(); return }
+  
+  // Connections still connecting are quit by MarkConnected once they finish.
+  l.State = ListenerDraining
+  conn, connected := l.Connection, l.Connected
+  next, nextConnected := l.NextConnection, l.NextConnected
+  l.Connected = false
+  l.NextConnection = nil
+  l.NextConnected = false
+  l.Migrating = false
+  l.Lock.Unlock()
+  
+  if (connected) { conn.Quit() }
+  if (next != nil && nextConnected) { next.Quit() }
+  
+  l.Lock.Lock()
+  l.State = ListenerDead
+  l.Lock.Unlock()
+  
+  logger.Info("Closed listener.", LogFields{ "listener": l.Username })
+}
+
+// Listener. Returns the number of channels waiting to be joined.
+func (l *Listener) BufferedCount() int {
+  
+  l.Lock.Lock()
+  defer l.Lock.Unlock()
+  
+  return l.ChannelBuffer.Count
+}
+
+// Listener. Returns the number of channels joined.
+func (l *Listener) JoinedCount() int {
+  
+  l.Lock.Lock()
+  defer l.Lock.Unlock()
+  
+  return len(l.Channels)
+}
+
+// Listener. Returns the number of channels joined or waiting to be joined.
+func (l *Listener) ChannelCount() int {
+  
+  l.Lock.Lock()
+  defer l.Lock.Unlock()
+  
+  return len(l.Channels) + l.ChannelBuffer.Count
+}
+
+// Listener. Returns the logins of every joined channel.
+func (l *Listener) JoinedNames() []string {
+  
+  l.Lock.Lock()
+  defer l.Lock.Unlock()
+  
+  names := make([]string, 0, len(l.Channels))
+  for name := range l.Channels {
+    
+    names = append(names, name)
+  }
+  
+  return names
+}
+
+// Listener. Returns the joined channel with the given login, or nil.
+func (l *Listener) GetChannel(name string) *ogdm.IdentitySlim {
+  
+  l.Lock.Lock()
+  defer l.Lock.Unlock()
+  
+  return l.Channels[name]
+}
+
+// Listener. Queues a channel to be joined.
+func (l *Listener) QueueChannel(user *ogdm.IdentitySlim) {
+  
+  l.Lock.Lock()
+  defer l.Lock.Unlock()
+  
+  l.ChannelBuffer.Push(user)
+}
+
+// Listener. Parts a channel and forgets it, whether it was joined or still waiting to be.
+// Without a connection up there is nothing to part, so the channel is only forgotten.
+func (l *Listener) Part(name string) {
+  
+  l.Lock.Lock()
+  
+  _, joined := l.Channels[name]
+  delete(l.Channels, name)
+  
+  // The queue has no removal, so rebuild it without the channel.
+  queued := l.ChannelBuffer
+  l.ChannelBuffer = ogdm.IdentityQueueNew(ChannelBufferCapacity)
+  for queued.Count > 0 {
+    
+    next := queued.Pop()
+    if (next.Login != name) { l.ChannelBuffer.Push(next) }
+  }
+  
+  connected := (l.State == ListenerJoined && l.Connected)
+  conn := l.Connection
+  l.Lock.Unlock()
+  
+  if (joined && connected) { conn.Part("#" + name) }
+}
+
+// Listener. Replaces the listener's copy of a channel, joined or waiting, with one whose platform ID has been filled in.
+func (l *Listener) Backfill(user *ogdm.IdentitySlim) {
+  
+  l.Lock.Lock()
+  defer l.Lock.Unlock()
+  
+  if _, joined := l.Channels[user.Login]; joined { l.Channels[user.Login] = user }
+  
+  queued := l.ChannelBuffer
+  l.ChannelBuffer = ogdm.IdentityQueueNew(ChannelBufferCapacity)
+  for queued.Count > 0 {
+    
+    next := queued.Pop()
+    if (next.Login == user.Login) { next = user }
+    l.ChannelBuffer.Push(next)
+  }
+}
+
+// Listener. Parts every joined channel and forgets the ones still waiting to be joined. Returns how many were parted,
+// which is none without a connection up.
+func (l *Listener) PartAll() int {
+  
+  l.Lock.Lock()
+  
+  names := make([]string, 0, len(l.Channels))
+  for name := range l.Channels { names = append(names, "#" + name) }
+  
+  l.Channels = make(map[string]*ogdm.IdentitySlim, 0)
+  l.ChannelBuffer = ogdm.IdentityQueueNew(ChannelBufferCapacity)
+  
+  connected := (l.State == ListenerJoined && l.Connected)
+  conn := l.Connection
+  l.Lock.Unlock()
+  
+  if (!connected) { return 0 }
+  
+  for ind := 0; ind < len(names); ind += config.Joins.BatchSize {
+    
+    end := ind + config.Joins.BatchSize
+    if (end > len(names)) { end = len(names) }
+    
+    conn.Part(strings.Join(names[ind:end], ","))
+  }
+  
+  return len(names)
+}
+
+// Listener. Called when the client connects to the IRC server.
+func (l *Listener) On001(e *irc.Event) {
+  
+  l.Lock.Lock()
+  
+  if (e.Connection != nil && e.Connection == l.NextConnection) {
+    
+    l.NextConnected = true
+    l.Lock.Unlock()
+    
+    e.Connection.SendRaw("CAP REQ :twitch.tv/commands")
+    e.Connection.SendRaw("CAP REQ :twitch.tv/tags")
+    
+    go l.RejoinChannels(e.Connection)
+    return
+  }
+  
+  // A 001 on the active connection while joined means it reconnected by itself, losing its channels all the same.
+  if (l.State != ListenerConnecting && !(l.State == ListenerJoined && l.IsActiveConnectionLocked(e))) { l.Lock.Unlock(); return }
+  
+  if (l.State == ListenerJoined) { logger.Warn("Connection re-registered while joined. Rejoining channels.", LogFields{ "listener": l.Username }) }
+  
+  // A reconnecting listener's new connection can register before Connect returns. It is the one to use from here on.
+  if (e.Connection != nil) { l.Connection = e.Connection; l.Connected = true }
+  conn := l.Connection
+  
+  l.Failures = 0
+  
+  // After a reconnect, every previously joined channel must be joined again.
+  for name, channel := range l.Channels {
+    
+    l.ChannelBuffer.Push(channel)
+    delete(l.Channels, name)
+  }
+  
+  l.State = ListenerJoined
+  
+  l.Lock.Unlock()
+  
+  l.IrcDriver.PoolFailures.Store(0)
+  
+  conn.SendRaw("CAP REQ :twitch.tv/commands")
+  conn.SendRaw("CAP REQ :twitch.tv/tags")
+}
@@ -0,0 +1,313 @@
+/*
+*
+* Name:     Twitch IRC Listener
+* Sys Name: twitch-irc
+* Author:   Nifty255
+*
+*/
+
+package main
+
+import (
+  "time"    // Timing related functions.
+  "regexp"  // Regular expressions.
+  "strconv" // String conversion functions.
+  "strings" // String manipulation functions.
+  "testing" // Go's testing framework.
+)
+
+func TestShutdownWithListenersNeverConnected(t *testing.T) {
+  
+  srv, _ := startTestDriver(t)
+  
+  // With the server gone every connect fails, leaving the listener reconnecting with nothing connected.
+  srv.Close()
+  
+  if _, err := ListenToChannels(kiteRequest(t, testChannels("dallas", 2, 100))); err != nil { t.Fatal(err) }
+  
+  listener := ircDriver.ListenerPool.Last()
+  if err := srv.WaitFor(func() bool { return listener.Status().Failures > 0 }, 5 * time.Second); err != nil { t.Fatalf("listener = %+v, want it reconnecting", listener.Status()) }
+  
+  // A second listener that never even started connecting.
+  ircDriver.StateLock.Lock()
+  created := ircDriver.NewListener()
+  ircDriver.ListenerPool.Add(created)
+  ircDriver.StateLock.Unlock()
+  
+  start := time.Now()
+  ircDriver.Shutdown(time.Second)
+  
+  if elapsed := time.Since(start); elapsed >= ListenerCloseTimeout { t.Errorf("Shutdown took %v, want it not to wait on unconnected listeners", elapsed) }
+  if (listener.GetState() != ListenerDead || created.GetState() != ListenerDead) { t.Errorf("states = %v %v, want both dead", listener.GetState(), created.GetState()) }
+}
+
+func TestMarkConnectedAfterClose(t *testing.T) {
+  
+  srv, _ := startTestDriver(t)
+  
+  l := CreateListener("justinfan1234", nil, ircDriver)
+  conn := l.Connection
+  
+  l.Lock.Lock()
+  l.State = ListenerConnecting
+  l.Lock.Unlock()
+  
+  if err := conn.Connect(srv.Addr); err != nil { t.Fatal(err) }
+  
+  // Closed while connecting: nothing to quit yet.
+  l.Close()
+  
+  if (l.MarkConnected(conn)) { t.Errorf("a closed listener took the connection") }
+  if err := srv.WaitFor(func() bool { return len(srv.ConnectedClients()) == 0 }, 5 * time.Second); err != nil { t.Errorf("clients = %d, want the late connection quit", len(srv.ConnectedClients())) }
+}
+
+func TestMarkConnectedWhileConnecting(t *testing.T) {
+  
+  srv, _ := startTestDriver(t)
+  
+  l := CreateListener("justinfan1234", nil, ircDriver)
+  
+  l.Lock.Lock()
+  l.State = ListenerConnecting
+  l.Lock.Unlock()
+  
+  // A fresh connection from a reconnect replaces the old one once it has connected.
+  conn := l.NewConnection()
+  if err := conn.Connect(srv.Addr); err != nil { t.Fatal(err) }
+  
+  if (!l.MarkConnected(conn)) { t.Fatalf("a connecting listener refused its new connection") }
+  
+  l.Lock.Lock()
+  active, connected := l.Connection, l.Connected
+  l.Lock.Unlock()
+  
+  if (active != conn || !connected) { t.Errorf("connection = %p connected %v, want %p connected", active, connected, conn) }
+  
+  l.Close()
+}
+
+// Runs fn, failing the test if it has not returned within a second.
+func withinSecond(t *testing.T, what string, fn func()) {
+  
+  t.Helper()
+  
+  done := make(chan struct{})
+  go func() { fn(); close(done) }()
+  
+  select {
+    case <- done:
+    case <- time.After(time.Second):
+    t.Fatalf("%s did not return.", what)
+  }
+}
+
+func TestPartWithoutConnection(t *testing.T) {
+  
+  saved := config
+  defer func() { config = saved }()
+  
+  config = DefaultConfig()
+  
+  // Joined channels on a connection that never connected, as after a failed reconnect.
+  l := CreateListener("justinfan1234", nil, nil)
+  channels := testChannels("dallas", 3, 100)
+  
+  l.State = ListenerJoined
+  l.Channels[channels[0].Login] = &channels[0]
+  l.Channels[channels[1].Login] = &channels[1]
+  l.ChannelBuffer.Push(&channels[2])
+  
+  withinSecond(t, "Part", func() { l.Part(channels[0].Login) })
+  
+  if (l.GetChannel(channels[0].Login) != nil || l.ChannelCount() != 2) { t.Errorf("channels = %d, want the parted one forgotten", l.ChannelCount()) }
+  
+  withinSecond(t, "PartAll", func() {
+    
+    if parted := l.PartAll(); parted != 0 { t.Errorf("parted = %d, want none sent", parted) }
+  })
+  
+  if (l.ChannelCount() != 0) { t.Errorf("channels = %d, want all forgotten", l.ChannelCount()) }
+  
+  // The emptied queue still takes channels.
+  for ind := 0; ind < len(channels); ind++ { l.QueueChannel(&channels[ind]) }
+  
+  if (l.BufferedCount() != len(channels)) { t.Errorf("buffered = %d after PartAll, want %d", l.BufferedCount(), len(channels)) }
+  
+  // As does a queue rebuilt by Part and Backfill.
+  l.Part(channels[0].Login)
+  l.Backfill(&channels[1])
+  l.QueueChannel(&channels[0])
+  
+  if (l.BufferedCount() != len(channels)) { t.Errorf("buffered = %d after Part and Backfill, want %d", l.BufferedCount(), len(channels)) }
+}
+
+func TestListenerMigratesOnReconnect(t *testing.T) {
+  
+  srv, sink := startTestDriver(t)
+  
+  channels := testChannels("dallas", 3, 100)
+  listenAndWait(t, srv, channels)
+  
+  old := srv.ConnectedClients()
+  if (len(old) != 1) { t.Fatalf("clients = %d, want 1", len(old)) }
+  
+  // Messages keep coming, round robin across the channels, throughout the handover.
+  stop := make(chan bool)
+  total := make(chan int, 1)
+  go func() {
+    
+    for n := 0; ; n++ {
+      
+      select {
+        case <- stop:
+        total <- n
+        return
+        default:
+      }
+      
+      channel := channels[n % len(channels)]
+      srv.Privmsg(channel.Login, "ronni", "id=msg-" + strconv.Itoa(n) + ";room-id=" + channel.PlatformID + ";user-id=9", "line " + strconv.Itoa(n))
+      time.Sleep(time.Millisecond)
+    }
+  }()
+  
+  if err := srv.WaitFor(func() bool { return sink.ChatCount() >= 20 }, 5 * time.Second); err != nil { close(stop); t.Fatalf("chat lines = %d before reconnect", sink.ChatCount()) }
+  
+  srv.Reconnect(0)
+  
+  // Migrated once the old client has quit and a new one holds every channel.
+  err := srv.WaitFor(func() bool {
+    
+    clients := srv.ConnectedClients()
+    if (len(clients) != 1 || clients[0] == old[0]) { return false }
+    
+    for ind := 0; ind < len(channels); ind++ {
+      
+      if (!clients[0].InChannel(channels[ind].Login)) { return false }
+    }
+    
+    return true
+  }, 10 * time.Second)
+  if (err != nil) { close(stop); t.Fatalf("listener did not migrate: %v", err) }
+  
+  migrated := sink.ChatCount()
+  if err := srv.WaitFor(func() bool { return sink.ChatCount() >= migrated + 20 }, 5 * time.Second); err != nil { t.Errorf("chat stalled after migration") }
+  
+  close(stop)
+  sent := <-total
+  
+  if err := srv.WaitFor(func() bool { return sink.ChatCount() >= sent }, 5 * time.Second); err != nil { t.Errorf("chat lines = %d, want %d", sink.ChatCount(), sent) }
+  time.Sleep(50 * time.Millisecond)
+  
+  // Every message once, none lost to the switch and none taken from both connections.
+  sink.Lock.Lock()
+  seen := make(map[string]int, len(sink.Chat))
+  idFinder := regexp.MustCompile(`id=(msg-\d+)`)
+  for ind := 0; ind < len(sink.Chat); ind++ { seen[idFinder.FindStringSubmatch(sink.Chat[ind])[1]]++ }
+  sink.Lock.Unlock()
+  
+  for n := 0; n < sent; n++ {
+    
+    if count := seen["msg-" + strconv.Itoa(n)]; count != 1 { t.Errorf("msg-%d delivered %d times, want once", n, count) }
+  }
+  
+  // Each channel was joined a second time, on the new connection, before the old one quit.
+  joins := make(map[string]int, len(channels))
+  quit := false
+  lines := srv.Lines()
+  for ind := 0; ind < len(lines) && !quit; ind++ {
+    
+    command, rest, _ := strings.Cut(lines[ind].Line, " ")
+    
+    if (command == "QUIT") { quit = true }
+    if (command != "JOIN") { continue }
+    
+    names := strings.Split(rest, ",")
+    for name := 0; name < len(names); name++ { joins[strings.TrimPrefix(names[name], "#")]++ }
+  }
+  
+  if (!quit) { t.Errorf("the old connection never quit") }
+  
+  for ind := 0; ind < len(channels); ind++ {
+    
+    if (joins[channels[ind].Login] != 2) { t.Errorf("%s joined %d times before the old connection quit, want 2", channels[ind].Login, joins[channels[ind].Login]) }
+  }
+}
+
+// Returns a counter's value for the given label values.
+func counterValue(m *MetricFamily, values ...string) float64 {
+  
+  m.Lock.Lock()
+  defer m.Lock.Unlock()
+  
+  return m.Get(values).Value
+}
+
+// Returns the listener's consecutive connection failures.
+func listenerFailures(l *Listener) int {
+  
+  l.Lock.Lock()
+  defer l.Lock.Unlock()
+  
+  return l.Failures
+}
+
+func TestListenerReconnectsAfterDrop(t *testing.T) {
+  
+  srv, _ := startTestDriver(t, func(c *Config) { c.Reconnect = ConfigReconnect{ BaseDelayMs: 200, MaxDelayMs: 400, BreakerThreshold: 5, BreakerCooldownMs: 1000 } })
+  
+  channels := testChannels("dallas", 3, 100)
+  listenAndWait(t, srv, channels)
+  
+  l := ircDriver.ListenerPool.Snapshot()[0]
+  reconnects := counterValue(ReconnectsTotal, l.Username)
+  
+  old := srv.ConnectedClients()[0]
+  dropped := time.Now()
+  srv.Drop(old)
+  
+  err := srv.WaitFor(func() bool {
+    
+    clients := srv.ConnectedClients()
+    return len(clients) == 1 && clients[0] != old
+  }, 5 * time.Second)
+  if (err != nil) { t.Fatalf("listener did not reconnect: %v", err) }
+  
+  // The first retry waits at least half the base delay.
+  if elapsed := time.Since(dropped); elapsed < 100 * time.Millisecond { t.Errorf("reconnected after %v, want a backoff of at least 100ms", elapsed) }
+  
+  if err := srv.WaitForJoins(channelLogins(channels), 5 * time.Second); err != nil { t.Fatalf("channels not rejoined: %v", err) }
+  
+  if got := counterValue(ReconnectsTotal, l.Username) - reconnects; got != 1 { t.Errorf("reconnects = %v, want 1", got) }
+  if (listenerFailures(l) != 0) { t.Errorf("failures = %d, want them reset once connected", listenerFailures(l)) }
+}
+
+func TestListenerBreakerOpens(t *testing.T) {
+  
+  srv, _ := startTestDriver(t, func(c *Config) { c.Reconnect = ConfigReconnect{ BaseDelayMs: 10, MaxDelayMs: 20, BreakerThreshold: 2, BreakerCooldownMs: 2000 } })
+  
+  channels := testChannels("dallas", 1, 100)
+  listenAndWait(t, srv, channels)
+  
+  l := ircDriver.ListenerPool.Snapshot()[0]
+  
+  // Every login is refused until the breaker has opened.
+  srv.Lock.Lock()
+  srv.Authenticate = func(nick, password string) bool { return false }
+  srv.Lock.Unlock()
+  
+  srv.Drop(srv.ConnectedClients()[0])
+  
+  if err := srv.WaitFor(func() bool { return listenerFailures(l) >= 2 }, 5 * time.Second); err != nil { t.Fatalf("failures = %d, want 2", listenerFailures(l)) }
+  
+  // Without the breaker the next attempt would follow a refused login's extra second; with it, it waits out the cooldown.
+  time.Sleep(1500 * time.Millisecond)
+  if (listenerFailures(l) != 2) { t.Errorf("failures = %d, want the breaker holding at 2", listenerFailures(l)) }
+  
+  srv.Lock.Lock()
+  srv.Authenticate = nil
+  srv.Lock.Unlock()
+  
+  if err := srv.WaitFor(func() bool { return len(srv.ConnectedClients()) == 1 && srv.ConnectedClients()[0].InChannel(channels[0].Login) }, 5 * time.Second); err != nil { t.Fatalf("listener did not recover after the cooldown: %v", err) }
+  if (listenerFailures(l) != 0) { t.Errorf("failures = %d, want them reset once connected", listenerFailures(l)) }
+}
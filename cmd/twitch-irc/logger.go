@@ -0,0 +1,243 @@
+/*
+*
+* Name:     Twitch IRC Listener
+* Sys Name: twitch-irc
+* Author:   Nifty255
+*
+*/
+
+package main
+
+import (
+  "io"            // Reader/Writer interfaces.
+  "os"            // File functions.
+  "fmt"           // Prints to console.
+  "sort"          // Sorting functions.
+  "sync"          // Mutual exclusion locks.
+  "time"          // Timing related functions.
+  "bytes"         // Byte buffer functions.
+  "strings"       // String manipulation functions.
+  "sync/atomic"   // Atomic primitives.
+  "encoding/json" // JSON encoding functions.
+)
+
+// Specifies how severe a log line is. Lines below the logger's level are discarded.
+type LogLevel int32
+
+const (
+  LogDebug LogLevel = iota
+  LogInfo
+  LogWarn
+  LogError
+)
+
+func (l LogLevel) String() string {
+  
+  switch(l) {
+    
+    case LogDebug:
+    return "debug"
+    case LogInfo:
+    return "info"
+    case LogWarn:
+    return "warn"
+    case LogError:
+    return "error"
+  }
+  
+  return "unknown"
+}
+
+// Static. Parses a level name. Returns false if it is not one.
+func ParseLogLevel(name string) (LogLevel, bool) {
+  
+  switch(strings.ToLower(name)) {
+    
+    case "debug":
+    return LogDebug, true
+    case "info":
+    return LogInfo, true
+    case "warn", "warning":
+    return LogWarn, true
+    case "error":
+    return LogError, true
+  }
+  
+  return LogInfo, false
+}
+
+// Specifies the structured fields of a log line, such as "listener", "channel", "msg_id" and "event_id".
+type LogFields map[string]interface{}
+
+// Specifies how many times a message has been logged in the current window.
+type LogLimit struct {
+  
+  Start      time.Time
+  Count      int
+  Suppressed int
+}
+
+// Specifies a leveled logger writing JSON or logfmt lines. Warnings and errors are rate limited per message,
+// so keep messages constant and put anything variable in fields.
+type Logger struct {
+  
+  Level      atomic.Int32
+  Format     string
+  Output     io.Writer
+  RateWindow time.Duration
+  RateBurst  int
+  Limits     map[string]*LogLimit
+  Lock       sync.Mutex
+}
+
+// The process-wide logger. It logs at info in logfmt until Configure is called with the loaded config.
+var logger = LoggerNew(os.Stdout)
+
+// Static. Creates a Logger with default settings.
+func LoggerNew(output io.Writer) *Logger {
+  
+  l := &(Logger{
+    Format: "logfmt",
+    Output: output,
+    RateWindow: 10 * time.Second,
+    RateBurst: 5,
+    Limits: make(map[string]*LogLimit, 64) })
+  
+  l.Level.Store(int32(LogInfo))
+  
+  return l
+}
+
+// Logger. Applies logging config.
+func (l *Logger) Configure(c ConfigLogging) {
+  
+  if level, ok := ParseLogLevel(c.Level); ok { l.SetLevel(level) }
+  
+  l.Lock.Lock()
+  defer l.Lock.Unlock()
+  
+  if (c.Format == "json" || c.Format == "logfmt") { l.Format = c.Format }
+  if (c.RateLimitWindowMs > 0) { l.RateWindow = time.Duration(c.RateLimitWindowMs) * time.Millisecond }
+  if (c.RateLimitBurst > 0) { l.RateBurst = c.RateLimitBurst }
+}
+
+func (l *Logger) SetLevel(level LogLevel) {
+  
+  l.Level.Store(int32(level))
+}
+
+func (l *Logger) GetLevel() LogLevel {
+  
+  return LogLevel(l.Level.Load())
+}
+
+func (l *Logger) Debug(msg string, fields LogFields) { l.Log(LogDebug, msg, fields) }
+func (l *Logger) Info(msg string, fields LogFields)  { l.Log(LogInfo, msg, fields) }
+func (l *Logger) Warn(msg string, fields LogFields)  { l.Log(LogWarn, msg, fields) }
+func (l *Logger) Error(msg string, fields LogFields) { l.Log(LogError, msg, fields) }
+
+// Logger. Writes a line if level is enabled and, for warnings and errors, the message is not over its rate limit.
+// The first line after a suppressed run carries a "suppressed" count.
+func (l *Logger) Log(level LogLevel, msg string, fields LogFields) {
+  
+  if (level < l.GetLevel()) { return }
+  
+  now := time.Now()
+  
+  l.Lock.Lock()
+  defer l.Lock.Unlock()
+  
+  if (level >= LogWarn) {
+    
+    limit, ok := l.Limits[msg]
+    if (!ok || now.Sub(limit.Start) >= l.RateWindow) {
+      
+      suppressed := 0
+      if (ok) { suppressed = limit.Suppressed }
+      
+      limit = &(LogLimit{ Start: now })
+      l.Limits[msg] = limit
+      
+      if (suppressed > 0) {
+        
+        copied := make(LogFields, len(fields) + 1)
+        for key, value := range fields { copied[key] = value }
+        copied["suppressed"] = suppressed
+        fields = copied
+      }
+    }
+    
+    if (limit.Count >= l.RateBurst) { limit.Suppressed++; return }
+    limit.Count++
+  }
+  
+  var line []byte
+  if (l.Format == "json") {
+    
+    line = FormatJsonLine(now, level, msg, fields)
+  } else {
+    
+    line = FormatLogfmtLine(now, level, msg, fields)
+  }
+  
+  l.Output.Write(line)
+}
+
+// Static. Returns the field names in a stable order.
+func SortedFieldNames(fields LogFields) []string {
+  
+  names := make([]string, 0, len(fields))
+  for name := range fields { names = append(names, name) }
+  sort.Strings(names)
+  
+  return names
+}
+
+// Static. Formats a log line as a single JSON object.
+func FormatJsonLine(now time.Time, level LogLevel, msg string, fields LogFields) []byte {
+  
+  record := make(map[string]interface{}, len(fields) + 3)
+  for name, value := range fields {
+    
+    if err, ok := value.(error); ok { value = err.Error() }
+    record[name] = value
+  }
+  record["time"] = now.UTC().Format(time.RFC3339Nano)
+  record["level"] = level.String()
+  record["msg"] = msg
+  
+  data, err := json.Marshal(record)
+  if (err != nil) { data, _ = json.Marshal(map[string]string{ "level": "error", "msg": "Unable to encode log line.", "error": err.Error() }) }
+  
+  return append(data, '\n')
+}
+
+// Static. Formats a log line as logfmt key=value pairs.
+func FormatLogfmtLine(now time.Time, level LogLevel, msg string, fields LogFields) []byte {
+  
+  var buffer bytes.Buffer
+  
+  buffer.WriteString("time=" + now.UTC().Format(time.RFC3339Nano))
+  buffer.WriteString(" level=" + level.String())
+  buffer.WriteString(" msg=" + LogfmtValue(msg))
+  
+  names := SortedFieldNames(fields)
+  for ind := 0; ind < len(names); ind++ {
+    
+    buffer.WriteString(" " + names[ind] + "=" + LogfmtValue(fmt.Sprint(fields[names[ind]])))
+  }
+  
+  buffer.WriteByte('\n')
+  
+  return buffer.Bytes()
+}
+
+// Static. Quotes a logfmt value if it is empty or contains spaces, quotes, equals signs or control characters.
+func LogfmtValue(value string) string {
+  
+  if (value != "" && !strings.ContainsAny(value, " \"=\\\t\r\n")) { return value }
+  
+  quoted, _ := json.Marshal(value)
+  
+  return string(quoted)
+}
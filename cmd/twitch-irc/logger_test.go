@@ -0,0 +1,78 @@
+/*
+*
+* Name:     Twitch IRC Listener
+* Sys Name: twitch-irc
+* Author:   Nifty255
+*
+*/
+
+package main
+
+import (
+  "bytes"                        // Byte buffer functions.
+  "strings"                      // String manipulation functions.
+  "testing"                      // Go's testing framework.
+  "github.com/koding/kite"       // Microservice functions and structures.
+  "github.com/koding/kite/dnode" // Kite argument structures.
+)
+
+// Replaces the process-wide logger with one writing to a buffer until the test ends.
+func captureLogs(t *testing.T) *bytes.Buffer {
+  
+  t.Helper()
+  
+  var out bytes.Buffer
+  saved := logger
+  logger = LoggerNew(&out)
+  
+  t.Cleanup(func() { logger = saved })
+  
+  return &out
+}
+
+func TestSetLogLevelAtRuntime(t *testing.T) {
+  
+  out := captureLogs(t)
+  
+  cases := []struct {
+    
+    arg     interface{}
+    level   string
+    fails   bool
+    written []string
+    dropped []string
+  }{
+    { "debug", "debug", false, []string{ "debug line" }, nil },
+    { "WARNING", "warn", false, []string{ "warn line", "error line" }, []string{ "debug line", "info line" } },
+    { "error", "error", false, []string{ "error line" }, []string{ "info line", "warn line" } },
+    
+    // An unknown level leaves the current one alone.
+    { "loud", "error", true, []string{ "error line" }, []string{ "warn line" } },
+    { nil, "error", false, []string{ "error line" }, []string{ "warn line" } },
+  }
+  
+  for ind := 0; ind < len(cases); ind++ {
+    
+    request := &(kite.Request{ Args: &(dnode.Partial{ Raw: []byte("[]") }) })
+    if (cases[ind].arg != nil) { request = kiteRequest(t, cases[ind].arg) }
+    
+    level, err := SetLogLevel(request)
+    if (level != cases[ind].level || cases[ind].fails != (err != nil)) { t.Errorf("set %v: level %v, err %v, want %s and failure %v", cases[ind].arg, level, err, cases[ind].level, cases[ind].fails) }
+    
+    out.Reset()
+    logger.Debug("debug line", nil)
+    logger.Info("info line", nil)
+    logger.Warn("warn line", nil)
+    logger.Error("error line", nil)
+    
+    for j := 0; j < len(cases[ind].written); j++ {
+      
+      if (!strings.Contains(out.String(), cases[ind].written[j])) { t.Errorf("at %s, %q was not logged", cases[ind].level, cases[ind].written[j]) }
+    }
+    
+    for j := 0; j < len(cases[ind].dropped); j++ {
+      
+      if (strings.Contains(out.String(), cases[ind].dropped[j])) { t.Errorf("at %s, %q was logged", cases[ind].level, cases[ind].dropped[j]) }
+    }
+  }
+}
@@ -9,9 +9,9 @@
 package main
 
 import (
-  "fmt"
   "os"
   "os/signal"
+  "time"
   "syscall"
   "errors"
   "github.com/koding/kite"
@@ -21,82 +21,145 @@ import (
 
 var config    *Config
 var ircDriver *IRCDriver
-var closer    chan bool
+var closer    chan int
+
+// Exit codes, so a supervisor can tell a clean stop from one that lost items. Go uses 2 for a panic.
+const (
+  ExitClean           = 0
+  ExitUndelivered     = 3 // The drain deadline passed with items still buffered.
+  ExitListenerFailure = 4 // Too many consecutive connection failures across the listener pool.
+  ExitForced          = 5 // A second signal arrived during shutdown.
+  ExitConfig          = 6 // The config leaves nowhere to deliver to, such as no working sinks.
+)
 
 func main() {
   
-  closer = make(chan bool)
+  closer = make(chan int, 1)
   
   envType := os.Getenv("ENVTYPE")
   
   config = LoadConfig(envType)
+  logger.Configure(config.Logging)
   
   k := kite.New(config.Name, config.Version)
   
   dbDriver := ogcn.DatabaseDriverNew(config.Database.Urls, config.Database.Replset, config.Database.DbName)
-  ircDriver = CreateIrcDriver(dbDriver, k)
+  driver, err := CreateIrcDriver(dbDriver, k)
+  if (err != nil) {
+    
+    logger.Error("Unable to start.", LogFields{ "error": err })
+    os.Exit(ExitConfig)
+  }
+  
+  ircDriver = driver
   
   k.HandleFunc("force-restart", Restart).DisableAuthentication()
   k.HandleFunc("set-primary", SetPrimary).DisableAuthentication()
   k.HandleFunc("are-you-primary", PrimaryCheck).DisableAuthentication()
   k.HandleFunc("are-you-ready", ReadyCheck).DisableAuthentication()
+  k.HandleFunc("listener-status", ListenerStatusCheck).DisableAuthentication()
+  k.HandleFunc("buffer-status", BufferStatusCheck).DisableAuthentication()
+  k.HandleFunc("latency-report", LatencyReportCheck).DisableAuthentication()
+  k.HandleFunc("set-log-level", SetLogLevel).DisableAuthentication()
+  k.HandleFunc("account-status", AccountStatusCheck).DisableAuthentication()
+  k.HandleFunc("refresh-tokens", RefreshTokens).DisableAuthentication()
+  k.HandleFunc("say", Say).DisableAuthentication()
+  k.HandleFunc("reply", Reply).DisableAuthentication()
   k.HandleFunc("listen-to-channels", ListenToChannels).DisableAuthentication()
+  k.HandleFunc("part-channels", PartChannels).DisableAuthentication()
+  k.HandleFunc("replace-channel-set", ReplaceChannelSet).DisableAuthentication()
+  k.HandleFunc("shard-channels", ShardChannels).DisableAuthentication()
+  k.HandleFunc("shard-part-channels", ShardPartChannels).DisableAuthentication()
+  k.HandleFunc("shard-sync", ShardSync).DisableAuthentication()
+  k.HandleFunc("channel-owner", ChannelOwnerCheck).DisableAuthentication()
+  k.HandleFunc("channel-state", ChannelStateCheck).DisableAuthentication()
   
   k.Config.Port = config.Ports.Irc
   go k.Run()
   
+  if (config.Metrics.Enabled) { go ServeMetrics(config.Metrics.Address) }
+  
   sigs := make(chan os.Signal, 1)
   signal.Notify(sigs)
   shouldQuit := false
+  code := ExitClean
   
   for shouldQuit == false {
     
     select {
       
       case s := <-sigs:
-        fmt.Println("RECEIVED SIGNAL:", s)
-        if (s == syscall.SIGTERM ||
-            s == syscall.SIGKILL ||
-            s == syscall.SIGQUIT ||
-            s == syscall.SIGINT) {
-
-          shouldQuit = true
-        }
-      case <- closer:
-        fmt.Println("INTERNAL CLOSURE.")
+        logger.Info("Received signal.", LogFields{ "signal": s.String() })
+        shouldQuit = IsQuitSignal(s)
+      case code = <- closer:
+        logger.Info("Internal closure.", LogFields{ "code": code })
         shouldQuit = true
     }
   }
   
-  ircDriver.CloseListeners()
+  // Draining can take a while. Another quit signal gives up on it.
+  go func() {
+    for s := range sigs {
+      
+      if (IsQuitSignal(s)) {
+        
+        logger.Warn("Received second signal. Exiting without draining.", LogFields{ "signal": s.String() })
+        os.Exit(ExitForced)
+      }
+    }
+  }()
+  
+  drained := ircDriver.Shutdown(time.Duration(config.Shutdown.DrainTimeoutMs) * time.Millisecond)
   
   k.Close()
   
-  panic(errors.New("Closing!"))
+  if (!drained && code == ExitClean) { code = ExitUndelivered }
+  
+  logger.Info("Closed.", LogFields{ "code": code })
+  os.Exit(code)
+}
+
+func IsQuitSignal(s os.Signal) bool {
+  
+  return (s == syscall.SIGTERM ||
+          s == syscall.SIGKILL ||
+          s == syscall.SIGQUIT ||
+          s == syscall.SIGINT)
+}
+
+// Asks main to shut down and exit with the given code. Only the first request counts.
+func RequestClose(code int) {
+  
+  select {
+    case closer <- code:
+    default:
+  }
 }
 
 func Restart(r *kite.Request) (interface{}, error) {
   
-  closer <- true
+  RequestClose(ExitClean)
   
   return true, nil
 }
 
 func SetPrimary(r *kite.Request) (interface{}, error) {
   
+  if (ircDriver.Elector != nil) { return false, errors.New("Primary is elected. Set election.enabled to false to set it by hand.") }
+  
   isPrimary, err := r.Args.One().Bool()
   
   if (err != nil) {
     
-    return ircDriver.IsPrimary, err
+    return ircDriver.IsPrimary.Load(), err
   }
   
-  ircDriver.IsPrimary = isPrimary
+  ircDriver.IsPrimary.Store(isPrimary)
   
   if (isPrimary) {
-    fmt.Println("Made primary!")
+    logger.Info("Made primary.", nil)
   } else {
-    fmt.Println("No longer primary")
+    logger.Info("No longer primary.", nil)
   }
   
   return isPrimary, nil
@@ -104,14 +167,16 @@ func SetPrimary(r *kite.Request) (interface{}, error) {
 
 func PrimaryCheck(r *kite.Request) (interface{}, error) {
   
-  return ircDriver.IsPrimary, nil
+  return ircDriver.PrimaryStatus(), nil
 }
 
 func ReadyCheck(r *kite.Request) (interface{}, error) {
   
-  for i := 0; i < len(ircDriver.ListenerPool); i++ {
+  listeners := ircDriver.ListenerPool.Snapshot()
+  
+  for i := 0; i < len(listeners); i++ {
     
-    if (ircDriver.ListenerPool[i].ChannelBuffer.Count > 0) {
+    if (listeners[i].BufferedCount() > 0) {
       
       return false, nil
     }
@@ -120,24 +185,274 @@ func ReadyCheck(r *kite.Request) (interface{}, error) {
   return true, nil
 }
 
+func ListenerStatusCheck(r *kite.Request) (interface{}, error) {
+  
+  return ircDriver.ListenerPool.Status(), nil
+}
+
+func BufferStatusCheck(r *kite.Request) (interface{}, error) {
+  
+  return ircDriver.BufferStatus(), nil
+}
+
+func LatencyReportCheck(r *kite.Request) (interface{}, error) {
+  
+  return ircDriver.Tracer.Report(), nil
+}
+
+// Sets the log level, e.g. "debug", and returns the level now in effect. With no arguments, only returns it.
+func SetLogLevel(r *kite.Request) (interface{}, error) {
+  
+  if args, _ := r.Args.Slice(); len(args) == 0 { return logger.GetLevel().String(), nil }
+  
+  name, err := r.Args.One().String()
+  if (err != nil) { return logger.GetLevel().String(), err }
+  
+  level, ok := ParseLogLevel(name)
+  if (!ok) { return logger.GetLevel().String(), errors.New("Unknown log level \"" + name + "\".") }
+  
+  logger.SetLevel(level)
+  logger.Info("Log level changed.", LogFields{ "level": level.String() })
+  
+  return level.String(), nil
+}
+
+func AccountStatusCheck(r *kite.Request) (interface{}, error) {
+  
+  return ircDriver.AccountStatuses(), nil
+}
+
+// Refreshes the named account's token, or every account's with no arguments, and returns the accounts' status.
+// Call it after rotating a token file to have the new token validated and used from the next connect.
+func RefreshTokens(r *kite.Request) (interface{}, error) {
+  
+  login := ""
+  
+  if args, _ := r.Args.Slice(); len(args) > 0 {
+    
+    name, err := r.Args.One().String()
+    if (err != nil) { return nil, err }
+    login = name
+  }
+  
+  return ircDriver.RefreshAccounts(login), nil
+}
+
+// Sends a message to a channel through an authenticated listener. Takes a SayRequest.
+func Say(r *kite.Request) (interface{}, error) {
+  
+  var req SayRequest
+  
+  if err := r.Args.One().Unmarshal(&req); err != nil {
+    
+    logger.Warn("Unable to unmarshal say request.", LogFields{ "error": err })
+    return nil, errors.New("Unable to unmarshal.")
+  }
+  
+  if (ircDriver.ShuttingDown.Load()) { return nil, errors.New("Shutting down.") }
+  
+  return ircDriver.Say(req)
+}
+
+// Replies to a message, given by its id in reply_to. Takes a SayRequest.
+func Reply(r *kite.Request) (interface{}, error) {
+  
+  var req SayRequest
+  
+  if err := r.Args.One().Unmarshal(&req); err != nil {
+    
+    logger.Warn("Unable to unmarshal reply request.", LogFields{ "error": err })
+    return nil, errors.New("Unable to unmarshal.")
+  }
+  
+  if (req.ReplyTo == "") { return nil, errors.New("No reply_to.") }
+  if (ircDriver.ShuttingDown.Load()) { return nil, errors.New("Shutting down.") }
+  
+  return ircDriver.Say(req)
+}
+
 func ListenToChannels(r *kite.Request) (interface{}, error) {
   
   channels := make([]ogdm.IdentitySlim, 0, 10000)
   
   if err := r.Args.One().Unmarshal(&channels); err != nil {
     
-    fmt.Println(err)
+    logger.Warn("Unable to unmarshal channels.", LogFields{ "error": err })
     return false, errors.New("Unable to unmarshal.")
   }
   
-  fmt.Println("Told to listen to", len(channels), "channels.")
+  logger.Info("Told to listen to channels.", LogFields{ "count": len(channels) })
   
   if (len(channels) == 0) { return false, errors.New("Empty list.") }
+  if (ircDriver.ShuttingDown.Load()) { return false, errors.New("Shutting down.") }
   
   for i := 0; i < len(channels); i++ {
     
     ircDriver.ListenToChannel(&channels[i])
   }
   
+  version := ircDriver.TouchChannels(0)
+  if (ircDriver.Sharder != nil) { go ircDriver.ShareChannels("shard-channels", version, channels) }
+  
+  return true, nil
+}
+
+// Stops listening to channels, matched by platform ID or else login. Listeners left empty are closed.
+func PartChannels(r *kite.Request) (interface{}, error) {
+  
+  channels := make([]ogdm.IdentitySlim, 0, 10000)
+  
+  if err := r.Args.One().Unmarshal(&channels); err != nil {
+    
+    logger.Warn("Unable to unmarshal channels.", LogFields{ "error": err })
+    return false, errors.New("Unable to unmarshal.")
+  }
+  
+  if (len(channels) == 0) { return false, errors.New("Empty list.") }
+  if (ircDriver.ShuttingDown.Load()) { return false, errors.New("Shutting down.") }
+  
+  removed := ircDriver.RemoveChannels(channels)
+  logger.Info("Told to part channels.", LogFields{ "count": len(channels), "removed": removed })
+  
+  version := ircDriver.TouchChannels(0)
+  if (ircDriver.Sharder != nil) { go ircDriver.ShareChannels("shard-part-channels", version, channels) }
+  
+  return true, nil
+}
+
+// Listens to exactly the given channels, parting any others. An empty list is refused, as it would part everything;
+// use "part-channels" for that.
+func ReplaceChannelSet(r *kite.Request) (interface{}, error) {
+  
+  channels := make([]ogdm.IdentitySlim, 0, 10000)
+  
+  if err := r.Args.One().Unmarshal(&channels); err != nil {
+    
+    logger.Warn("Unable to unmarshal channels.", LogFields{ "error": err })
+    return false, errors.New("Unable to unmarshal.")
+  }
+  
+  if (len(channels) == 0) { return false, errors.New("Empty list.") }
+  if (ircDriver.ShuttingDown.Load()) { return false, errors.New("Shutting down.") }
+  
+  removed := ircDriver.ReplaceChannels(channels)
+  logger.Info("Told to replace channel set.", LogFields{ "count": len(channels), "removed": removed })
+  
+  version := ircDriver.TouchChannels(0)
+  if (ircDriver.Sharder != nil) { go ircDriver.ShareChannels("shard-sync", version, channels) }
+  
+  return true, nil
+}
+
+// Static. Unmarshals a set sent by another shard.
+func UnmarshalShardSet(r *kite.Request) (ShardChannelSet, error) {
+  
+  var set ShardChannelSet
+  
+  if err := r.Args.One().Unmarshal(&set); err != nil {
+    
+    logger.Warn("Unable to unmarshal shard channels.", LogFields{ "error": err })
+    return set, errors.New("Unable to unmarshal.")
+  }
+  
+  if (ircDriver.ShuttingDown.Load()) { return set, errors.New("Shutting down.") }
+  
+  return set, nil
+}
+
+// Takes channels shared by another shard. They are not shared on again.
+func ShardChannels(r *kite.Request) (interface{}, error) {
+  
+  set, err := UnmarshalShardSet(r)
+  if (err != nil) { return false, err }
+  
+  for i := 0; i < len(set.Channels); i++ {
+    
+    ircDriver.ListenToChannel(&set.Channels[i])
+  }
+  
+  ircDriver.TouchChannels(set.Version)
+  
   return true, nil
 }
+
+// Parts channels another shard was told to part.
+func ShardPartChannels(r *kite.Request) (interface{}, error) {
+  
+  set, err := UnmarshalShardSet(r)
+  if (err != nil) { return false, err }
+  
+  ircDriver.RemoveChannels(set.Channels)
+  ircDriver.TouchChannels(set.Version)
+  
+  return true, nil
+}
+
+// Takes a batch of another shard's whole channel set. Returns false if this shard's set is as new or newer.
+func ShardSync(r *kite.Request) (interface{}, error) {
+  
+  set, err := UnmarshalShardSet(r)
+  if (err != nil) { return false, err }
+  
+  return ircDriver.ReceiveSync(set), nil
+}
+
+// Specifies which shard owns a channel, as returned by the "channel-owner" kite method.
+type ChannelOwner struct {
+  
+  Login      string           `json:"login"`
+  PlatformID string           `json:"platform_id"`
+  Owner      string           `json:"owner"`
+  Self       bool             `json:"self"`
+  Instances  []ConfigInstance `json:"instances"`
+}
+
+// Returns which shard owns a channel, given its login or platform ID, and where that shard's instances are.
+func ChannelOwnerCheck(r *kite.Request) (interface{}, error) {
+  
+  name, err := r.Args.One().String()
+  if (err != nil) { return nil, err }
+  
+  user := ircDriver.FindChannel(name)
+  if (user == nil) { return nil, errors.New("Unknown channel \"" + name + "\".") }
+  
+  owner := ChannelOwner{ Login: user.Login, PlatformID: user.PlatformID, Self: true, Instances: []ConfigInstance{} }
+  
+  if (ircDriver.Sharder == nil) {
+    
+    owner.Owner = config.Name
+    return owner, nil
+  }
+  
+  // Channels given without an ID are placed by login until their ROOMSTATE supplies one.
+  key := user.PlatformID
+  if (key == "") { key = "#" + user.Login }
+  
+  owner.Owner = ircDriver.Sharder.Owner(key)
+  owner.Self = (owner.Owner == ircDriver.Sharder.Self)
+  
+  peers := ircDriver.Sharder.ShardPeers(owner.Owner)
+  for i := 0; i < len(peers); i++ {
+    
+    owner.Instances = append(owner.Instances, ConfigInstance{ Name: peers[i].Name, Address: peers[i].Address, Port: peers[i].Port })
+  }
+  
+  return owner, nil
+}
+
+// Returns a channel's chat modes, given its login or platform ID, or every known channel's if no name is given.
+func ChannelStateCheck(r *kite.Request) (interface{}, error) {
+  
+  if args, _ := r.Args.Slice(); len(args) == 0 { return ircDriver.AllRoomStates(), nil }
+  
+  name, err := r.Args.One().String()
+  if (err != nil) { return nil, err }
+  
+  user := ircDriver.FindChannel(name)
+  if (user == nil) { return nil, errors.New("Unknown channel \"" + name + "\".") }
+  
+  state, ok := ircDriver.GetRoomState(user.Login)
+  if (!ok) { return nil, errors.New("No room state for \"" + user.Login + "\" yet.") }
+  
+  return state, nil
+}
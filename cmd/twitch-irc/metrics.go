@@ -0,0 +1,268 @@
+/*
+*
+* Name:     Twitch IRC Listener
+* Sys Name: twitch-irc
+* Author:   Nifty255
+*
+*/
+
+package main
+
+import (
+  "io"       // Reader/Writer interfaces.
+  "fmt"      // Prints to console.
+  "sort"     // Sorting functions.
+  "sync"     // Mutual exclusion locks.
+  "strings"  // String manipulation functions.
+  "strconv"  // String/Number conversion functions.
+  "net/http" // HTTP server functions.
+)
+
+// Buckets, in seconds, for latency histograms. They span a fast local send up to a handler outage.
+var LatencyBuckets = []float64{ 0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60 }
+
+var (
+  MessagesTotal   = CounterNew("twitch_irc_messages_total", "IRC messages received, by command.", "command")
+  EventsTotal     = CounterNew("twitch_irc_events_total", "Events fired, by event type.", "type")
+  ReconnectsTotal = CounterNew("twitch_irc_reconnects_total", "Reconnect attempts, by listener.", "listener")
+  SinkFailures    = CounterNew("twitch_irc_sink_failures_total", "Failed sends, by sink.", "sink")
+  SinkLatency     = HistogramNew("twitch_irc_sink_send_seconds", "Time taken by a send to a sink.", LatencyBuckets, "sink")
+  DeliveryLatency = HistogramNew("twitch_irc_delivery_latency_seconds", "Time from tmi-sent-ts to delivery, by sink member buffer.", LatencyBuckets, "buffer")
+)
+
+// Specifies one labelled series of a MetricFamily.
+type MetricSeries struct {
+  
+  Labels []string
+  Value  float64
+  Counts []uint64
+  Count  uint64
+}
+
+// Specifies a counter or histogram and all of its labelled series, written in the Prometheus text format.
+type MetricFamily struct {
+  
+  Name    string
+  Help    string
+  Type    string
+  Labels  []string
+  Buckets []float64
+  Series  map[string]*MetricSeries
+  Lock    sync.Mutex
+}
+
+// Static. Creates a counter with the given label names.
+func CounterNew(name, help string, labels ...string) *MetricFamily {
+  
+  return &(MetricFamily{
+    Name: name,
+    Help: help,
+    Type: "counter",
+    Labels: labels,
+    Series: make(map[string]*MetricSeries, 16) })
+}
+
+// Static. Creates a histogram with the given upper bounds and label names.
+func HistogramNew(name, help string, buckets []float64, labels ...string) *MetricFamily {
+  
+  return &(MetricFamily{
+    Name: name,
+    Help: help,
+    Type: "histogram",
+    Labels: labels,
+    Buckets: buckets,
+    Series: make(map[string]*MetricSeries, 16) })
+}
+
+// MetricFamily. Returns the series for the given label values, creating it if needed. Call with Lock held.
+func (m *MetricFamily) Get(values []string) *MetricSeries {
+  
+  key := strings.Join(values, "\xff")
+  series, ok := m.Series[key]
+  
+  if (!ok) {
+    
+    series = &(MetricSeries{
+      Labels: append([]string{}, values...),
+      Counts: make([]uint64, len(m.Buckets)) })
+    m.Series[key] = series
+  }
+  
+  return series
+}
+
+// MetricFamily. Adds to a counter.
+func (m *MetricFamily) Add(delta float64, values ...string) {
+  
+  m.Lock.Lock()
+  defer m.Lock.Unlock()
+  
+  m.Get(values).Value += delta
+}
+
+// MetricFamily. Adds one to a counter.
+func (m *MetricFamily) Inc(values ...string) {
+  
+  m.Add(1, values...)
+}
+
+// MetricFamily. Records a histogram observation.
+func (m *MetricFamily) Observe(value float64, values ...string) {
+  
+  m.Lock.Lock()
+  defer m.Lock.Unlock()
+  
+  series := m.Get(values)
+  series.Value += value
+  series.Count++
+  
+  for ind := 0; ind < len(m.Buckets); ind++ {
+    
+    if (value <= m.Buckets[ind]) { series.Counts[ind]++ }
+  }
+}
+
+// MetricFamily. Writes every series in the Prometheus text format.
+func (m *MetricFamily) Write(w io.Writer) {
+  
+  m.Lock.Lock()
+  defer m.Lock.Unlock()
+  
+  fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.Name, m.Help, m.Name, m.Type)
+  
+  keys := make([]string, 0, len(m.Series))
+  for key := range m.Series { keys = append(keys, key) }
+  sort.Strings(keys)
+  
+  for ind := 0; ind < len(keys); ind++ {
+    
+    series := m.Series[keys[ind]]
+    
+    if (m.Type != "histogram") {
+      
+      fmt.Fprintf(w, "%s%s %s\n", m.Name, FormatLabels(m.Labels, series.Labels), FormatFloat(series.Value))
+      continue
+    }
+    
+    names := append(append([]string{}, m.Labels...), "le")
+    for bucket := 0; bucket < len(m.Buckets); bucket++ {
+      
+      values := append(append([]string{}, series.Labels...), FormatFloat(m.Buckets[bucket]))
+      fmt.Fprintf(w, "%s_bucket%s %d\n", m.Name, FormatLabels(names, values), series.Counts[bucket])
+    }
+    
+    values := append(append([]string{}, series.Labels...), "+Inf")
+    fmt.Fprintf(w, "%s_bucket%s %d\n", m.Name, FormatLabels(names, values), series.Count)
+    fmt.Fprintf(w, "%s_sum%s %s\n", m.Name, FormatLabels(m.Labels, series.Labels), FormatFloat(series.Value))
+    fmt.Fprintf(w, "%s_count%s %d\n", m.Name, FormatLabels(m.Labels, series.Labels), series.Count)
+  }
+}
+
+// Static. Formats label pairs as {name="value",...}, or nothing if there are none.
+func FormatLabels(names, values []string) string {
+  
+  if (len(names) == 0) { return "" }
+  
+  escaper := strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n")
+  pairs := make([]string, len(names))
+  
+  for ind := 0; ind < len(names); ind++ {
+    
+    value := ""
+    if (ind < len(values)) { value = values[ind] }
+    
+    pairs[ind] = names[ind] + "=\"" + escaper.Replace(value) + "\""
+  }
+  
+  return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func FormatFloat(value float64) string {
+  
+  return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// Static. Writes a family whose values are read at scrape time rather than kept in a MetricFamily.
+func WriteSamples(w io.Writer, name, help, kind string, labels []string, samples map[string]float64, sampleLabels map[string][]string) {
+  
+  fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+  
+  keys := make([]string, 0, len(samples))
+  for key := range samples { keys = append(keys, key) }
+  sort.Strings(keys)
+  
+  for ind := 0; ind < len(keys); ind++ {
+    
+    fmt.Fprintf(w, "%s%s %s\n", name, FormatLabels(labels, sampleLabels[keys[ind]]), FormatFloat(samples[keys[ind]]))
+  }
+}
+
+// Serves every metric in the Prometheus text format. Listener and buffer gauges are read from the driver at scrape time.
+func MetricsHandler(w http.ResponseWriter, r *http.Request) {
+  
+  w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+  
+  statuses := ircDriver.ListenerPool.Status()
+  
+  state := make(map[string]float64, len(statuses))
+  joined := make(map[string]float64, len(statuses))
+  buffered := make(map[string]float64, len(statuses))
+  stateLabels := make(map[string][]string, len(statuses))
+  listenerLabels := make(map[string][]string, len(statuses))
+  
+  for ind := 0; ind < len(statuses); ind++ {
+    
+    name := statuses[ind].Username
+    
+    state[name] = 1
+    stateLabels[name] = []string{ name, statuses[ind].State }
+    joined[name] = float64(statuses[ind].Joined)
+    buffered[name] = float64(statuses[ind].Buffered)
+    listenerLabels[name] = []string{ name }
+  }
+  
+  WriteSamples(w, "twitch_irc_listener_state", "Current state of each listener.", "gauge", []string{ "listener", "state" }, state, stateLabels)
+  WriteSamples(w, "twitch_irc_channels_joined", "Channels joined, by listener.", "gauge", []string{ "listener" }, joined, listenerLabels)
+  WriteSamples(w, "twitch_irc_channels_buffered", "Channels waiting to be joined, by listener.", "gauge", []string{ "listener" }, buffered, listenerLabels)
+  
+  buffers := ircDriver.BufferStatus()
+  
+  depth := make(map[string]float64, len(buffers))
+  depthLabels := make(map[string][]string, len(buffers))
+  dropped := make(map[string]float64, len(buffers) * 3)
+  droppedLabels := make(map[string][]string, len(buffers) * 3)
+  
+  for ind := 0; ind < len(buffers); ind++ {
+    
+    depth[buffers[ind].Name] = float64(buffers[ind].Count + buffers[ind].Spilled)
+    depthLabels[buffers[ind].Name] = []string{ buffers[ind].Name }
+    
+    for priority, count := range buffers[ind].Dropped {
+      
+      key := buffers[ind].Name + "/" + priority
+      dropped[key] = float64(count)
+      droppedLabels[key] = []string{ buffers[ind].Name, priority }
+    }
+  }
+  
+  WriteSamples(w, "twitch_irc_buffer_depth", "Items waiting for delivery, by buffer.", "gauge", []string{ "buffer" }, depth, depthLabels)
+  WriteSamples(w, "twitch_irc_buffer_dropped_total", "Items dropped on overflow, by buffer and priority.", "counter", []string{ "buffer", "priority" }, dropped, droppedLabels)
+  
+  families := []*MetricFamily{ MessagesTotal, EventsTotal, ReconnectsTotal, DuplicatesTotal, SaysTotal, SayRejectsTotal, SinkFailures, SinkLatency, DeliveryLatency, StageLatency, TraceLatency }
+  for ind := 0; ind < len(families); ind++ {
+    
+    families[ind].Write(w)
+  }
+}
+
+// Static. Serves /metrics on the configured address until the process exits.
+func ServeMetrics(address string) {
+  
+  mux := http.NewServeMux()
+  mux.HandleFunc("/metrics", MetricsHandler)
+  
+  if err := http.ListenAndServe(address, mux); err != nil {
+    
+    logger.Error("Metrics server stopped.", LogFields{ "address": address, "error": err })
+  }
+}
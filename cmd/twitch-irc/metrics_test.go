@@ -0,0 +1,84 @@
+/*
+*
+* Name:     Twitch IRC Listener
+* Sys Name: twitch-irc
+* Author:   Nifty255
+*
+*/
+
+package main
+
+import (
+  "strings"           // String manipulation functions.
+  "testing"           // Go's testing framework.
+  "net/http/httptest" // HTTP testing functions.
+)
+
+func TestMetricFamilyWrite(t *testing.T) {
+  
+  counter := CounterNew("test_total", "A test counter.", "sink")
+  counter.Inc("webhook")
+  counter.Add(2.5, "file")
+  counter.Inc("say \"hi\"\n")
+  
+  histogram := HistogramNew("test_seconds", "A test histogram.", []float64{ 0.1, 1 }, "sink")
+  histogram.Observe(0.05, "file")
+  histogram.Observe(0.5, "file")
+  histogram.Observe(5, "file")
+  
+  cases := []struct {
+    
+    family *MetricFamily
+    want   string
+  }{
+    { counter, "# HELP test_total A test counter.\n# TYPE test_total counter\n" +
+      "test_total{sink=\"file\"} 2.5\n" +
+      "test_total{sink=\"say \\\"hi\\\"\\n\"} 1\n" +
+      "test_total{sink=\"webhook\"} 1\n" },
+    { histogram, "# HELP test_seconds A test histogram.\n# TYPE test_seconds histogram\n" +
+      "test_seconds_bucket{sink=\"file\",le=\"0.1\"} 1\n" +
+      "test_seconds_bucket{sink=\"file\",le=\"1\"} 2\n" +
+      "test_seconds_bucket{sink=\"file\",le=\"+Inf\"} 3\n" +
+      "test_seconds_sum{sink=\"file\"} 5.55\n" +
+      "test_seconds_count{sink=\"file\"} 3\n" },
+  }
+  
+  for ind := 0; ind < len(cases); ind++ {
+    
+    var out strings.Builder
+    cases[ind].family.Write(&out)
+    
+    if (out.String() != cases[ind].want) { t.Errorf("%s wrote:\n%s\nwant:\n%s", cases[ind].family.Name, out.String(), cases[ind].want) }
+  }
+}
+
+func TestMetricsHandler(t *testing.T) {
+  
+  srv, _ := startTestDriver(t)
+  
+  listenAndWait(t, srv, testChannels("dallas", 2, 100))
+  
+  listener := ircDriver.ListenerPool.Snapshot()[0].Username
+  
+  recorder := httptest.NewRecorder()
+  MetricsHandler(recorder, httptest.NewRequest("GET", "/metrics", nil))
+  
+  body := recorder.Body.String()
+  if (!strings.HasPrefix(recorder.Header().Get("Content-Type"), "text/plain")) { t.Errorf("content type = %q, want the text format", recorder.Header().Get("Content-Type")) }
+  
+  want := []string{
+    "# TYPE twitch_irc_listener_state gauge\n",
+    "twitch_irc_listener_state{listener=\"" + listener + "\",state=\"joined\"} 1\n",
+    "twitch_irc_channels_joined{listener=\"" + listener + "\"} 2\n",
+    "twitch_irc_channels_buffered{listener=\"" + listener + "\"} 0\n",
+    "# TYPE twitch_irc_buffer_depth gauge\n",
+    "# TYPE twitch_irc_messages_total counter\n",
+    "twitch_irc_messages_total{command=\"JOIN\"} ",
+    "# TYPE twitch_irc_sink_send_seconds histogram\n",
+  }
+  
+  for ind := 0; ind < len(want); ind++ {
+    
+    if (!strings.Contains(body, want[ind])) { t.Errorf("metrics lack %q:\n%s", want[ind], body) }
+  }
+}
@@ -0,0 +1,516 @@
+/*
+*
+* Name:     Twitch IRC Listener
+* Sys Name: twitch-irc
+* Author:   Nifty255
+*
+*/
+
+package main
+
+import (
+  "sync"          // Mutual exclusion locks.
+  "time"          // Timing related functions.
+  "path/filepath" // File path functions.
+  ogdm "github.com/the-opera-house/go-common-lib/models"
+)
+
+// Overflow policies for an OutboundBuffer that has reached its capacity.
+const (
+  OverflowBlock      = "block"         // Push waits for the sender to make room. This stalls the listener that pushed.
+  OverflowDropOldest = "drop-oldest"   // The oldest item of the lowest priority is dropped.
+  OverflowDropNewest = "drop-newest"   // The newest item of the lowest priority is dropped, which may be the one being pushed.
+  OverflowSpill      = "spill-to-disk" // Items past capacity are written to a spill file and read back as room frees up.
+)
+
+// Delivery priorities. When something must be dropped, lower priorities go first.
+const (
+  PriorityChat     = iota // Raw chat lines.
+  PriorityEvent           // Events with no money attached, such as hosts and raids.
+  PriorityMonetary        // Bits, subs and gifts.
+)
+
+// Priority counted against items lost without being read, such as an unreadable spill file.
+const PriorityUnknown = -1
+
+// Event types that carry money. These are the last thing an OutboundBuffer drops.
+var MonetaryEventTypes = map[string]bool{
+  "bits": true,
+  "sub": true,
+  "resub": true,
+  "subgift": true,
+  "anonsubgift": true,
+  "submysterygift": true,
+  "anonsubmysterygift": true,
+  "giftpaidupgrade": true,
+  "anongiftpaidupgrade": true,
+  "primepaidupgrade": true,
+  "standardpayforward": true,
+  "communitypayforward": true,
+  "charitydonation": true }
+
+// Static. Returns the delivery priority of an event.
+func EventPriority(e *ogdm.Event) int {
+  
+  if (MonetaryEventTypes[e.EventType]) { return PriorityMonetary }
+  
+  return PriorityEvent
+}
+
+// Static. Returns the name of a delivery priority, as reported by the "buffer-status" kite method.
+func PriorityName(priority int) string {
+  
+  switch(priority) {
+    
+    case PriorityChat:
+    return "chat"
+    case PriorityEvent:
+    return "event"
+    case PriorityMonetary:
+    return "monetary"
+  }
+  
+  return "unknown"
+}
+
+// Specifies a buffered event or chat line waiting for its sink. Exactly one of Event or Chat is set.
+// Id orders items within their buffer. Seq is the item's position in the write-ahead log, or 0 if there is no log.
+// SentAt is the source message's tmi-sent-ts, if it had one. Queued and SentAt are zero for replayed items.
+// Traced items are latency probes.
+type OutboundItem struct {
+  
+  Id       uint64
+  Seq      uint64
+  Priority int
+  Traced   bool
+  SentAt   time.Time
+  Queued   time.Time
+  Event    *ogdm.Event
+  Chat     string
+}
+
+// Specifies a point-in-time view of an OutboundBuffer, as reported by the "buffer-status" kite method.
+type BufferStatus struct {
+  
+  Name     string         `json:"name"`
+  Count    int            `json:"count"`
+  Spilled  int            `json:"spilled"`
+  Capacity int            `json:"capacity"`
+  Overflow string         `json:"overflow"`
+  Dropped  map[string]int `json:"dropped"`
+}
+
+// Specifies a FIFO of items waiting for delivery, optionally backed by a write-ahead log.
+// Items are only removed once the sender acknowledges them, so a failed send is retried in order.
+// Notify is signalled on every push so the sender can wake without polling.
+// Yield is a lower-priority buffer that lends room, shedding an item if it has none free, in place of this buffer
+// dropping a monetary one. Borrowed room counts against Yield's capacity, as Lent, until this buffer is back under
+// its own, so the two together never hold more than both capacities. Lock order is this buffer, then Yield.
+type OutboundBuffer struct {
+  
+  Name     string
+  Items    []OutboundItem
+  Head     int
+  NextId   uint64
+  Capacity int
+  Overflow string
+  Spill    *SpillFile
+  Yield    *OutboundBuffer
+  Borrowed int
+  Lent     int
+  Dropped  map[int]int
+  Wal      *Wal
+  Notify   chan bool
+  Space    *sync.Cond
+  Closed   bool
+  Lock     sync.Mutex
+}
+
+// Static. Creates an OutboundBuffer. If the write-ahead log is enabled, it lives in a directory named after the
+// buffer, and anything left undelivered by a previous run is queued ahead of new items, regardless of capacity.
+func OutboundBufferNew(name string, c ConfigBuffer, w ConfigWal) *OutboundBuffer {
+  
+  initial := c.Capacity
+  if (initial <= 0 || initial > 4096) { initial = 4096 }
+  
+  b := &(OutboundBuffer{
+    Name: name,
+    Items: make([]OutboundItem, 0, initial),
+    NextId: 1,
+    Capacity: c.Capacity,
+    Overflow: c.Overflow,
+    Dropped: make(map[int]int, 3),
+    Notify: make(chan bool, 1) })
+  
+  b.Space = sync.NewCond(&b.Lock)
+  
+  if (b.Overflow == OverflowSpill) {
+    
+    spill, err := SpillFileNew(filepath.Join(c.SpillPath, name + ".jsonl"))
+    if (err != nil) {
+      
+      logger.Error("Failed to open spill file. Dropping oldest instead.", LogFields{ "buffer": name, "error": err })
+      b.Overflow = OverflowDropOldest
+    } else {
+      
+      b.Spill = spill
+    }
+  }
+  
+  if (!w.Enabled) { return b }
+  
+  wal, pending, err := WalOpen(filepath.Join(w.Path, name), w)
+  if (err != nil) {
+    
+    logger.Error("Failed to open write-ahead log. Buffering in memory only.", LogFields{ "buffer": name, "error": err })
+    return b
+  }
+  
+  b.Wal = wal
+  
+  for ind := 0; ind < len(pending); ind++ {
+    
+    item := OutboundItem{ Id: b.NextId, Seq: pending[ind].Seq, Event: pending[ind].Event, Chat: pending[ind].Chat }
+    if (item.Event != nil) { item.Priority = EventPriority(item.Event) }
+    
+    b.Items = append(b.Items, item)
+    b.NextId++
+  }
+  
+  if (len(pending) > 0) { logger.Info("Replaying from the write-ahead log.", LogFields{ "buffer": name, "count": len(pending) }) }
+  
+  return b
+}
+
+// OutboundBuffer. Returns the number of items held in memory. Call with Lock held.
+func (b *OutboundBuffer) Len() int {
+  
+  return len(b.Items) - b.Head
+}
+
+// OutboundBuffer. Returns how many items the buffer holds in memory before overflowing: its capacity,
+// plus room borrowed from a higher-priority buffer's Yield, less room lent to one. Call with Lock held.
+func (b *OutboundBuffer) Limit() int {
+  
+  return b.Capacity + b.Borrowed - b.Lent
+}
+
+// OutboundBuffer. Adds an item to the end of the buffer. If the buffer is full, the overflow policy decides
+// what happens. Only items the policy keeps are logged, if there is a write-ahead log.
+func (b *OutboundBuffer) Push(item OutboundItem) {
+  
+  // An item handed on from another buffer keeps its SentAt and Traced, but not its place in that buffer's log.
+  item.Seq = 0
+  item.Queued = time.Now()
+  
+  b.Lock.Lock()
+  defer b.Lock.Unlock()
+  
+  // Blocked pushers wait before taking an Id, so Ids stay in buffer order.
+  if (b.Overflow == OverflowBlock && b.Capacity > 0) {
+    
+    for b.Len() >= b.Limit() && !b.Closed { b.Space.Wait() }
+  }
+  
+  item.Id = b.NextId
+  b.NextId++
+  
+  if (b.Capacity > 0 && (b.Len() >= b.Limit() || (b.Spill != nil && b.Spill.Count > 0))) {
+    
+    if (!b.Overflowed(&item)) { return }
+  }
+  
+  b.Log(&item)
+  b.Items = append(b.Items, item)
+  b.Signal()
+}
+
+// OutboundBuffer. Appends an item to the write-ahead log, if there is one, and sets its Seq.
+// Items already logged are left alone. Call with Lock held.
+func (b *OutboundBuffer) Log(item *OutboundItem) {
+  
+  if (b.Wal == nil || item.Seq > 0) { return }
+  
+  seq, err := b.Wal.Append(WalRecord{ Event: item.Event, Chat: item.Chat })
+  if (err != nil) { logger.Error("Failed to append to write-ahead log.", LogFields{ "buffer": b.Name, "error": err }) }
+  
+  item.Seq = seq
+}
+
+// OutboundBuffer. Counts a logged item as dropped and marks it so in the write-ahead log, so it is not replayed
+// after a restart. Call with Lock held.
+func (b *OutboundBuffer) Discard(item OutboundItem) {
+  
+  b.Dropped[item.Priority]++
+  
+  if (b.Wal == nil || item.Seq == 0) { return }
+  
+  if err := b.Wal.Drop(item.Seq); err != nil { logger.Error("Failed to mark a dropped item in the write-ahead log.", LogFields{ "buffer": b.Name, "error": err }) }
+}
+
+// OutboundBuffer. Applies the overflow policy to an item pushed while the buffer is full.
+// Returns whether the item should still be appended in memory. Call with Lock held.
+func (b *OutboundBuffer) Overflowed(item *OutboundItem) bool {
+  
+  switch(b.Overflow) {
+    
+    case OverflowBlock:
+    // Only reached once the buffer is closed.
+    return true
+    
+    case OverflowSpill:
+    // Once anything is spilled, everything after it is too, so order is kept. Spilled items are logged first,
+    // so they are replayed if the spill file is lost with the process.
+    b.Log(item)
+    if err := b.Spill.Write(*item); err != nil {
+      
+      logger.Error("Failed to spill. Holding in memory.", LogFields{ "buffer": b.Name, "error": err })
+      return true
+    }
+    b.Signal()
+    return false
+  }
+  
+  // Find the lowest-priority victim, oldest or newest first. The pushed item counts as the newest.
+  victim := -1
+  if (b.Overflow == OverflowDropNewest) {
+    
+    for ind := len(b.Items) - 1; ind >= b.Head; ind-- {
+      
+      if (victim == -1 || b.Items[ind].Priority < b.Items[victim].Priority) { victim = ind }
+    }
+    if (victim == -1 || item.Priority <= b.Items[victim].Priority) { victim = len(b.Items) }
+  } else {
+    
+    for ind := b.Head; ind < len(b.Items); ind++ {
+      
+      if (victim == -1 || b.Items[ind].Priority < b.Items[victim].Priority) { victim = ind }
+    }
+    if (victim == -1 || item.Priority < b.Items[victim].Priority) { victim = len(b.Items) }
+  }
+  
+  victimPriority := item.Priority
+  if (victim < len(b.Items)) { victimPriority = b.Items[victim].Priority }
+  
+  // Monetary items borrow room from the lower-priority buffer for as long as it has any to give.
+  if (victimPriority >= PriorityMonetary && b.Yield != nil && b.Yield.Lend()) { b.Borrowed++; return true }
+  
+  // The pushed item was never logged.
+  if (victim == len(b.Items)) { b.Dropped[victimPriority]++; return false }
+  
+  b.Discard(b.Items[victim])
+  
+  copy(b.Items[victim:], b.Items[victim + 1:])
+  b.Items[len(b.Items) - 1] = OutboundItem{}
+  b.Items = b.Items[:len(b.Items) - 1]
+  
+  return true
+}
+
+// OutboundBuffer. Lends one item's room to a higher-priority buffer, dropping the oldest lowest-priority item held
+// in memory if none is free. An unbounded buffer has no room to lend, and a full one that blocks or spills keeps its
+// items rather than lend. Returns whether room was lent.
+func (b *OutboundBuffer) Lend() bool {
+  
+  b.Lock.Lock()
+  defer b.Lock.Unlock()
+  
+  if (b.Capacity <= 0 || b.Limit() <= 0) { return false }
+  
+  if (b.Len() < b.Limit()) { b.Lent++; return true }
+  
+  if (b.Len() == 0 || b.Overflow == OverflowBlock || b.Overflow == OverflowSpill) { return false }
+  
+  victim := b.Head
+  for ind := b.Head + 1; ind < len(b.Items); ind++ {
+    
+    if (b.Items[ind].Priority < b.Items[victim].Priority) { victim = ind }
+  }
+  
+  b.Discard(b.Items[victim])
+  
+  copy(b.Items[victim:], b.Items[victim + 1:])
+  b.Items[len(b.Items) - 1] = OutboundItem{}
+  b.Items = b.Items[:len(b.Items) - 1]
+  
+  b.Lent++
+  
+  return true
+}
+
+// OutboundBuffer. Gives borrowed room back to Yield once this buffer no longer needs it. Call with Lock held.
+func (b *OutboundBuffer) Repay() {
+  
+  over := b.Len() - b.Capacity
+  if (over < 0) { over = 0 }
+  
+  repaid := b.Borrowed - over
+  if (repaid <= 0) { return }
+  
+  b.Borrowed -= repaid
+  
+  b.Yield.Lock.Lock()
+  defer b.Yield.Lock.Unlock()
+  
+  b.Yield.Lent -= repaid
+  b.Yield.Refill()
+  b.Yield.Space.Broadcast()
+}
+
+// OutboundBuffer. Wakes the sender. Call with Lock held.
+func (b *OutboundBuffer) Signal() {
+  
+  select {
+  case b.Notify <- true:
+  default:
+  }
+}
+
+// OutboundBuffer. Returns up to max items from the front of the buffer without removing them.
+func (b *OutboundBuffer) Peek(max int) []OutboundItem {
+  
+  b.Lock.Lock()
+  defer b.Lock.Unlock()
+  
+  count := b.Len()
+  if (count > max) { count = max }
+  if (count <= 0) { return nil }
+  
+  items := make([]OutboundItem, count)
+  copy(items, b.Items[b.Head:b.Head + count])
+  
+  return items
+}
+
+// OutboundBuffer. Removes delivered items, as returned by Peek, from the front of the buffer.
+// Items dropped while they were being sent are already gone and are skipped.
+func (b *OutboundBuffer) Ack(items []OutboundItem) {
+  
+  if (len(items) == 0) { return }
+  
+  b.Lock.Lock()
+  defer b.Lock.Unlock()
+  
+  last := items[len(items) - 1]
+  
+  for b.Head < len(b.Items) && b.Items[b.Head].Id <= last.Id {
+    
+    b.Items[b.Head] = OutboundItem{}
+    b.Head++
+  }
+  
+  // Reclaim the delivered prefix once it makes up most of the slice.
+  if (b.Head >= 1024 && b.Head * 2 >= len(b.Items)) {
+    
+    remaining := copy(b.Items, b.Items[b.Head:])
+    for ind := remaining; ind < len(b.Items); ind++ {
+      
+      b.Items[ind] = OutboundItem{}
+    }
+    b.Items = b.Items[:remaining]
+    b.Head = 0
+  }
+  
+  b.Refill()
+  b.Repay()
+  b.Space.Broadcast()
+  
+  if (b.Wal != nil && last.Seq > 0) { b.Wal.Ack(last.Seq) }
+}
+
+// OutboundBuffer. Reads spilled items back into memory while there is room. Call with Lock held.
+func (b *OutboundBuffer) Refill() {
+  
+  if (b.Spill == nil) { return }
+  
+  for b.Spill.Count > 0 && b.Len() < b.Limit() {
+    
+    item, err := b.Spill.Read()
+    if (err != nil) {
+      
+      logger.Error("Failed to read spill file. Discarding it.", LogFields{ "buffer": b.Name, "error": err })
+      b.Dropped[PriorityUnknown] += b.Spill.Count
+      b.Spill.Reset()
+      return
+    }
+    
+    b.Items = append(b.Items, item)
+  }
+}
+
+// OutboundBuffer. Returns the number of items waiting for delivery, including spilled ones.
+func (b *OutboundBuffer) Count() int {
+  
+  b.Lock.Lock()
+  defer b.Lock.Unlock()
+  
+  if (b.Spill != nil) { return b.Len() + b.Spill.Count }
+  
+  return b.Len()
+}
+
+// OutboundBuffer. Returns how many more items can be pushed without the overflow policy dropping or blocking.
+// Spilling keeps every item, so a spilling or unbounded buffer always has room.
+func (b *OutboundBuffer) Room() int {
+  
+  if (b.Capacity <= 0 || b.Overflow == OverflowSpill) { return int(^uint(0) >> 1) }
+  
+  b.Lock.Lock()
+  defer b.Lock.Unlock()
+  
+  room := b.Limit() - b.Len()
+  if (room < 0) { room = 0 }
+  
+  return room
+}
+
+// OutboundBuffer. Whether a push would have to wait for room.
+func (b *OutboundBuffer) Full() bool {
+  
+  if (b.Overflow != OverflowBlock || b.Capacity <= 0) { return false }
+  
+  b.Lock.Lock()
+  defer b.Lock.Unlock()
+  
+  return b.Len() >= b.Limit()
+}
+
+// OutboundBuffer. Returns the buffer's status and drop counters.
+func (b *OutboundBuffer) Status() BufferStatus {
+  
+  b.Lock.Lock()
+  defer b.Lock.Unlock()
+  
+  status := BufferStatus{
+    Name: b.Name,
+    Count: b.Len(),
+    Capacity: b.Capacity,
+    Overflow: b.Overflow,
+    Dropped: make(map[string]int, len(b.Dropped)) }
+  
+  if (b.Spill != nil) { status.Spilled = b.Spill.Count }
+  
+  for priority, count := range b.Dropped {
+    
+    status.Dropped[PriorityName(priority)] = count
+  }
+  
+  return status
+}
+
+// OutboundBuffer. Releases blocked pushers and closes the write-ahead log and spill file, if any.
+// Undelivered items are replayed on the next start only if there is a write-ahead log.
+func (b *OutboundBuffer) Close() error {
+  
+  b.Lock.Lock()
+  defer b.Lock.Unlock()
+  
+  b.Closed = true
+  b.Space.Broadcast()
+  
+  if (b.Spill != nil) { b.Spill.Close() }
+  
+  if (b.Wal == nil) { return nil }
+  
+  return b.Wal.Close()
+}
@@ -0,0 +1,102 @@
+/*
+*
+* Name:     Twitch IRC Listener
+* Sys Name: twitch-irc
+* Author:   Nifty255
+*
+*/
+
+package main
+
+import (
+  "strconv" // String conversion functions.
+  "testing" // Go's testing framework.
+  ogdm "github.com/the-opera-house/go-common-lib/models"
+)
+
+// Returns the chat lines held in memory, in order.
+func bufferedChat(b *OutboundBuffer) []string {
+  
+  items := b.Peek(b.Count())
+  
+  lines := make([]string, len(items))
+  for ind := 0; ind < len(items); ind++ { lines[ind] = items[ind].Chat }
+  
+  return lines
+}
+
+func TestOverflowDropsAreNotReplayed(t *testing.T) {
+  
+  w := ConfigWal{ Enabled: true, Path: t.TempDir(), Fsync: WalFsyncAlways }
+  
+  for _, overflow := range []string{ OverflowDropOldest, OverflowDropNewest } {
+    
+    b := OutboundBufferNew("chat-" + overflow, ConfigBuffer{ Capacity: 2, Overflow: overflow }, w)
+    
+    for ind := 0; ind < 4; ind++ { b.Push(OutboundItem{ Chat: "line" + strconv.Itoa(ind), Priority: PriorityChat }) }
+    
+    kept := bufferedChat(b)
+    if (b.Status().Dropped["chat"] != 2) { t.Errorf("%s: dropped = %v, want 2", overflow, b.Status().Dropped) }
+    
+    b.Close()
+    
+    // A restart replays what was kept and nothing that was dropped.
+    b = OutboundBufferNew("chat-" + overflow, ConfigBuffer{ Capacity: 2, Overflow: overflow }, w)
+    replayed := bufferedChat(b)
+    b.Close()
+    
+    if (len(replayed) != len(kept) || len(replayed) != 2 || replayed[0] != kept[0] || replayed[1] != kept[1]) { t.Errorf("%s: replayed %q, want %q", overflow, replayed, kept) }
+  }
+}
+
+func TestMonetaryBorrowingKeepsCapacity(t *testing.T) {
+  
+  events := OutboundBufferNew("events", ConfigBuffer{ Capacity: 2, Overflow: OverflowDropOldest }, ConfigWal{})
+  chat := OutboundBufferNew("chat", ConfigBuffer{ Capacity: 3, Overflow: OverflowDropOldest }, ConfigWal{})
+  events.Yield = chat
+  
+  bits := func(id int) OutboundItem {
+    
+    return OutboundItem{ Event: &(ogdm.Event{ EventID: "bits" + strconv.Itoa(id), EventType: "bits" }), Priority: PriorityMonetary }
+  }
+  
+  for ind := 0; ind < 3; ind++ { chat.Push(OutboundItem{ Chat: "line" + strconv.Itoa(ind), Priority: PriorityChat }) }
+  
+  // Monetary items past the events capacity take room from chat until it has none left to give.
+  for ind := 0; ind < 6; ind++ { events.Push(bits(ind)) }
+  
+  if (events.Count() != 5 || chat.Count() != 0) { t.Fatalf("events = %d, chat = %d, want all 5 slots given to events", events.Count(), chat.Count()) }
+  if (events.Status().Dropped["monetary"] != 1 || chat.Status().Dropped["chat"] != 3) { t.Errorf("dropped = %v %v, want one monetary and every chat line", events.Status().Dropped, chat.Status().Dropped) }
+  
+  // Chat cannot grow back into the lent room while events still hold it.
+  chat.Push(OutboundItem{ Chat: "late", Priority: PriorityChat })
+  if (events.Count() + chat.Count() > 5) { t.Errorf("events = %d, chat = %d, want at most both capacities together", events.Count(), chat.Count()) }
+  
+  // Delivering events returns the room.
+  events.Ack(events.Peek(3))
+  for ind := 0; ind < 3; ind++ { chat.Push(OutboundItem{ Chat: "again" + strconv.Itoa(ind), Priority: PriorityChat }) }
+  
+  if (events.Count() != 2 || chat.Count() != 3) { t.Errorf("events = %d, chat = %d, want chat back to its capacity", events.Count(), chat.Count()) }
+}
+
+func TestFullBlockingOrSpillingBufferDoesNotLend(t *testing.T) {
+  
+  for _, overflow := range []string{ OverflowBlock, OverflowSpill } {
+    
+    events := OutboundBufferNew("events-" + overflow, ConfigBuffer{ Capacity: 1, Overflow: OverflowDropOldest }, ConfigWal{})
+    chat := OutboundBufferNew("chat-" + overflow, ConfigBuffer{ Capacity: 2, Overflow: overflow, SpillPath: t.TempDir() }, ConfigWal{})
+    events.Yield = chat
+    
+    for ind := 0; ind < 2; ind++ { chat.Push(OutboundItem{ Chat: "line" + strconv.Itoa(ind), Priority: PriorityChat }) }
+    
+    // With chat full, the second monetary item finds no room to borrow and the events buffer's own policy applies.
+    for ind := 0; ind < 2; ind++ { events.Push(OutboundItem{ Event: &(ogdm.Event{ EventID: "bits" + strconv.Itoa(ind), EventType: "bits" }), Priority: PriorityMonetary }) }
+    
+    if lines := bufferedChat(chat); len(lines) != 2 || lines[0] != "line0" || lines[1] != "line1" { t.Errorf("%s: chat = %q, want both lines kept", overflow, lines) }
+    if (chat.Status().Dropped["chat"] != 0) { t.Errorf("%s: chat dropped = %v, want none", overflow, chat.Status().Dropped) }
+    if (events.Count() != 1 || events.Status().Dropped["monetary"] != 1) { t.Errorf("%s: events = %d, dropped %v, want one kept and one dropped", overflow, events.Count(), events.Status().Dropped) }
+    
+    events.Close()
+    chat.Close()
+  }
+}
@@ -0,0 +1,197 @@
+/*
+*
+* Name:     Twitch IRC Listener
+* Sys Name: twitch-irc
+* Author:   Nifty255
+*
+*/
+
+package main
+
+import (
+  "time"    // Timing related functions.
+  "strconv" // String/Number conversion functions.
+  ogdm "github.com/the-opera-house/go-common-lib/models"
+)
+
+// Specifies a channel's chat modes, as last reported by ROOMSTATE, and reported by the "channel-state" kite method.
+// FollowersOnly is the minutes a viewer must have followed for, or -1 when the mode is off; Slow is in seconds, 0 when off.
+type RoomState struct {
+  
+  Channel       string    `json:"channel"`
+  RoomID        string    `json:"room_id"`
+  EmoteOnly     bool      `json:"emote_only"`
+  FollowersOnly int       `json:"followers_only"`
+  R9k           bool      `json:"r9k"`
+  Slow          int       `json:"slow"`
+  SubsOnly      bool      `json:"subs_only"`
+  UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// Specifies one of a room's modes and its value, as carried by a "room-mode" Event.
+type RoomMode struct {
+  
+  Name  string
+  Value int
+  On    bool
+}
+
+// Static. Returns the state of a channel before any ROOMSTATE: every mode off.
+func RoomStateNew(channel string) *RoomState {
+  
+  return &(RoomState{
+    Channel: channel,
+    FollowersOnly: -1 })
+}
+
+// Static. Converts a boolean mode to the 1 or 0 of its tag.
+func ModeValue(on bool) int {
+  
+  if (on) { return 1 }
+  
+  return 0
+}
+
+// RoomState. Applies the mode tags of a ROOMSTATE. Twitch sends every tag on join and only the changed ones afterwards,
+// so absent tags leave their mode as it was.
+func (r *RoomState) Apply(tags map[string]string) {
+  
+  if value, ok := tags["emote-only"]; ok { r.EmoteOnly = (value == "1") }
+  if value, ok := tags["r9k"]; ok { r.R9k = (value == "1") }
+  if value, ok := tags["subs-only"]; ok { r.SubsOnly = (value == "1") }
+  
+  if value, ok := tags["followers-only"]; ok {
+    
+    if minutes, err := strconv.Atoi(value); err == nil { r.FollowersOnly = minutes }
+  }
+  
+  if value, ok := tags["slow"]; ok {
+    
+    if seconds, err := strconv.Atoi(value); err == nil { r.Slow = seconds }
+  }
+  
+  if id, ok := tags["room-id"]; ok && id != "" { r.RoomID = id }
+  
+  r.UpdatedAt = time.Now()
+}
+
+// RoomState. Returns every mode, in a fixed order.
+func (r *RoomState) Modes() []RoomMode {
+  
+  return []RoomMode{
+    RoomMode{ Name: "emote-only", Value: ModeValue(r.EmoteOnly), On: r.EmoteOnly },
+    RoomMode{ Name: "followers-only", Value: r.FollowersOnly, On: (r.FollowersOnly >= 0) },
+    RoomMode{ Name: "r9k", Value: ModeValue(r.R9k), On: r.R9k },
+    RoomMode{ Name: "slow", Value: r.Slow, On: (r.Slow > 0) },
+    RoomMode{ Name: "subs-only", Value: ModeValue(r.SubsOnly), On: r.SubsOnly } }
+}
+
+// RoomState. Returns the modes whose value differs from the given earlier state.
+func (r *RoomState) Changes(old *RoomState) []RoomMode {
+  
+  before := old.Modes()
+  after := r.Modes()
+  changes := make([]RoomMode, 0, len(after))
+  
+  for ind := 0; ind < len(after); ind++ {
+    
+    if (after[ind].Value != before[ind].Value) { changes = append(changes, after[ind]) }
+  }
+  
+  return changes
+}
+
+// Records the modes of a ROOMSTATE and fires a "room-mode" Event for each that changed.
+// The first ROOMSTATE of a channel, sent on join, only sets the state; after a reconnect the join's ROOMSTATE
+// fires whatever changed while disconnected. A room-id back-fills the channel's platform ID if it was given without one.
+func (i *IRCDriver) UpdateRoomState(channel string, tags map[string]string) {
+  
+  i.RoomsLock.Lock()
+  
+  state, known := i.RoomStates[channel]
+  if (!known) {
+    
+    state = RoomStateNew(channel)
+    i.RoomStates[channel] = state
+  }
+  
+  old := *state
+  state.Apply(tags)
+  current := *state
+  
+  i.RoomsLock.Unlock()
+  
+  if (current.RoomID != "") { i.BackfillChannelID(channel, current.RoomID) }
+  
+  if (!known) { return }
+  
+  changes := current.Changes(&old)
+  for ind := 0; ind < len(changes); ind++ {
+    
+    logger.Debug("Room mode changed.", LogFields{ "channel": channel, "mode": changes[ind].Name, "value": changes[ind].Value })
+    
+    event := CreateRoomModeEvent(&current, changes[ind])
+    i.FireEvent(event, time.Time{})
+  }
+}
+
+// Returns a copy of a channel's room state, and whether it is known.
+func (i *IRCDriver) GetRoomState(channel string) (RoomState, bool) {
+  
+  i.RoomsLock.RLock()
+  defer i.RoomsLock.RUnlock()
+  
+  state, ok := i.RoomStates[channel]
+  if (!ok) { return RoomState{}, false }
+  
+  return *state, true
+}
+
+// Returns a copy of every known room state.
+func (i *IRCDriver) AllRoomStates() []RoomState {
+  
+  i.RoomsLock.RLock()
+  defer i.RoomsLock.RUnlock()
+  
+  states := make([]RoomState, 0, len(i.RoomStates))
+  for _, state := range i.RoomStates { states = append(states, *state) }
+  
+  return states
+}
+
+// Forgets a channel's room state, once it is parted.
+func (i *IRCDriver) ForgetRoomState(channel string) {
+  
+  i.RoomsLock.Lock()
+  defer i.RoomsLock.Unlock()
+  
+  delete(i.RoomStates, channel)
+}
+
+// Creates a room mode Event. The subtype is the mode, the amount its new value (seconds for slow, minutes for
+// followers-only, 1 or 0 otherwise) and the message "on" or "off". ROOMSTATE carries no timestamp, so its Time is now.
+func CreateRoomModeEvent(state *RoomState, mode RoomMode) *ogdm.Event {
+  
+  timeOfEvent := time.Now()
+  
+  modeMessage := "off"
+  if (mode.On) { modeMessage = "on" }
+  
+  return &(ogdm.Event{
+    Time: timeOfEvent,
+    Platform: "twitch",
+    EventID: "",
+    EventType: "room-mode",
+    EventSubtype: mode.Name,
+    EventSenderID: "",
+    EventSenderLogin: "",
+    EventSenderDisplay: "",
+    EventTargetID: "",
+    EventTargetLogin: "",
+    EventTargetDisplay: "",
+    EventChannelID: state.RoomID,
+    EventChannelName: state.Channel,
+    EventAmount: mode.Value,
+    EventMessage: modeMessage,
+    EventCmotes: []string{} })
+}
@@ -0,0 +1,273 @@
+/*
+*
+* Name:     Twitch IRC Listener
+* Sys Name: twitch-irc
+* Author:   Nifty255
+*
+*/
+
+package main
+
+import (
+  "sort"                   // Sorting functions.
+  "sync"                   // Mutual exclusion locks.
+  "time"                   // Timing related functions.
+  "strconv"                // String/Number conversion functions.
+  "hash/fnv"               // Non-cryptographic hash functions.
+  "github.com/koding/kite" // Microservice functions and structures.
+)
+
+// Specifies a consistent-hash ring of instance names. Each instance is placed at several points so that
+// when one joins or leaves only its share of channels moves.
+type HashRing struct {
+  
+  Members []string
+  Hashes  []uint32
+  Owners  map[uint32]string
+}
+
+// Static. Hashes a string onto the ring.
+func HashKey(key string) uint32 {
+  
+  h := fnv.New32a()
+  h.Write([]byte(key))
+  
+  return h.Sum32()
+}
+
+// Static. Creates a HashRing with virtualNodes points per member.
+func HashRingNew(members []string, virtualNodes int) *HashRing {
+  
+  r := &(HashRing{
+    Members: append([]string{}, members...),
+    Hashes: make([]uint32, 0, len(members) * virtualNodes),
+    Owners: make(map[uint32]string, len(members) * virtualNodes) })
+  
+  sort.Strings(r.Members)
+  
+  for ind := 0; ind < len(r.Members); ind++ {
+    
+    for point := 0; point < virtualNodes; point++ {
+      
+      hash := HashKey(r.Members[ind] + "#" + strconv.Itoa(point))
+      if _, taken := r.Owners[hash]; taken { continue }
+      
+      r.Owners[hash] = r.Members[ind]
+      r.Hashes = append(r.Hashes, hash)
+    }
+  }
+  
+  sort.Slice(r.Hashes, func(a, b int) bool { return r.Hashes[a] < r.Hashes[b] })
+  
+  return r
+}
+
+// HashRing. Returns the member owning a key: the first point at or after the key's hash, wrapping around.
+func (r *HashRing) Owner(key string) string {
+  
+  if (len(r.Hashes) == 0) { return "" }
+  
+  hash := HashKey(key)
+  ind := sort.Search(len(r.Hashes), func(ind int) bool { return r.Hashes[ind] >= hash })
+  if (ind == len(r.Hashes)) { ind = 0 }
+  
+  return r.Owners[r.Hashes[ind]]
+}
+
+// HashRing. Returns whether two rings have the same members.
+func (r *HashRing) Same(other *HashRing) bool {
+  
+  if (len(r.Members) != len(other.Members)) { return false }
+  
+  for ind := 0; ind < len(r.Members); ind++ {
+    
+    if (r.Members[ind] != other.Members[ind]) { return false }
+  }
+  
+  return true
+}
+
+// Specifies another instance. Several entries may share a name when a shard has replicas;
+// the shard is up while any of them is.
+type ShardPeer struct {
+  
+  Name     string
+  Address  string
+  Port     int
+  Kite     *KiteSink
+  LastSeen time.Time
+  Up       bool
+}
+
+// Specifies this instance's view of the shards. Peers are watched over kite; one that has been unreachable
+// for DownAfter leaves the ring, and it rejoins as soon as it is reachable again.
+// Every peer starts out assumed up, so a fresh start does not join every channel only to part most of them.
+type Sharder struct {
+  
+  Self         string
+  VirtualNodes int
+  DownAfter    time.Duration
+  Peers        []*ShardPeer
+  Ring         *HashRing
+  OnChange     func(old, ring *HashRing)
+  OnPeerUp     func(peer *ShardPeer)
+  Ticker       *time.Ticker
+  Done         chan bool
+  Lock         sync.RWMutex
+}
+
+// Static. Creates a Sharder, dials every other instance and starts watching them.
+// onChange is called when the ring's members change, onPeerUp when a peer becomes reachable.
+func SharderNew(k *kite.Kite, c ConfigSharding, onChange func(old, ring *HashRing), onPeerUp func(peer *ShardPeer)) *Sharder {
+  
+  s := &(Sharder{
+    Self: c.Self,
+    VirtualNodes: c.VirtualNodes,
+    DownAfter: time.Duration(c.DownAfterMs) * time.Millisecond,
+    Peers: make([]*ShardPeer, 0, len(c.Instances)),
+    OnChange: onChange,
+    OnPeerUp: onPeerUp,
+    Ticker: time.NewTicker(time.Second),
+    Done: make(chan bool) })
+  
+  now := time.Now()
+  
+  for ind := 0; ind < len(c.Instances); ind++ {
+    
+    instance := c.Instances[ind]
+    if (instance.Name == s.Self) { continue }
+    
+    s.Peers = append(s.Peers, &(ShardPeer{
+      Name: instance.Name,
+      Address: instance.Address,
+      Port: instance.Port,
+      Kite: KiteSinkNew(k, "shard " + instance.Name, instance.Address, instance.Port, "shard-channels", ""),
+      LastSeen: now }))
+  }
+  
+  s.Ring = HashRingNew(s.LiveMembers(now), s.VirtualNodes)
+  
+  go func() {
+    for {
+      select {
+      case <- s.Ticker.C:
+        s.Check()
+      case <- s.Done:
+        return
+      }
+    }
+  }()
+  
+  return s
+}
+
+// Sharder. Returns the names of this instance and every peer seen within DownAfter. Call with Lock held.
+func (s *Sharder) LiveMembers(now time.Time) []string {
+  
+  seen := make(map[string]bool, len(s.Peers) + 1)
+  seen[s.Self] = true
+  
+  for ind := 0; ind < len(s.Peers); ind++ {
+    
+    if (now.Sub(s.Peers[ind].LastSeen) < s.DownAfter) { seen[s.Peers[ind].Name] = true }
+  }
+  
+  members := make([]string, 0, len(seen))
+  for name := range seen { members = append(members, name) }
+  
+  return members
+}
+
+// Sharder. Refreshes peer liveness and rebuilds the ring if its members changed.
+func (s *Sharder) Check() {
+  
+  now := time.Now()
+  arrived := make([]*ShardPeer, 0)
+  
+  s.Lock.Lock()
+  
+  for ind := 0; ind < len(s.Peers); ind++ {
+    
+    peer := s.Peers[ind]
+    up := peer.Kite.Ready()
+    
+    if (up) { peer.LastSeen = now }
+    if (up && !peer.Up) { arrived = append(arrived, peer) }
+    peer.Up = up
+  }
+  
+  old := s.Ring
+  ring := HashRingNew(s.LiveMembers(now), s.VirtualNodes)
+  changed := !ring.Same(old)
+  if (changed) { s.Ring = ring }
+  
+  s.Lock.Unlock()
+  
+  for ind := 0; ind < len(arrived); ind++ {
+    
+    logger.Info("Shard peer reachable.", LogFields{ "shard": arrived[ind].Name, "address": arrived[ind].Address })
+    if (s.OnPeerUp != nil) { s.OnPeerUp(arrived[ind]) }
+  }
+  
+  if (!changed) { return }
+  
+  logger.Info("Shard membership changed. Rebalancing.", LogFields{ "shards": len(ring.Members), "before": len(old.Members) })
+  if (s.OnChange != nil) { s.OnChange(old, ring) }
+}
+
+// Sharder. Returns which shard owns the channel with the given platform ID.
+func (s *Sharder) Owner(channelID string) string {
+  
+  s.Lock.RLock()
+  defer s.Lock.RUnlock()
+  
+  return s.Ring.Owner(channelID)
+}
+
+// Sharder. Returns whether this shard owns the channel with the given platform ID.
+func (s *Sharder) Owns(channelID string) bool {
+  
+  return (s.Owner(channelID) == s.Self)
+}
+
+// Sharder. Returns every peer that is currently reachable.
+func (s *Sharder) UpPeers() []*ShardPeer {
+  
+  s.Lock.RLock()
+  defer s.Lock.RUnlock()
+  
+  peers := make([]*ShardPeer, 0, len(s.Peers))
+  for ind := 0; ind < len(s.Peers); ind++ {
+    
+    if (s.Peers[ind].Up) { peers = append(peers, s.Peers[ind]) }
+  }
+  
+  return peers
+}
+
+// Sharder. Returns the peers belonging to the named shard.
+func (s *Sharder) ShardPeers(name string) []*ShardPeer {
+  
+  s.Lock.RLock()
+  defer s.Lock.RUnlock()
+  
+  peers := make([]*ShardPeer, 0, 2)
+  for ind := 0; ind < len(s.Peers); ind++ {
+    
+    if (s.Peers[ind].Name == name) { peers = append(peers, s.Peers[ind]) }
+  }
+  
+  return peers
+}
+
+// Sharder. Stops watching and closes every peer client.
+func (s *Sharder) Stop() {
+  
+  s.Ticker.Stop()
+  close(s.Done)
+  
+  for ind := 0; ind < len(s.Peers); ind++ {
+    
+    s.Peers[ind].Kite.Close()
+  }
+}
@@ -0,0 +1,182 @@
+/*
+*
+* Name:     Twitch IRC Listener
+* Sys Name: twitch-irc
+* Author:   Nifty255
+*
+*/
+
+package main
+
+import (
+  "time"    // Timing related functions.
+  "strconv" // String conversion functions.
+  "testing" // Go's testing framework.
+)
+
+// Returns the first key, channel0, channel1, ..., whose hash satisfies match.
+func keyHashing(t *testing.T, match func(hash uint32) bool) string {
+  
+  t.Helper()
+  
+  for ind := 0; ind < 1000000; ind++ {
+    
+    key := "channel" + strconv.Itoa(ind)
+    if (match(HashKey(key))) { return key }
+  }
+  
+  t.Fatalf("no key hashes as wanted")
+  return ""
+}
+
+// Returns the share of n keys whose owner differs between two rings, and whether every move satisfies moved.
+func movedShare(before, after *HashRing, n int, moved func(from, to string) bool) (float64, bool) {
+  
+  count, expected := 0, true
+  
+  for ind := 0; ind < n; ind++ {
+    
+    key := strconv.Itoa(100000 + ind)
+    from, to := before.Owner(key), after.Owner(key)
+    if (from == to) { continue }
+    
+    count++
+    if (!moved(from, to)) { expected = false }
+  }
+  
+  return float64(count) / float64(n), expected
+}
+
+func TestHashRingOwner(t *testing.T) {
+  
+  ring := HashRingNew([]string{ "a", "b", "c" }, 128)
+  first, last := ring.Hashes[0], ring.Hashes[len(ring.Hashes) - 1]
+  mid := len(ring.Hashes) / 2
+  
+  cases := []struct {
+    
+    name  string
+    match func(hash uint32) bool
+    owner string
+  }{
+    { "before the first point", func(hash uint32) bool { return hash <= first }, ring.Owners[first] },
+    { "past the last point wraps around", func(hash uint32) bool { return hash > last }, ring.Owners[first] },
+    { "between points", func(hash uint32) bool { return hash > ring.Hashes[mid - 1] && hash <= ring.Hashes[mid] }, ring.Owners[ring.Hashes[mid]] },
+  }
+  
+  for ind := 0; ind < len(cases); ind++ {
+    
+    key := keyHashing(t, cases[ind].match)
+    if owner := ring.Owner(key); owner != cases[ind].owner { t.Errorf("%s: owner of %s = %s, want %s", cases[ind].name, key, owner, cases[ind].owner) }
+  }
+  
+  // Every instance builds the same ring whatever order it lists the members in.
+  shuffled := HashRingNew([]string{ "c", "a", "b" }, 128)
+  for ind := 0; ind < 1000; ind++ {
+    
+    key := strconv.Itoa(ind)
+    if (ring.Owner(key) != shuffled.Owner(key)) { t.Fatalf("owner of %s differs by member order", key) }
+  }
+  
+  if owner := HashRingNew(nil, 128).Owner("channel0"); owner != "" { t.Errorf("owner on an empty ring = %q, want none", owner) }
+}
+
+func TestHashRingMovesOnlyItsShare(t *testing.T) {
+  
+  four := HashRingNew([]string{ "a", "b", "c", "d" }, 128)
+  
+  cases := []struct {
+    
+    name  string
+    after *HashRing
+    share float64
+    moved func(from, to string) bool
+  }{
+    { "adding a member", HashRingNew([]string{ "a", "b", "c", "d", "e" }, 128), 1.0 / 5, func(from, to string) bool { return to == "e" } },
+    { "removing a member", HashRingNew([]string{ "a", "b", "c" }, 128), 1.0 / 4, func(from, to string) bool { return from == "d" } },
+  }
+  
+  for ind := 0; ind < len(cases); ind++ {
+    
+    share, expected := movedShare(four, cases[ind].after, 20000, cases[ind].moved)
+    
+    if (share < cases[ind].share * 0.6 || share > cases[ind].share * 1.4) { t.Errorf("%s: moved %.3f of the keys, want about %.3f", cases[ind].name, share, cases[ind].share) }
+    if (!expected) { t.Errorf("%s: keys moved between members that did not change", cases[ind].name) }
+  }
+}
+
+func TestHashRingSame(t *testing.T) {
+  
+  ring := HashRingNew([]string{ "a", "b" }, 16)
+  
+  cases := []struct {
+    
+    name    string
+    members []string
+    same    bool
+  }{
+    { "same members", []string{ "a", "b" }, true },
+    { "other order", []string{ "b", "a" }, true },
+    { "one more", []string{ "a", "b", "c" }, false },
+    { "one fewer", []string{ "a" }, false },
+    { "one replaced", []string{ "a", "c" }, false },
+  }
+  
+  for ind := 0; ind < len(cases); ind++ {
+    
+    if same := ring.Same(HashRingNew(cases[ind].members, 16)); same != cases[ind].same { t.Errorf("%s: Same = %v, want %v", cases[ind].name, same, cases[ind].same) }
+  }
+}
+
+func TestSharderDropsPeerAfterDownAfter(t *testing.T) {
+  
+  changes := make(chan *HashRing, 4)
+  arrivals := make(chan string, 4)
+  
+  peers := []*ShardPeer{ &(ShardPeer{ Name: "b", Kite: &KiteSink{} }), &(ShardPeer{ Name: "c", Kite: &KiteSink{} }) }
+  peers[0].Kite.Connected.Store(true)
+  peers[1].Kite.Connected.Store(true)
+  
+  s := &(Sharder{
+    Self: "a",
+    VirtualNodes: 128,
+    DownAfter: 100 * time.Millisecond,
+    Peers: peers,
+    OnChange: func(old, ring *HashRing) { changes <- ring },
+    OnPeerUp: func(peer *ShardPeer) { arrivals <- peer.Name } })
+  
+  now := time.Now()
+  for ind := 0; ind < len(peers); ind++ { peers[ind].LastSeen = now }
+  s.Ring = HashRingNew(s.LiveMembers(now), s.VirtualNodes)
+  
+  s.Check()
+  
+  if (len(arrivals) != 2 || len(changes) != 0) { t.Fatalf("arrivals = %d, changes = %d, want both peers up and the ring unchanged", len(arrivals), len(changes)) }
+  <-arrivals
+  <-arrivals
+  
+  // Unreachable, but not yet for DownAfter.
+  peers[1].Kite.Connected.Store(false)
+  s.Check()
+  
+  if (len(changes) != 0 || len(s.UpPeers()) != 1) { t.Errorf("changes = %d, up = %d, want c down but still in the ring", len(changes), len(s.UpPeers())) }
+  
+  time.Sleep(150 * time.Millisecond)
+  s.Check()
+  
+  if (len(changes) != 1) { t.Fatalf("changes = %d, want the ring rebuilt once c is past DownAfter", len(changes)) }
+  if ring := <-changes; !ring.Same(HashRingNew([]string{ "a", "b" }, 16)) { t.Errorf("ring members = %v, want a and b", ring.Members) }
+  
+  for ind := 0; ind < 1000; ind++ {
+    
+    if owner := s.Owner(strconv.Itoa(ind)); owner == "c" { t.Fatalf("channel %d still owned by c", ind) }
+  }
+  
+  // Reachable again, c rejoins at once.
+  peers[1].Kite.Connected.Store(true)
+  s.Check()
+  
+  if (len(changes) != 1 || len(arrivals) != 1) { t.Fatalf("changes = %d, arrivals = %d, want c back in the ring", len(changes), len(arrivals)) }
+  if ring := <-changes; len(ring.Members) != 3 { t.Errorf("ring members = %v, want a, b and c", ring.Members) }
+  if name := <-arrivals; name != "c" { t.Errorf("arrived = %s, want c", name) }
+}
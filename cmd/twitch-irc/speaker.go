@@ -0,0 +1,288 @@
+/*
+*
+* Name:     Twitch IRC Listener
+* Sys Name: twitch-irc
+* Author:   Nifty255
+*
+*/
+
+package main
+
+import (
+  "sync"    // Mutual exclusion locks.
+  "time"    // Timing related functions.
+  "errors"  // Error creation functions.
+  "regexp"  // Regular Expression functions.
+  "strings" // String manipulation functions.
+)
+
+var (
+  SaysTotal       = CounterNew("twitch_irc_says_total", "Messages sent, by account.", "account")
+  SayRejectsTotal = CounterNew("twitch_irc_say_rejects_total", "Messages not sent, by reason.", "reason")
+)
+
+// Appended to alternate repeats of a message, since Twitch drops a message identical to the previous one within 30 seconds.
+// It is an invisible tag character, so viewers see the same text.
+const DuplicateSuffix = " \U000E0000"
+
+var msgIDFinder = regexp.MustCompile(`^[A-Za-z0-9-]{1,64}$`)
+
+// Specifies a message to send, as accepted by the "say" and "reply" kite methods.
+// Account picks which bot account should speak; another is used if none of its listeners are joined, or any if it is empty.
+type SayRequest struct {
+  
+  Channel string `json:"channel"`
+  Message string `json:"message"`
+  ReplyTo string `json:"reply_to"`
+  Account string `json:"account"`
+}
+
+// Specifies a message as it was sent.
+type SayResult struct {
+  
+  Account string    `json:"account"`
+  Channel string    `json:"channel"`
+  Message string    `json:"message"`
+  ReplyTo string    `json:"reply_to,omitempty"`
+  SentAt  time.Time `json:"sent_at"`
+}
+
+// Specifies the last message an account sent to a channel.
+type SpokenMessage struct {
+  
+  Message string
+  SentAt  time.Time
+}
+
+// Specifies what an account may say. Twitch allows an account Limit messages per window across every channel it is not
+// a moderator of, and ModLimit across all channels; every message takes from the latter and non-moderator ones from both.
+// Waits keeps messages to a channel in order while they wait out limits and its slow mode, without holding up other
+// channels. SendLock is held only to send and record a message, never while waiting.
+type AccountSpeaker struct {
+  
+  Account    *BotAccount
+  Limiter    *JoinLimiter
+  ModLimiter *JoinLimiter
+  Mod        map[string]bool
+  Last       map[string]SpokenMessage
+  Waits      map[string]*sync.Mutex
+  SendLock   sync.Mutex
+  Lock       sync.Mutex
+}
+
+// Specifies how the driver talks in chat: one AccountSpeaker per account.
+type Speaker struct {
+  
+  Config   ConfigSay
+  Accounts map[*BotAccount]*AccountSpeaker
+  Lock     sync.Mutex
+}
+
+// Static. Creates a Speaker from config.
+func SpeakerNew(c ConfigSay) *Speaker {
+  
+  return &(Speaker{
+    Config: c,
+    Accounts: make(map[*BotAccount]*AccountSpeaker, 4) })
+}
+
+// Speaker. Returns the AccountSpeaker for an account, creating it on first use.
+func (s *Speaker) For(account *BotAccount) *AccountSpeaker {
+  
+  s.Lock.Lock()
+  defer s.Lock.Unlock()
+  
+  speaker, ok := s.Accounts[account]
+  if (!ok) {
+    
+    window := time.Duration(s.Config.WindowMs) * time.Millisecond
+    
+    speaker = &(AccountSpeaker{
+      Account: account,
+      Limiter: JoinLimiterNew(s.Config.Limit, window),
+      ModLimiter: JoinLimiterNew(s.Config.ModLimit, window),
+      Mod: make(map[string]bool, 16),
+      Last: make(map[string]SpokenMessage, 16),
+      Waits: make(map[string]*sync.Mutex, 16) })
+    s.Accounts[account] = speaker
+  }
+  
+  return speaker
+}
+
+// Speaker. Records whether an account moderates a channel, from the USERSTATE Twitch sends on join and after each message.
+func (s *Speaker) SetMod(account *BotAccount, channel string, mod bool) {
+  
+  speaker := s.For(account)
+  
+  speaker.Lock.Lock()
+  defer speaker.Lock.Unlock()
+  
+  speaker.Mod[channel] = mod
+}
+
+// AccountSpeaker. Returns whether the account moderates, or owns, the channel. Unknown channels count as not.
+func (a *AccountSpeaker) IsMod(channel string) bool {
+  
+  a.Lock.Lock()
+  defer a.Lock.Unlock()
+  
+  return (a.Mod[channel] || channel == a.Account.Login)
+}
+
+// AccountSpeaker. Takes one message from the account's limits, without blocking. Returns whether it may be sent.
+func (a *AccountSpeaker) Take(mod bool) bool {
+  
+  if (mod) { return (a.ModLimiter.Take(1) == 1) }
+  
+  if (a.Limiter.Take(1) == 0) { return false }
+  if (a.ModLimiter.Take(1) == 1) { return true }
+  
+  a.Limiter.Give(1)
+  return false
+}
+
+// AccountSpeaker. Gives back a message taken from the account's limits that was not sent.
+func (a *AccountSpeaker) Give(mod bool) {
+  
+  if (!mod) { a.Limiter.Give(1) }
+  
+  a.ModLimiter.Give(1)
+}
+
+// AccountSpeaker. Returns the lock messages to a channel wait under, creating it on first use.
+func (a *AccountSpeaker) Wait(channel string) *sync.Mutex {
+  
+  a.Lock.Lock()
+  defer a.Lock.Unlock()
+  
+  wait, ok := a.Waits[channel]
+  if (!ok) {
+    
+    wait = &sync.Mutex{}
+    a.Waits[channel] = wait
+  }
+  
+  return wait
+}
+
+// AccountSpeaker. Returns the last message sent to a channel.
+func (a *AccountSpeaker) LastSpoken(channel string) SpokenMessage {
+  
+  a.Lock.Lock()
+  defer a.Lock.Unlock()
+  
+  return a.Last[channel]
+}
+
+// Static. Strips line breaks, which would end the IRC line early, and trims the message to Twitch's length limit.
+func CleanMessage(message string, maxLength int) string {
+  
+  message = strings.TrimSpace(strings.NewReplacer("\r", " ", "\n", " ").Replace(message))
+  
+  runes := []rune(message)
+  if (maxLength > 0 && len(runes) > maxLength) { message = string(runes[:maxLength]) }
+  
+  return message
+}
+
+// Returns the authenticated listener to speak through, preferring, in order: one of login's listeners joined to the channel,
+// any of login's, any listener joined to the channel, and any at all. An empty login matches every account.
+func (i *IRCDriver) SpeakingListener(channel, login string) *Listener {
+  
+  listeners := i.ListenerPool.Snapshot()
+  var best *Listener
+  bestRank := 0
+  
+  for ind := 0; ind < len(listeners); ind++ {
+    
+    l := listeners[ind]
+    if (l.Account == nil || l.GetState() != ListenerJoined) { continue }
+    
+    rank := 1
+    if (login == "" || strings.EqualFold(login, l.Account.Login)) { rank += 2 }
+    if (l.GetChannel(channel) != nil) { rank += 1 }
+    
+    if (rank == 4) { return l }
+    if (rank > bestRank) { best, bestRank = l, rank }
+  }
+  
+  return best
+}
+
+// Sends a message, or a reply if ReplyTo is set, through an authenticated listener.
+// It waits up to the configured maximum for the account's limits and the channel's slow mode, and fails if that is not enough,
+// or if the listener is no longer connected once it may send.
+func (i *IRCDriver) Say(req SayRequest) (SayResult, error) {
+  
+  c := i.Speaker.Config
+  channel := strings.ToLower(strings.TrimPrefix(strings.TrimSpace(req.Channel), "#"))
+  message := CleanMessage(req.Message, c.MaxLength)
+  
+  if (channel == "") { return SayResult{}, errors.New("No channel.") }
+  if (message == "") { return SayResult{}, errors.New("Empty message.") }
+  if (req.ReplyTo != "" && !msgIDFinder.MatchString(req.ReplyTo)) { return SayResult{}, errors.New("Invalid reply_to.") }
+  
+  l := i.SpeakingListener(channel, req.Account)
+  if (l == nil) { SayRejectsTotal.Inc("no_listener"); return SayResult{}, errors.New("No authenticated listener is connected.") }
+  
+  speaker := i.Speaker.For(l.Account)
+  
+  wait := speaker.Wait(channel)
+  wait.Lock()
+  defer wait.Unlock()
+  
+  deadline := time.Now().Add(time.Duration(c.MaxWaitMs) * time.Millisecond)
+  mod := speaker.IsMod(channel)
+  last := speaker.LastSpoken(channel)
+  
+  // Moderators are exempt from slow mode.
+  if room, _ := i.GetRoomState(channel); room.Slow > 0 && !mod {
+    
+    ready := last.SentAt.Add(time.Duration(room.Slow) * time.Second)
+    if (ready.After(deadline)) { SayRejectsTotal.Inc("slow_mode"); return SayResult{}, errors.New("Slow mode.") }
+    time.Sleep(time.Until(ready))
+  }
+  
+  for !speaker.Take(mod) {
+    
+    if (time.Now().After(deadline)) { SayRejectsTotal.Inc("rate_limit"); return SayResult{}, errors.New("Rate limited.") }
+    time.Sleep(100 * time.Millisecond)
+  }
+  
+  if (last.Message == message && time.Since(last.SentAt) < time.Duration(c.DuplicateWindowMs) * time.Millisecond) {
+    
+    message = CleanMessage(message, c.MaxLength - len([]rune(DuplicateSuffix))) + DuplicateSuffix
+  }
+  
+  line := "PRIVMSG #" + channel + " :" + message
+  if (req.ReplyTo != "") { line = "@reply-parent-msg-id=" + req.ReplyTo + " " + line }
+  
+  // A reconnecting listener's connection would hold the send until it came back.
+  conn := l.SendingConnection()
+  if (conn == nil) {
+    
+    speaker.Give(mod)
+    SayRejectsTotal.Inc("disconnected")
+    return SayResult{}, errors.New("Listener is not connected.")
+  }
+  
+  speaker.SendLock.Lock()
+  conn.SendRaw(line)
+  sentAt := time.Now()
+  speaker.SendLock.Unlock()
+  
+  speaker.Lock.Lock()
+  speaker.Last[channel] = SpokenMessage{ Message: message, SentAt: sentAt }
+  speaker.Lock.Unlock()
+  
+  SaysTotal.Inc(l.Account.Login)
+  logger.Debug("Sent message.", LogFields{ "listener": l.Username, "account": l.Account.Login, "channel": channel, "reply_to": req.ReplyTo })
+  
+  return SayResult{
+    Account: l.Account.Login,
+    Channel: channel,
+    Message: message,
+    ReplyTo: req.ReplyTo,
+    SentAt: sentAt }, nil
+}
@@ -0,0 +1,225 @@
+/*
+*
+* Name:     Twitch IRC Listener
+* Sys Name: twitch-irc
+* Author:   Nifty255
+*
+*/
+
+package main
+
+import (
+  "time"    // Timing related functions.
+  "strconv" // String conversion functions.
+  "strings" // String manipulation functions.
+  "testing" // Go's testing framework.
+)
+
+// Adds a listener for a bot account, joined to the given channels on a connection to the fake server.
+func joinedBotListener(t *testing.T, addr string, login string, channels ...string) *Listener {
+  
+  t.Helper()
+  
+  l := CreateListener(login, &(BotAccount{ Login: login }), ircDriver)
+  conn := l.Connection
+  
+  l.Lock.Lock()
+  l.State = ListenerConnecting
+  l.Lock.Unlock()
+  
+  if err := conn.Connect(addr); err != nil { t.Fatal(err) }
+  if (!l.MarkConnected(conn)) { t.Fatal("the listener refused its connection") }
+  
+  l.Lock.Lock()
+  l.State = ListenerJoined
+  for ind := 0; ind < len(channels); ind++ { l.Channels[channels[ind]] = &(testChannels(channels[ind], 1, 100)[0]) }
+  l.Lock.Unlock()
+  
+  ircDriver.ListenerPool.Add(l)
+  
+  return l
+}
+
+func TestSayWithoutConnection(t *testing.T) {
+  
+  startTestDriver(t)
+  
+  // Joined, but its connection dropped and is being replaced.
+  l := CreateListener("nifty_bot", &(BotAccount{ Login: "nifty_bot" }), ircDriver)
+  l.State = ListenerJoined
+  ircDriver.ListenerPool.Add(l)
+  
+  withinSecond(t, "Say", func() {
+    
+    if _, err := ircDriver.Say(SayRequest{ Channel: "dallas", Message: "hello" }); err == nil { t.Errorf("Say through a disconnected listener succeeded") }
+  })
+  
+  // The message was not sent, so it does not count against the account.
+  speaker := ircDriver.Speaker.For(l.Account)
+  if (speaker.Limiter.Take(config.Say.Limit) != config.Say.Limit) { t.Errorf("the rejected message took from the account's limit") }
+}
+
+func TestSaySlowModeHoldsOnlyItsChannel(t *testing.T) {
+  
+  srv, _ := startTestDriver(t)
+  
+  l := joinedBotListener(t, srv.Addr, "nifty_bot", "slowchan", "fastchan")
+  speaker := ircDriver.Speaker.For(l.Account)
+  
+  ircDriver.RoomsLock.Lock()
+  ircDriver.RoomStates["slowchan"] = &(RoomState{ Channel: "slowchan", Slow: 2 })
+  ircDriver.RoomsLock.Unlock()
+  
+  speaker.Lock.Lock()
+  speaker.Last["slowchan"] = SpokenMessage{ Message: "earlier", SentAt: time.Now() }
+  speaker.Lock.Unlock()
+  
+  slow := make(chan error, 1)
+  go func() { _, err := ircDriver.Say(SayRequest{ Channel: "slowchan", Message: "waits" }); slow <- err }()
+  
+  time.Sleep(100 * time.Millisecond)
+  
+  // Another channel is not held up by slowchan's wait.
+  withinSecond(t, "Say to another channel", func() {
+    
+    if _, err := ircDriver.Say(SayRequest{ Channel: "fastchan", Message: "right away" }); err != nil { t.Error(err) }
+  })
+  
+  if err := <- slow; err != nil { t.Fatal(err) }
+  
+  if err := srv.WaitFor(func() bool { return len(srv.LinesWithCommand("PRIVMSG")) == 2 }, 5 * time.Second); err != nil { t.Fatalf("PRIVMSG lines = %q, want both sent", srv.LinesWithCommand("PRIVMSG")) }
+  
+  lines := srv.LinesWithCommand("PRIVMSG")
+  if (!strings.Contains(lines[0], "#fastchan") || !strings.Contains(lines[1], "#slowchan")) { t.Errorf("PRIVMSG lines = %q, want fastchan sent first", lines) }
+}
+
+func TestSpeakingListenerPrefersAccountThenChannel(t *testing.T) {
+  
+  srv, _ := startTestDriver(t)
+  
+  alpha := joinedBotListener(t, srv.Addr, "alpha_bot", "dallas")
+  beta := joinedBotListener(t, srv.Addr, "beta_bot", "ronni")
+  
+  cases := []struct {
+    
+    channel string
+    login   string
+    want    *Listener
+  }{
+    { "dallas", "", alpha },
+    { "ronni", "", beta },
+    { "dallas", "beta_bot", beta },
+    { "ronni", "ALPHA_BOT", alpha },
+    { "dallas", "gamma_bot", alpha },
+    { "ronni", "gamma_bot", beta },
+  }
+  
+  for ind := 0; ind < len(cases); ind++ {
+    
+    if got := ircDriver.SpeakingListener(cases[ind].channel, cases[ind].login); got != cases[ind].want {
+      
+      t.Errorf("%s as %q: spoke through %v, want %s", cases[ind].channel, cases[ind].login, got, cases[ind].want.Username)
+    }
+  }
+  
+  // Neither is in the channel nor the requested account, but someone still speaks.
+  if got := ircDriver.SpeakingListener("nowhere", "gamma_bot"); got == nil { t.Errorf("no listener to speak through, want any joined one") }
+}
+
+func TestSaySlowModeWaitsOrRejects(t *testing.T) {
+  
+  srv, _ := startTestDriver(t, func(c *Config) { c.Say.MaxWaitMs = 3000 })
+  
+  l := joinedBotListener(t, srv.Addr, "nifty_bot", "slowchan")
+  speaker := ircDriver.Speaker.For(l.Account)
+  
+  cases := []struct {
+    
+    name    string
+    slow    int
+    mod     bool
+    fails   bool
+    waitMin time.Duration
+    waitMax time.Duration
+  }{
+    { "within the maximum wait", 1, false, false, 800 * time.Millisecond, 2 * time.Second },
+    { "longer than the maximum wait", 10, false, true, 0, 100 * time.Millisecond },
+    { "as a moderator", 10, true, false, 0, 100 * time.Millisecond },
+  }
+  
+  for ind := 0; ind < len(cases); ind++ {
+    
+    ircDriver.RoomsLock.Lock()
+    ircDriver.RoomStates["slowchan"] = &(RoomState{ Channel: "slowchan", Slow: cases[ind].slow })
+    ircDriver.RoomsLock.Unlock()
+    
+    ircDriver.Speaker.SetMod(l.Account, "slowchan", cases[ind].mod)
+    
+    speaker.Lock.Lock()
+    speaker.Last["slowchan"] = SpokenMessage{ Message: "earlier", SentAt: time.Now() }
+    speaker.Lock.Unlock()
+    
+    start := time.Now()
+    _, err := ircDriver.Say(SayRequest{ Channel: "slowchan", Message: cases[ind].name })
+    took := time.Since(start)
+    
+    if (cases[ind].fails != (err != nil)) { t.Errorf("%s: err = %v, want failure %v", cases[ind].name, err, cases[ind].fails) }
+    if (took < cases[ind].waitMin || took > cases[ind].waitMax) { t.Errorf("%s: took %v, want between %v and %v", cases[ind].name, took, cases[ind].waitMin, cases[ind].waitMax) }
+  }
+}
+
+func TestSayModLimiter(t *testing.T) {
+  
+  srv, _ := startTestDriver(t, func(c *Config) { c.Say.Limit = 2; c.Say.ModLimit = 3; c.Say.MaxWaitMs = 0 })
+  
+  l := joinedBotListener(t, srv.Addr, "nifty_bot", "plainchan", "modchan")
+  ircDriver.Speaker.SetMod(l.Account, "modchan", true)
+  
+  cases := []struct {
+    
+    channel string
+    sent    bool
+  }{
+    { "plainchan", true },
+    { "plainchan", true },
+    
+    // The account's own limit is spent, but it is still allowed more where it moderates.
+    { "plainchan", false },
+    { "modchan", true },
+    
+    // Now the limit across all channels is spent too.
+    { "modchan", false },
+    { "nifty_bot", false },
+  }
+  
+  for ind := 0; ind < len(cases); ind++ {
+    
+    _, err := ircDriver.Say(SayRequest{ Channel: cases[ind].channel, Message: "message " + strconv.Itoa(ind) })
+    if (cases[ind].sent != (err == nil)) { t.Errorf("message %d to %s: err = %v, want sent %v", ind, cases[ind].channel, err, cases[ind].sent) }
+  }
+  
+  if got := counterValue(SayRejectsTotal, "rate_limit"); got < 3 { t.Errorf("rate_limit rejects = %v, want at least 3", got) }
+}
+
+func TestSayAlternatesDuplicateSuffix(t *testing.T) {
+  
+  srv, _ := startTestDriver(t)
+  
+  joinedBotListener(t, srv.Addr, "nifty_bot", "dallas")
+  
+  want := []string{ "hello", "hello" + DuplicateSuffix, "hello", "bye" }
+  
+  for ind := 0; ind < len(want); ind++ {
+    
+    message := strings.TrimSuffix(want[ind], DuplicateSuffix)
+    if result, err := ircDriver.Say(SayRequest{ Channel: "dallas", Message: message }); err != nil || result.Message != want[ind] { t.Errorf("say %d = %q, %v, want %q", ind, result.Message, err, want[ind]) }
+  }
+  
+  if err := srv.WaitFor(func() bool { return len(srv.LinesWithCommand("PRIVMSG")) == len(want) }, 5 * time.Second); err != nil { t.Fatalf("PRIVMSG lines = %q, want %d", srv.LinesWithCommand("PRIVMSG"), len(want)) }
+  
+  lines := srv.LinesWithCommand("PRIVMSG")
+  for ind := 0; ind < len(want); ind++ {
+    
+    if (lines[ind] != "PRIVMSG #dallas :" + want[ind]) { t.Errorf("line %d = %q, want the message %q", ind, lines[ind], want[ind]) }
+  }
+}
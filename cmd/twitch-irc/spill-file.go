@@ -0,0 +1,84 @@
+/*
+*
+* Name:     Twitch IRC Listener
+* Sys Name: twitch-irc
+* Author:   Nifty255
+*
+*/
+
+package main
+
+import (
+  "os"            // File functions.
+  "io"            // Reader/Writer interfaces.
+  "bufio"         // Buffered reading functions.
+  "path/filepath" // File path functions.
+  "encoding/json" // JSON encoding functions.
+)
+
+// Specifies an on-disk FIFO that holds an OutboundBuffer's overflow. It only relieves memory; it is
+// truncated on open and whenever it empties, so durability across restarts is the write-ahead log's job.
+type SpillFile struct {
+  
+  Path   string
+  File   *os.File
+  Reader *bufio.Reader
+  Count  int
+}
+
+// Static. Creates or truncates the spill file at the given path.
+func SpillFileNew(path string) (*SpillFile, error) {
+  
+  if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil { return nil, err }
+  
+  file, err := os.OpenFile(path, os.O_CREATE | os.O_RDWR | os.O_TRUNC, 0644)
+  if (err != nil) { return nil, err }
+  
+  return &(SpillFile{
+    Path: path,
+    File: file,
+    Reader: bufio.NewReader(io.NewSectionReader(file, 0, 1 << 62)) }), nil
+}
+
+// SpillFile. Appends an item.
+func (s *SpillFile) Write(item OutboundItem) error {
+  
+  data, err := json.Marshal(item)
+  if (err != nil) { return err }
+  
+  if _, err := s.File.Write(append(data, '\n')); err != nil { return err }
+  
+  s.Count++
+  
+  return nil
+}
+
+// SpillFile. Reads the oldest unread item. The file is truncated once every item has been read.
+func (s *SpillFile) Read() (OutboundItem, error) {
+  
+  var item OutboundItem
+  
+  line, err := s.Reader.ReadBytes('\n')
+  if (err != nil) { return item, err }
+  
+  if err := json.Unmarshal(line, &item); err != nil { return item, err }
+  
+  s.Count--
+  if (s.Count == 0) { s.Reset() }
+  
+  return item, nil
+}
+
+// SpillFile. Discards everything in the file.
+func (s *SpillFile) Reset() {
+  
+  s.File.Truncate(0)
+  s.File.Seek(0, io.SeekStart)
+  s.Reader.Reset(io.NewSectionReader(s.File, 0, 1 << 62))
+  s.Count = 0
+}
+
+func (s *SpillFile) Close() error {
+  
+  return s.File.Close()
+}
@@ -0,0 +1,238 @@
+/*
+*
+* Name:     Twitch IRC Listener
+* Sys Name: twitch-irc
+* Author:   Nifty255
+*
+*/
+
+package main
+
+import (
+  "time"    // Timing related functions.
+  "strings" // String manipulation functions.
+  "strconv" // String/Number conversion functions.
+)
+
+// Specifies a single Twitch badge, such as "subscriber/12".
+type TwitchBadge struct {
+  
+  Name    string
+  Version string
+}
+
+// Specifies a single emote occurrence within a message. Start and End are inclusive rune positions.
+type TwitchEmote struct {
+  
+  ID    string
+  Start int
+  End   int
+  Text  string
+}
+
+// Specifies the Twitch tags of a single IRC line, decoded once.
+type TwitchTags struct {
+  
+  ID                     string
+  MsgID                  string
+  Login                  string
+  DisplayName            string
+  UserID                 string
+  RoomID                 string
+  Color                  string
+  Badges                 []TwitchBadge
+  BadgeInfo              []TwitchBadge
+  SubscriberMonths       int
+  Emotes                 []TwitchEmote
+  Mod                    bool
+  Subscriber             bool
+  Vip                    bool
+  Broadcaster            bool
+  Bits                   int
+  HasBits                bool
+  SentAt                 time.Time
+  ReplyParentMsgID       string
+  ReplyParentUserID      string
+  ReplyParentUserLogin   string
+  ReplyParentDisplayName string
+  ReplyParentMsgBody     string
+  TargetUserID           string
+  TargetMsgID            string
+  BanDuration            int
+  HasBanDuration         bool
+  Raw                    map[string]string
+}
+
+// Static. Decodes the Twitch tags of the provided message.
+func ParseTwitchTags(msg *IrcMessage) *TwitchTags {
+  
+  t := TwitchTags{
+    ID: msg.Tags["id"],
+    MsgID: msg.Tags["msg-id"],
+    Login: msg.Tags["login"],
+    DisplayName: msg.Tags["display-name"],
+    UserID: msg.Tags["user-id"],
+    RoomID: msg.Tags["room-id"],
+    Color: msg.Tags["color"],
+    Badges: ParseTwitchBadges(msg.Tags["badges"]),
+    BadgeInfo: ParseTwitchBadges(msg.Tags["badge-info"]),
+    SubscriberMonths: 0,
+    Emotes: ParseTwitchEmotes(msg.Tags["emotes"], msg.Message()),
+    Mod: msg.Tags["mod"] == "1",
+    Subscriber: msg.Tags["subscriber"] == "1",
+    Vip: false,
+    Broadcaster: false,
+    Bits: 0,
+    HasBits: false,
+    ReplyParentMsgID: msg.Tags["reply-parent-msg-id"],
+    ReplyParentUserID: msg.Tags["reply-parent-user-id"],
+    ReplyParentUserLogin: msg.Tags["reply-parent-user-login"],
+    ReplyParentDisplayName: msg.Tags["reply-parent-display-name"],
+    ReplyParentMsgBody: msg.Tags["reply-parent-msg-body"],
+    TargetUserID: msg.Tags["target-user-id"],
+    TargetMsgID: msg.Tags["target-msg-id"],
+    BanDuration: 0,
+    HasBanDuration: false,
+    Raw: msg.Tags }
+  
+  // PRIVMSG carries no login tag; the prefix nick is the login.
+  if (t.Login == "") { t.Login = msg.Nick }
+  
+  if _, isVip := msg.Tags["vip"]; isVip { t.Vip = true }
+  
+  for i := 0; i < len(t.Badges); i++ {
+    
+    switch(t.Badges[i].Name) {
+      
+      case "vip":
+      t.Vip = true
+      case "moderator":
+      t.Mod = true
+      case "broadcaster":
+      t.Broadcaster = true
+    }
+  }
+  
+  for i := 0; i < len(t.BadgeInfo); i++ {
+    
+    if (t.BadgeInfo[i].Name == "subscriber" || t.BadgeInfo[i].Name == "founder") {
+      
+      if months, err := strconv.Atoi(t.BadgeInfo[i].Version); err == nil { t.SubscriberMonths = months }
+    }
+  }
+  
+  if bitsStr, bP := msg.Tags["bits"]; bP {
+    
+    if bitsNum, err := strconv.Atoi(bitsStr); err == nil {
+      
+      t.Bits = bitsNum
+      t.HasBits = true
+    }
+  }
+  
+  if durationStr, dP := msg.Tags["ban-duration"]; dP {
+    
+    if durationNum, err := strconv.Atoi(durationStr); err == nil {
+      
+      t.BanDuration = durationNum
+      t.HasBanDuration = true
+    }
+  }
+  
+  if ms, err := strconv.ParseInt(msg.Tags["tmi-sent-ts"], 10, 64); err == nil {
+    
+    t.SentAt = time.UnixMilli(ms)
+  }
+  
+  return &t
+}
+
+// Static. Parses a "badges" or "badge-info" tag value, e.g. "subscriber/12,bits/100".
+func ParseTwitchBadges(raw string) []TwitchBadge {
+  
+  badges := make([]TwitchBadge, 0, 4)
+  
+  if (raw == "") { return badges }
+  
+  parts := strings.Split(raw, ",")
+  for i := 0; i < len(parts); i++ {
+    
+    name, version, _ := strings.Cut(parts[i], "/")
+    if (name == "") { continue }
+    
+    badges = append(badges, TwitchBadge{ Name: name, Version: version })
+  }
+  
+  return badges
+}
+
+// Static. Parses an "emotes" tag value, e.g. "25:0-4,12-16/1902:6-10", mapping each range onto the message.
+func ParseTwitchEmotes(raw string, message string) []TwitchEmote {
+  
+  emotes := make([]TwitchEmote, 0, 4)
+  
+  if (raw == "") { return emotes }
+  
+  // Twitch positions count code points, not bytes.
+  runes := []rune(message)
+  
+  groups := strings.Split(raw, "/")
+  for i := 0; i < len(groups); i++ {
+    
+    id, ranges, found := strings.Cut(groups[i], ":")
+    if (!found || id == "") { continue }
+    
+    positions := strings.Split(ranges, ",")
+    for j := 0; j < len(positions); j++ {
+      
+      startStr, endStr, found := strings.Cut(positions[j], "-")
+      if (!found) { continue }
+      
+      start, err1 := strconv.Atoi(startStr)
+      end, err2 := strconv.Atoi(endStr)
+      if (err1 != nil || err2 != nil || start < 0 || end < start) { continue }
+      
+      text := ""
+      if (end < len(runes)) { text = string(runes[start:end + 1]) }
+      
+      emotes = append(emotes, TwitchEmote{ ID: id, Start: start, End: end, Text: text })
+    }
+  }
+  
+  return emotes
+}
+
+// TwitchTags. Returns when the message's event happened, which every event built from a tagged message takes as its Time:
+// Twitch's tmi-sent-ts, so that every instance receiving it agrees, or now if the message has none.
+func (t *TwitchTags) EventTime() time.Time {
+  
+  if (t.SentAt.IsZero()) { return time.Now() }
+  
+  return t.SentAt
+}
+
+// TwitchTags. Returns the value of the "msg-param-<name>" tag.
+func (t *TwitchTags) Param(name string) string {
+  
+  return t.Raw["msg-param-" + name]
+}
+
+// TwitchTags. Returns the "msg-param-<name>" tag as an integer, and whether it was present and numeric.
+func (t *TwitchTags) ParamInt(name string) (int, bool) {
+  
+  value, exists := t.Raw["msg-param-" + name]
+  if (!exists) { return 0, false }
+  
+  num, err := strconv.Atoi(value)
+  if (err != nil) { return 0, false }
+  
+  return num, true
+}
+
+// TwitchTags. Returns whether the "msg-param-<name>" tag is present.
+func (t *TwitchTags) HasParam(name string) bool {
+  
+  _, exists := t.Raw["msg-param-" + name]
+  
+  return exists
+}
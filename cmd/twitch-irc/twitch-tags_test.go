@@ -0,0 +1,148 @@
+/*
+*
+* Name:     Twitch IRC Listener
+* Sys Name: twitch-irc
+* Author:   Nifty255
+*
+*/
+
+package main
+
+import (
+  "time"    // Timing related functions.
+  "reflect" // Deep equality checks.
+  "testing" // Go's testing framework.
+  ogdm "github.com/the-opera-house/go-common-lib/models"
+)
+
+// Parses a raw line and decodes its tags, failing the test if it does not parse.
+func mustParseTags(t *testing.T, raw string) (*IrcMessage, *TwitchTags) {
+  
+  t.Helper()
+  
+  msg, err := ParseIrcMessage(raw)
+  if (err != nil) { t.Fatalf("%q: unexpected error: %v", raw, err) }
+  
+  return msg, ParseTwitchTags(msg)
+}
+
+func TestParseTwitchTagsPrivmsg(t *testing.T) {
+  
+  raw := `@badge-info=subscriber/14;badges=moderator/1,subscriber/12,bits/1000;bits=100;color=#FF4500;display-name=Ronni\sR;` +
+    `emotes=25:0-4,12-16/1902:6-10;id=b34ccfc7-4977-403a-8a94-33c6bac34fb8;mod=0;room-id=12345678;subscriber=1;` +
+    `tmi-sent-ts=1642715756806;user-id=87654321 :ronni!ronni@ronni.tmi.twitch.tv PRIVMSG #dallas :Kappa Keepo Kappa`
+  
+  _, tags := mustParseTags(t, raw)
+  
+  if (tags.ID != "b34ccfc7-4977-403a-8a94-33c6bac34fb8" || tags.UserID != "87654321" || tags.RoomID != "12345678") { t.Errorf("ids = %q %q %q", tags.ID, tags.UserID, tags.RoomID) }
+  if (tags.Login != "ronni") { t.Errorf("login = %q, want the prefix nick", tags.Login) }
+  if (tags.DisplayName != "Ronni R") { t.Errorf("display name = %q, want it unescaped", tags.DisplayName) }
+  if (!tags.Mod || !tags.Subscriber || tags.Vip || tags.Broadcaster) { t.Errorf("flags = mod %v sub %v vip %v broadcaster %v", tags.Mod, tags.Subscriber, tags.Vip, tags.Broadcaster) }
+  if (tags.SubscriberMonths != 14) { t.Errorf("subscriber months = %d, want 14", tags.SubscriberMonths) }
+  if (!tags.HasBits || tags.Bits != 100) { t.Errorf("bits = %d %v, want 100", tags.Bits, tags.HasBits) }
+  if (!tags.SentAt.Equal(time.UnixMilli(1642715756806))) { t.Errorf("sent at = %v", tags.SentAt) }
+  
+  badges := []TwitchBadge{ { Name: "moderator", Version: "1" }, { Name: "subscriber", Version: "12" }, { Name: "bits", Version: "1000" } }
+  if (!reflect.DeepEqual(tags.Badges, badges)) { t.Errorf("badges = %+v", tags.Badges) }
+  
+  emotes := []TwitchEmote{ { ID: "25", Start: 0, End: 4, Text: "Kappa" }, { ID: "25", Start: 12, End: 16, Text: "Kappa" }, { ID: "1902", Start: 6, End: 10, Text: "Keepo" } }
+  if (!reflect.DeepEqual(tags.Emotes, emotes)) { t.Errorf("emotes = %+v", tags.Emotes) }
+}
+
+func TestParseTwitchTagsEmpty(t *testing.T) {
+  
+  _, tags := mustParseTags(t, `@badge-info=;badges=;bits=;color=;emotes=;tmi-sent-ts=;vip :tmi.twitch.tv USERSTATE #dallas`)
+  
+  if (len(tags.Badges) != 0 || len(tags.BadgeInfo) != 0 || len(tags.Emotes) != 0) { t.Errorf("badges %+v, badge info %+v, emotes %+v, want none", tags.Badges, tags.BadgeInfo, tags.Emotes) }
+  if (tags.HasBits) { t.Errorf("an empty bits tag decoded as bits") }
+  if (!tags.SentAt.IsZero()) { t.Errorf("sent at = %v, want zero", tags.SentAt) }
+  if (!tags.Vip) { t.Errorf("a valueless vip tag should still mark a VIP") }
+}
+
+func TestParseTwitchTagsReply(t *testing.T) {
+  
+  raw := `@reply-parent-display-name=Dallas;reply-parent-msg-body=hello\sthere\:\sfriend;reply-parent-msg-id=b34ccfc7-4977-403a-8a94-33c6bac34fb8;` +
+    `reply-parent-user-id=12345678;reply-parent-user-login=dallas :ronni!ronni@ronni.tmi.twitch.tv PRIVMSG #dallas :@Dallas hi`
+  
+  _, tags := mustParseTags(t, raw)
+  
+  if (tags.ReplyParentMsgID != "b34ccfc7-4977-403a-8a94-33c6bac34fb8" || tags.ReplyParentUserID != "12345678") { t.Errorf("reply ids = %q %q", tags.ReplyParentMsgID, tags.ReplyParentUserID) }
+  if (tags.ReplyParentUserLogin != "dallas" || tags.ReplyParentDisplayName != "Dallas") { t.Errorf("reply user = %q %q", tags.ReplyParentUserLogin, tags.ReplyParentDisplayName) }
+  if (tags.ReplyParentMsgBody != "hello there; friend") { t.Errorf("reply body = %q, want it unescaped", tags.ReplyParentMsgBody) }
+}
+
+func TestParseTwitchTagsTargets(t *testing.T) {
+  
+  _, tags := mustParseTags(t, `@ban-duration=600;room-id=12345678;target-user-id=87654321;tmi-sent-ts=1642715756806 :tmi.twitch.tv CLEARCHAT #dallas :ronni`)
+  
+  if (tags.TargetUserID != "87654321" || !tags.HasBanDuration || tags.BanDuration != 600) { t.Errorf("target = %q, ban duration = %d %v, want a 600s timeout of 87654321", tags.TargetUserID, tags.BanDuration, tags.HasBanDuration) }
+  
+  _, tags = mustParseTags(t, `@ban-duration=;room-id=12345678;target-user-id=87654321 :tmi.twitch.tv CLEARCHAT #dallas :ronni`)
+  
+  if (tags.HasBanDuration) { t.Errorf("an empty ban-duration tag decoded as a timeout") }
+  
+  _, tags = mustParseTags(t, `@login=ronni;room-id=;target-msg-id=abc-123;tmi-sent-ts=1642720582342 :tmi.twitch.tv CLEARMSG #dallas :HeyGuys`)
+  
+  if (tags.TargetMsgID != "abc-123") { t.Errorf("target msg id = %q", tags.TargetMsgID) }
+}
+
+func TestParseTwitchTagsParams(t *testing.T) {
+  
+  _, tags := mustParseTags(t, `@login=ronni;msg-id=resub;msg-param-cumulative-months=6;msg-param-sub-plan-name=Channel\sSub;msg-param-months=x :tmi.twitch.tv USERNOTICE #dallas`)
+  
+  if (tags.Login != "ronni" || tags.MsgID != "resub") { t.Errorf("login %q msg-id %q", tags.Login, tags.MsgID) }
+  if (tags.Param("sub-plan-name") != "Channel Sub") { t.Errorf("sub-plan-name = %q", tags.Param("sub-plan-name")) }
+  if months, ok := tags.ParamInt("cumulative-months"); !ok || months != 6 { t.Errorf("cumulative-months = %d %v", months, ok) }
+  if _, ok := tags.ParamInt("months"); ok { t.Errorf("a non-numeric param decoded as a number") }
+  if _, ok := tags.ParamInt("streak-months"); ok { t.Errorf("a missing param decoded as a number") }
+  if (!tags.HasParam("months") || tags.HasParam("streak-months")) { t.Errorf("HasParam disagrees with the tags") }
+}
+
+func TestParseTwitchEmotes(t *testing.T) {
+  
+  cases := []struct {
+    
+    Raw     string
+    Message string
+    Emotes  []TwitchEmote
+  }{
+    // Positions count code points, so the emoji before the emote counts as one.
+    { "25:2-6", "\U0001F600 Kappa", []TwitchEmote{ { ID: "25", Start: 2, End: 6, Text: "Kappa" } } },
+    // Ranges past the end of the message keep their position but have no text.
+    { "25:0-4", "Kap", []TwitchEmote{ { ID: "25", Start: 0, End: 4, Text: "" } } },
+    { "25:4-0,x-1,1-y/:0-1/1902", "Kappa", []TwitchEmote{} },
+    { "emotesv2_abc:0-4", "Kappa", []TwitchEmote{ { ID: "emotesv2_abc", Start: 0, End: 4, Text: "Kappa" } } },
+  }
+  
+  for ind := 0; ind < len(cases); ind++ {
+    
+    got := ParseTwitchEmotes(cases[ind].Raw, cases[ind].Message)
+    if (!reflect.DeepEqual(got, cases[ind].Emotes)) { t.Errorf("ParseTwitchEmotes(%q, %q) = %+v, want %+v", cases[ind].Raw, cases[ind].Message, got, cases[ind].Emotes) }
+  }
+}
+
+func TestEventsTakeTwitchTime(t *testing.T) {
+  
+  sentAt := time.UnixMilli(1642715756806)
+  
+  cases := []struct {
+    
+    raw    string
+    create func(msg *IrcMessage, tags *TwitchTags) *ogdm.Event
+  }{
+    { `@login=ronni;msg-id=sub;msg-param-sub-plan=1000;room-id=100;tmi-sent-ts=1642715756806;user-id=9 :tmi.twitch.tv USERNOTICE #dallas`, CreateSubEvent },
+    { `@login=ronni;msg-id=raid;msg-param-viewerCount=5;room-id=100;tmi-sent-ts=1642715756806;user-id=9 :tmi.twitch.tv USERNOTICE #dallas`, CreateRaidEvent },
+    { `@ban-duration=60;room-id=100;target-user-id=9;tmi-sent-ts=1642715756806 :tmi.twitch.tv CLEARCHAT #dallas :ronni`, CreateClearChatEvent },
+    { `@login=ronni;target-msg-id=abc;tmi-sent-ts=1642715756806 :tmi.twitch.tv CLEARMSG #dallas :hello`, CreateDeleteEvent },
+  }
+  
+  for ind := 0; ind < len(cases); ind++ {
+    
+    msg, tags := mustParseTags(t, cases[ind].raw)
+    if e := cases[ind].create(msg, tags); !e.Time.Equal(sentAt) { t.Errorf("%s: time = %v, want tmi-sent-ts %v", e.EventType, e.Time, sentAt) }
+  }
+  
+  // Without a timestamp, the event happened when it arrived.
+  msg, tags := mustParseTags(t, `@login=ronni;msg-id=announcement;room-id=100;user-id=9 :tmi.twitch.tv USERNOTICE #dallas :hi`)
+  if e := CreateNoticeEvent(msg, tags, "announcement", "", -1); time.Since(e.Time) > time.Second { t.Errorf("time = %v, want now", e.Time) }
+}
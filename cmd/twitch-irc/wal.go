@@ -0,0 +1,307 @@
+/*
+*
+* Name:     Twitch IRC Listener
+* Sys Name: twitch-irc
+* Author:   Nifty255
+*
+*/
+
+package main
+
+import (
+  "os"            // File functions.
+  "fmt"           // Prints to console.
+  "sort"          // Sorting functions.
+  "sync"          // Mutual exclusion locks.
+  "time"          // Timing related functions.
+  "bufio"         // Buffered reading functions.
+  "strings"       // String manipulation functions.
+  "strconv"       // String/Number conversion functions.
+  "io/ioutil"     // Whole-file reading functions.
+  "path/filepath" // File path functions.
+  "encoding/json" // JSON encoding functions.
+  ogdm "github.com/the-opera-house/go-common-lib/models"
+)
+
+// Fsync policies for the write-ahead log.
+const (
+  WalFsyncAlways   = "always"   // Sync after every append. Nothing acknowledged by Push is lost on a crash.
+  WalFsyncInterval = "interval" // Sync every SyncIntervalMs. A crash may lose the last interval.
+  WalFsyncNever    = "never"    // Leave syncing to the OS.
+)
+
+// Specifies a single entry in the write-ahead log. Exactly one of Event, Chat or Dropped is set.
+// Dropped marks the record with that sequence number as dropped by an overflow policy, so it is not replayed.
+type WalRecord struct {
+  
+  Seq     uint64      `json:"seq"`
+  Event   *ogdm.Event `json:"event,omitempty"`
+  Chat    string      `json:"chat,omitempty"`
+  Dropped uint64      `json:"dropped,omitempty"`
+}
+
+// Specifies an append-only log of outbound items, split into segment files named after their first sequence number.
+// Delivery progress is kept in a separate "acked" file, written every sync interval, so a crash redelivers at most
+// one interval's worth of items. Segments whose items have all been acknowledged are deleted.
+type Wal struct {
+  
+  Dir          string
+  SegmentBytes int64
+  Fsync        string
+  Segments     []uint64
+  File         *os.File
+  FileSize     int64
+  NextSeq      uint64
+  Acked        uint64
+  SavedAcked   uint64
+  Ticker       *time.Ticker
+  Done         chan bool
+  Lock         sync.Mutex
+}
+
+// Static. Opens the log in the given directory, creating it if needed, and returns the records that were
+// never acknowledged, in order. Appends always go to a fresh segment, so a torn final line is never extended.
+func WalOpen(dir string, c ConfigWal) (*Wal, []WalRecord, error) {
+  
+  if err := os.MkdirAll(dir, 0755); err != nil { return nil, nil, err }
+  
+  w := &(Wal{
+    Dir: dir,
+    SegmentBytes: int64(c.SegmentBytes),
+    Fsync: c.Fsync,
+    Segments: make([]uint64, 0, 16),
+    NextSeq: 1 })
+  
+  if (w.SegmentBytes <= 0) { w.SegmentBytes = 16 << 20 }
+  if (w.Fsync == "") { w.Fsync = WalFsyncInterval }
+  
+  if data, err := ioutil.ReadFile(filepath.Join(dir, "acked")); err == nil {
+    
+    w.Acked, _ = strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+  }
+  w.SavedAcked = w.Acked
+  
+  entries, err := ioutil.ReadDir(dir)
+  if (err != nil) { return nil, nil, err }
+  
+  for ind := 0; ind < len(entries); ind++ {
+    
+    name := entries[ind].Name()
+    if (!strings.HasSuffix(name, ".log")) { continue }
+    
+    first, err := strconv.ParseUint(strings.TrimSuffix(name, ".log"), 10, 64)
+    if (err != nil) { continue }
+    
+    w.Segments = append(w.Segments, first)
+  }
+  sort.Slice(w.Segments, func(a, b int) bool { return w.Segments[a] < w.Segments[b] })
+  
+  unacked := make([]WalRecord, 0, 256)
+  dropped := make(map[uint64]bool, 16)
+  
+  for ind := 0; ind < len(w.Segments); ind++ {
+    
+    records, err := w.ReadSegment(w.Segments[ind])
+    if (err != nil) { return nil, nil, err }
+    
+    for rec := 0; rec < len(records); rec++ {
+      
+      if (records[rec].Seq >= w.NextSeq) { w.NextSeq = records[rec].Seq + 1 }
+      if (records[rec].Dropped > 0) { dropped[records[rec].Dropped] = true; continue }
+      if (records[rec].Seq > w.Acked) { unacked = append(unacked, records[rec]) }
+    }
+  }
+  
+  pending := make([]WalRecord, 0, len(unacked))
+  for ind := 0; ind < len(unacked); ind++ {
+    
+    if (!dropped[unacked[ind].Seq]) { pending = append(pending, unacked[ind]) }
+  }
+  
+  if (w.Acked >= w.NextSeq) { w.NextSeq = w.Acked + 1 }
+  
+  if err := w.Rotate(); err != nil { return nil, nil, err }
+  w.Compact()
+  
+  interval := time.Duration(c.SyncIntervalMs) * time.Millisecond
+  if (interval <= 0) { interval = time.Second }
+  w.Ticker = time.NewTicker(interval)
+  w.Done = make(chan bool)
+  
+  go func() {
+    for {
+      select {
+      case <- w.Ticker.C:
+        w.Lock.Lock()
+        w.Checkpoint()
+        w.Lock.Unlock()
+      case <- w.Done:
+        return
+      }
+    }
+  }()
+  
+  return w, pending, nil
+}
+
+// Wal. Returns the path of the segment starting at the given sequence number.
+func (w *Wal) SegmentPath(first uint64) string {
+  
+  return filepath.Join(w.Dir, fmt.Sprintf("%020d.log", first))
+}
+
+// Wal. Reads every intact record of a segment. A line that fails to decode is where a crash cut a write short,
+// so the segment is truncated there, dropping it and anything after it.
+func (w *Wal) ReadSegment(first uint64) ([]WalRecord, error) {
+  
+  file, err := os.Open(w.SegmentPath(first))
+  if (err != nil) { return nil, err }
+  defer file.Close()
+  
+  records := make([]WalRecord, 0, 256)
+  scanner := bufio.NewScanner(file)
+  scanner.Buffer(make([]byte, 64 * 1024), 4 << 20)
+  
+  var intact int64
+  for scanner.Scan() {
+    
+    var rec WalRecord
+    if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+      
+      logger.Warn("Truncating torn write-ahead log record.", LogFields{ "segment": w.SegmentPath(first), "offset": intact })
+      
+      if err := os.Truncate(w.SegmentPath(first), intact); err != nil { return nil, err }
+      break
+    }
+    
+    records = append(records, rec)
+    intact += int64(len(scanner.Bytes())) + 1
+  }
+  
+  return records, nil
+}
+
+// Wal. Closes the current segment, if any, and starts a new one at NextSeq. Call with Lock held.
+func (w *Wal) Rotate() error {
+  
+  if (w.File != nil) {
+    
+    w.File.Sync()
+    w.File.Close()
+    w.File = nil
+  }
+  
+  file, err := os.OpenFile(w.SegmentPath(w.NextSeq), os.O_CREATE | os.O_WRONLY | os.O_APPEND, 0644)
+  if (err != nil) { return err }
+  
+  w.File = file
+  w.FileSize = 0
+  
+  // A previous run may have left an empty segment at this position.
+  if (len(w.Segments) == 0 || w.Segments[len(w.Segments) - 1] != w.NextSeq) {
+    
+    w.Segments = append(w.Segments, w.NextSeq)
+  }
+  
+  return nil
+}
+
+// Wal. Appends a record, assigning it the next sequence number, which is returned.
+func (w *Wal) Append(rec WalRecord) (uint64, error) {
+  
+  w.Lock.Lock()
+  defer w.Lock.Unlock()
+  
+  if (w.FileSize >= w.SegmentBytes) {
+    
+    if err := w.Rotate(); err != nil { return 0, err }
+  }
+  
+  rec.Seq = w.NextSeq
+  
+  data, err := json.Marshal(rec)
+  if (err != nil) { return 0, err }
+  
+  n, err := w.File.Write(append(data, '\n'))
+  w.FileSize += int64(n)
+  if (err != nil) { return 0, err }
+  
+  w.NextSeq++
+  
+  if (w.Fsync == WalFsyncAlways) {
+    
+    if err := w.File.Sync(); err != nil { return rec.Seq, err }
+  }
+  
+  return rec.Seq, nil
+}
+
+// Wal. Records that the item with the given sequence number was dropped, so it is not replayed.
+func (w *Wal) Drop(seq uint64) error {
+  
+  _, err := w.Append(WalRecord{ Dropped: seq })
+  
+  return err
+}
+
+// Wal. Records that every item up to and including seq has been delivered.
+func (w *Wal) Ack(seq uint64) {
+  
+  w.Lock.Lock()
+  defer w.Lock.Unlock()
+  
+  if (seq > w.Acked) { w.Acked = seq }
+}
+
+// Wal. Syncs the current segment, saves the acked position and deletes fully acknowledged segments.
+// Call with Lock held.
+func (w *Wal) Checkpoint() {
+  
+  if (w.File != nil && w.Fsync != WalFsyncNever) { w.File.Sync() }
+  
+  if (w.Acked == w.SavedAcked) { return }
+  
+  path := filepath.Join(w.Dir, "acked")
+  if err := ioutil.WriteFile(path + ".tmp", []byte(strconv.FormatUint(w.Acked, 10)), 0644); err != nil {
+    
+    logger.Error("Failed to save write-ahead log position.", LogFields{ "dir": w.Dir, "error": err })
+    return
+  }
+  if err := os.Rename(path + ".tmp", path); err != nil {
+    
+    logger.Error("Failed to save write-ahead log position.", LogFields{ "dir": w.Dir, "error": err })
+    return
+  }
+  
+  w.SavedAcked = w.Acked
+  w.Compact()
+}
+
+// Wal. Deletes every segment, except the current one, whose records have all been acknowledged. Call with Lock held.
+func (w *Wal) Compact() {
+  
+  for len(w.Segments) > 1 && w.Segments[1] - 1 <= w.SavedAcked {
+    
+    os.Remove(w.SegmentPath(w.Segments[0]))
+    w.Segments = w.Segments[1:]
+  }
+}
+
+// Wal. Saves the final position and closes the current segment.
+func (w *Wal) Close() error {
+  
+  w.Ticker.Stop()
+  close(w.Done)
+  
+  w.Lock.Lock()
+  defer w.Lock.Unlock()
+  
+  w.Checkpoint()
+  
+  if (w.File == nil) { return nil }
+  
+  err := w.File.Close()
+  w.File = nil
+  
+  return err
+}
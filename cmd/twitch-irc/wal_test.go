@@ -0,0 +1,171 @@
+/*
+*
+* Name:     Twitch IRC Listener
+* Sys Name: twitch-irc
+* Author:   Nifty255
+*
+*/
+
+package main
+
+import (
+  "os"            // File functions.
+  "strconv"       // String conversion functions.
+  "testing"       // Go's testing framework.
+  "path/filepath" // File path functions.
+)
+
+// Opens a write-ahead log in dir that syncs every append, failing the test if it cannot.
+func openTestWal(t *testing.T, dir string, segmentBytes int) (*Wal, []WalRecord) {
+  
+  t.Helper()
+  
+  w, pending, err := WalOpen(dir, ConfigWal{ Enabled: true, Fsync: WalFsyncAlways, SegmentBytes: segmentBytes })
+  if (err != nil) { t.Fatal(err) }
+  
+  return w, pending
+}
+
+// Appends chat lines named prefix0, prefix1, ... and returns their sequence numbers.
+func appendTestChat(t *testing.T, w *Wal, prefix string, n int) []uint64 {
+  
+  t.Helper()
+  
+  seqs := make([]uint64, n)
+  for ind := 0; ind < n; ind++ {
+    
+    seq, err := w.Append(WalRecord{ Chat: prefix + strconv.Itoa(ind) })
+    if (err != nil) { t.Fatal(err) }
+    
+    seqs[ind] = seq
+  }
+  
+  return seqs
+}
+
+// Returns the chat lines of the given records, in order.
+func walChat(records []WalRecord) []string {
+  
+  lines := make([]string, len(records))
+  for ind := 0; ind < len(records); ind++ { lines[ind] = records[ind].Chat }
+  
+  return lines
+}
+
+// Returns the segment files in dir.
+func walSegments(t *testing.T, dir string) []string {
+  
+  t.Helper()
+  
+  segments, err := filepath.Glob(filepath.Join(dir, "*.log"))
+  if (err != nil) { t.Fatal(err) }
+  
+  return segments
+}
+
+func TestWalReplaysInOrderAfterReopen(t *testing.T) {
+  
+  dir := t.TempDir()
+  
+  w, pending := openTestWal(t, dir, 0)
+  if (len(pending) != 0) { t.Fatalf("pending = %d in a new log, want none", len(pending)) }
+  
+  seqs := appendTestChat(t, w, "line", 5)
+  w.Ack(seqs[1])
+  w.Close()
+  
+  // Everything after the acknowledged position comes back, in the order it was appended.
+  w, pending = openTestWal(t, dir, 0)
+  
+  if got := walChat(pending); len(got) != 3 || got[0] != "line2" || got[1] != "line3" || got[2] != "line4" { t.Errorf("replayed %q, want line2 to line4", got) }
+  
+  // Sequence numbers carry on from where the last run left off.
+  if seq, _ := w.Append(WalRecord{ Chat: "later" }); seq != seqs[4] + 1 { t.Errorf("next seq = %d, want %d", seq, seqs[4] + 1) }
+  w.Close()
+  
+  _, pending = openTestWal(t, dir, 0)
+  if got := walChat(pending); len(got) != 4 || got[3] != "later" { t.Errorf("replayed %q, want the later line last", got) }
+}
+
+func TestWalRotatesAndCompacts(t *testing.T) {
+  
+  dir := t.TempDir()
+  
+  // Every append fills its segment, so the next one starts a new segment.
+  w, _ := openTestWal(t, dir, 1)
+  seqs := appendTestChat(t, w, "line", 4)
+  
+  if got := len(walSegments(t, dir)); got != 4 { t.Fatalf("segments = %d, want one per record", got) }
+  
+  // Acknowledged segments go at the next checkpoint; the one still holding an unacknowledged record stays.
+  w.Ack(seqs[2])
+  w.Lock.Lock()
+  w.Checkpoint()
+  w.Lock.Unlock()
+  
+  if got := len(walSegments(t, dir)); got != 1 { t.Errorf("segments = %d after compaction, want only the unacknowledged one", got) }
+  
+  w.Close()
+  
+  _, pending := openTestWal(t, dir, 1)
+  if got := walChat(pending); len(got) != 1 || got[0] != "line3" { t.Errorf("replayed %q, want only line3", got) }
+}
+
+func TestWalTruncatesTornRecord(t *testing.T) {
+  
+  dir := t.TempDir()
+  
+  w, _ := openTestWal(t, dir, 0)
+  appendTestChat(t, w, "line", 3)
+  w.Close()
+  
+  segments := walSegments(t, dir)
+  segment := segments[len(segments) - 1]
+  
+  info, err := os.Stat(segment)
+  if (err != nil) { t.Fatal(err) }
+  intact := info.Size()
+  
+  // A crash cut the last append short.
+  file, err := os.OpenFile(segment, os.O_WRONLY | os.O_APPEND, 0644)
+  if (err != nil) { t.Fatal(err) }
+  file.WriteString(`{"seq":4,"chat":"li`)
+  file.Close()
+  
+  w, pending := openTestWal(t, dir, 0)
+  
+  if got := walChat(pending); len(got) != 3 || got[2] != "line2" { t.Errorf("replayed %q, want the three intact lines", got) }
+  
+  info, err = os.Stat(segment)
+  if (err != nil) { t.Fatal(err) }
+  if (info.Size() != intact) { t.Errorf("segment size = %d, want it truncated to %d", info.Size(), intact) }
+  
+  // The torn record's sequence number is reused, as it was never written.
+  if seq, _ := w.Append(WalRecord{ Chat: "after" }); seq != 4 { t.Errorf("next seq = %d, want 4", seq) }
+  w.Close()
+  
+  _, pending = openTestWal(t, dir, 0)
+  if got := walChat(pending); len(got) != 4 || got[3] != "after" { t.Errorf("replayed %q, want the line appended after reopening", got) }
+}
+
+func TestWalDropMarkersPreventReplay(t *testing.T) {
+  
+  dir := t.TempDir()
+  
+  // Markers may land in a later segment than the records they drop.
+  w, _ := openTestWal(t, dir, 1)
+  seqs := appendTestChat(t, w, "line", 4)
+  
+  if err := w.Drop(seqs[1]); err != nil { t.Fatal(err) }
+  if err := w.Drop(seqs[3]); err != nil { t.Fatal(err) }
+  w.Close()
+  
+  _, pending := openTestWal(t, dir, 1)
+  
+  if got := walChat(pending); len(got) != 2 || got[0] != "line0" || got[1] != "line2" { t.Errorf("replayed %q, want line0 and line2", got) }
+  
+  for ind := 0; ind < len(pending); ind++ {
+    
+    if (pending[ind].Dropped != 0) { t.Errorf("replayed a drop marker: %+v", pending[ind]) }
+  }
+}
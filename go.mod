@@ -0,0 +1,8 @@
+module github.com/the-opera-house/go-chat-bot
+
+go 1.19
+
+require gopkg.in/mgo.v2 v2.0.0-20190816093944-a6b53ec6cb22
+
+// github.com/koding/kite, github.com/thoj/go-ircevent and github.com/the-opera-house/go-common-lib
+// are not pinned yet: run "go mod tidy" with network access to add them at their current versions and write go.sum.